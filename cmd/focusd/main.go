@@ -1,19 +1,50 @@
 package main
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
 	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/spf13/cobra"
 	"focusd/internal/config"
+	"focusd/internal/control"
 	"focusd/internal/daemon"
+	"focusd/internal/logging"
+	"focusd/internal/matcher"
+	"focusd/internal/proxy"
+	"focusd/internal/resolver"
 	"focusd/internal/state"
 	"focusd/internal/usbkey"
+	"focusd/internal/version"
 )
 
 var (
 	configPath string
 	cfg        *config.Config
+	commitFor  time.Duration
+	totpCode   string
+
+	blockedLimit   int
+	blockedSummary bool
+	historyLimit   int
+	statsLimit     int
+
+	listJSON  bool
+	listCount bool
+
+	statusJSON bool
+
+	initForce bool
+
+	genKeyLength int
+	genKeyForce  bool
 )
 
 func main() {
@@ -30,7 +61,7 @@ var rootCmd = &cobra.Command{
 Enabling or disabling the blocker requires a USB key for authentication.`,
 	PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
 		// Skip config loading for commands that don't need it
-		if cmd.Name() == "help" || cmd.Name() == "completion" {
+		if cmd.Name() == "help" || cmd.Name() == "completion" || cmd.Name() == "doctor" || cmd.Name() == "validate-config" || cmd.Name() == "init" || cmd.Name() == "version" {
 			return nil
 		}
 
@@ -40,6 +71,13 @@ Enabling or disabling the blocker requires a USB key for authentication.`,
 		if err != nil {
 			return fmt.Errorf("loading config: %w", err)
 		}
+
+		// Runtime category toggles apply to every command, like the config
+		toggles, err := state.NewCategories(state.DefaultCategoriesPath).Load()
+		if err != nil {
+			return err
+		}
+		cfg.SetCategoryToggles(toggles)
 		return nil
 	},
 }
@@ -49,7 +87,10 @@ var daemonCmd = &cobra.Command{
 	Short: "Run the focusd daemon",
 	Long:  `Starts the focusd daemon which manages DNS and nftables blocking rules.`,
 	RunE: func(cmd *cobra.Command, args []string) error {
-		d := daemon.New(cfg)
+		if err := logging.Setup(os.Stderr, cfg.LogFormat, cfg.LogLevel); err != nil {
+			return err
+		}
+		d := daemon.New(cfg, configPath)
 		return d.Run()
 	},
 }
@@ -57,15 +98,38 @@ var daemonCmd = &cobra.Command{
 var enableCmd = &cobra.Command{
 	Use:   "enable",
 	Short: "Enable blocking",
-	Long:  `Enables the distraction blocker.`,
+	Long: `Enables the distraction blocker.
+With --commit, disabling is refused entirely (even with the USB key)
+until the commitment period has passed.`,
 	RunE: func(cmd *cobra.Command, args []string) error {
+		if commitFor < 0 {
+			return fmt.Errorf("commitment duration cannot be negative")
+		}
+
 		// Update state
-		st := state.New(state.DefaultStatePath)
+		st := newState()
 		if err := st.SetEnabled(true); err != nil {
 			return fmt.Errorf("updating state: %w", err)
 		}
+		if err := st.ClearSnooze(); err != nil {
+			return err
+		}
+
+		if commitFor > 0 {
+			if err := st.CommitUntil(time.Now().Add(commitFor)); err != nil {
+				return fmt.Errorf("recording commitment: %w", err)
+			}
+			until, err := st.CommittedUntil()
+			if err != nil {
+				return fmt.Errorf("reading commitment: %w", err)
+			}
+			fmt.Printf("Blocker enabled and committed until %s\n", until.Local().Format(time.DateTime))
+			notifyDaemon()
+			return nil
+		}
 
 		fmt.Println("Blocker enabled successfully")
+		notifyDaemon()
 		return nil
 	},
 }
@@ -73,50 +137,1170 @@ var enableCmd = &cobra.Command{
 var disableCmd = &cobra.Command{
 	Use:   "disable",
 	Short: "Disable blocking (requires USB key)",
-	Long:  `Disables the distraction blocker. Requires the USB key to be present.`,
+	Long: `Disables the distraction blocker. Requires the USB key to be present,
+or a TOTP code given with --totp if totpSecretPath is configured.`,
 	RunE: func(cmd *cobra.Command, args []string) error {
+		st := newState()
+		if err := st.CheckCommitment(); err != nil {
+			return err
+		}
+
 		// Verify USB key
-		verifier := usbkey.New(cfg.USBKeyPath, cfg.TokenHashPath)
-		if err := verifier.Verify(); err != nil {
-			return fmt.Errorf("USB key verification failed: %w", err)
+		auth, err := verifyKey()
+		if err != nil {
+			return err
 		}
+		st.SetAuth(auth)
 
 		// Update state
-		st := state.New(state.DefaultStatePath)
 		if err := st.SetEnabled(false); err != nil {
 			return fmt.Errorf("updating state: %w", err)
 		}
+		if err := st.ClearSnooze(); err != nil {
+			return err
+		}
 
 		fmt.Println("Blocker disabled successfully")
+		notifyDaemon()
+		return nil
+	},
+}
+
+var snoozeCmd = &cobra.Command{
+	Use:   "snooze <duration>",
+	Short: "Disable blocking for a limited time (requires USB key)",
+	Long: `Disables the distraction blocker for the given duration (e.g. 15m),
+after which the daemon re-enables it automatically. Requires the USB key.
+Durations longer than maxSnoozeMinutes are refused.`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		duration, err := time.ParseDuration(args[0])
+		if err != nil {
+			return fmt.Errorf("invalid duration: %w", err)
+		}
+		if duration <= 0 {
+			return fmt.Errorf("snooze duration must be positive")
+		}
+		if limit := time.Duration(cfg.MaxSnoozeMinutes) * time.Minute; duration > limit {
+			return fmt.Errorf("snooze of %s exceeds the maximum of %s", duration, limit)
+		}
+
+		st := newState()
+		if err := st.CheckCommitment(); err != nil {
+			return err
+		}
+
+		auth, err := verifyKey()
+		if err != nil {
+			return err
+		}
+		st.SetAuth(auth)
+
+		until := time.Now().Add(duration)
+		if err := st.Snooze(until); err != nil {
+			return fmt.Errorf("updating state: %w", err)
+		}
+
+		fmt.Printf("Blocker snoozed until %s\n", until.Format(time.DateTime))
+		notifyDaemon()
 		return nil
 	},
 }
 
+// statusReport is the output of status --json. Durations are in seconds
+// and the daemon's own view is null when it isn't running.
+type statusReport struct {
+	Enabled                bool            `json:"enabled"`
+	State                  string          `json:"state"`
+	ScheduleActive         *bool           `json:"scheduleActive,omitempty"`
+	ScheduleNextChange     *time.Time      `json:"scheduleNextChange,omitempty"`
+	Categories             map[string]bool `json:"categories,omitempty"`
+	CommitRemainingSeconds int64           `json:"commitRemainingSeconds"`
+	SnoozeRemainingSeconds int64           `json:"snoozeRemainingSeconds"`
+	SessionOverrides       map[string]bool `json:"sessionOverrides,omitempty"`
+	Daemon                 *daemon.Status  `json:"daemon"`
+	DaemonError            string          `json:"daemonError,omitempty"`
+}
+
 var statusCmd = &cobra.Command{
 	Use:   "status",
 	Short: "Show current blocking status",
-	Long:  `Displays whether the blocker is currently enabled or disabled.`,
+	Long: `Displays whether the blocker is currently enabled or disabled and, if
+the daemon is running, its uptime, blocklist size, blocked addresses, last
+refresh and proxy. With --json, prints the same as a JSON object, for scripts
+and status bars.`,
 	RunE: func(cmd *cobra.Command, args []string) error {
-		st := state.New(state.DefaultStatePath)
+		if statusJSON {
+			report, err := collectStatus(time.Now())
+			if err != nil {
+				return err
+			}
+			enc := json.NewEncoder(os.Stdout)
+			enc.SetIndent("", "  ")
+			return enc.Encode(report)
+		}
+
+		st := newState()
 		status, err := st.String()
 		if err != nil {
 			return fmt.Errorf("reading status: %w", err)
 		}
 
 		fmt.Printf("focusd: %s\n", status)
+
+		if err := printSchedule(time.Now()); err != nil {
+			return err
+		}
+
+		// A missing blocklist is reported by the commands that need it
+		if categories, err := cfg.BlocklistCategories(); err == nil && len(categories) > 0 {
+			parts := make([]string, 0, len(categories))
+			for _, name := range categories {
+				parts = append(parts, fmt.Sprintf("%s (%s)", name, categoryStatus(name)))
+			}
+			fmt.Printf("Categories: %s\n", strings.Join(parts, ", "))
+		}
+
+		remaining, err := st.CommitmentRemaining()
+		if err != nil {
+			return fmt.Errorf("reading commitment: %w", err)
+		}
+		if remaining > 0 {
+			fmt.Printf("Committed: %s remaining\n", remaining.Round(time.Second))
+		}
+
+		snoozed, err := st.SnoozeRemaining()
+		if err != nil {
+			return fmt.Errorf("reading snooze: %w", err)
+		}
+		if snoozed > 0 {
+			fmt.Printf("Snoozed: %s remaining\n", snoozed.Round(time.Second))
+		}
+
+		overrides, err := state.NewOverrides(state.DefaultOverridesPath).Load()
+		if err != nil {
+			return fmt.Errorf("reading session overrides: %w", err)
+		}
+		if len(overrides) > 0 {
+			fmt.Println("Session overrides:")
+			domains := make([]string, 0, len(overrides))
+			for domain := range overrides {
+				domains = append(domains, domain)
+			}
+			sort.Strings(domains)
+			for _, domain := range domains {
+				verdict := "allowed"
+				if overrides[domain] {
+					verdict = "blocked"
+				}
+				fmt.Printf("  %s: %s\n", domain, verdict)
+			}
+		}
+
+		printDaemonStatus()
+		return nil
+	},
+}
+
+var doctorCmd = &cobra.Command{
+	Use:   "doctor",
+	Short: "Check that the environment supports focusd",
+	Long: `Runs the same environment checks the daemon performs at startup
+(nftables netlink access, the nft and ip commands, transparent proxy
+sockets) and reports each result.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		failed := 0
+		for _, check := range daemon.Preflight() {
+			if check.Err != nil {
+				failed++
+				fmt.Printf("FAIL  %s: %v\n", check.Name, check.Err)
+			} else {
+				fmt.Printf("OK    %s\n", check.Name)
+			}
+		}
+
+		if failed > 0 {
+			return fmt.Errorf("%d check(s) failed", failed)
+		}
+		return nil
+	},
+}
+
+var initCmd = &cobra.Command{
+	Use:   "init",
+	Short: "Write a default config and blocklist and create focusd's directories",
+	Long: `Writes a default config to --config and a starter blocklist, and creates
+the config, state and runtime directories. Existing files are kept unless
+--force is given, so it is safe to run again.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		c := config.DefaultConfig()
+		steps, err := config.Init(c, configPath, initForce)
+		for _, step := range steps {
+			fmt.Println(step)
+		}
+		if err != nil {
+			return err
+		}
+
+		fmt.Printf(`
+Next steps:
+  1. Set usbKeyPath in %s to where your USB stick's key file will be
+  2. Create the key and store its hash in %s:
+       sudo focusd gen-key /path/to/usb/FOCUSD/focusd.key
+  3. Edit the blocklist at %s
+  4. Check everything with: focusd validate-config --config %s
+  5. Start the daemon: sudo systemctl enable --now focusd
+`, configPath, c.TokenHashPath, c.BlocklistPath, configPath)
+		return nil
+	},
+}
+
+var genKeyCmd = &cobra.Command{
+	Use:   "gen-key <key-path>",
+	Short: "Create a USB key file and store its hash",
+	Long: `Writes a random key to <key-path> (a file on the mounted USB stick) and
+its SHA256, in sha256sum format, to tokenHashPath. Refuses to replace an
+existing key or hash unless --force is given.`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		keyPath := args[0]
+		if _, err := usbkey.GenerateKey(keyPath, cfg.TokenHashPath, genKeyLength, genKeyForce); err != nil {
+			return err
+		}
+		fmt.Printf("Wrote a %d-byte key to %s\n", genKeyLength, keyPath)
+		fmt.Printf("Wrote its hash to %s\n", cfg.TokenHashPath)
+
+		if ok, _ := filepath.Match(cfg.USBKeyPath, keyPath); !ok {
+			fmt.Printf("Warning: usbKeyPath (%s) does not match %s; update it so the key is found\n", cfg.USBKeyPath, keyPath)
+		}
+		return nil
+	},
+}
+
+var versionCmd = &cobra.Command{
+	Use:   "version",
+	Short: "Print the version, commit and build date",
+	Run: func(cmd *cobra.Command, args []string) {
+		fmt.Println(version.String())
+	},
+}
+
+var validateConfigCmd = &cobra.Command{
+	Use:   "validate-config",
+	Short: "Check the config and blocklist without starting the daemon",
+	Long: `Loads the config and local blocklist and reports every problem found,
+rather than stopping at the first. Warnings are for settings that work but are
+likely mistakes; only errors make the command fail.`,
+	SilenceUsage: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		c, err := config.Read(configPath)
+		if err != nil {
+			return err
+		}
+
+		report := c.Check()
+		for _, err := range report.Errors {
+			fmt.Printf("ERROR  %v\n", err)
+		}
+		for _, warning := range report.Warnings {
+			fmt.Printf("WARN   %s\n", warning)
+		}
+
+		if !report.OK() {
+			return fmt.Errorf("%d error(s) in %s", len(report.Errors), configPath)
+		}
+		fmt.Printf("%s is valid\n", configPath)
+		return nil
+	},
+}
+
+var toggleCmd = &cobra.Command{
+	Use:   "toggle <domain>",
+	Short: "Flip a domain between blocked and allowed for this session",
+	Long: `Flips a single domain between blocked and allowed until the next reboot.
+Blocking a domain needs no authentication; unblocking requires the USB key.
+The change is recorded in the audit log and the running daemon is reloaded
+to apply it.`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		domain := state.NormalizeDomain(args[0])
+
+		domains, err := cfg.LoadBlocklist()
+		if err != nil {
+			return fmt.Errorf("loading blocklist: %w", err)
+		}
+
+		overrides := state.NewOverrides(state.DefaultOverridesPath)
+		current, err := overrides.Load()
+		if err != nil {
+			return fmt.Errorf("reading session overrides: %w", err)
+		}
+
+		// Determine the domain's current effective state
+		effective := state.ApplyOverrides(domains, current)
+		match := matchingEntry(domain, effective)
+		blocked := match != ""
+
+		if blocked && match != domain {
+			return fmt.Errorf("%s is blocked via %s; toggle that entry instead", domain, match)
+		}
+
+		st := newState()
+		if blocked {
+			// Unblocking weakens protection, so honour commitments and require the key
+			if err := st.CheckCommitment(); err != nil {
+				return err
+			}
+			auth, err := verifyKey()
+			if err != nil {
+				return err
+			}
+			st.SetAuth(auth)
+		}
+
+		// An unblock must be on record before it takes effect, while
+		// blocking is never held up by the audit log
+		auditErr := st.AuditOverride(domain, !blocked)
+		if auditErr != nil && blocked {
+			return fmt.Errorf("recording audit entry: %w", auditErr)
+		}
+
+		if err := overrides.Set(domain, !blocked); err != nil {
+			return fmt.Errorf("updating session overrides: %w", err)
+		}
+
+		if blocked {
+			fmt.Printf("%s allowed for this session\n", domain)
+		} else {
+			fmt.Printf("%s blocked for this session\n", domain)
+		}
+		if auditErr != nil {
+			fmt.Fprintf(os.Stderr, "Warning: could not record audit entry: %v\n", auditErr)
+		}
+		reloadDaemon()
+		return nil
+	},
+}
+
+var blockedCmd = &cobra.Command{
+	Use:   "blocked",
+	Short: "Show recent blocked connection attempts",
+	Long: `Prints the most recent entries of the blocked-attempt log (blockedLogPath).
+With --summary, counts the attempts per host instead, most frequent first.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if cfg.BlockedLogPath == "" {
+			return fmt.Errorf("blocked log is disabled (set blockedLogPath)")
+		}
+
+		limit := blockedLimit
+		if blockedSummary {
+			limit = 0
+		}
+		attempts, err := proxy.ReadBlockedAttempts(cfg.BlockedLogPath, limit)
+		if err != nil {
+			return err
+		}
+		if len(attempts) == 0 {
+			fmt.Println("No blocked attempts recorded")
+			return nil
+		}
+
+		if !blockedSummary {
+			for _, a := range attempts {
+				host := a.Host
+				if host == "" {
+					host = "(no SNI)"
+				}
+				fmt.Printf("%s  %-5s  %-40s  %s\n", a.Time.Local().Format(time.DateTime), a.Protocol, host, a.Dest)
+			}
+			return nil
+		}
+
+		counts := make(map[string]int)
+		for _, a := range attempts {
+			counts[a.Host]++
+		}
+		hosts := make([]string, 0, len(counts))
+		for host := range counts {
+			hosts = append(hosts, host)
+		}
+		sort.Slice(hosts, func(i, j int) bool {
+			if counts[hosts[i]] != counts[hosts[j]] {
+				return counts[hosts[i]] > counts[hosts[j]]
+			}
+			return hosts[i] < hosts[j]
+		})
+		if blockedLimit > 0 && len(hosts) > blockedLimit {
+			hosts = hosts[:blockedLimit]
+		}
+		fmt.Printf("%d blocked attempts since %s\n", len(attempts), attempts[0].Time.Local().Format(time.DateTime))
+		for _, host := range hosts {
+			name := host
+			if name == "" {
+				name = "(no SNI)"
+			}
+			fmt.Printf("%6d  %s\n", counts[host], name)
+		}
+		return nil
+	},
+}
+
+var historyCmd = &cobra.Command{
+	Use:   "history",
+	Short: "Show when blocking was enabled and disabled",
+	Long: `Prints the most recent entries of the audit log (auditLogPath): each
+enable, disable, snooze and toggled domain, who ran it and whether the USB
+key (or a TOTP code) was verified.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if cfg.AuditLogPath == "" {
+			return fmt.Errorf("audit log is disabled (set auditLogPath)")
+		}
+
+		entries, err := state.ReadAuditLog(cfg.AuditLogPath, historyLimit)
+		if err != nil {
+			return err
+		}
+		if len(entries) == 0 {
+			fmt.Println("No state changes recorded")
+			return nil
+		}
+
+		for _, e := range entries {
+			verdict := "disabled"
+			if e.Enabled {
+				verdict = "enabled"
+			}
+			if e.Domain != "" {
+				verdict = "allowed"
+				if e.Enabled {
+					verdict = "blocked"
+				}
+				e.Reason = "toggle " + e.Domain
+			}
+			auth := e.Auth
+			if auth == "" {
+				auth = "-"
+			}
+			line := fmt.Sprintf("%s  %-8s  %-12s  %-7s", e.Time.Local().Format(time.DateTime), verdict, e.User, auth)
+			if e.Reason != "" {
+				line += "  " + e.Reason
+			}
+			fmt.Println(strings.TrimRight(line, " "))
+		}
+		return nil
+	},
+}
+
+var statsCmd = &cobra.Command{
+	Use:   "stats",
+	Short: "Show which domains were blocked most often",
+	Long: `Asks the running daemon how many connections the proxy blocked per
+domain, most blocked first. Counts start when the daemon does, unless
+blockStatsPath keeps them across restarts.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if cfg.ControlSocketPath == "" {
+			return fmt.Errorf("control socket is disabled (controlSocketPath is empty)")
+		}
+		output, err := control.Send(cfg.ControlSocketPath, fmt.Sprintf("blocks %d", statsLimit))
+		if err != nil {
+			return err
+		}
+		if output == "" {
+			fmt.Println("No blocked connections counted")
+			return nil
+		}
+
+		fmt.Printf("%8s  %s\n", "BLOCKS", "DOMAIN")
+		for line := range strings.Lines(output) {
+			count, host, _ := strings.Cut(strings.TrimSpace(line), " ")
+			fmt.Printf("%8s  %s\n", count, host)
+		}
+		return nil
+	},
+}
+
+var reloadCmd = &cobra.Command{
+	Use:   "reload",
+	Short: "Make the running daemon reload its configuration",
+	Long: `Asks the running daemon to re-read its configuration and blocklist and
+re-apply the rules, like sending it SIGHUP.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		var err error
+		if cfg.ControlSocketPath == "" {
+			if cfg.PIDFilePath == "" {
+				return fmt.Errorf("control socket and PID file are disabled (controlSocketPath and pidFilePath are empty); use systemctl reload focusd")
+			}
+			err = signalReload()
+		} else {
+			_, err = control.Send(cfg.ControlSocketPath, "reload")
+		}
+		if err != nil {
+			if errors.Is(err, control.ErrDaemonNotRunning) {
+				return fmt.Errorf("%w; start it with systemctl start focusd", err)
+			}
+			return fmt.Errorf("reload failed: %w", err)
+		}
+		if cfg.ControlSocketPath == "" {
+			fmt.Println("Sent SIGHUP to the daemon")
+		} else {
+			fmt.Println("Daemon reloaded")
+		}
+		return nil
+	},
+}
+
+var addCmd = &cobra.Command{
+	Use:   "add <domain>...",
+	Short: "Add domains to the blocklist file",
+	Long: `Adds domains to the blocklist file (blocklistPath), keeping its comments
+and layout, and reloads the running daemon. Requires the USB key while
+blocking is enabled.`,
+	Args: cobra.MinimumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		domains, err := parseDomainArgs(args)
+		if err != nil {
+			return err
+		}
+		if err := authorizeBlocklistEdit(false); err != nil {
+			return err
+		}
+
+		added, err := cfg.AddToBlocklist(domains)
+		if err != nil {
+			return fmt.Errorf("updating blocklist: %w", err)
+		}
+		if len(added) == 0 {
+			fmt.Println("All domains are already in the blocklist")
+			return nil
+		}
+		fmt.Printf("Added to the blocklist: %s\n", strings.Join(added, ", "))
+		reloadDaemon()
 		return nil
 	},
 }
 
+var removeCmd = &cobra.Command{
+	Use:   "remove <domain>...",
+	Short: "Remove domains from the blocklist file",
+	Long: `Removes domains from the blocklist file (blocklistPath), keeping its
+comments and layout, and reloads the running daemon. While blocking is
+enabled this requires the USB key and is refused during a commitment.`,
+	Args: cobra.MinimumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		domains, err := parseDomainArgs(args)
+		if err != nil {
+			return err
+		}
+		if err := authorizeBlocklistEdit(true); err != nil {
+			return err
+		}
+
+		removed, err := cfg.RemoveFromBlocklist(domains)
+		if err != nil {
+			return fmt.Errorf("updating blocklist: %w", err)
+		}
+		if len(removed) == 0 {
+			return fmt.Errorf("none of the domains are in the blocklist file")
+		}
+		fmt.Printf("Removed from the blocklist: %s\n", strings.Join(removed, ", "))
+		reloadDaemon()
+		return nil
+	},
+}
+
+var categoryCmd = &cobra.Command{
+	Use:   "category",
+	Short: "Show or switch blocklist categories",
+	Long: `Lists the categories of the blocklist file and whether each is blocked.
+Use the enable and disable subcommands to switch one at runtime; the
+change persists across reboots and overrides activeCategories.`,
+	Args: cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		names, err := cfg.BlocklistCategories()
+		if err != nil {
+			return fmt.Errorf("loading blocklist: %w", err)
+		}
+		if len(names) == 0 {
+			fmt.Println("The blocklist file has no categories")
+			return nil
+		}
+		for _, name := range names {
+			fmt.Printf("%-20s %s\n", name, categoryStatus(name))
+		}
+		return nil
+	},
+}
+
+var categoryEnableCmd = &cobra.Command{
+	Use:   "enable <category>",
+	Short: "Block a category (requires USB key while enabled)",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return setCategory(args[0], true)
+	},
+}
+
+var categoryDisableCmd = &cobra.Command{
+	Use:   "disable <category>",
+	Short: "Stop blocking a category (requires USB key while enabled)",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return setCategory(args[0], false)
+	},
+}
+
+// listEntry is one effective blocklist entry as printed by list --json
+type listEntry struct {
+	Domain   string   `json:"domain"`
+	Variants []string `json:"variants"`
+	Budget   string   `json:"budget,omitempty"`
+}
+
+var listCmd = &cobra.Command{
+	Use:   "list",
+	Short: "Show the effective blocklist",
+	Long: `Prints the domains currently blocked: the configured blocklist, remote
+blocklists and session overrides, with the names each entry expands to,
+followed by the allowlist exceptions.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		domains, err := cfg.LoadBlocklist()
+		if err != nil {
+			return fmt.Errorf("loading blocklist: %w", err)
+		}
+		overrides, err := state.NewOverrides(state.DefaultOverridesPath).Load()
+		if err != nil {
+			return fmt.Errorf("reading session overrides: %w", err)
+		}
+		domains = state.ApplyOverrides(domains, overrides)
+
+		budgets, err := cfg.LoadBudgets()
+		if err != nil {
+			return fmt.Errorf("loading budgets: %w", err)
+		}
+
+		if listCount {
+			fmt.Println(len(domains))
+			return nil
+		}
+
+		entries := make([]listEntry, 0, len(domains))
+		for _, domain := range domains {
+			entry := listEntry{Domain: domain, Variants: []string{domain}}
+			if !strings.HasPrefix(domain, "*.") && !matcher.IsPattern(domain) {
+				entry.Variants = resolver.GetDomainVariants(domain)
+			}
+			if budget, ok := budgets[domain]; ok {
+				entry.Budget = budget.String()
+			}
+			entries = append(entries, entry)
+		}
+
+		if listJSON {
+			enc := json.NewEncoder(os.Stdout)
+			enc.SetIndent("", "  ")
+			return enc.Encode(struct {
+				Blocked []listEntry `json:"blocked"`
+				Allowed []string    `json:"allowed"`
+			}{Blocked: entries, Allowed: append([]string{}, cfg.AllowedDomains...)})
+		}
+
+		fmt.Printf("Blocked (%d):\n", len(entries))
+		for _, entry := range entries {
+			line := "  " + entry.Domain
+			if len(entry.Variants) > 1 {
+				line += " (also " + strings.Join(entry.Variants[1:], ", ") + ")"
+			}
+			if entry.Budget != "" {
+				line += " [budget " + entry.Budget + "/day]"
+			}
+			fmt.Println(line)
+		}
+		if len(cfg.AllowedDomains) > 0 {
+			fmt.Printf("Allowed exceptions (%d):\n", len(cfg.AllowedDomains))
+			for _, domain := range cfg.AllowedDomains {
+				fmt.Printf("  %s\n", domain)
+			}
+		}
+		return nil
+	},
+}
+
+var testCmd = &cobra.Command{
+	Use:   "test <host>...",
+	Short: "Check whether hostnames would be blocked",
+	Long: `Reports for each hostname whether the proxy would block it and which
+blocklist or allowlist entry decided it. Exits non-zero if any is blocked.`,
+	Args:          cobra.MinimumNArgs(1),
+	SilenceUsage:  true,
+	SilenceErrors: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		domains, err := cfg.LoadBlocklist()
+		if err != nil {
+			return fmt.Errorf("loading blocklist: %w", err)
+		}
+		overrides, err := state.NewOverrides(state.DefaultOverridesPath).Load()
+		if err != nil {
+			return fmt.Errorf("reading session overrides: %w", err)
+		}
+		m := matcher.New(state.ApplyOverrides(domains, overrides), cfg.AllowedDomains)
+
+		blocked := 0
+		for _, host := range args {
+			match := m.Match(host)
+			switch {
+			case match.Blocked:
+				blocked++
+				fmt.Printf("%s: blocked (%s match on %s)\n", host, match.Kind, match.Entry)
+			case match.Kind == matcher.KindAllowlist:
+				fmt.Printf("%s: allowed (allowlist entry %s overrides %s)\n", host, match.Allow, match.Entry)
+			default:
+				fmt.Printf("%s: allowed (no matching entry)\n", host)
+			}
+		}
+
+		if blocked > 0 {
+			return fmt.Errorf("%d of %d hosts blocked", blocked, len(args))
+		}
+		return nil
+	},
+}
+
+var ctlCmd = &cobra.Command{
+	Use:   "ctl <command> [args...]",
+	Short: "Send a command to the running daemon",
+	Long: `Sends a command over the daemon's control socket and prints the reply.
+Commands: status [json], stats, blocks [n], reload, sync, snooze <duration>.`,
+	Args: cobra.MinimumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if cfg.ControlSocketPath == "" {
+			return fmt.Errorf("control socket is disabled (controlSocketPath is empty)")
+		}
+		output, err := control.Send(cfg.ControlSocketPath, strings.Join(args, " "))
+		if err != nil {
+			return err
+		}
+		fmt.Print(output)
+		if output != "" && !strings.HasSuffix(output, "\n") {
+			fmt.Println()
+		}
+		return nil
+	},
+}
+
+var benchMatchCmd = &cobra.Command{
+	Use:    "bench-match [host...]",
+	Short:  "Measure the proxy's per-connection matching cost for the current blocklist",
+	Hidden: true,
+	Long: `Times the proxy's block decision against the current blocklist.
+Hosts that are blocked and hosts that are allowed are measured separately,
+since an allowed host has to be compared against every entry.
+Without arguments, representative hostnames are derived from the blocklist.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		domains, err := cfg.LoadBlocklist()
+		if err != nil {
+			return fmt.Errorf("loading blocklist: %w", err)
+		}
+		if len(domains) == 0 {
+			return fmt.Errorf("blocklist is empty")
+		}
+
+		hits, misses := benchHosts(domains)
+		if len(args) > 0 {
+			hits, misses = nil, nil
+			for _, host := range args {
+				if matchingEntry(state.NormalizeDomain(host), domains) != "" {
+					hits = append(hits, host)
+				} else {
+					misses = append(misses, host)
+				}
+			}
+		}
+
+		fmt.Printf("Blocklist: %d entries\n", len(domains))
+		for _, sample := range []struct {
+			name  string
+			hosts []string
+		}{
+			{name: "blocked", hosts: hits},
+			{name: "allowed", hosts: misses},
+		} {
+			if len(sample.hosts) == 0 {
+				continue
+			}
+			r := proxy.BenchMatch(domains, sample.hosts)
+			fmt.Printf("  %-8s %4d hosts  %10d ns/op  %6d B/op  %4d allocs/op\n",
+				sample.name, len(sample.hosts), r.NsPerOp(), r.AllocedBytesPerOp(), r.AllocsPerOp())
+		}
+		return nil
+	},
+}
+
+// benchHosts derives representative hostnames from the blocklist: bare and
+// subdomain hits on its entries, and common hosts that aren't blocked
+func benchHosts(domains []string) (hits, misses []string) {
+	for i, entry := range domains {
+		if i == 100 {
+			break
+		}
+		if matcher.IsPattern(entry) {
+			continue
+		}
+		entry = strings.TrimPrefix(state.NormalizeDomain(entry), "*.")
+		hits = append(hits, entry, "cdn.static."+entry)
+	}
+
+	for _, host := range []string{
+		"github.com", "api.github.com", "docs.google.com", "mail.google.com",
+		"stackoverflow.com", "en.wikipedia.org", "pkg.go.dev", "www.kernel.org",
+	} {
+		if matchingEntry(host, domains) == "" {
+			misses = append(misses, host)
+		}
+	}
+	return hits, misses
+}
+
+// printSchedule reports whether a blocking schedule is active and when that changes
+func printSchedule(now time.Time) error {
+	sched, err := cfg.Schedule()
+	if err != nil {
+		return fmt.Errorf("reading schedules: %w", err)
+	}
+	if sched.Empty() {
+		return nil
+	}
+
+	active := "inactive"
+	if sched.Active(now) {
+		active = "active"
+	}
+	next, ok := sched.NextTransition(now)
+	if !ok {
+		fmt.Printf("Schedule: %s\n", active)
+		return nil
+	}
+	fmt.Printf("Schedule: %s until %s\n", active, next.Local().Format("Mon "+time.DateTime))
+	return nil
+}
+
+// collectStatus gathers what status prints, and asks the daemon for its
+// own state if it is running
+func collectStatus(now time.Time) (statusReport, error) {
+	st := newState()
+	var report statusReport
+	enabled, err := st.IsEnabled()
+	if err != nil {
+		return report, fmt.Errorf("reading status: %w", err)
+	}
+	report.Enabled = enabled
+	report.State = "disabled"
+	if enabled {
+		report.State = "enabled"
+	}
+
+	sched, err := cfg.Schedule()
+	if err != nil {
+		return report, fmt.Errorf("reading schedules: %w", err)
+	}
+	if !sched.Empty() {
+		active := sched.Active(now)
+		report.ScheduleActive = &active
+		if next, ok := sched.NextTransition(now); ok {
+			report.ScheduleNextChange = &next
+		}
+	}
+
+	// A missing blocklist is reported by the commands that need it
+	if categories, err := cfg.BlocklistCategories(); err == nil && len(categories) > 0 {
+		report.Categories = make(map[string]bool, len(categories))
+		for _, name := range categories {
+			report.Categories[name] = cfg.CategoryActive(name)
+		}
+	}
+
+	remaining, err := st.CommitmentRemaining()
+	if err != nil {
+		return report, fmt.Errorf("reading commitment: %w", err)
+	}
+	report.CommitRemainingSeconds = int64(remaining.Round(time.Second) / time.Second)
+
+	snoozed, err := st.SnoozeRemaining()
+	if err != nil {
+		return report, fmt.Errorf("reading snooze: %w", err)
+	}
+	report.SnoozeRemainingSeconds = int64(snoozed.Round(time.Second) / time.Second)
+
+	overrides, err := state.NewOverrides(state.DefaultOverridesPath).Load()
+	if err != nil {
+		return report, fmt.Errorf("reading session overrides: %w", err)
+	}
+	if len(overrides) > 0 {
+		report.SessionOverrides = overrides
+	}
+
+	if cfg.ControlSocketPath != "" {
+		status, err := daemonStatus()
+		switch {
+		case errors.Is(err, control.ErrDaemonNotRunning):
+			// Reported as a null daemon
+		case err != nil:
+			report.DaemonError = err.Error()
+		default:
+			report.Daemon = status
+		}
+	}
+	return report, nil
+}
+
+// daemonStatus asks the running daemon for its state over the control socket
+func daemonStatus() (*daemon.Status, error) {
+	output, err := control.Send(cfg.ControlSocketPath, "status json")
+	if err != nil {
+		return nil, err
+	}
+	var status daemon.Status
+	if err := json.Unmarshal([]byte(output), &status); err != nil {
+		return nil, fmt.Errorf("decoding daemon status: %w", err)
+	}
+	return &status, nil
+}
+
+// printDaemonStatus reports the running daemon's own state, or that it
+// can't be reached, when the control socket is enabled
+func printDaemonStatus() {
+	if cfg.ControlSocketPath == "" {
+		return
+	}
+	status, err := daemonStatus()
+	switch {
+	case errors.Is(err, control.ErrDaemonNotRunning):
+		fmt.Println("Daemon: not running")
+		return
+	case err != nil:
+		fmt.Printf("Daemon: unreachable (%v)\n", err)
+		return
+	}
+
+	blocking := "inactive"
+	if status.Blocking {
+		blocking = "active"
+	}
+	fmt.Printf("Daemon: up %s, blocking %s\n", time.Duration(status.UptimeSeconds)*time.Second, blocking)
+	fmt.Printf("  Blocklist: %d domains, %d addresses\n", status.BlockedDomains, status.BlockedAddresses)
+	if status.LastRefresh != nil {
+		fmt.Printf("  Last refresh: %s\n", status.LastRefresh.Local().Format(time.DateTime))
+	}
+	if status.NextRefresh != nil {
+		fmt.Printf("  Next refresh: %s\n", status.NextRefresh.Local().Format(time.DateTime))
+	}
+	if status.ProxyRunning {
+		fmt.Printf("  Proxy: listening, %d connections\n", status.ProxyConnections)
+	} else {
+		fmt.Println("  Proxy: not running")
+	}
+	if status.LastReloadError != "" {
+		fmt.Printf("  Last reload failed: %s\n", status.LastReloadError)
+	}
+}
+
+// newVerifier creates a USB key verifier from the loaded config
+func newVerifier() *usbkey.Verifier {
+	verifier := usbkey.New(cfg.USBKeyPath, cfg.TokenHashPath)
+	verifier.SetStrictPermissions(cfg.StrictTokenPermissions)
+	verifier.SetTOTP(cfg.TOTPSecretPath, cfg.TOTPWindow)
+	return verifier
+}
+
+// verifyKey requires the USB key, or a TOTP code given with --totp when
+// the key is absent and TOTP is configured. It returns how the user was
+// verified, for the audit log.
+func verifyKey() (string, error) {
+	verifier := newVerifier()
+	err := verifier.Verify()
+	if err == nil {
+		return state.AuthUSBKey, nil
+	}
+	if totpCode == "" {
+		return "", fmt.Errorf("USB key verification failed: %w", err)
+	}
+	if totpErr := verifier.VerifyTOTP(totpCode); totpErr != nil {
+		return "", fmt.Errorf("USB key verification failed (%v) and TOTP verification failed: %w", err, totpErr)
+	}
+	return state.AuthTOTP, nil
+}
+
+// newState returns the state store, recording changes in the audit log
+func newState() *state.State {
+	st := state.New(state.DefaultStatePath)
+	st.SetAuditLog(cfg.AuditLogPath)
+	return st
+}
+
+// notifyDaemon asks a running daemon to apply a state change immediately.
+// Without a reachable daemon the change still applies within a minute.
+func notifyDaemon() {
+	if cfg.ControlSocketPath == "" {
+		return
+	}
+	if _, err := control.Send(cfg.ControlSocketPath, "sync"); err != nil && !errors.Is(err, control.ErrDaemonNotRunning) {
+		fmt.Fprintf(os.Stderr, "Warning: could not notify the daemon: %v\n", err)
+	}
+}
+
+// setCategory switches a blocklist category on or off and reloads the daemon
+func setCategory(name string, active bool) error {
+	names, err := cfg.BlocklistCategories()
+	if err != nil {
+		return fmt.Errorf("loading blocklist: %w", err)
+	}
+	if !slices.Contains(names, name) {
+		return fmt.Errorf("no category %q in the blocklist file", name)
+	}
+	if err := authorizeBlocklistEdit(!active); err != nil {
+		return err
+	}
+
+	if err := state.NewCategories(state.DefaultCategoriesPath).Set(name, active); err != nil {
+		return fmt.Errorf("updating categories: %w", err)
+	}
+	if active {
+		fmt.Printf("Category %s is now blocked\n", name)
+	} else {
+		fmt.Printf("Category %s is no longer blocked\n", name)
+	}
+	reloadDaemon()
+	return nil
+}
+
+// categoryStatus describes whether a category is blocked
+func categoryStatus(name string) string {
+	if cfg.CategoryActive(name) {
+		return "active"
+	}
+	return "inactive"
+}
+
+// reloadDaemon asks a running daemon to reload after the blocklist changed
+func reloadDaemon() {
+	var err error
+	switch {
+	case cfg.ControlSocketPath != "":
+		_, err = control.Send(cfg.ControlSocketPath, "reload")
+	case cfg.PIDFilePath != "":
+		err = signalReload()
+	default:
+		fmt.Println("Run systemctl reload focusd to apply the change")
+		return
+	}
+	if err != nil && !errors.Is(err, control.ErrDaemonNotRunning) {
+		fmt.Fprintf(os.Stderr, "Warning: could not reload the daemon: %v\n", err)
+	}
+}
+
+// signalReload sends SIGHUP to the daemon named in the PID file, for when
+// the control socket is disabled
+func signalReload() error {
+	pid, err := daemon.ReadPID(cfg.PIDFilePath)
+	if err != nil {
+		return err
+	}
+	return syscall.Kill(pid, syscall.SIGHUP)
+}
+
+// parseDomainArgs normalizes and validates domains given on the command line
+func parseDomainArgs(args []string) ([]string, error) {
+	domains := make([]string, 0, len(args))
+	for _, arg := range args {
+		domain := state.NormalizeDomain(arg)
+		if strings.HasPrefix(arg, matcher.RegexPrefix) {
+			// Case matters in a regex (\d vs \D)
+			domain = strings.TrimSpace(arg)
+		}
+		if err := config.ValidateDomain(domain); err != nil {
+			return nil, err
+		}
+		domains = append(domains, domain)
+	}
+	return domains, nil
+}
+
+// authorizeBlocklistEdit requires the USB key to change the blocklist while
+// blocking is enabled. Removals weaken protection, so they also honour
+// commitments.
+func authorizeBlocklistEdit(removing bool) error {
+	st := newState()
+	enabled, err := st.IsEnabled()
+	if err != nil {
+		return fmt.Errorf("reading state: %w", err)
+	}
+	if !enabled {
+		return nil
+	}
+	if removing {
+		if err := st.CheckCommitment(); err != nil {
+			return err
+		}
+	}
+	if _, err := verifyKey(); err != nil {
+		return err
+	}
+	return nil
+}
+
+// matchingEntry returns the blocklist entry that blocks domain, or "" if none does
+func matchingEntry(domain string, domains []string) string {
+	m := matcher.New(domains, nil).Match(domain)
+	if !m.Blocked {
+		return ""
+	}
+	return strings.TrimPrefix(state.NormalizeDomain(m.Entry), "*.")
+}
+
 func init() {
 	// Global flags
 	rootCmd.PersistentFlags().StringVarP(&configPath, "config", "c", "/etc/focusd/config.yaml", "path to config file")
 
+	// Command flags
+	enableCmd.Flags().DurationVar(&commitFor, "commit", 0, "refuse to disable until this much time has passed (e.g. 2h)")
+	for _, c := range []*cobra.Command{disableCmd, snoozeCmd, toggleCmd, addCmd, removeCmd, categoryEnableCmd, categoryDisableCmd} {
+		c.Flags().StringVar(&totpCode, "totp", "", "authenticator code to use if the USB key is absent (needs totpSecretPath)")
+	}
+	blockedCmd.Flags().IntVarP(&blockedLimit, "lines", "n", 20, "number of entries (or hosts with --summary) to show; 0 for all")
+	blockedCmd.Flags().BoolVar(&blockedSummary, "summary", false, "count attempts per host")
+	historyCmd.Flags().IntVarP(&historyLimit, "lines", "n", 20, "number of entries to show; 0 for all")
+	statsCmd.Flags().IntVarP(&statsLimit, "lines", "n", 20, "number of domains to show; 0 for all")
+	listCmd.Flags().BoolVar(&listJSON, "json", false, "print as JSON")
+	statusCmd.Flags().BoolVar(&statusJSON, "json", false, "print as JSON, including the running daemon's state")
+	listCmd.Flags().BoolVar(&listCount, "count", false, "print only the number of blocked entries")
+	initCmd.Flags().BoolVar(&initForce, "force", false, "overwrite an existing config and blocklist")
+	genKeyCmd.Flags().IntVar(&genKeyLength, "length", usbkey.DefaultKeyLength, "key size in bytes")
+	genKeyCmd.Flags().BoolVar(&genKeyForce, "force", false, "replace an existing key and hash")
+
 	// Add subcommands
 	rootCmd.AddCommand(daemonCmd)
 	rootCmd.AddCommand(enableCmd)
 	rootCmd.AddCommand(disableCmd)
+	rootCmd.AddCommand(snoozeCmd)
 	rootCmd.AddCommand(statusCmd)
+	rootCmd.AddCommand(toggleCmd)
+	rootCmd.AddCommand(addCmd)
+	categoryCmd.AddCommand(categoryEnableCmd)
+	categoryCmd.AddCommand(categoryDisableCmd)
+	rootCmd.AddCommand(categoryCmd)
+	rootCmd.AddCommand(removeCmd)
+	rootCmd.AddCommand(doctorCmd)
+	rootCmd.AddCommand(validateConfigCmd)
+	rootCmd.AddCommand(initCmd)
+	rootCmd.AddCommand(genKeyCmd)
+	rootCmd.AddCommand(versionCmd)
+	rootCmd.AddCommand(reloadCmd)
+	rootCmd.AddCommand(listCmd)
+	rootCmd.AddCommand(testCmd)
+	rootCmd.AddCommand(ctlCmd)
+	rootCmd.AddCommand(blockedCmd)
+	rootCmd.AddCommand(historyCmd)
+	rootCmd.AddCommand(statsCmd)
+	rootCmd.AddCommand(benchMatchCmd)
 
 	// Disable the completion command (optional)
 	rootCmd.CompletionOptions.DisableDefaultCmd = true
@@ -26,6 +26,8 @@
           ldflags = [
             "-s"
             "-w"
+            "-X focusd/internal/version.Version=${version}"
+            "-X focusd/internal/version.Commit=${self.rev or self.dirtyRev or "unknown"}"
           ];
 
           meta = with pkgs.lib; {
@@ -0,0 +1,90 @@
+package config
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"focusd/internal/matcher"
+)
+
+// lowRefreshIntervalMinutes is the refresh interval below which Check warns
+// that every refresh re-resolves the whole blocklist very often
+const lowRefreshIntervalMinutes = 5
+
+// Report lists the problems Check found
+type Report struct {
+	// Errors would stop the daemon or a command from working
+	Errors []error
+
+	// Warnings are settings that work but are likely mistakes
+	Warnings []string
+}
+
+// checkExists reports an error if nothing exists at path, which may be a
+// glob
+func checkExists(path string) error {
+	if strings.ContainsAny(path, "*?[") {
+		matches, err := filepath.Glob(path)
+		if err == nil && len(matches) == 0 {
+			err = fmt.Errorf("no file matching %q", path)
+		}
+		return err
+	}
+	_, err := os.Stat(path)
+	return err
+}
+
+// OK reports whether no errors were found
+func (r Report) OK() bool {
+	return len(r.Errors) == 0
+}
+
+// Check validates the configuration and its local blocklist, collecting
+// every problem rather than stopping at the first. Remote blocklists are
+// not fetched.
+func (c *Config) Check() Report {
+	var r Report
+	r.Errors = c.validate()
+
+	// The key's own path is a mount point that only exists while it's
+	// plugged in, but what it is checked against must be there
+	if err := checkExists(c.TokenHashPath); err != nil {
+		r.Errors = append(r.Errors, fmt.Errorf("token hash: %w", err))
+	}
+	if c.TOTPSecretPath != "" {
+		if err := checkExists(c.TOTPSecretPath); err != nil {
+			r.Errors = append(r.Errors, fmt.Errorf("TOTP secret: %w", err))
+		}
+	}
+
+	domains, err := c.loadLocalBlocklist()
+	if err != nil {
+		r.Errors = append(r.Errors, fmt.Errorf("loading blocklist: %w", err))
+	}
+	for _, domain := range domains {
+		if err := validateEntry(domain); err != nil {
+			r.Errors = append(r.Errors, fmt.Errorf("blocklist: %w", err))
+		}
+	}
+	for _, domain := range c.AllowedDomains {
+		if err := validateEntry(domain); err != nil {
+			r.Errors = append(r.Errors, fmt.Errorf("allowed domains: %w", err))
+		}
+	}
+
+	if err == nil && len(domains) == 0 && len(c.BlocklistURLs) == 0 {
+		r.Warnings = append(r.Warnings, "the blocklist is empty, so nothing will be blocked")
+	}
+	if c.RefreshIntervalMinutes > 0 && c.RefreshIntervalMinutes < lowRefreshIntervalMinutes {
+		r.Warnings = append(r.Warnings, fmt.Sprintf("refresh interval of %d minute(s) re-resolves the whole blocklist very often", c.RefreshIntervalMinutes))
+	}
+	if u, err := url.Parse(c.BlockRedirectURL); err == nil && u.Hostname() != "" {
+		if m, err := matcher.Compile(domains, c.AllowedDomains); err == nil && m.Blocked(u.Hostname()) {
+			r.Warnings = append(r.Warnings, fmt.Sprintf("block redirect URL %s is itself blocked, so redirects will loop", c.BlockRedirectURL))
+		}
+	}
+	return r
+}
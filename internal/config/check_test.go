@@ -0,0 +1,81 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCheck(t *testing.T) {
+	dir := t.TempDir()
+	hash := filepath.Join(dir, "token.sha256")
+	if err := os.WriteFile(hash, []byte("x"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	empty := filepath.Join(dir, "empty.yml")
+	if err := os.WriteFile(empty, []byte("domains: []\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name         string
+		yaml         string
+		wantErrors   []string
+		wantWarnings []string
+	}{
+		{
+			name: "valid",
+			yaml: "blockedDomains: [example.com]\ntokenHashPath: " + hash + "\n",
+		},
+		{
+			name: "every problem reported",
+			yaml: "blockedDomains: [example.com, bad_domain.com]\nproxyMark: 1\nbypassCIDRs: [10.0.0.0]\n" +
+				"refreshIntervalMinutes: 2\ntokenHashPath: " + filepath.Join(dir, "missing") + "\n",
+			wantErrors:   []string{"bypass CIDR", "proxy mark 1", "token hash", "bad_domain.com"},
+			wantWarnings: []string{"refresh interval"},
+		},
+		{
+			name:       "missing blocklist",
+			yaml:       "blocklistPath: " + filepath.Join(dir, "missing.yml") + "\ntokenHashPath: " + hash + "\n",
+			wantErrors: []string{"loading blocklist"},
+		},
+		{
+			name:         "empty blocklist",
+			yaml:         "blocklistPath: " + empty + "\ntokenHashPath: " + hash + "\n",
+			wantWarnings: []string{"blocklist is empty"},
+		},
+		{
+			name:         "redirect loop",
+			yaml:         "blockedDomains: [example.com]\nhttpBlockMode: redirect\nblockRedirectURL: http://www.example.com/\ntokenHashPath: " + hash + "\n",
+			wantWarnings: []string{"redirects will loop"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, err := Read(writeConfig(t, tt.yaml))
+			if err != nil {
+				t.Fatalf("Read() error = %v", err)
+			}
+			r := c.Check()
+
+			if len(r.Errors) != len(tt.wantErrors) {
+				t.Errorf("Check() errors = %v, want %d", r.Errors, len(tt.wantErrors))
+			}
+			for i, want := range tt.wantErrors {
+				if i < len(r.Errors) && !strings.Contains(r.Errors[i].Error(), want) {
+					t.Errorf("Check() error %d = %v, want containing %q", i, r.Errors[i], want)
+				}
+			}
+			if len(r.Warnings) != len(tt.wantWarnings) {
+				t.Errorf("Check() warnings = %q, want %d", r.Warnings, len(tt.wantWarnings))
+			}
+			for i, want := range tt.wantWarnings {
+				if i < len(r.Warnings) && !strings.Contains(r.Warnings[i], want) {
+					t.Errorf("Check() warning %d = %q, want containing %q", i, r.Warnings[i], want)
+				}
+			}
+		})
+	}
+}
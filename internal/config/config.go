@@ -1,65 +1,405 @@
 package config
 
 import (
+	"bytes"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"net"
+	"net/url"
 	"os"
 	"os/user"
 	"path/filepath"
+	"reflect"
+	"slices"
+	"sort"
 	"strings"
+	"time"
 
 	"gopkg.in/yaml.v3"
+
+	"focusd/internal/logging"
+	"focusd/internal/matcher"
+	"focusd/internal/schedule"
 )
 
 // Config represents the focusd configuration
 type Config struct {
 	// BlockedDomains is the list of domains to block (optional if BlocklistPath is set)
-	BlockedDomains []string `yaml:"blockedDomains,omitempty"`
+	BlockedDomains []string `json:"blockedDomains,omitempty" yaml:"blockedDomains,omitempty"`
+
+	// AllowedDomains are never blocked, even under a blocked parent domain.
+	// The most specific matching entry wins; allow wins ties.
+	AllowedDomains []string `json:"allowedDomains,omitempty" yaml:"allowedDomains,omitempty"`
 
 	// BlocklistPath is the path to a separate blocklist file
 	// Default: /etc/blocklist.yml
-	BlocklistPath string `yaml:"blocklistPath,omitempty"`
+	BlocklistPath string `json:"blocklistPath,omitempty" yaml:"blocklistPath,omitempty"`
+
+	// ActiveCategories selects which categories of the blocklist file are
+	// blocked. When empty, all of them are.
+	ActiveCategories []string `json:"activeCategories,omitempty" yaml:"activeCategories,omitempty"`
+
+	// BlocklistURLs are HTTPS URLs of remote blocklists (blocklist YAML or one
+	// domain per line), merged with the local entries
+	BlocklistURLs []string `json:"blocklistURLs,omitempty" yaml:"blocklistURLs,omitempty"`
+
+	// BlocklistCacheDir keeps the last successful download of each remote
+	// blocklist, used when a later fetch fails
+	BlocklistCacheDir string `json:"blocklistCacheDir,omitempty" yaml:"blocklistCacheDir,omitempty"`
+
+	// BlocklistFetchTimeoutSeconds bounds each remote blocklist download
+	BlocklistFetchTimeoutSeconds int `json:"blocklistFetchTimeoutSeconds,omitempty" yaml:"blocklistFetchTimeoutSeconds,omitempty"`
+
+	// BlocklistMaxBytes is the largest remote blocklist accepted
+	BlocklistMaxBytes int64 `json:"blocklistMaxBytes,omitempty" yaml:"blocklistMaxBytes,omitempty"`
+
+	// ResolverAddrs are upstream DNS servers used to resolve blocked domains,
+	// tried in order per query. Empty uses the system resolver.
+	ResolverAddrs []string `json:"resolverAddrs,omitempty" yaml:"resolverAddrs,omitempty"`
+
+	// ResolverTimeoutSeconds bounds each query to a single resolver
+	ResolverTimeoutSeconds int `json:"resolverTimeoutSeconds,omitempty" yaml:"resolverTimeoutSeconds,omitempty"`
+
+	// ResolverConcurrency is how many domains are resolved in parallel
+	ResolverConcurrency int `json:"resolverConcurrency,omitempty" yaml:"resolverConcurrency,omitempty"`
+
+	// ResolverCacheTTLMinutes is how long resolved addresses are reused
+	// before being looked up again (0 disables the cache)
+	ResolverCacheTTLMinutes int `json:"resolverCacheTTLMinutes" yaml:"resolverCacheTTLMinutes"`
+
+	// ResolverDoHURL is a DNS-over-HTTPS endpoint (JSON API) queried before
+	// ResolverAddrs; they are only used if it fails
+	ResolverDoHURL string `json:"resolverDoHURL,omitempty" yaml:"resolverDoHURL,omitempty"`
+
+	// ResolverSkipCIDRs are networks whose addresses are never IP-blocked
+	// when a blocked domain resolves to them, replacing the default
+	// loopback, link-local, private and unspecified ranges
+	ResolverSkipCIDRs []string `json:"resolverSkipCIDRs,omitempty" yaml:"resolverSkipCIDRs,omitempty"`
+
+	// SkipSharedCDN leaves addresses in the published Cloudflare and Fastly
+	// ranges out of IP blocking, since many unrelated sites share them;
+	// those domains are blocked by DNS and the proxy alone
+	SkipSharedCDN bool `json:"skipSharedCDN,omitempty" yaml:"skipSharedCDN,omitempty"`
+
+	// SharedCIDRs are further networks of shared addresses left out of IP
+	// blocking, whether or not SkipSharedCDN is set
+	SharedCIDRs []string `json:"sharedCIDRs,omitempty" yaml:"sharedCIDRs,omitempty"`
 
 	// RefreshIntervalMinutes specifies how often to refresh IP addresses
-	RefreshIntervalMinutes int `yaml:"refreshIntervalMinutes"`
+	// 0 disables periodic refresh; IPs are only resolved on enable and reload
+	RefreshIntervalMinutes int `json:"refreshIntervalMinutes" yaml:"refreshIntervalMinutes"`
+
+	// RefreshJitterPercent moves each refresh a random amount of up to this
+	// percentage of the interval earlier or later, so that machines started
+	// together don't all query DNS at once. 0 refreshes exactly on interval.
+	RefreshJitterPercent int `json:"refreshJitterPercent" yaml:"refreshJitterPercent"`
+
+	// RefreshRetries is how many times a failed periodic refresh is retried
+	// before waiting for the next one. 0 disables retries.
+	RefreshRetries int `json:"refreshRetries" yaml:"refreshRetries"`
+
+	// RefreshRetryBaseSeconds is the delay before the first retry; each
+	// further retry waits twice as long as the one before
+	RefreshRetryBaseSeconds int `json:"refreshRetryBaseSeconds,omitempty" yaml:"refreshRetryBaseSeconds,omitempty"`
 
 	// USBKeyPath is a glob pattern for finding the USB key file
-	USBKeyPath string `yaml:"usbKeyPath"`
+	USBKeyPath string `json:"usbKeyPath" yaml:"usbKeyPath"`
+
+	// TokenHashPath is the path to the expected token hash file, a directory
+	// of hash files or a glob; any hash listed in them is accepted
+	TokenHashPath string `json:"tokenHashPath" yaml:"tokenHashPath"`
+
+	// TOTPSecretPath is a file holding a base32 TOTP secret. When set, a code
+	// from an authenticator app (--totp) is accepted in place of an absent
+	// USB key. Empty keeps authentication hardware-only.
+	TOTPSecretPath string `json:"totpSecretPath,omitempty" yaml:"totpSecretPath,omitempty"`
 
-	// TokenHashPath is the path to the expected token hash file
-	TokenHashPath string `yaml:"tokenHashPath"`
+	// TOTPWindow is how many 30-second steps of clock drift either side of
+	// the current time a TOTP code may be from
+	TOTPWindow int `json:"totpWindow,omitempty" yaml:"totpWindow,omitempty"`
+
+	// StrictTokenPermissions refuses USB verification (instead of warning) when
+	// the token hash file or its directory is group/world-writable
+	StrictTokenPermissions bool `json:"strictTokenPermissions,omitempty" yaml:"strictTokenPermissions,omitempty"`
 
 	// DnsmasqConfigPath is where to write the dnsmasq configuration
-	DnsmasqConfigPath string `yaml:"dnsmasqConfigPath"`
+	DnsmasqConfigPath string `json:"dnsmasqConfigPath" yaml:"dnsmasqConfigPath"`
+
+	// DnsmasqReloadCommand is run after the dnsmasq config is written or
+	// removed. Empty sends SIGHUP to the dnsmasq process instead.
+	DnsmasqReloadCommand []string `json:"dnsmasqReloadCommand,omitempty" yaml:"dnsmasqReloadCommand,omitempty"`
+
+	// DnsmasqPIDFile is where to find the dnsmasq PID for SIGHUP; if it
+	// doesn't exist, the process is looked up with pgrep
+	DnsmasqPIDFile string `json:"dnsmasqPIDFile,omitempty" yaml:"dnsmasqPIDFile,omitempty"`
+
+	// HostsFilePath, if set, also exports the blocklist to this hosts file
+	// (e.g. /etc/hosts) for machines without dnsmasq. Only focusd's marked
+	// section of the file is changed.
+	HostsFilePath string `json:"hostsFilePath,omitempty" yaml:"hostsFilePath,omitempty"`
+
+	// AtomicRuleReplace rewrites the whole blocked IP set in a single nftables
+	// transaction on each refresh instead of applying only the changes
+	AtomicRuleReplace bool `json:"atomicRuleReplace,omitempty" yaml:"atomicRuleReplace,omitempty"`
+
+	// PersistRulesOnExit leaves the DNS and IP blocking rules in place when
+	// the daemon stops, even if blocking is disabled. The proxy and its
+	// rules are removed either way.
+	PersistRulesOnExit bool `json:"persistRulesOnExit,omitempty" yaml:"persistRulesOnExit,omitempty"`
+
+	// DnsBlockMode is how blocked domains are answered: "sinkhole" (0.0.0.0,
+	// the default) or "nxdomain" (host not found, so clients fail fast)
+	DnsBlockMode string `json:"dnsBlockMode,omitempty" yaml:"dnsBlockMode,omitempty"`
+
+	// Schedules are time windows during which blocking is enforced even
+	// when disabled. Outside them, the enabled/disabled state applies.
+	Schedules []schedule.Entry `json:"schedules,omitempty" yaml:"schedules,omitempty"`
+
+	// MaxSnoozeMinutes is the longest snooze `focusd snooze` accepts, so a
+	// snooze can't stand in for a permanent disable
+	MaxSnoozeMinutes int `json:"maxSnoozeMinutes,omitempty" yaml:"maxSnoozeMinutes,omitempty"`
+
+	// RequireKeyToStartDisabled makes the daemon fail closed at startup:
+	// a persisted "disabled" state is only honoured if a valid USB key is present
+	RequireKeyToStartDisabled bool `json:"requireKeyToStartDisabled,omitempty" yaml:"requireKeyToStartDisabled,omitempty"`
+
+	// RequireKeyWhileDisabled makes the USB key a continuous requirement:
+	// while blocking is disabled the key is polled, and removing it
+	// re-enables blocking
+	RequireKeyWhileDisabled bool `json:"requireKeyWhileDisabled,omitempty" yaml:"requireKeyWhileDisabled,omitempty"`
+
+	// KeyPollIntervalSeconds is how often the USB key is polled
+	KeyPollIntervalSeconds int `json:"keyPollIntervalSeconds,omitempty" yaml:"keyPollIntervalSeconds,omitempty"`
+
+	// ReverseDNSBlock makes the proxy check the PTR record of the destination IP
+	// when a connection's Host/SNI is a bare IP address
+	ReverseDNSBlock bool `json:"reverseDNSBlock,omitempty" yaml:"reverseDNSBlock,omitempty"`
+
+	// ProxyIdleTimeoutMinutes is how long a proxied connection may sit idle
+	// before it is force-closed (0 uses the proxy default of 5 minutes)
+	ProxyIdleTimeoutMinutes int `json:"proxyIdleTimeoutMinutes,omitempty" yaml:"proxyIdleTimeoutMinutes,omitempty"`
+
+	// UsageLogPath enables logging of allowed connection metadata (host, start,
+	// duration, bytes) as JSON lines. Off by default since it is privacy-sensitive.
+	UsageLogPath string `json:"usageLogPath,omitempty" yaml:"usageLogPath,omitempty"`
+
+	// UsageSampleRate is the fraction (0-1] of allowed connections recorded in the usage log
+	UsageSampleRate float64 `json:"usageSampleRate,omitempty" yaml:"usageSampleRate,omitempty"`
+
+	// BlockedLogPath enables an append-only log of blocked connection
+	// attempts (time, host, destination, protocol), read by `focusd blocked`
+	BlockedLogPath string `json:"blockedLogPath,omitempty" yaml:"blockedLogPath,omitempty"`
+
+	// BlockedLogMaxBytes is the size at which the blocked log is rotated
+	BlockedLogMaxBytes int64 `json:"blockedLogMaxBytes,omitempty" yaml:"blockedLogMaxBytes,omitempty"`
+
+	// Redirects maps blocked domains to an alternative URL. Blocked HTTP
+	// requests are redirected there; the most specific entry wins.
+	Redirects map[string]string `json:"redirects,omitempty" yaml:"redirects,omitempty"`
+
+	// BlockPagePath is an HTML template shown for blocked HTTP requests,
+	// rendered with {{.Host}} and {{.Time}}. Empty uses the built-in page.
+	BlockPagePath string `json:"blockPagePath,omitempty" yaml:"blockPagePath,omitempty"`
+
+	// HTTPBlockMode is how blocked HTTP requests are answered: "forbidden"
+	// (a 403 with the block page, the default) or "redirect" (a 302 to
+	// BlockRedirectURL)
+	HTTPBlockMode string `json:"httpBlockMode,omitempty" yaml:"httpBlockMode,omitempty"`
+
+	// BlockRedirectURL is where blocked HTTP requests are sent in redirect
+	// mode. Entries in Redirects take precedence.
+	BlockRedirectURL string `json:"blockRedirectURL,omitempty" yaml:"blockRedirectURL,omitempty"`
+
+	// ProxyListenAddr is the IPv4 or IPv6 address the transparent proxy binds to
+	// Default: all IPv4 interfaces
+	ProxyListenAddr string `json:"proxyListenAddr,omitempty" yaml:"proxyListenAddr,omitempty"`
+
+	// ProxyHTTPPort and ProxyHTTPSPort are the local ports the proxy listens
+	// on for intercepted traffic (default 50080 and 50443)
+	ProxyHTTPPort  int `json:"proxyHTTPPort,omitempty" yaml:"proxyHTTPPort,omitempty"`
+	ProxyHTTPSPort int `json:"proxyHTTPSPort,omitempty" yaml:"proxyHTTPSPort,omitempty"`
+
+	// ProxyMark is the firewall mark on the proxy's own outbound connections
+	// that exempts them from interception (default 50)
+	ProxyMark int `json:"proxyMark,omitempty" yaml:"proxyMark,omitempty"`
+
+	// ProxyMaxConnections limits how many connections the proxy handles at
+	// once; beyond it new connections are closed (default 4096)
+	ProxyMaxConnections int `json:"proxyMaxConnections,omitempty" yaml:"proxyMaxConnections,omitempty"`
+
+	// BypassCIDRs are destination networks whose traffic skips the proxy,
+	// replacing the default RFC 1918 ranges. Loopback always skips it.
+	BypassCIDRs []string `json:"bypassCIDRs,omitempty" yaml:"bypassCIDRs,omitempty"`
+
+	// InspectQUIC makes the proxy read the SNI from QUIC (HTTP/3) Initial
+	// packets and relay allowed flows, rather than dropping all QUIC
+	InspectQUIC bool `json:"inspectQUIC,omitempty" yaml:"inspectQUIC,omitempty"`
+
+	// BlockQUIC drops QUIC (UDP port 443) that isn't inspected, so clients
+	// fall back to TCP where the proxy sees the SNI (default true). Not
+	// omitted when false, so a written config keeps it off.
+	BlockQUIC bool `json:"blockQUIC" yaml:"blockQUIC"`
+
+	// BlockDoT drops DNS-over-TLS (port 853), which clients use to bypass
+	// dnsmasq
+	BlockDoT bool `json:"blockDoT,omitempty" yaml:"blockDoT,omitempty"`
+
+	// DoHResolverIPs are addresses or CIDRs of DNS-over-HTTPS resolvers;
+	// HTTPS and QUIC to them is dropped so clients can't bypass dnsmasq
+	DoHResolverIPs []string `json:"dohResolverIPs,omitempty" yaml:"dohResolverIPs,omitempty"`
+
+	// LogLevel controls log verbosity: "debug", "info" (default), "warn" or
+	// "error"
+	LogLevel string `json:"logLevel,omitempty" yaml:"logLevel,omitempty"`
+
+	// LogFormat is "text" (default) or "json" for shipping to a log collector
+	LogFormat string `json:"logFormat,omitempty" yaml:"logFormat,omitempty"`
+
+	// BudgetStatePath is where consumed daily allowances are persisted
+	BudgetStatePath string `json:"budgetStatePath,omitempty" yaml:"budgetStatePath,omitempty"`
+
+	// AuditLogPath is an append-only JSON lines log of every enable, disable
+	// and snooze (empty disables it)
+	AuditLogPath string `json:"auditLogPath,omitempty" yaml:"auditLogPath,omitempty"`
+
+	// RuntimeStatePath is where in-memory daemon state (stats, commitment
+	// deadline) is saved at clean shutdown and restored at startup, so
+	// restarting for an upgrade is seamless. The resolved IPs are kept in
+	// IPCachePath instead. Empty disables it.
+	RuntimeStatePath string `json:"runtimeStatePath,omitempty" yaml:"runtimeStatePath,omitempty"`
+
+	// IPCachePath is where the last resolved blocked IPs are written after
+	// each resolution, so that a restart, even after a crash, blocks them
+	// straight away instead of waiting for DNS. Empty disables it.
+	IPCachePath string `json:"ipCachePath,omitempty" yaml:"ipCachePath,omitempty"`
+
+	// IPCacheMaxAgeHours is how old the IP cache may be and still be used
+	IPCacheMaxAgeHours int `json:"ipCacheMaxAgeHours,omitempty" yaml:"ipCacheMaxAgeHours,omitempty"`
+
+	// ControlSocketPath is the Unix socket the daemon accepts runtime
+	// commands on (reload, status, snooze, ...). Empty disables it.
+	ControlSocketPath string `json:"controlSocketPath,omitempty" yaml:"controlSocketPath,omitempty"`
+
+	// PIDFilePath is where the daemon writes its PID, holding a lock on the
+	// file so that a second instance refuses to start. Empty disables it.
+	PIDFilePath string `json:"pidFilePath,omitempty" yaml:"pidFilePath,omitempty"`
+
+	// MetricsTextfilePath, if set, is where metrics are periodically written in
+	// Prometheus text format for node_exporter's textfile collector
+	MetricsTextfilePath string `json:"metricsTextfilePath,omitempty" yaml:"metricsTextfilePath,omitempty"`
+
+	// MetricsTextfileIntervalSeconds is how often the metrics textfile is rewritten
+	MetricsTextfileIntervalSeconds int `json:"metricsTextfileIntervalSeconds,omitempty" yaml:"metricsTextfileIntervalSeconds,omitempty"`
+
+	// BlockStatsPath, if set, is where per-domain block counts are flushed
+	// so they survive restarts. Empty keeps them in memory only.
+	BlockStatsPath string `json:"blockStatsPath,omitempty" yaml:"blockStatsPath,omitempty"`
+
+	// BlockStatsFlushMinutes is how often block counts are flushed
+	BlockStatsFlushMinutes int `json:"blockStatsFlushMinutes,omitempty" yaml:"blockStatsFlushMinutes,omitempty"`
+
+	// categoryToggles are runtime overrides of ActiveCategories
+	categoryToggles map[string]bool
 }
 
 // Blocklist represents the structure of the blocklist file
 type Blocklist struct {
-	Domains []string `yaml:"domains"`
+	Domains []BlocklistEntry `yaml:"domains"`
+
+	// Categories are named groups of entries that can be switched on and
+	// off independently; see Config.ActiveCategories
+	Categories map[string][]BlocklistEntry `yaml:"categories,omitempty"`
+}
+
+// BlocklistEntry is a blocked domain, optionally with a daily allowance.
+// In YAML it is either a plain domain string or a mapping:
+//
+//   - domain: reddit.com
+//     budget: 30m
+type BlocklistEntry struct {
+	Domain string `yaml:"domain"`
+
+	// Budget is how long the domain may be used per day before it is blocked
+	Budget time.Duration `yaml:"budget,omitempty"`
+}
+
+// UnmarshalYAML accepts either a plain domain string or a mapping
+func (e *BlocklistEntry) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind == yaml.ScalarNode {
+		return value.Decode(&e.Domain)
+	}
+	type plain BlocklistEntry
+	return value.Decode((*plain)(e))
 }
 
 // DefaultConfig returns a configuration with sensible defaults
 func DefaultConfig() *Config {
 	return &Config{
-		BlockedDomains:         []string{},
-		BlocklistPath:          "/etc/blocklist.yml",
-		RefreshIntervalMinutes: 60,
-		USBKeyPath:             "/run/media/zac/*/FOCUSD/focusd.key",
-		TokenHashPath:          "/etc/focusd/token.sha256",
-		DnsmasqConfigPath:      "/run/focusd/dnsmasq.conf",
+		BlockedDomains:          []string{},
+		BlocklistPath:           "/etc/blocklist.yml",
+		RefreshIntervalMinutes:  60,
+		RefreshJitterPercent:    10,
+		RefreshRetries:          3,
+		RefreshRetryBaseSeconds: 10,
+		ResolverCacheTTLMinutes: 30,
+		USBKeyPath:              "/run/media/zac/*/FOCUSD/focusd.key",
+		TokenHashPath:           "/etc/focusd/token.sha256",
+		TOTPWindow:              1,
+		DnsmasqConfigPath:       "/run/focusd/dnsmasq.conf",
+		BudgetStatePath:         "/var/lib/focusd/budget.json",
+		RuntimeStatePath:        "/var/lib/focusd/runtime.json",
+		IPCachePath:             "/var/lib/focusd/ips.json",
+		AuditLogPath:            "/var/lib/focusd/audit.log",
+		ControlSocketPath:       "/run/focusd/control.sock",
+		PIDFilePath:             "/run/focusd/focusd.pid",
+		BlocklistCacheDir:       "/var/lib/focusd/blocklists",
+
+		MetricsTextfileIntervalSeconds: 60,
+		BlockStatsFlushMinutes:         10,
+		KeyPollIntervalSeconds:         5,
+		MaxSnoozeMinutes:               60,
+		BlocklistFetchTimeoutSeconds:   30,
+		BlocklistMaxBytes:              5 << 20,
+		BlockQUIC:                      true,
+		IPCacheMaxAgeHours:             24,
 	}
 }
 
-// Load reads and parses a YAML configuration file
+// Load reads and parses a YAML or JSON configuration file, then applies
+// any FOCUSD_* environment overrides (see EnvVar) and validates the result
 func Load(path string) (*Config, error) {
+	cfg, err := Read(path)
+	if err != nil {
+		return nil, err
+	}
+	if err := cfg.Validate(); err != nil {
+		return nil, fmt.Errorf("validating config: %w", err)
+	}
+	return cfg, nil
+}
+
+// Read is Load without the validation, for reporting every problem with
+// Check instead of failing on the first
+func Read(path string) (*Config, error) {
 	data, err := os.ReadFile(path)
 	if err != nil {
 		return nil, fmt.Errorf("reading config file: %w", err)
 	}
 
 	cfg := DefaultConfig()
-	if err := yaml.Unmarshal(data, cfg); err != nil {
+	if err := decode(path, data, cfg); err != nil {
 		return nil, fmt.Errorf("parsing config file: %w", err)
 	}
+	if err := cfg.applyEnv(); err != nil {
+		return nil, fmt.Errorf("applying environment overrides: %w", err)
+	}
+	for _, domains := range []*[]string{&cfg.BlockedDomains, &cfg.AllowedDomains} {
+		if err := asciiDomains(*domains); err != nil {
+			return nil, fmt.Errorf("parsing config file: %w", err)
+		}
+	}
 
 	// If BlocklistPath wasn't set in config, use default
 	if cfg.BlocklistPath == "" {
@@ -69,49 +409,439 @@ func Load(path string) (*Config, error) {
 	// Expand home directory in BlocklistPath
 	cfg.BlocklistPath = expandPath(cfg.BlocklistPath)
 
-	if err := cfg.Validate(); err != nil {
-		return nil, fmt.Errorf("validating config: %w", err)
+	return cfg, nil
+}
+
+// isJSON reports whether the config file at path is JSON: a .json file, or
+// one without a YAML extension whose content starts with '{'
+func isJSON(path string, data []byte) bool {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".json":
+		return true
+	case ".yaml", ".yml":
+		return false
 	}
+	return bytes.HasPrefix(bytes.TrimSpace(data), []byte("{"))
+}
 
-	return cfg, nil
+// decode parses a YAML or JSON config file into cfg. Unknown keys are
+// rejected so a typo doesn't silently fall back to a default.
+func decode(path string, data []byte, cfg *Config) error {
+	if isJSON(path, data) {
+		dec := json.NewDecoder(bytes.NewReader(data))
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(cfg); err != nil && err != io.EOF {
+			if strings.Contains(err.Error(), "unknown field") {
+				return fmt.Errorf("%w (valid keys: %s)", err, strings.Join(ValidKeys(), ", "))
+			}
+			return err
+		}
+		return nil
+	}
+
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	if err := dec.Decode(cfg); err != nil && err != io.EOF {
+		var typeErr *yaml.TypeError
+		if errors.As(err, &typeErr) {
+			return fmt.Errorf("%w (valid keys: %s)", err, strings.Join(ValidKeys(), ", "))
+		}
+		return err
+	}
+	return nil
 }
 
-// Validate checks that the configuration is valid
+// ValidKeys returns the configuration keys accepted in the config file
+func ValidKeys() []string {
+	t := reflect.TypeOf(Config{})
+	keys := make([]string, 0, t.NumField())
+	for i := 0; i < t.NumField(); i++ {
+		tag := t.Field(i).Tag.Get("yaml")
+		name, _, _ := strings.Cut(tag, ",")
+		if name != "" && name != "-" {
+			keys = append(keys, name)
+		}
+	}
+	return keys
+}
+
+// Validate checks that the configuration is valid. Every problem found is
+// reported, joined into one error.
 func (c *Config) Validate() error {
-	// Note: We don't validate BlockedDomains or BlocklistPath here
-	// They will be validated at runtime when LoadBlocklist() is called
+	return errors.Join(c.validate()...)
+}
+
+// validate returns every problem with the configuration
+func (c *Config) validate() []error {
+	var errs []error
+
+	// Note: We don't validate the blocklist file here; it is validated at
+	// runtime when LoadBlocklist() is called
+	if _, err := matcher.Compile(c.BlockedDomains, c.AllowedDomains); err != nil {
+		errs = append(errs, err)
+	}
+
+	if c.RefreshIntervalMinutes < 0 {
+		errs = append(errs, fmt.Errorf("refresh interval cannot be negative (use 0 to disable periodic refresh)"))
+	}
+	if c.RefreshJitterPercent < 0 || c.RefreshJitterPercent > 50 {
+		errs = append(errs, fmt.Errorf("refresh jitter must be between 0 and 50 percent, got %d", c.RefreshJitterPercent))
+	}
+	if c.IPCachePath != "" && c.IPCacheMaxAgeHours < 1 {
+		errs = append(errs, fmt.Errorf("IP cache max age must be at least 1 hour"))
+	}
+	if c.RefreshRetries < 0 || c.RefreshRetries > 10 {
+		errs = append(errs, fmt.Errorf("refresh retries must be between 0 and 10, got %d", c.RefreshRetries))
+	}
+	if c.RefreshRetries > 0 && c.RefreshRetryBaseSeconds < 1 {
+		errs = append(errs, fmt.Errorf("refresh retry delay must be at least 1 second"))
+	}
+
+	for _, addr := range c.ResolverAddrs {
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			host = strings.Trim(addr, "[]")
+		}
+		if net.ParseIP(host) == nil {
+			errs = append(errs, fmt.Errorf("invalid resolver address %q", addr))
+		}
+	}
+
+	if c.ResolverDoHURL != "" {
+		parsed, err := url.Parse(c.ResolverDoHURL)
+		if err != nil || parsed.Scheme != "https" || parsed.Host == "" {
+			errs = append(errs, fmt.Errorf("invalid resolver DoH URL %q (must be an https URL)", c.ResolverDoHURL))
+		}
+	}
+
+	for _, cidr := range c.ResolverSkipCIDRs {
+		if _, _, err := net.ParseCIDR(cidr); err != nil {
+			errs = append(errs, fmt.Errorf("invalid resolver skip CIDR %q", cidr))
+		}
+	}
+
+	for _, cidr := range c.SharedCIDRs {
+		if _, _, err := net.ParseCIDR(cidr); err != nil {
+			errs = append(errs, fmt.Errorf("invalid shared CIDR %q", cidr))
+		}
+	}
+
+	if c.ResolverTimeoutSeconds < 0 {
+		errs = append(errs, fmt.Errorf("resolver timeout cannot be negative"))
+	}
+
+	if c.ResolverConcurrency < 0 {
+		errs = append(errs, fmt.Errorf("resolver concurrency cannot be negative"))
+	}
+
+	if c.ResolverCacheTTLMinutes < 0 {
+		errs = append(errs, fmt.Errorf("resolver cache TTL cannot be negative (use 0 to disable the cache)"))
+	}
 
-	if c.RefreshIntervalMinutes < 1 {
-		return fmt.Errorf("refresh interval must be at least 1 minute")
+	if c.ProxyIdleTimeoutMinutes < 0 {
+		errs = append(errs, fmt.Errorf("proxy idle timeout cannot be negative"))
+	}
+
+	if c.UsageSampleRate < 0 || c.UsageSampleRate > 1 {
+		errs = append(errs, fmt.Errorf("usage sample rate must be between 0 and 1"))
+	}
+
+	if c.BlockedLogMaxBytes < 0 {
+		errs = append(errs, fmt.Errorf("blocked log max bytes cannot be negative"))
+	}
+
+	if c.ProxyListenAddr != "" && net.ParseIP(c.ProxyListenAddr) == nil {
+		errs = append(errs, fmt.Errorf("invalid proxy listen address %q", c.ProxyListenAddr))
+	}
+
+	for _, port := range []int{c.ProxyHTTPPort, c.ProxyHTTPSPort} {
+		if port < 0 || port > 65535 {
+			errs = append(errs, fmt.Errorf("invalid proxy port %d (must be 1-65535, or 0 for the default)", port))
+		}
+	}
+	if c.ProxyHTTPPort != 0 && c.ProxyHTTPPort == c.ProxyHTTPSPort {
+		errs = append(errs, fmt.Errorf("proxy HTTP and HTTPS ports must differ"))
+	}
+
+	if c.ProxyMaxConnections < 0 {
+		errs = append(errs, fmt.Errorf("proxy max connections cannot be negative"))
+	}
+
+	for _, cidr := range c.BypassCIDRs {
+		if _, _, err := net.ParseCIDR(cidr); err != nil {
+			errs = append(errs, fmt.Errorf("invalid bypass CIDR %q", cidr))
+		}
+	}
+	for _, resolver := range c.DoHResolverIPs {
+		if net.ParseIP(resolver) == nil {
+			if _, _, err := net.ParseCIDR(resolver); err != nil {
+				errs = append(errs, fmt.Errorf("invalid DoH resolver address %q (must be an IP address or CIDR)", resolver))
+			}
+		}
+	}
+
+	if c.ProxyMark < 0 {
+		errs = append(errs, fmt.Errorf("proxy mark cannot be negative"))
+	}
+	if c.ProxyMark == 1 {
+		// Mark 1 routes intercepted packets to the proxy
+		errs = append(errs, fmt.Errorf("proxy mark 1 is reserved for intercepted traffic"))
+	}
+
+	for _, u := range c.BlocklistURLs {
+		parsed, err := url.Parse(u)
+		if err != nil || parsed.Scheme != "https" || parsed.Host == "" {
+			errs = append(errs, fmt.Errorf("invalid blocklist URL %q (must be an https URL)", u))
+		}
+	}
+	if len(c.BlocklistURLs) > 0 {
+		if c.BlocklistFetchTimeoutSeconds < 1 {
+			errs = append(errs, fmt.Errorf("blocklist fetch timeout must be at least 1 second"))
+		}
+		if c.BlocklistMaxBytes < 1 {
+			errs = append(errs, fmt.Errorf("blocklist max bytes must be positive"))
+		}
+		if c.BlocklistCacheDir == "" {
+			errs = append(errs, fmt.Errorf("blocklist cache directory cannot be empty"))
+		}
+	}
+
+	for domain, target := range c.Redirects {
+		if !isRedirectURL(target) {
+			errs = append(errs, fmt.Errorf("invalid redirect URL %q for %s (must be an absolute http or https URL)", target, domain))
+		}
+	}
+
+	switch c.HTTPBlockMode {
+	case "", "forbidden":
+	case "redirect":
+		if c.BlockRedirectURL == "" {
+			errs = append(errs, fmt.Errorf("HTTP block mode redirect requires blockRedirectURL"))
+		}
+	default:
+		errs = append(errs, fmt.Errorf("invalid HTTP block mode %q (must be forbidden or redirect)", c.HTTPBlockMode))
+	}
+	if c.BlockRedirectURL != "" && !isRedirectURL(c.BlockRedirectURL) {
+		errs = append(errs, fmt.Errorf("invalid block redirect URL %q (must be an absolute http or https URL)", c.BlockRedirectURL))
+	}
+
+	if c.MaxSnoozeMinutes < 1 {
+		errs = append(errs, fmt.Errorf("max snooze must be at least 1 minute"))
+	}
+
+	if _, err := schedule.Parse(c.Schedules); err != nil {
+		errs = append(errs, err)
+	}
+
+	if _, err := logging.NewHandler(io.Discard, c.LogFormat, c.LogLevel); err != nil {
+		errs = append(errs, err)
+	}
+
+	if c.RequireKeyWhileDisabled && c.KeyPollIntervalSeconds < 1 {
+		errs = append(errs, fmt.Errorf("key poll interval must be at least 1 second"))
+	}
+
+	if c.MetricsTextfilePath != "" && c.MetricsTextfileIntervalSeconds < 1 {
+		errs = append(errs, fmt.Errorf("metrics textfile interval must be at least 1 second"))
+	}
+
+	if c.BlockStatsPath != "" && c.BlockStatsFlushMinutes < 1 {
+		errs = append(errs, fmt.Errorf("block stats flush interval must be at least 1 minute"))
 	}
 
 	if c.USBKeyPath == "" {
-		return fmt.Errorf("USB key path cannot be empty")
+		errs = append(errs, fmt.Errorf("USB key path cannot be empty"))
 	}
 
 	if c.TokenHashPath == "" {
-		return fmt.Errorf("token hash path cannot be empty")
+		errs = append(errs, fmt.Errorf("token hash path cannot be empty"))
+	}
+
+	if c.TOTPWindow < 0 || c.TOTPWindow > 10 {
+		errs = append(errs, fmt.Errorf("TOTP window must be between 0 and 10 steps"))
 	}
 
 	if c.DnsmasqConfigPath == "" {
-		return fmt.Errorf("dnsmasq config path cannot be empty")
+		errs = append(errs, fmt.Errorf("dnsmasq config path cannot be empty"))
 	}
 
-	return nil
+	switch c.DnsBlockMode {
+	case "", "sinkhole", "nxdomain":
+	default:
+		errs = append(errs, fmt.Errorf("invalid DNS block mode %q (must be sinkhole or nxdomain)", c.DnsBlockMode))
+	}
+
+	return errs
+}
+
+// isRedirectURL reports whether target is an absolute http or https URL
+func isRedirectURL(target string) bool {
+	u, err := url.Parse(target)
+	return err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != ""
 }
 
-// LoadBlocklist loads domains from the blocklist file
+// Schedule returns the parsed blocking schedule. Validate has already
+// checked the entries, so errors only occur for unvalidated configs.
+func (c *Config) Schedule() (*schedule.Schedule, error) {
+	return schedule.Parse(c.Schedules)
+}
+
+// ManualRefresh returns true if periodic IP refresh is disabled
+func (c *Config) ManualRefresh() bool {
+	return c.RefreshIntervalMinutes == 0
+}
+
+// LoadBlocklist loads domains from the blocklist file, merged with any
+// remote blocklists
 func (c *Config) LoadBlocklist() ([]string, error) {
+	domains, err := c.loadLocalBlocklist()
+	if err != nil {
+		return nil, err
+	}
+	if len(c.BlocklistURLs) == 0 {
+		return domains, nil
+	}
+	return dedupeDomains(append(domains, c.loadRemoteBlocklists()...)), nil
+}
+
+// loadLocalBlocklist returns BlockedDomains if set, or else the blocklist file
+func (c *Config) loadLocalBlocklist() ([]string, error) {
 	// If BlockedDomains is set in config, use that
 	if len(c.BlockedDomains) > 0 {
+		for _, domain := range c.BlockedDomains {
+			if err := validateEntry(domain); err != nil {
+				return nil, fmt.Errorf("parsing config file: %w", err)
+			}
+		}
 		return c.BlockedDomains, nil
 	}
 
-	// Otherwise load from blocklist file
+	entries, err := c.loadBlocklistFile()
+	if err != nil {
+		return nil, err
+	}
+
+	domains := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		domains = append(domains, entry.Domain)
+	}
+	if _, err := matcher.Compile(domains, nil); err != nil {
+		return nil, fmt.Errorf("parsing blocklist file: %w", err)
+	}
+	// A domain may be listed in more than one category
+	return dedupeDomains(domains), nil
+}
+
+// LoadBudgets returns the daily allowance for each blocklist entry that has one
+func (c *Config) LoadBudgets() (map[string]time.Duration, error) {
+	budgets := map[string]time.Duration{}
+	if len(c.BlockedDomains) > 0 {
+		return budgets, nil
+	}
+
+	entries, err := c.loadBlocklistFile()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, entry := range entries {
+		if entry.Budget > 0 {
+			budgets[entry.Domain] = entry.Budget
+		}
+	}
+	return budgets, nil
+}
+
+// SetCategoryToggles overrides ActiveCategories for the named categories,
+// mapping each to whether it is active. Toggles are set at runtime with
+// `focusd category` and kept outside the config file.
+func (c *Config) SetCategoryToggles(toggles map[string]bool) {
+	c.categoryToggles = toggles
+}
+
+// CategoryActive reports whether the named blocklist category is blocked.
+// Without activeCategories in the config, every category is.
+func (c *Config) CategoryActive(name string) bool {
+	if active, ok := c.categoryToggles[name]; ok {
+		return active
+	}
+	return len(c.ActiveCategories) == 0 || slices.Contains(c.ActiveCategories, name)
+}
+
+// BlocklistCategories returns the names of the categories in the blocklist
+// file, sorted
+func (c *Config) BlocklistCategories() ([]string, error) {
+	if len(c.BlockedDomains) > 0 || c.BlocklistPath == "" {
+		return nil, nil
+	}
+	blocklist, err := c.readBlocklistFile()
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(blocklist.Categories))
+	for name := range blocklist.Categories {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// loadBlocklistFile reads and parses the entries in the blocklist file,
+// including those of active categories
+func (c *Config) loadBlocklistFile() ([]BlocklistEntry, error) {
 	if c.BlocklistPath == "" {
-		return []string{}, nil // No blocklist configured, return empty list
+		return []BlocklistEntry{}, nil // No blocklist configured, return empty list
+	}
+
+	blocklist, err := c.readBlocklistFile()
+	if err != nil {
+		return nil, err
+	}
+
+	names := make([]string, 0, len(blocklist.Categories))
+	for name := range blocklist.Categories {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	entries := blocklist.Domains
+	for _, name := range names {
+		if c.CategoryActive(name) {
+			entries = append(entries, blocklist.Categories[name]...)
+		}
+	}
+
+	if len(entries) == 0 {
+		fmt.Printf("Warning: Blocklist file %s contains no active domains\n", c.BlocklistPath)
+		return []BlocklistEntry{}, nil
 	}
 
+	for _, entry := range entries {
+		if entry.Domain == "" {
+			return nil, fmt.Errorf("parsing blocklist file: entry without a domain")
+		}
+		if entry.Budget < 0 {
+			return nil, fmt.Errorf("parsing blocklist file: negative budget for %s", entry.Domain)
+		}
+	}
+	for i := range entries {
+		domain, err := asciiDomain(entries[i].Domain)
+		if err != nil {
+			return nil, fmt.Errorf("parsing blocklist file: %w", err)
+		}
+		// Entries end up in the dnsmasq config, so one that isn't a valid
+		// name could inject directives into it
+		if err := validateEntry(domain); err != nil {
+			return nil, fmt.Errorf("parsing blocklist file: %w", err)
+		}
+		entries[i].Domain = domain
+	}
+
+	return entries, nil
+}
+
+// readBlocklistFile reads and parses the blocklist file
+func (c *Config) readBlocklistFile() (*Blocklist, error) {
 	data, err := os.ReadFile(c.BlocklistPath)
 	if err != nil {
 		if os.IsNotExist(err) {
@@ -140,13 +870,7 @@ func (c *Config) LoadBlocklist() ([]string, error) {
 	if err := yaml.Unmarshal(data, &blocklist); err != nil {
 		return nil, fmt.Errorf("parsing blocklist file: %w", err)
 	}
-
-	if len(blocklist.Domains) == 0 {
-		fmt.Printf("Warning: Blocklist file %s contains no domains\n", c.BlocklistPath)
-		return []string{}, nil
-	}
-
-	return blocklist.Domains, nil
+	return &blocklist, nil
 }
 
 // expandPath expands ~ to the user's home directory
@@ -0,0 +1,446 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLoadRefreshInterval(t *testing.T) {
+	tests := []struct {
+		name       string
+		yaml       string
+		want       int
+		wantJitter int
+		wantManual bool
+		wantErr    bool
+	}{
+		{
+			name:       "default",
+			yaml:       "usbKeyPath: /key\n",
+			want:       60,
+			wantJitter: 10,
+		},
+		{
+			name:       "manual",
+			yaml:       "refreshIntervalMinutes: 0\n",
+			want:       0,
+			wantJitter: 10,
+			wantManual: true,
+		},
+		{
+			name:    "negative",
+			yaml:    "refreshIntervalMinutes: -5\n",
+			wantErr: true,
+		},
+		{
+			name:       "no jitter",
+			yaml:       "refreshJitterPercent: 0\n",
+			want:       60,
+			wantJitter: 0,
+		},
+		{
+			name:    "jitter over half the interval",
+			yaml:    "refreshJitterPercent: 75\n",
+			wantErr: true,
+		},
+		{
+			name:    "negative retries",
+			yaml:    "refreshRetries: -1\n",
+			wantErr: true,
+		},
+		{
+			name:    "retries without a delay",
+			yaml:    "refreshRetries: 2\nrefreshRetryBaseSeconds: 0\n",
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, err := Load(writeConfig(t, tt.yaml))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Load() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if cfg.RefreshIntervalMinutes != tt.want {
+				t.Errorf("RefreshIntervalMinutes = %d, want %d", cfg.RefreshIntervalMinutes, tt.want)
+			}
+			if cfg.RefreshJitterPercent != tt.wantJitter {
+				t.Errorf("RefreshJitterPercent = %d, want %d", cfg.RefreshJitterPercent, tt.wantJitter)
+			}
+			if cfg.ManualRefresh() != tt.wantManual {
+				t.Errorf("ManualRefresh() = %v, want %v", cfg.ManualRefresh(), tt.wantManual)
+			}
+		})
+	}
+}
+
+// writeConfig writes a config file into a temp directory and returns its path
+func writeConfig(t *testing.T, contents string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte(contents), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadJSON(t *testing.T) {
+	yamlConfig := `usbKeyPath: /run/media/*/FOCUSD/focusd.key
+blockedDomains: [example.com, "*.ru"]
+refreshIntervalMinutes: 15
+proxyHTTPPort: 8080
+reverseDNSBlock: true
+usageSampleRate: 0.5
+redirects:
+  example.com: https://tasks.example.com
+schedules:
+  - days: [Mon, Tue]
+    start: "09:00"
+    end: "17:00"
+`
+	jsonConfig := `{
+  "usbKeyPath": "/run/media/*/FOCUSD/focusd.key",
+  "blockedDomains": ["example.com", "*.ru"],
+  "refreshIntervalMinutes": 15,
+  "proxyHTTPPort": 8080,
+  "reverseDNSBlock": true,
+  "usageSampleRate": 0.5,
+  "redirects": {"example.com": "https://tasks.example.com"},
+  "schedules": [{"days": ["Mon", "Tue"], "start": "09:00", "end": "17:00"}]
+}
+`
+	want, err := Load(writeConfig(t, yamlConfig))
+	if err != nil {
+		t.Fatalf("Load(yaml) error = %v", err)
+	}
+
+	dir := t.TempDir()
+	for _, name := range []string{"config.json", "config"} {
+		t.Run(name, func(t *testing.T) {
+			path := filepath.Join(dir, name)
+			if err := os.WriteFile(path, []byte(jsonConfig), 0o644); err != nil {
+				t.Fatal(err)
+			}
+			got, err := Load(path)
+			if err != nil {
+				t.Fatalf("Load(json) error = %v", err)
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("Load(json) = %+v, want %+v", got, want)
+			}
+		})
+	}
+
+	// Unknown keys and invalid values are rejected as for YAML
+	for _, contents := range []string{`{"refreshIntervalMinute": 5}`, `{"proxyMark": 1}`} {
+		path := filepath.Join(dir, "invalid.json")
+		if err := os.WriteFile(path, []byte(contents), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := Load(path); err == nil {
+			t.Errorf("Load(%s) succeeded, want error", contents)
+		}
+	}
+}
+
+func TestLoadUnknownKey(t *testing.T) {
+	tests := []struct {
+		name    string
+		yaml    string
+		wantErr string
+	}{
+		{
+			name:    "misspelled key",
+			yaml:    "refreshIntervalMinute: 5\n",
+			wantErr: "field refreshIntervalMinute not found",
+		},
+		{
+			name:    "wrong case",
+			yaml:    "RefreshIntervalMinutes: 5\n",
+			wantErr: "field RefreshIntervalMinutes not found",
+		},
+		{
+			name: "empty file",
+			yaml: "",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Load(writeConfig(t, tt.yaml))
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("Load() error = %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("Load() error = %v, want containing %q", err, tt.wantErr)
+			}
+			if !strings.Contains(err.Error(), "refreshIntervalMinutes") {
+				t.Errorf("Load() error does not list valid keys: %v", err)
+			}
+		})
+	}
+}
+
+func TestValidKeys(t *testing.T) {
+	keys := ValidKeys()
+	want := map[string]bool{"blockedDomains": false, "refreshIntervalMinutes": false, "usbKeyPath": false}
+	for _, k := range keys {
+		if _, ok := want[k]; ok {
+			want[k] = true
+		}
+	}
+	for k, found := range want {
+		if !found {
+			t.Errorf("ValidKeys() missing %q", k)
+		}
+	}
+}
+
+func TestLoadBudgets(t *testing.T) {
+	dir := t.TempDir()
+	blocklist := filepath.Join(dir, "blocklist.yml")
+	contents := `domains:
+  - youtube.com
+  - domain: reddit.com
+    budget: 30m
+  - domain: twitter.com
+`
+	if err := os.WriteFile(blocklist, []byte(contents), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := DefaultConfig()
+	cfg.BlocklistPath = blocklist
+
+	domains, err := cfg.LoadBlocklist()
+	if err != nil {
+		t.Fatalf("LoadBlocklist() error = %v", err)
+	}
+	if want := []string{"youtube.com", "reddit.com", "twitter.com"}; !reflect.DeepEqual(domains, want) {
+		t.Errorf("LoadBlocklist() = %v, want %v", domains, want)
+	}
+
+	budgets, err := cfg.LoadBudgets()
+	if err != nil {
+		t.Fatalf("LoadBudgets() error = %v", err)
+	}
+	if want := map[string]time.Duration{"reddit.com": 30 * time.Minute}; !reflect.DeepEqual(budgets, want) {
+		t.Errorf("LoadBudgets() = %v, want %v", budgets, want)
+	}
+}
+
+func TestLoadBlocklistCategories(t *testing.T) {
+	blocklist := filepath.Join(t.TempDir(), "blocklist.yml")
+	contents := `domains:
+  - example.com
+categories:
+  social:
+    - twitter.com
+    - domain: reddit.com
+      budget: 30m
+  news:
+    - news.ycombinator.com
+    - reddit.com
+  video:
+    - youtube.com
+`
+	if err := os.WriteFile(blocklist, []byte(contents), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		active  []string
+		toggles map[string]bool
+		want    []string
+	}{
+		{
+			name: "all by default",
+			want: []string{"example.com", "news.ycombinator.com", "reddit.com", "twitter.com", "youtube.com"},
+		},
+		{
+			name:   "selected",
+			active: []string{"social"},
+			want:   []string{"example.com", "twitter.com", "reddit.com"},
+		},
+		{
+			name:    "toggled",
+			active:  []string{"social"},
+			toggles: map[string]bool{"social": false, "video": true},
+			want:    []string{"example.com", "youtube.com"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := DefaultConfig()
+			cfg.BlocklistPath = blocklist
+			cfg.ActiveCategories = tt.active
+			cfg.SetCategoryToggles(tt.toggles)
+
+			domains, err := cfg.LoadBlocklist()
+			if err != nil {
+				t.Fatalf("LoadBlocklist() error = %v", err)
+			}
+			if !reflect.DeepEqual(domains, tt.want) {
+				t.Errorf("LoadBlocklist() = %v, want %v", domains, tt.want)
+			}
+		})
+	}
+
+	cfg := DefaultConfig()
+	cfg.BlocklistPath = blocklist
+	names, err := cfg.BlocklistCategories()
+	if err != nil {
+		t.Fatalf("BlocklistCategories() error = %v", err)
+	}
+	if want := []string{"news", "social", "video"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("BlocklistCategories() = %v, want %v", names, want)
+	}
+}
+
+func TestLoadBlocklistInvalidPattern(t *testing.T) {
+	blocklist := filepath.Join(t.TempDir(), "blocklist.yml")
+	if err := os.WriteFile(blocklist, []byte("domains:\n  - youtube.com\n  - \"re:(ads\"\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	cfg := DefaultConfig()
+	cfg.BlocklistPath = blocklist
+	if _, err := cfg.LoadBlocklist(); err == nil || !strings.Contains(err.Error(), "invalid pattern") {
+		t.Errorf("LoadBlocklist() error = %v, want invalid pattern error", err)
+	}
+
+	if _, err := Load(writeConfig(t, "allowedDomains:\n  - \"re:[a-\"\n")); err == nil {
+		t.Error("Load() with an invalid allowlist pattern succeeded")
+	}
+}
+
+func TestLoadBlocklistRejectsInjection(t *testing.T) {
+	blocklist := filepath.Join(t.TempDir(), "blocklist.yml")
+	data := "domains:\n  - youtube.com\n  - \"evil.com\\naddress=/good.com/1.2.3.4\"\n"
+	if err := os.WriteFile(blocklist, []byte(data), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	cfg := DefaultConfig()
+	cfg.BlocklistPath = blocklist
+	if _, err := cfg.LoadBlocklist(); err == nil || !strings.Contains(err.Error(), "invalid character") {
+		t.Errorf("LoadBlocklist() error = %v, want invalid character error", err)
+	}
+
+	cfg = DefaultConfig()
+	cfg.BlockedDomains = []string{"evil.com address=/good.com/1.2.3.4"}
+	if _, err := cfg.LoadBlocklist(); err == nil {
+		t.Error("LoadBlocklist() with an injected blockedDomains entry succeeded")
+	}
+}
+
+func TestLoadBlocklistIDN(t *testing.T) {
+	blocklist := filepath.Join(t.TempDir(), "blocklist.yml")
+	contents := "domains:\n  - пример.рф\n  - domain: Bücher.de\n    budget: 10m\n  - xn--bcher-kva.de\n"
+	if err := os.WriteFile(blocklist, []byte(contents), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	cfg := DefaultConfig()
+	cfg.BlocklistPath = blocklist
+
+	domains, err := cfg.LoadBlocklist()
+	if err != nil {
+		t.Fatalf("LoadBlocklist() error = %v", err)
+	}
+	if want := []string{"xn--e1afmkfd.xn--p1ai", "xn--bcher-kva.de"}; !reflect.DeepEqual(domains, want) {
+		t.Errorf("LoadBlocklist() = %v, want %v", domains, want)
+	}
+	budgets, err := cfg.LoadBudgets()
+	if err != nil {
+		t.Fatalf("LoadBudgets() error = %v", err)
+	}
+	if budgets["xn--bcher-kva.de"] != 10*time.Minute {
+		t.Errorf("LoadBudgets() = %v, want the budget under the punycode name", budgets)
+	}
+
+	if err := os.WriteFile(blocklist, []byte("domains:\n  - xn--a.com\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cfg.LoadBlocklist(); err == nil {
+		t.Error("LoadBlocklist() with a malformed IDN succeeded")
+	}
+
+	loaded, err := Load(writeConfig(t, "allowedDomains:\n  - сайт.bücher.de\n"))
+	if err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+	if want := []string{"xn--80aswg.xn--bcher-kva.de"}; !reflect.DeepEqual(loaded.AllowedDomains, want) {
+		t.Errorf("AllowedDomains = %v, want %v", loaded.AllowedDomains, want)
+	}
+}
+
+func TestLoadProxySettings(t *testing.T) {
+	tests := []struct {
+		name    string
+		yaml    string
+		wantErr bool
+	}{
+		{name: "defaults", yaml: "usbKeyPath: /key\n"},
+		{name: "custom", yaml: "proxyHTTPPort: 8080\nproxyHTTPSPort: 8443\nproxyMark: 77\n"},
+		{name: "port out of range", yaml: "proxyHTTPSPort: 70000\n", wantErr: true},
+		{name: "same port", yaml: "proxyHTTPPort: 8080\nproxyHTTPSPort: 8080\n", wantErr: true},
+		{name: "reserved mark", yaml: "proxyMark: 1\n", wantErr: true},
+		{name: "bypass CIDRs", yaml: "bypassCIDRs: [10.0.0.0/8, \"fd00::/8\"]\n"},
+		{name: "invalid bypass CIDR", yaml: "bypassCIDRs: [10.0.0.0]\n", wantErr: true},
+		{name: "resolver skip CIDRs", yaml: "resolverSkipCIDRs: [127.0.0.0/8, \"::1/128\"]\n"},
+		{name: "invalid resolver skip CIDR", yaml: "resolverSkipCIDRs: [127.0.0.1]\n", wantErr: true},
+		{name: "shared CIDRs", yaml: "skipSharedCDN: true\nsharedCIDRs: [198.51.100.0/24]\n"},
+		{name: "invalid shared CIDR", yaml: "sharedCIDRs: [cdn.example]\n", wantErr: true},
+		{name: "redirect mode", yaml: "httpBlockMode: redirect\nblockRedirectURL: http://focus.local/why\n"},
+		{name: "redirect mode without URL", yaml: "httpBlockMode: redirect\n", wantErr: true},
+		{name: "relative redirect URL", yaml: "httpBlockMode: redirect\nblockRedirectURL: /why\n", wantErr: true},
+		{name: "unknown block mode", yaml: "httpBlockMode: teapot\n", wantErr: true},
+		{name: "ipv4 listen address", yaml: "proxyListenAddr: 127.0.0.1\n"},
+		{name: "ipv6 listen address", yaml: "proxyListenAddr: \"::\"\n"},
+		{name: "listen address with port", yaml: "proxyListenAddr: \"127.0.0.1:8080\"\n", wantErr: true},
+		{name: "listen hostname", yaml: "proxyListenAddr: localhost\n", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Load(writeConfig(t, tt.yaml))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Load() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestLoadBlockQUIC(t *testing.T) {
+	tests := []struct {
+		name string
+		yaml string
+		want bool
+	}{
+		{name: "default", yaml: "usbKeyPath: /key\n", want: true},
+		{name: "off", yaml: "blockQUIC: false\n", want: false},
+		{name: "on", yaml: "blockQUIC: true\n", want: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, err := Load(writeConfig(t, tt.yaml))
+			if err != nil {
+				t.Fatalf("Load() error = %v", err)
+			}
+			if cfg.BlockQUIC != tt.want {
+				t.Errorf("BlockQUIC = %v, want %v", cfg.BlockQUIC, tt.want)
+			}
+		})
+	}
+}
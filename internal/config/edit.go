@@ -0,0 +1,250 @@
+package config
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+
+	"focusd/internal/atomicfile"
+	"focusd/internal/idn"
+	"focusd/internal/matcher"
+)
+
+// ValidateDomain checks that domain is a syntactically valid hostname,
+// optionally prefixed with "*." for a wildcard entry, or a valid regex or
+// glob pattern
+func ValidateDomain(domain string) error {
+	if matcher.IsPattern(domain) {
+		_, err := matcher.Compile([]string{domain}, nil)
+		return err
+	}
+
+	// An internationalized name is checked in its punycode form
+	ascii, err := idn.ToASCII(domain)
+	if err != nil {
+		return err
+	}
+	name := strings.TrimPrefix(ascii, "*.")
+	if name == "" {
+		return fmt.Errorf("empty domain")
+	}
+	if len(name) > 253 {
+		return fmt.Errorf("domain %q is longer than 253 characters", domain)
+	}
+
+	labels := strings.Split(name, ".")
+	if len(labels) < 2 && name == ascii {
+		return fmt.Errorf("domain %q needs at least two labels", domain)
+	}
+	for _, label := range labels {
+		if len(label) == 0 || len(label) > 63 {
+			return fmt.Errorf("domain %q has an empty or overlong label", domain)
+		}
+		if label[0] == '-' || label[len(label)-1] == '-' {
+			return fmt.Errorf("domain %q has a label starting or ending with a hyphen", domain)
+		}
+		for _, r := range label {
+			if (r < 'a' || r > 'z') && (r < '0' || r > '9') && r != '-' {
+				return fmt.Errorf("domain %q contains invalid character %q", domain, r)
+			}
+		}
+	}
+	return nil
+}
+
+// validateEntry is ValidateDomain for a blocklist or allowlist entry, which
+// may differ from the canonical form in case or by a trailing dot
+func validateEntry(domain string) error {
+	return ValidateDomain(strings.ToLower(strings.TrimSuffix(domain, ".")))
+}
+
+// asciiDomain converts an internationalized domain to punycode, the form
+// DNS and TLS carry, so that it matches and can be handed to dnsmasq and
+// the resolver. Patterns are returned unchanged.
+func asciiDomain(domain string) (string, error) {
+	if matcher.IsPattern(domain) {
+		return domain, nil
+	}
+	return idn.ToASCII(strings.TrimSpace(domain))
+}
+
+// asciiDomains converts each of domains in place with asciiDomain
+func asciiDomains(domains []string) error {
+	for i, domain := range domains {
+		ascii, err := asciiDomain(domain)
+		if err != nil {
+			return err
+		}
+		domains[i] = ascii
+	}
+	return nil
+}
+
+// AddToBlocklist appends domains to the blocklist file, creating it if
+// needed, and returns the ones that weren't already listed. Comments and
+// the layout of existing entries are preserved.
+func (c *Config) AddToBlocklist(domains []string) ([]string, error) {
+	doc, seq, err := c.readBlocklistNode(true)
+	if err != nil {
+		return nil, err
+	}
+
+	listed := make(map[string]bool, len(seq.Content))
+	for _, item := range seq.Content {
+		listed[entryKey(item)] = true
+	}
+
+	var added []string
+	for _, domain := range domains {
+		key := domainKey(domain)
+		if listed[key] {
+			continue
+		}
+		listed[key] = true
+		seq.Content = append(seq.Content, &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: domain})
+		added = append(added, domain)
+	}
+	if len(added) == 0 {
+		return nil, nil
+	}
+
+	if err := c.writeBlocklistNode(doc); err != nil {
+		return nil, err
+	}
+	return added, nil
+}
+
+// RemoveFromBlocklist deletes the entries for domains from the blocklist
+// file and returns the ones that were found. Entries with a budget are
+// removed as a whole.
+func (c *Config) RemoveFromBlocklist(domains []string) ([]string, error) {
+	doc, seq, err := c.readBlocklistNode(false)
+	if err != nil {
+		return nil, err
+	}
+
+	remove := make(map[string]string, len(domains))
+	for _, domain := range domains {
+		remove[domainKey(domain)] = domain
+	}
+
+	var removed []string
+	kept := seq.Content[:0]
+	for _, item := range seq.Content {
+		if domain, ok := remove[entryKey(item)]; ok {
+			removed = append(removed, domain)
+			delete(remove, entryKey(item))
+			continue
+		}
+		kept = append(kept, item)
+	}
+	seq.Content = kept
+	if len(removed) == 0 {
+		return nil, nil
+	}
+
+	if err := c.writeBlocklistNode(doc); err != nil {
+		return nil, err
+	}
+	return removed, nil
+}
+
+// readBlocklistNode parses the blocklist file into a YAML node tree and
+// returns the document along with its domains sequence. A missing file or
+// domains key is created when create is set.
+func (c *Config) readBlocklistNode(create bool) (*yaml.Node, *yaml.Node, error) {
+	if len(c.BlockedDomains) > 0 {
+		return nil, nil, fmt.Errorf("blockedDomains is set in the config file; edit the list there instead")
+	}
+	if c.BlocklistPath == "" {
+		return nil, nil, fmt.Errorf("no blocklist file configured (set blocklistPath)")
+	}
+
+	data, err := os.ReadFile(c.BlocklistPath)
+	if err != nil && !(create && errors.Is(err, os.ErrNotExist)) {
+		return nil, nil, fmt.Errorf("reading blocklist file %s: %w", c.BlocklistPath, err)
+	}
+
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, nil, fmt.Errorf("parsing blocklist file: %w", err)
+	}
+	if doc.Kind == 0 {
+		doc = yaml.Node{Kind: yaml.DocumentNode, Content: []*yaml.Node{{Kind: yaml.MappingNode, Tag: "!!map"}}}
+	}
+	root := doc.Content[0]
+	if root.Kind != yaml.MappingNode {
+		return nil, nil, fmt.Errorf("parsing blocklist file: expected a mapping with a domains key")
+	}
+
+	for i := 0; i+1 < len(root.Content); i += 2 {
+		if root.Content[i].Value != "domains" {
+			continue
+		}
+		seq := root.Content[i+1]
+		if seq.Kind == yaml.ScalarNode && seq.Tag == "!!null" {
+			// "domains:" with no entries yet
+			*seq = yaml.Node{Kind: yaml.SequenceNode, Tag: "!!seq"}
+		}
+		if seq.Kind != yaml.SequenceNode {
+			return nil, nil, fmt.Errorf("parsing blocklist file: domains is not a list")
+		}
+		return &doc, seq, nil
+	}
+
+	if !create {
+		return nil, nil, fmt.Errorf("blocklist file %s has no domains", c.BlocklistPath)
+	}
+	seq := &yaml.Node{Kind: yaml.SequenceNode, Tag: "!!seq"}
+	root.Content = append(root.Content, &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: "domains"}, seq)
+	return &doc, seq, nil
+}
+
+// writeBlocklistNode atomically replaces the blocklist file with doc,
+// keeping the file's permissions
+func (c *Config) writeBlocklistNode(doc *yaml.Node) error {
+	var buf bytes.Buffer
+	enc := yaml.NewEncoder(&buf)
+	enc.SetIndent(2)
+	if err := enc.Encode(doc); err != nil {
+		return fmt.Errorf("encoding blocklist: %w", err)
+	}
+	if err := enc.Close(); err != nil {
+		return fmt.Errorf("encoding blocklist: %w", err)
+	}
+
+	mode := os.FileMode(0o644)
+	if info, err := os.Stat(c.BlocklistPath); err == nil {
+		mode = info.Mode().Perm()
+	}
+
+	if err := atomicfile.Write(c.BlocklistPath, buf.Bytes(), mode); err != nil {
+		return fmt.Errorf("writing blocklist file: %w", err)
+	}
+	return nil
+}
+
+// entryKey returns the comparison key of a blocklist entry node, which is
+// either a bare domain or a mapping with a domain key
+func entryKey(item *yaml.Node) string {
+	switch item.Kind {
+	case yaml.ScalarNode:
+		return domainKey(item.Value)
+	case yaml.MappingNode:
+		for i := 0; i+1 < len(item.Content); i += 2 {
+			if item.Content[i].Value == "domain" {
+				return domainKey(item.Content[i+1].Value)
+			}
+		}
+	}
+	return ""
+}
+
+// domainKey normalizes a domain for comparison, ignoring case and a trailing dot
+func domainKey(domain string) string {
+	return strings.ToLower(strings.TrimSuffix(domain, "."))
+}
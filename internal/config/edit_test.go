@@ -0,0 +1,102 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestValidateDomain(t *testing.T) {
+	tests := []struct {
+		domain  string
+		wantErr bool
+	}{
+		{domain: "youtube.com"},
+		{domain: "*.reddit.com"},
+		{domain: "a-b.example.co.uk"},
+		{domain: "localhost", wantErr: true},
+		{domain: "", wantErr: true},
+		{domain: "-bad.com", wantErr: true},
+		{domain: "bad..com", wantErr: true},
+		{domain: "https://youtube.com", wantErr: true},
+		{domain: "you_tube.com", wantErr: true},
+		{domain: "bücher.de"},
+		{domain: "*.xn--e1afmkfd.xn--p1ai"},
+		{domain: "xn--a.com", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.domain, func(t *testing.T) {
+			if err := ValidateDomain(tt.domain); (err != nil) != tt.wantErr {
+				t.Errorf("ValidateDomain(%q) error = %v, wantErr %v", tt.domain, err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestEditBlocklist(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "blocklist.yml")
+	original := "# Distractions\ndomains:\n  - youtube.com # video\n  - domain: reddit.com\n    budget: 30m\n"
+	if err := os.WriteFile(path, []byte(original), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := DefaultConfig()
+	cfg.BlocklistPath = path
+
+	added, err := cfg.AddToBlocklist([]string{"twitter.com", "YouTube.com"})
+	if err != nil {
+		t.Fatalf("AddToBlocklist() error = %v", err)
+	}
+	if want := []string{"twitter.com"}; !reflect.DeepEqual(added, want) {
+		t.Errorf("AddToBlocklist() = %v, want %v", added, want)
+	}
+
+	removed, err := cfg.RemoveFromBlocklist([]string{"reddit.com", "example.com"})
+	if err != nil {
+		t.Fatalf("RemoveFromBlocklist() error = %v", err)
+	}
+	if want := []string{"reddit.com"}; !reflect.DeepEqual(removed, want) {
+		t.Errorf("RemoveFromBlocklist() = %v, want %v", removed, want)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "# Distractions\ndomains:\n  - youtube.com # video\n  - twitter.com\n"
+	if string(data) != want {
+		t.Errorf("blocklist file =\n%s\nwant\n%s", data, want)
+	}
+	if info, err := os.Stat(path); err != nil || info.Mode().Perm() != 0o600 {
+		t.Errorf("blocklist file mode = %v, %v; want 0600", info.Mode().Perm(), err)
+	}
+
+	domains, err := cfg.LoadBlocklist()
+	if err != nil {
+		t.Fatalf("LoadBlocklist() error = %v", err)
+	}
+	if want := []string{"youtube.com", "twitter.com"}; !reflect.DeepEqual(domains, want) {
+		t.Errorf("LoadBlocklist() = %v, want %v", domains, want)
+	}
+}
+
+func TestAddToBlocklistCreatesFile(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.BlocklistPath = filepath.Join(t.TempDir(), "blocklist.yml")
+
+	if _, err := cfg.RemoveFromBlocklist([]string{"youtube.com"}); err == nil {
+		t.Error("RemoveFromBlocklist() on a missing file succeeded, want error")
+	}
+	if _, err := cfg.AddToBlocklist([]string{"youtube.com"}); err != nil {
+		t.Fatalf("AddToBlocklist() error = %v", err)
+	}
+	data, err := os.ReadFile(cfg.BlocklistPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "domains:\n  - youtube.com\n"; string(data) != want {
+		t.Errorf("blocklist file = %q, want %q", data, want)
+	}
+}
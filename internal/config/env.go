@@ -0,0 +1,112 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// EnvPrefix starts the name of every environment variable that overrides a
+// config key
+const EnvPrefix = "FOCUSD_"
+
+// envVarExceptions names the variables of keys whose words can't be told
+// apart by case alone
+var envVarExceptions = map[string]string{
+	"resolverDoHURL": EnvPrefix + "RESOLVER_DOH_URL",
+	"blockDoT":       EnvPrefix + "BLOCK_DOT",
+}
+
+// EnvVar returns the environment variable that overrides a config key:
+// EnvPrefix followed by the key in upper snake case, so usbKeyPath is
+// FOCUSD_USB_KEY_PATH and proxyHTTPPort is FOCUSD_PROXY_HTTP_PORT
+func EnvVar(key string) string {
+	if name, ok := envVarExceptions[key]; ok {
+		return name
+	}
+	runes := []rune(key)
+	var b strings.Builder
+	b.WriteString(EnvPrefix)
+	for i, r := range runes {
+		// A word starts at an upper-case letter after a lower-case one, or at
+		// the last letter of an acronym followed by a lower-case one other
+		// than a plural s (CIDRs)
+		if i > 0 && unicode.IsUpper(r) &&
+			(unicode.IsLower(runes[i-1]) || (i+1 < len(runes) && unicode.IsLower(runes[i+1]) && !pluralS(runes, i+1))) {
+			b.WriteByte('_')
+		}
+		b.WriteRune(unicode.ToUpper(r))
+	}
+	return b.String()
+}
+
+// pluralS reports whether runes[i] is an s ending a word
+func pluralS(runes []rune, i int) bool {
+	return runes[i] == 's' && (i+1 == len(runes) || unicode.IsUpper(runes[i+1]))
+}
+
+// applyEnv overrides config keys from their environment variables. Keys
+// holding strings, numbers, booleans or lists (comma-separated) can be
+// overridden; mappings such as redirects and schedules can't.
+func (c *Config) applyEnv() error {
+	v := reflect.ValueOf(c).Elem()
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		key, _, _ := strings.Cut(t.Field(i).Tag.Get("yaml"), ",")
+		if key == "" || key == "-" {
+			continue
+		}
+		name := EnvVar(key)
+		value, ok := os.LookupEnv(name)
+		if !ok {
+			continue
+		}
+		if err := setField(v.Field(i), value); err != nil {
+			return fmt.Errorf("invalid %s=%q: %w", name, value, err)
+		}
+	}
+	return nil
+}
+
+// setField parses value into field according to its kind
+func setField(field reflect.Value, value string) error {
+	switch field.Kind() {
+	case reflect.String:
+		field.SetString(value)
+	case reflect.Int, reflect.Int64:
+		n, err := strconv.ParseInt(strings.TrimSpace(value), 10, 64)
+		if err != nil {
+			return fmt.Errorf("expected an integer")
+		}
+		field.SetInt(n)
+	case reflect.Float64:
+		f, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+		if err != nil {
+			return fmt.Errorf("expected a number")
+		}
+		field.SetFloat(f)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(strings.TrimSpace(value))
+		if err != nil {
+			return fmt.Errorf("expected true or false")
+		}
+		field.SetBool(b)
+	case reflect.Slice:
+		if field.Type().Elem().Kind() != reflect.String {
+			return fmt.Errorf("can't be set from the environment")
+		}
+		var items []string
+		for item := range strings.SplitSeq(value, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				items = append(items, item)
+			}
+		}
+		field.Set(reflect.ValueOf(items))
+	default:
+		return fmt.Errorf("can't be set from the environment")
+	}
+	return nil
+}
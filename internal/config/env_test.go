@@ -0,0 +1,64 @@
+package config
+
+import (
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestEnvVar(t *testing.T) {
+	tests := map[string]string{
+		"usbKeyPath":             "FOCUSD_USB_KEY_PATH",
+		"refreshIntervalMinutes": "FOCUSD_REFRESH_INTERVAL_MINUTES",
+		"dnsmasqConfigPath":      "FOCUSD_DNSMASQ_CONFIG_PATH",
+		"proxyHTTPPort":          "FOCUSD_PROXY_HTTP_PORT",
+		"totpWindow":             "FOCUSD_TOTP_WINDOW",
+		"bypassCIDRs":            "FOCUSD_BYPASS_CIDRS",
+		"resolverDoHURL":         "FOCUSD_RESOLVER_DOH_URL",
+		"blockDoT":               "FOCUSD_BLOCK_DOT",
+		"dohResolverIPs":         "FOCUSD_DOH_RESOLVER_IPS",
+	}
+	for key, want := range tests {
+		if got := EnvVar(key); got != want {
+			t.Errorf("EnvVar(%q) = %q, want %q", key, got, want)
+		}
+	}
+}
+
+func TestLoadEnvOverrides(t *testing.T) {
+	path := writeConfig(t, "refreshIntervalMinutes: 60\nusbKeyPath: /file/key\n")
+
+	t.Setenv("FOCUSD_REFRESH_INTERVAL_MINUTES", "5")
+	t.Setenv("FOCUSD_USB_KEY_PATH", "/env/key")
+	t.Setenv("FOCUSD_BLOCKED_DOMAINS", "example.com, example.org")
+	t.Setenv("FOCUSD_REVERSE_DNS_BLOCK", "true")
+	cfg, err := Load(path)
+	if err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+	if cfg.RefreshIntervalMinutes != 5 || cfg.USBKeyPath != "/env/key" || !cfg.ReverseDNSBlock {
+		t.Errorf("Load() = %d, %q, %v, want overrides applied", cfg.RefreshIntervalMinutes, cfg.USBKeyPath, cfg.ReverseDNSBlock)
+	}
+	if want := []string{"example.com", "example.org"}; !slices.Equal(cfg.BlockedDomains, want) {
+		t.Errorf("Load() blockedDomains = %q, want %q", cfg.BlockedDomains, want)
+	}
+
+	tests := []struct {
+		name, value, wantErr string
+	}{
+		{name: "FOCUSD_REFRESH_INTERVAL_MINUTES", value: "5m", wantErr: "expected an integer"},
+		{name: "FOCUSD_REVERSE_DNS_BLOCK", value: "sometimes", wantErr: "expected true or false"},
+		{name: "FOCUSD_SCHEDULES", value: "09:00-17:00", wantErr: "can't be set"},
+		// Overrides are validated like the file
+		{name: "FOCUSD_PROXY_MARK", value: "1", wantErr: "mark"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv(tt.name, tt.value)
+			_, err := Load(path)
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("Load() error = %v, want containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
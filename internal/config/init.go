@@ -0,0 +1,111 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+
+	"gopkg.in/yaml.v3"
+)
+
+// configHeader starts a config file written by Init
+const configHeader = `# focusd configuration, written by focusd init
+# See config.example.yaml for every option
+`
+
+// starterBlocklist is the blocklist written by Init
+const starterBlocklist = `# focusd blocklist
+# Blocking a domain also blocks its subdomains. After editing, reload the
+# daemon to apply the changes:
+#   sudo systemctl reload focusd
+
+domains:
+  - youtube.com
+  - twitter.com
+  - x.com
+  - reddit.com
+  - facebook.com
+  - instagram.com
+  - tiktok.com
+`
+
+// Init scaffolds a new installation: it creates the directories the paths
+// in cfg live in, writes cfg to path and writes a starter blocklist to
+// cfg.BlocklistPath. Existing files are kept unless force is set, so it is
+// safe to run again. It returns a line describing each step taken.
+func Init(cfg *Config, path string, force bool) ([]string, error) {
+	var steps []string
+
+	// The state directory holds the audit log and budgets, so it isn't
+	// world-readable; dnsmasq must be able to read its generated config.
+	// These match the NixOS module's tmpfiles rules.
+	dirs := []struct {
+		path string
+		perm fs.FileMode
+	}{
+		{filepath.Dir(path), 0o755},
+		{filepath.Dir(cfg.TokenHashPath), 0o755},
+		{filepath.Dir(cfg.RuntimeStatePath), 0o750},
+		{filepath.Dir(cfg.IPCachePath), 0o750},
+		{filepath.Dir(cfg.AuditLogPath), 0o750},
+		{filepath.Dir(cfg.BudgetStatePath), 0o750},
+		{filepath.Dir(cfg.DnsmasqConfigPath), 0o755},
+		{filepath.Dir(cfg.ControlSocketPath), 0o755},
+		{filepath.Dir(cfg.PIDFilePath), 0o755},
+	}
+	for _, dir := range dirs {
+		if _, err := os.Stat(dir.path); err == nil {
+			continue
+		}
+		if err := os.MkdirAll(dir.path, dir.perm); err != nil {
+			return steps, fmt.Errorf("creating directory: %w", err)
+		}
+		steps = append(steps, "created "+dir.path)
+	}
+
+	data, err := yaml.Marshal(cfg)
+	if err != nil {
+		return steps, fmt.Errorf("encoding config: %w", err)
+	}
+	files := []struct {
+		path string
+		data []byte
+	}{
+		{path, append([]byte(configHeader), data...)},
+		{expandPath(cfg.BlocklistPath), []byte(starterBlocklist)},
+	}
+	for _, f := range files {
+		step, err := writeInitFile(f.path, f.data, force)
+		if err != nil {
+			return steps, err
+		}
+		steps = append(steps, step)
+	}
+	return steps, nil
+}
+
+// writeInitFile writes data to path unless the file exists and force is
+// not set, and describes what it did
+func writeInitFile(path string, data []byte, force bool) (string, error) {
+	flags := os.O_WRONLY | os.O_CREATE | os.O_EXCL
+	if force {
+		flags = os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	}
+	f, err := os.OpenFile(path, flags, 0o644)
+	if errors.Is(err, fs.ErrExist) {
+		return "kept existing " + path + " (use --force to overwrite)", nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("writing %s: %w", path, err)
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return "", fmt.Errorf("writing %s: %w", path, err)
+	}
+	if err := f.Close(); err != nil {
+		return "", fmt.Errorf("writing %s: %w", path, err)
+	}
+	return "wrote " + path, nil
+}
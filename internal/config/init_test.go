@@ -0,0 +1,65 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestInit(t *testing.T) {
+	root := t.TempDir()
+	cfg := DefaultConfig()
+	cfg.BlocklistPath = filepath.Join(root, "etc", "blocklist.yml")
+	cfg.TokenHashPath = filepath.Join(root, "etc", "focusd", "token.sha256")
+	cfg.RuntimeStatePath = filepath.Join(root, "var", "lib", "focusd", "runtime.json")
+	cfg.IPCachePath = filepath.Join(root, "var", "lib", "focusd", "ips.json")
+	cfg.AuditLogPath = filepath.Join(root, "var", "lib", "focusd", "audit.log")
+	cfg.BudgetStatePath = filepath.Join(root, "var", "lib", "focusd", "budget.json")
+	cfg.DnsmasqConfigPath = filepath.Join(root, "run", "focusd", "dnsmasq.conf")
+	cfg.ControlSocketPath = filepath.Join(root, "run", "focusd", "control.sock")
+	cfg.PIDFilePath = filepath.Join(root, "run", "focusd", "focusd.pid")
+	path := filepath.Join(root, "etc", "focusd", "config.yaml")
+
+	if _, err := Init(cfg, path, false); err != nil {
+		t.Fatalf("Init() error = %v", err)
+	}
+	info, err := os.Stat(filepath.Join(root, "var", "lib", "focusd"))
+	if err != nil || info.Mode().Perm() != 0o750 {
+		t.Errorf("state directory = %v, %v, want mode 0750", info, err)
+	}
+
+	// The written config loads back to what was scaffolded, blocklist included
+	got, err := Read(path)
+	if err != nil {
+		t.Fatalf("Read() error = %v", err)
+	}
+	if !reflect.DeepEqual(got, cfg) {
+		t.Errorf("Read() = %+v, want %+v", got, cfg)
+	}
+	domains, err := got.LoadBlocklist()
+	if err != nil || len(domains) == 0 {
+		t.Errorf("LoadBlocklist() = %v, %v, want the starter blocklist", domains, err)
+	}
+
+	// Running again keeps edits unless forced
+	if err := os.WriteFile(path, []byte("refreshIntervalMinutes: 5\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	steps, err := Init(cfg, path, false)
+	if err != nil {
+		t.Fatalf("Init() again error = %v", err)
+	}
+	if len(steps) != 2 {
+		t.Errorf("Init() again steps = %q, want only the two kept files", steps)
+	}
+	if data, _ := os.ReadFile(path); string(data) != "refreshIntervalMinutes: 5\n" {
+		t.Errorf("Init() without force overwrote the config: %q", data)
+	}
+	if _, err := Init(cfg, path, true); err != nil {
+		t.Fatalf("Init(force) error = %v", err)
+	}
+	if got, err := Read(path); err != nil || got.RefreshIntervalMinutes != cfg.RefreshIntervalMinutes {
+		t.Errorf("Init(force) did not rewrite the config: %v", err)
+	}
+}
@@ -0,0 +1,169 @@
+package config
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+
+	"focusd/internal/atomicfile"
+)
+
+// blocklistTransport is the HTTP transport used to fetch remote blocklists
+var blocklistTransport http.RoundTripper = http.DefaultTransport
+
+// loadRemoteBlocklists fetches every BlocklistURLs entry. A URL that can't be
+// fetched falls back to its last successful download; if there is none it is
+// skipped with a warning rather than failing the whole blocklist.
+func (c *Config) loadRemoteBlocklists() []string {
+	client := &http.Client{
+		Transport: blocklistTransport,
+		Timeout:   time.Duration(c.BlocklistFetchTimeoutSeconds) * time.Second,
+	}
+
+	var domains []string
+	for _, url := range c.BlocklistURLs {
+		data, err := fetchBlocklist(client, url, c.BlocklistMaxBytes)
+		cachePath := c.blocklistCachePath(url)
+		if err == nil {
+			if err := writeBlocklistCache(cachePath, data); err != nil {
+				fmt.Fprintf(os.Stderr, "Warning: caching blocklist %s: %v\n", url, err)
+			}
+		} else {
+			cached, cacheErr := os.ReadFile(cachePath)
+			if cacheErr != nil {
+				fmt.Fprintf(os.Stderr, "Warning: skipping blocklist %s: %v (no cached copy)\n", url, err)
+				continue
+			}
+			fmt.Fprintf(os.Stderr, "Warning: fetching blocklist %s: %v (using cached copy)\n", url, err)
+			data = cached
+		}
+
+		domains = append(domains, parseRemoteBlocklist(data)...)
+	}
+	return domains
+}
+
+// fetchBlocklist downloads url, refusing bodies larger than maxBytes
+func fetchBlocklist(client *http.Client, url string, maxBytes int64) ([]byte, error) {
+	resp, err := client.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxBytes+1))
+	if err != nil {
+		return nil, fmt.Errorf("reading response: %w", err)
+	}
+	if int64(len(data)) > maxBytes {
+		return nil, fmt.Errorf("response exceeds %d bytes", maxBytes)
+	}
+	return data, nil
+}
+
+// parseRemoteBlocklist accepts either the blocklist YAML format or one domain
+// per line, with # comments and hosts-file lines ("0.0.0.0 example.com
+// www.example.com"), less the loopback names every hosts file starts with.
+// Internationalized names are converted to punycode and malformed ones
+// skipped.
+func parseRemoteBlocklist(data []byte) []string {
+	var domains []string
+	add := func(domain string) {
+		// Lists are third-party, so an entry that isn't a valid name is
+		// skipped rather than passed on to dnsmasq
+		if ascii, err := asciiDomain(domain); err == nil && validateEntry(ascii) == nil {
+			domains = append(domains, ascii)
+		}
+	}
+
+	var blocklist Blocklist
+	if err := yaml.Unmarshal(data, &blocklist); err == nil && len(blocklist.Domains) > 0 {
+		for _, entry := range blocklist.Domains {
+			if entry.Domain != "" {
+				add(entry.Domain)
+			}
+		}
+		return domains
+	}
+
+	sc := bufio.NewScanner(bytes.NewReader(data))
+	for sc.Scan() {
+		line, _, _ := strings.Cut(sc.Text(), "#")
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		// hosts-file format: every name after the sinkhole address
+		if _, err := netip.ParseAddr(fields[0]); err == nil {
+			fields = fields[1:]
+		}
+		for _, name := range fields {
+			if _, err := netip.ParseAddr(name); err == nil || hostsFileNames[strings.ToLower(name)] {
+				continue
+			}
+			add(name)
+		}
+	}
+	return domains
+}
+
+// hostsFileNames are the loopback and broadcast names of a standard hosts
+// file, which hosts-format blocklists start with
+var hostsFileNames = map[string]bool{
+	"localhost":             true,
+	"localhost.localdomain": true,
+	"local":                 true,
+	"broadcasthost":         true,
+	"ip6-localhost":         true,
+	"ip6-loopback":          true,
+	"ip6-localnet":          true,
+	"ip6-mcastprefix":       true,
+	"ip6-allnodes":          true,
+	"ip6-allrouters":        true,
+	"ip6-allhosts":          true,
+}
+
+// blocklistCachePath returns where the last download of url is kept
+func (c *Config) blocklistCachePath(url string) string {
+	sum := sha256.Sum256([]byte(url))
+	return filepath.Join(c.BlocklistCacheDir, hex.EncodeToString(sum[:8])+".txt")
+}
+
+// writeBlocklistCache atomically replaces a cached download
+func writeBlocklistCache(path string, data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0o750); err != nil {
+		return err
+	}
+	return atomicfile.Write(path, data, 0o640)
+}
+
+// dedupeDomains removes repeated domains (ignoring case and a trailing dot),
+// keeping the first occurrence
+func dedupeDomains(domains []string) []string {
+	seen := make(map[string]bool, len(domains))
+	out := make([]string, 0, len(domains))
+	for _, domain := range domains {
+		key := domainKey(domain)
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		out = append(out, domain)
+	}
+	return out
+}
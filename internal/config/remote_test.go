@@ -0,0 +1,150 @@
+package config
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestParseRemoteBlocklist(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+		want []string
+	}{
+		{
+			name: "yaml",
+			data: "domains:\n  - youtube.com\n  - domain: reddit.com\n    budget: 30m\n",
+			want: []string{"youtube.com", "reddit.com"},
+		},
+		{
+			name: "plain",
+			data: "# comment\nyoutube.com\n\n  reddit.com  # trailing\n",
+			want: []string{"youtube.com", "reddit.com"},
+		},
+		{
+			name: "hosts file",
+			data: "0.0.0.0 youtube.com\n127.0.0.1 reddit.com\n",
+			want: []string{"youtube.com", "reddit.com"},
+		},
+		{
+			name: "hosts file header",
+			data: `# Title: StevenBlack/hosts
+#
+# This hosts file is a merged collection of hosts from reputable sources
+
+127.0.0.1 localhost
+127.0.0.1 localhost.localdomain
+127.0.0.1 local
+255.255.255.255 broadcasthost
+::1 localhost ip6-localhost ip6-loopback
+fe80::1%lo0 localhost
+ff00::0 ip6-localnet
+ff00::0 ip6-mcastprefix
+ff02::1 ip6-allnodes
+ff02::2 ip6-allrouters
+ff02::3 ip6-allhosts
+0.0.0.0 0.0.0.0
+
+# Custom host records are listed here.
+
+0.0.0.0 ads.example.com tracker.example.com # aliases
+0.0.0.0 youtube.com
+`,
+			want: []string{"ads.example.com", "tracker.example.com", "youtube.com"},
+		},
+		{
+			name: "internationalized",
+			data: "bücher.de\nxn--a.com\nxn--e1afmkfd.xn--p1ai\n",
+			want: []string{"xn--bcher-kva.de", "xn--e1afmkfd.xn--p1ai"},
+		},
+		{
+			name: "invalid entries",
+			data: "domains:\n  - youtube.com\n  - \"evil.com\\naddress=/good.com/1.2.3.4\"\n  - bad/name.com\n",
+			want: []string{"youtube.com"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := parseRemoteBlocklist([]byte(tt.data)); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseRemoteBlocklist() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoadBlocklistRemote(t *testing.T) {
+	body := "reddit.com\nYouTube.com\nnews.ycombinator.com\n"
+	failing := false
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if failing {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte(body))
+	}))
+	defer srv.Close()
+
+	orig := blocklistTransport
+	blocklistTransport = srv.Client().Transport
+	defer func() { blocklistTransport = orig }()
+
+	cfg := DefaultConfig()
+	cfg.BlockedDomains = []string{"youtube.com", "twitter.com"}
+	cfg.BlocklistURLs = []string{srv.URL + "/list.txt"}
+	cfg.BlocklistCacheDir = t.TempDir()
+
+	want := []string{"youtube.com", "twitter.com", "reddit.com", "news.ycombinator.com"}
+	domains, err := cfg.LoadBlocklist()
+	if err != nil {
+		t.Fatalf("LoadBlocklist() error = %v", err)
+	}
+	if !reflect.DeepEqual(domains, want) {
+		t.Errorf("LoadBlocklist() = %v, want %v", domains, want)
+	}
+
+	// A failed refresh falls back to the cached download
+	failing = true
+	domains, err = cfg.LoadBlocklist()
+	if err != nil {
+		t.Fatalf("LoadBlocklist() after failure error = %v", err)
+	}
+	if !reflect.DeepEqual(domains, want) {
+		t.Errorf("LoadBlocklist() after failure = %v, want %v", domains, want)
+	}
+
+	// An oversized response is rejected, leaving the cache in use
+	failing = false
+	body = "a.example\nb.example\nc.example\n"
+	cfg.BlocklistMaxBytes = 8
+	domains, err = cfg.LoadBlocklist()
+	if err != nil {
+		t.Fatalf("LoadBlocklist() oversized error = %v", err)
+	}
+	if !reflect.DeepEqual(domains, want) {
+		t.Errorf("LoadBlocklist() oversized = %v, want %v", domains, want)
+	}
+}
+
+func TestValidateBlocklistURLs(t *testing.T) {
+	tests := []struct {
+		name    string
+		url     string
+		wantErr bool
+	}{
+		{name: "https", url: "https://example.com/list.txt"},
+		{name: "http", url: "http://example.com/list.txt", wantErr: true},
+		{name: "no host", url: "https:///list.txt", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Load(writeConfig(t, "blocklistURLs:\n  - "+tt.url+"\n"))
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Load() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
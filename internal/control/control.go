@@ -0,0 +1,225 @@
+// Package control implements the daemon's Unix control socket. Clients send a
+// single command line and receive a single JSON response line.
+package control
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// DefaultSocketPath is where the daemon listens for control commands
+const DefaultSocketPath = "/run/focusd/control.sock"
+
+const (
+	// maxRequestBytes bounds a command line
+	maxRequestBytes = 4096
+
+	// readTimeout bounds how long a client may take to send its command
+	readTimeout = 5 * time.Second
+
+	// replyTimeout bounds how long Send waits for the daemon to act, which
+	// may include resolving the whole blocklist on reload
+	replyTimeout = 2 * time.Minute
+)
+
+// ErrDaemonNotRunning is returned by Send when nothing is listening
+var ErrDaemonNotRunning = errors.New("daemon is not running")
+
+// Response is the reply to a command
+type Response struct {
+	OK     bool   `json:"ok"`
+	Output string `json:"output,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+// Request is a command received from a client. The receiver must call Reply
+// exactly once.
+type Request struct {
+	Command string
+	Args    []string
+
+	reply chan Response
+}
+
+// Reply answers the request with output, or with err if it is non-nil
+func (r *Request) Reply(output string, err error) {
+	if err != nil {
+		r.reply <- Response{Error: err.Error()}
+		return
+	}
+	r.reply <- Response{OK: true, Output: output}
+}
+
+// Server accepts control connections and hands their commands to the daemon
+// one at a time through Requests, so handlers need no locking of their own
+type Server struct {
+	path     string
+	listener net.Listener
+	requests chan *Request
+	done     chan struct{}
+	wg       sync.WaitGroup
+}
+
+// Listen creates the control socket at path, readable and writable only by
+// its owner and group
+func Listen(path string) (*Server, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0o750); err != nil {
+		return nil, fmt.Errorf("creating socket directory: %w", err)
+	}
+
+	// A socket left behind by a crashed daemon would make Listen fail
+	if info, err := os.Lstat(path); err == nil {
+		if info.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("%s exists and is not a socket", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, fmt.Errorf("removing stale socket: %w", err)
+		}
+	}
+
+	// Create the socket without group/other access so there is no window
+	// before the chmod below where anyone could connect
+	oldMask := syscall.Umask(0o117)
+	listener, err := net.Listen("unix", path)
+	syscall.Umask(oldMask)
+	if err != nil {
+		return nil, fmt.Errorf("listening on %s: %w", path, err)
+	}
+	if err := os.Chmod(path, 0o660); err != nil {
+		listener.Close()
+		return nil, fmt.Errorf("setting socket permissions: %w", err)
+	}
+
+	s := &Server{
+		path:     path,
+		listener: listener,
+		requests: make(chan *Request),
+		done:     make(chan struct{}),
+	}
+	s.wg.Add(1)
+	go s.acceptLoop()
+	return s, nil
+}
+
+// Requests returns the channel on which client commands arrive
+func (s *Server) Requests() <-chan *Request {
+	return s.requests
+}
+
+// Close stops accepting connections, waits for open ones to finish and
+// removes the socket
+func (s *Server) Close() error {
+	close(s.done)
+	err := s.listener.Close()
+	s.wg.Wait()
+	os.Remove(s.path)
+	return err
+}
+
+// acceptLoop serves each connection in its own goroutine
+func (s *Server) acceptLoop() {
+	defer s.wg.Done()
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			select {
+			case <-s.done:
+				return
+			default:
+			}
+			var ne net.Error
+			if errors.As(err, &ne) && ne.Timeout() {
+				continue
+			}
+			return
+		}
+
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			s.serve(conn)
+		}()
+	}
+}
+
+// serve reads one command from conn and writes the daemon's response
+func (s *Server) serve(conn net.Conn) {
+	defer conn.Close()
+
+	conn.SetReadDeadline(time.Now().Add(readTimeout))
+	line, err := bufio.NewReaderSize(conn, maxRequestBytes).ReadSlice('\n')
+	var resp Response
+	switch {
+	case errors.Is(err, bufio.ErrBufferFull):
+		resp = Response{Error: "command too long"}
+	case err != nil && len(line) == 0:
+		return
+	default:
+		// A final line without a newline is accepted
+		resp = s.dispatch(strings.Fields(string(line)))
+	}
+
+	conn.SetWriteDeadline(time.Now().Add(readTimeout))
+	json.NewEncoder(conn).Encode(resp)
+}
+
+// dispatch passes a command to the daemon and waits for its answer
+func (s *Server) dispatch(fields []string) Response {
+	if len(fields) == 0 {
+		return Response{Error: "empty command"}
+	}
+
+	req := &Request{
+		Command: fields[0],
+		Args:    fields[1:],
+		reply:   make(chan Response, 1),
+	}
+	select {
+	case s.requests <- req:
+	case <-s.done:
+		return Response{Error: "daemon is shutting down"}
+	}
+
+	select {
+	case resp := <-req.reply:
+		return resp
+	case <-s.done:
+		return Response{Error: "daemon is shutting down"}
+	}
+}
+
+// Send sends command to the daemon listening at path and returns its output.
+// It returns ErrDaemonNotRunning if no daemon is listening.
+func Send(path, command string) (string, error) {
+	conn, err := net.DialTimeout("unix", path, readTimeout)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) || errors.Is(err, syscall.ECONNREFUSED) {
+			return "", fmt.Errorf("%w (%s)", ErrDaemonNotRunning, path)
+		}
+		return "", fmt.Errorf("connecting to daemon: %w", err)
+	}
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(replyTimeout))
+	if _, err := fmt.Fprintln(conn, command); err != nil {
+		return "", fmt.Errorf("sending command: %w", err)
+	}
+
+	var resp Response
+	if err := json.NewDecoder(conn).Decode(&resp); err != nil {
+		return "", fmt.Errorf("reading response: %w", err)
+	}
+	if !resp.OK {
+		return "", errors.New(resp.Error)
+	}
+	return resp.Output, nil
+}
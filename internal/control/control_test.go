@@ -0,0 +1,94 @@
+package control
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// serveEcho answers each request with its command and arguments
+func serveEcho(srv *Server) {
+	for req := range srv.Requests() {
+		if req.Command == "fail" {
+			req.Reply("", errors.New("failed"))
+			continue
+		}
+		req.Reply(req.Command+":"+strings.Join(req.Args, ","), nil)
+	}
+}
+
+func TestServerConcurrentClients(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "control.sock")
+	srv, err := Listen(path)
+	if err != nil {
+		t.Fatalf("Listen() error = %v", err)
+	}
+	defer srv.Close()
+	go serveEcho(srv)
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if perm := info.Mode().Perm(); perm != 0o660 {
+		t.Errorf("socket permissions = %o, want 660", perm)
+	}
+
+	var wg sync.WaitGroup
+	for i := range 20 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			got, err := Send(path, fmt.Sprintf("snooze %dm", i))
+			if want := fmt.Sprintf("snooze:%dm", i); err != nil || got != want {
+				t.Errorf("Send() = %q, %v, want %q", got, err, want)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if _, err := Send(path, "fail"); err == nil || err.Error() != "failed" {
+		t.Errorf("Send(fail) error = %v, want failed", err)
+	}
+	if _, err := Send(path, "   "); err == nil {
+		t.Error("Send() of empty command succeeded")
+	}
+}
+
+func TestListenReplacesStaleSocket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "control.sock")
+
+	// A listener closed without unlinking leaves the socket file behind
+	stale, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+
+	srv, err := Listen(path)
+	if err != nil {
+		t.Fatalf("Listen() over stale socket error = %v", err)
+	}
+	srv.Close()
+
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("socket still present after Close(): %v", err)
+	}
+	if _, err := Send(path, "status"); !errors.Is(err, ErrDaemonNotRunning) {
+		t.Errorf("Send() without daemon error = %v, want ErrDaemonNotRunning", err)
+	}
+
+	// Anything other than a socket is left alone
+	if err := os.WriteFile(path, nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Listen(path); err == nil {
+		t.Error("Listen() replaced a regular file")
+	}
+}
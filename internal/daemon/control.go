@@ -0,0 +1,251 @@
+package daemon
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"strings"
+	"time"
+
+	"focusd/internal/control"
+	"focusd/internal/metrics"
+	"focusd/internal/state"
+	"focusd/internal/version"
+)
+
+// startControl listens on the configured control socket, returning nil if it
+// is disabled or can't be created (the daemon works without it)
+func (d *Daemon) startControl() *control.Server {
+	if d.cfg.ControlSocketPath == "" {
+		return nil
+	}
+	srv, err := control.Listen(d.cfg.ControlSocketPath)
+	if err != nil {
+		slog.Warn("Control socket unavailable", "err", err)
+		return nil
+	}
+	slog.Info("Listening for control commands", "path", d.cfg.ControlSocketPath)
+	return srv
+}
+
+// handleControl runs a control socket command and replies to the client
+func (d *Daemon) handleControl(req *control.Request) {
+	var (
+		output string
+		err    error
+	)
+	switch req.Command {
+	case "status":
+		output, err = d.controlStatus(req.Args)
+	case "stats":
+		var buf bytes.Buffer
+		err = metrics.WriteText(&buf)
+		output = buf.String()
+	case "blocks":
+		output, err = d.controlBlocks(req.Args)
+	case "reload":
+		slog.Info("Reload requested over control socket")
+		err = d.reload()
+		output = "reloaded"
+	case "sync":
+		output, err = d.controlSync()
+	case "snooze":
+		output, err = d.controlSnooze(req.Args)
+	default:
+		err = fmt.Errorf("unknown command %q (want status [json], stats, blocks [n], reload, sync or snooze <duration>)", req.Command)
+	}
+	req.Reply(output, err)
+}
+
+// Status is the daemon's state as reported by the status control command
+type Status struct {
+	Version                string     `json:"version"`
+	Commit                 string     `json:"commit,omitempty"`
+	State                  string     `json:"state"`
+	Blocking               bool       `json:"blocking"`
+	UptimeSeconds          int64      `json:"uptimeSeconds"`
+	SnoozeRemainingSeconds int64      `json:"snoozeRemainingSeconds"`
+	ProxyRunning           bool       `json:"proxyRunning"`
+	ProxyConnections       int        `json:"proxyConnections"`
+	BlockedDomains         int        `json:"blockedDomains"`
+	BlockedAddresses       int        `json:"blockedAddresses"`
+	LastRefresh            *time.Time `json:"lastRefresh,omitempty"`
+	NextRefresh            *time.Time `json:"nextRefresh,omitempty"`
+	LastReloadError        string     `json:"lastReloadError,omitempty"`
+}
+
+// status collects the daemon's current state
+func (d *Daemon) status() (Status, error) {
+	state, err := d.state.String()
+	if err != nil {
+		return Status{}, fmt.Errorf("reading status: %w", err)
+	}
+	snoozed, err := d.state.SnoozeRemaining()
+	if err != nil {
+		return Status{}, fmt.Errorf("reading snooze: %w", err)
+	}
+
+	s := Status{
+		Version:                version.Version,
+		Commit:                 version.Commit,
+		State:                  state,
+		Blocking:               d.blocking,
+		SnoozeRemainingSeconds: int64(snoozed.Round(time.Second) / time.Second),
+		BlockedDomains:         d.blockedDomains,
+		BlockedAddresses:       len(d.resolvedIPs),
+	}
+	if !d.startedAt.IsZero() {
+		s.UptimeSeconds = int64(time.Since(d.startedAt) / time.Second)
+	}
+	if d.proxy != nil {
+		s.ProxyRunning = true
+		s.ProxyConnections = d.proxy.InFlight()
+	}
+	if !d.lastRefresh.IsZero() {
+		refreshed := d.lastRefresh
+		s.LastRefresh = &refreshed
+	}
+	if !d.nextRefresh.IsZero() {
+		next := d.nextRefresh
+		s.NextRefresh = &next
+	}
+	if d.reloadErr != nil {
+		s.LastReloadError = d.reloadErr.Error()
+	}
+	return s, nil
+}
+
+// controlStatus describes the daemon's current state, as text or, given
+// the argument json, as a JSON Status
+func (d *Daemon) controlStatus(args []string) (string, error) {
+	asJSON := len(args) == 1 && args[0] == "json"
+	if len(args) > 0 && !asJSON {
+		return "", fmt.Errorf("usage: status [json]")
+	}
+	s, err := d.status()
+	if err != nil {
+		return "", err
+	}
+	if asJSON {
+		data, err := json.Marshal(s)
+		if err != nil {
+			return "", fmt.Errorf("encoding status: %w", err)
+		}
+		return string(data), nil
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "version: %s\n", version.String())
+	fmt.Fprintf(&b, "state: %s\n", s.State)
+	fmt.Fprintf(&b, "uptime: %s\n", time.Duration(s.UptimeSeconds)*time.Second)
+
+	blocking := "inactive"
+	if s.Blocking {
+		blocking = "active"
+	}
+	fmt.Fprintf(&b, "blocking: %s\n", blocking)
+
+	if s.SnoozeRemainingSeconds > 0 {
+		fmt.Fprintf(&b, "snoozed: %s remaining\n", time.Duration(s.SnoozeRemainingSeconds)*time.Second)
+	}
+
+	if s.ProxyRunning {
+		fmt.Fprintf(&b, "proxy connections: %d\n", s.ProxyConnections)
+	}
+
+	if s.LastRefresh != nil {
+		fmt.Fprintf(&b, "last refresh: %s (%d addresses)\n", s.LastRefresh.Local().Format(time.DateTime), s.BlockedAddresses)
+	}
+	if s.NextRefresh != nil {
+		fmt.Fprintf(&b, "next refresh: %s\n", s.NextRefresh.Local().Format(time.DateTime))
+	}
+	if s.LastReloadError != "" {
+		fmt.Fprintf(&b, "last reload failed: %s\n", s.LastReloadError)
+	}
+	return b.String(), nil
+}
+
+// controlBlocks lists the most blocked hosts since counting began, one
+// "count host" line each, limited to the first n if given
+func (d *Daemon) controlBlocks(args []string) (string, error) {
+	limit := 0
+	if len(args) > 1 {
+		return "", fmt.Errorf("usage: blocks [n]")
+	}
+	if len(args) == 1 {
+		n, err := strconv.Atoi(args[0])
+		if err != nil || n < 0 {
+			return "", fmt.Errorf("invalid limit %q", args[0])
+		}
+		limit = n
+	}
+
+	counts := d.blockStats.Counts()
+	if limit > 0 && len(counts) > limit {
+		counts = counts[:limit]
+	}
+	var b strings.Builder
+	for _, c := range counts {
+		host := c.Host
+		if host == "" {
+			host = "(no SNI)"
+		}
+		fmt.Fprintf(&b, "%d %s\n", c.Count, host)
+	}
+	return b.String(), nil
+}
+
+// controlSync applies a state change made by the CLI immediately instead of
+// waiting for the next state check
+func (d *Daemon) controlSync() (string, error) {
+	if err := d.expireSnooze(time.Now()); err != nil {
+		return "", fmt.Errorf("checking snooze: %w", err)
+	}
+	if _, err := d.syncBlocking(); err != nil {
+		return "", err
+	}
+	if d.blocking {
+		return "blocking active", nil
+	}
+	return "blocking inactive", nil
+}
+
+// controlSnooze disables blocking for the given duration, with the same
+// checks as `focusd snooze`: the maximum length, any commitment, and the key
+func (d *Daemon) controlSnooze(args []string) (string, error) {
+	if len(args) != 1 {
+		return "", fmt.Errorf("usage: snooze <duration>")
+	}
+	duration, err := time.ParseDuration(args[0])
+	if err != nil {
+		return "", fmt.Errorf("invalid duration: %w", err)
+	}
+	if duration <= 0 {
+		return "", fmt.Errorf("snooze duration must be positive")
+	}
+	if limit := time.Duration(d.cfg.MaxSnoozeMinutes) * time.Minute; duration > limit {
+		return "", fmt.Errorf("snooze of %s exceeds the maximum of %s", duration, limit)
+	}
+
+	if err := d.state.CheckCommitment(); err != nil {
+		return "", err
+	}
+
+	if err := d.verifier.Verify(); err != nil {
+		return "", fmt.Errorf("USB key verification failed: %w", err)
+	}
+
+	d.state.SetAuth(state.AuthUSBKey)
+	defer d.state.SetAuth("")
+
+	until := time.Now().Add(duration)
+	if err := d.state.Snooze(until); err != nil {
+		return "", fmt.Errorf("updating state: %w", err)
+	}
+	if _, err := d.syncBlocking(); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("snoozed until %s", until.Local().Format(time.DateTime)), nil
+}
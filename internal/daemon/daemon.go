@@ -1,59 +1,240 @@
 package daemon
 
 import (
+	"errors"
 	"fmt"
-	"log"
+	"log/slog"
+	"math/rand/v2"
+	"net"
 	"os"
 	"os/signal"
+	"reflect"
+	"slices"
 	"syscall"
 	"time"
 
 	"focusd/internal/config"
+	"focusd/internal/control"
 	"focusd/internal/dns"
+	"focusd/internal/logging"
+	"focusd/internal/metrics"
 	"focusd/internal/nft"
 	"focusd/internal/proxy"
 	"focusd/internal/resolver"
 	"focusd/internal/state"
+	"focusd/internal/usbkey"
+	"focusd/internal/version"
 )
 
+// keyVerifier checks whether a valid USB key is present
+type keyVerifier interface {
+	Verify() error
+}
+
 // Daemon is the main focusd daemon
 type Daemon struct {
-	cfg      *config.Config
-	state    *state.State
-	resolver *resolver.Resolver
-	nftMgr   *nft.Manager
-	dnsMgr   *dns.Manager
-	proxy    *proxy.TransparentProxy
+	cfg        *config.Config
+	configPath string
+	state      *state.State
+	overrides  *state.Overrides
+	categories *state.Categories
+	resolver   *resolver.Resolver
+	nftMgr     *nft.Manager
+	dnsMgr     *dns.Manager
+	hostsMgr   *dns.HostsFile // nil unless hostsFilePath is set
+	blockStats *proxy.BlockStats
+	proxy      *proxy.TransparentProxy
+	proxyCfg   proxy.Config    // settings d.proxy was started with
+	proxyRules *nft.ProxyRules // TPROXY rules applied, nil if none
+	verifier   keyVerifier
+
+	// startedAt is when Run was called
+	startedAt time.Time
+
+	// reloadErr is the error from the most recent failed reload, if any
+	reloadErr error
+
+	// refresh fires at nextRefresh to re-resolve blocked IPs, and is then
+	// re-armed about refreshEvery later; it is nil in manual mode
+	refresh      *time.Timer
+	refreshEvery time.Duration
+	nextRefresh  time.Time
+
+	// retry fires to retry a failed periodic refresh, and is nil when none
+	// is pending; retryAttempt counts the retries made since it failed
+	retry        *time.Timer
+	retryAttempt int
+
+	// metricsTicker and keyPoll tick while the metrics textfile and USB key
+	// polling are enabled; a reload retunes them
+	metricsTicker ticker
+	keyPoll       ticker
+
+	// resolvedIPs is the last successfully resolved blocked IP set and
+	// lastRefresh when it was resolved
+	resolvedIPs []net.IP
+	lastRefresh time.Time
+
+	// resolvePending is set while the rules are being applied at startup
+	// with IPs from the IP cache, which are re-resolved once the daemon is up
+	resolvePending bool
+
+	// blockedDomains is the size of the blocklist last applied
+	blockedDomains int
+
+	// keyPresent is the USB key presence seen by the last poll
+	keyPresent bool
+
+	// committedUntil is the latest commitment deadline seen in the state
+	// file, kept so that editing the file can't end a commitment early
+	committedUntil time.Time
+
+	// blocking is true while blocking rules are applied
+	blocking bool
 }
 
 // New creates a new Daemon instance
-func New(cfg *config.Config) *Daemon {
+// configPath is re-read on reload
+func New(cfg *config.Config, configPath string) *Daemon {
+	nftMgr := nft.New()
+	nftMgr.SetAtomicReplace(cfg.AtomicRuleReplace)
+
+	st := state.New(state.DefaultStatePath)
+	st.SetAuditLog(cfg.AuditLogPath)
+
 	return &Daemon{
-		cfg:      cfg,
-		state:    state.New(state.DefaultStatePath),
-		resolver: resolver.New(),
-		nftMgr:   nft.New(),
-		dnsMgr:   dns.New(cfg.DnsmasqConfigPath),
+		cfg:        cfg,
+		configPath: configPath,
+		state:      st,
+		overrides:  state.NewOverrides(state.DefaultOverridesPath),
+		categories: state.NewCategories(state.DefaultCategoriesPath),
+		resolver:   newResolver(cfg),
+		nftMgr:     nftMgr,
+		dnsMgr:     newDNSManager(cfg),
+		hostsMgr:   newHostsFile(cfg),
+		blockStats: proxy.NewBlockStats(cfg.BlockStatsPath),
+		verifier:   newVerifier(cfg),
+	}
+}
+
+// newVerifier creates the USB key verifier for cfg
+func newVerifier(cfg *config.Config) *usbkey.Verifier {
+	verifier := usbkey.New(cfg.USBKeyPath, cfg.TokenHashPath)
+	verifier.SetStrictPermissions(cfg.StrictTokenPermissions)
+	return verifier
+}
+
+// newResolver creates the resolver for blocked domains for cfg
+func newResolver(cfg *config.Config) *resolver.Resolver {
+	sharedCIDRs := cfg.SharedCIDRs
+	if cfg.SkipSharedCDN {
+		sharedCIDRs = append(slices.Clone(resolver.SharedCDNCIDRs), sharedCIDRs...)
+	}
+	return resolver.New(resolver.Config{
+		Servers:     cfg.ResolverAddrs,
+		Timeout:     time.Duration(cfg.ResolverTimeoutSeconds) * time.Second,
+		Concurrency: cfg.ResolverConcurrency,
+		CacheTTL:    time.Duration(cfg.ResolverCacheTTLMinutes) * time.Minute,
+		DoHURL:      cfg.ResolverDoHURL,
+		SkipCIDRs:   cfg.ResolverSkipCIDRs,
+		SharedCIDRs: sharedCIDRs,
+	})
+}
+
+// newDNSManager creates the dnsmasq manager for cfg
+func newDNSManager(cfg *config.Config) *dns.Manager {
+	return dns.New(cfg.DnsmasqConfigPath, dns.Config{
+		Mode:           dns.BlockMode(cfg.DnsBlockMode),
+		AllowedDomains: cfg.AllowedDomains,
+		ReloadCommand:  cfg.DnsmasqReloadCommand,
+		PIDFile:        cfg.DnsmasqPIDFile,
+	})
+}
+
+// newHostsFile creates the hosts file exporter for cfg, or nil if disabled
+func newHostsFile(cfg *config.Config) *dns.HostsFile {
+	if cfg.HostsFilePath == "" {
+		return nil
+	}
+	return dns.NewHostsFile(cfg.HostsFilePath, cfg.AllowedDomains)
+}
+
+// reloadDNS tells dnsmasq to pick up its new config. Failures are only
+// logged: the proxy and nftables still block without it.
+func (d *Daemon) reloadDNS() {
+	err := d.dnsMgr.Reload()
+	switch {
+	case errors.Is(err, dns.ErrNotRunning):
+		slog.Warn("dnsmasq is not running; DNS rules take effect when it starts")
+	case err != nil:
+		slog.Warn("Error reloading dnsmasq", "err", err)
+	default:
+		slog.Info("dnsmasq reloaded")
 	}
 }
 
 // Run starts the daemon and runs until interrupted
 func (d *Daemon) Run() error {
-	log.Println("focusd daemon starting...")
+	d.startedAt = time.Now()
+	slog.Info("focusd daemon starting", "version", version.Version, "commit", version.Commit)
+	metrics.BuildInfo.Set(version.Version, version.Commit, version.Date)
+
+	// Fail early with an actionable message in restricted environments
+	if err := preflight(); err != nil {
+		return fmt.Errorf("preflight check failed: %w", err)
+	}
+
+	// Two daemons would fight over the same nftables rules
+	if d.cfg.PIDFilePath != "" {
+		pid, err := lockPIDFile(d.cfg.PIDFilePath)
+		if err != nil {
+			return err
+		}
+		defer func() {
+			if err := pid.release(); err != nil {
+				slog.Warn("Error removing PID file", "err", err)
+			}
+		}()
+	}
+
+	// Pick up state handed over by a previous process (e.g. across an upgrade)
+	d.restoreRuntimeState()
+
+	// A snooze that ran out while the daemon was down ends now
+	if err := d.expireSnooze(time.Now()); err != nil {
+		return fmt.Errorf("checking snooze: %w", err)
+	}
+
+	// Block the IPs the last run resolved while DNS answers come in
+	d.resolvePending = d.loadIPCache(time.Now())
 
 	// Check initial state
-	enabled, err := d.state.IsEnabled()
+	enabled, err := d.startupEnabled()
 	if err != nil {
 		return fmt.Errorf("checking state: %w", err)
 	}
 
+	// Start from a clean slate: a run that crashed or was killed may have
+	// left tables and routing rules behind, which rules added on top of
+	// would duplicate
+	if removed, err := d.nftMgr.Reset(); err != nil {
+		slog.Warn("Error removing leftover rules", "err", err)
+	} else if len(removed) > 0 {
+		slog.Info("Removed rules left by a previous run", "removed", removed)
+	}
+
 	if enabled {
-		log.Println("Blocking is enabled, applying rules...")
+		slog.Info("Blocking is enabled, applying rules")
+		if err := d.applyRules(); err != nil {
+			return fmt.Errorf("applying initial rules: %w", err)
+		}
+	} else if d.scheduleActive(time.Now()) {
+		slog.Info("Blocking is disabled but a schedule is active, applying rules")
 		if err := d.applyRules(); err != nil {
 			return fmt.Errorf("applying initial rules: %w", err)
 		}
 	} else {
-		log.Println("Blocking is disabled, ensuring rules are removed...")
+		slog.Info("Blocking is disabled, ensuring rules are removed")
 		if err := d.removeRules(); err != nil {
 			return fmt.Errorf("removing rules: %w", err)
 		}
@@ -63,12 +244,59 @@ func (d *Daemon) Run() error {
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
 
-	// Set up ticker for periodic IP refresh
-	refreshInterval := time.Duration(d.cfg.RefreshIntervalMinutes) * time.Minute
-	ticker := time.NewTicker(refreshInterval)
-	defer ticker.Stop()
+	// Set up timer for periodic IP refresh; a reload replaces it if the
+	// interval changes
+	d.resetRefreshTimer()
+	defer d.stopRefreshTimer()
+	defer d.cancelRetry()
+	if d.refresh != nil {
+		slog.Info("Daemon running", "refresh", d.refreshInterval())
+	} else {
+		slog.Info("Daemon running; periodic IP refresh disabled, refreshing only on reload")
+	}
+
+	// Set up ticker for writing the metrics textfile; a reload retunes it
+	d.resetMetricsTicker()
+	defer d.metricsTicker.stop()
+
+	// Set up ticker for flushing block statistics
+	var blockStatsC <-chan time.Time
+	if d.cfg.BlockStatsPath != "" {
+		ticker := time.NewTicker(time.Duration(d.cfg.BlockStatsFlushMinutes) * time.Minute)
+		defer ticker.Stop()
+		blockStatsC = ticker.C
+	}
+
+	// Set up ticker for USB key polling (stopped unless the key must stay
+	// inserted); a reload retunes it
+	d.resetKeyPoll()
+	defer d.keyPoll.stop()
+
+	// Re-check state every minute so schedules and snoozes start and end on time
+	stateTicker := time.NewTicker(time.Minute)
+	defer stateTicker.Stop()
+	if len(d.cfg.Schedules) > 0 {
+		slog.Info("Enforcing blocking schedules", "count", len(d.cfg.Schedules))
+	}
 
-	log.Printf("Daemon running. Will refresh IPs every %v", refreshInterval)
+	// Accept runtime commands (nil channel if the socket is disabled)
+	var controlC <-chan *control.Request
+	if srv := d.startControl(); srv != nil {
+		defer srv.Close()
+		controlC = srv.Requests()
+	}
+
+	// Rules are applied and the proxy is up; units ordered after focusd
+	// can start
+	notifySystemd("READY=1")
+
+	if d.resolvePending {
+		d.resolvePending = false
+		if d.blocking {
+			slog.Info("Re-resolving blocked IPs loaded from the IP cache")
+			d.refreshIPs()
+		}
+	}
 
 	// Main loop
 	for {
@@ -76,124 +304,518 @@ func (d *Daemon) Run() error {
 		case sig := <-sigChan:
 			if sig == syscall.SIGHUP {
 				// SIGHUP triggers a reload
-				log.Println("Received SIGHUP, reloading...")
+				slog.Info("Received SIGHUP, reloading")
+				notifySystemd(reloadingState())
 				if err := d.reload(); err != nil {
-					log.Printf("Error reloading: %v", err)
+					slog.Error("Error reloading", "err", err)
 				}
+				notifySystemd("READY=1")
 			} else {
 				// SIGINT or SIGTERM triggers shutdown
-				log.Printf("Received signal %v, shutting down...", sig)
+				slog.Info("Shutting down", "signal", sig.String())
+				notifySystemd("STOPPING=1")
+				d.saveRuntimeState()
+				d.shutdown()
 				return nil
 			}
 
-		case <-ticker.C:
+		case <-d.refreshC():
+			d.scheduleRefresh()
+
 			// Periodic refresh
-			enabled, err := d.state.IsEnabled()
+			changed, err := d.syncBlocking()
 			if err != nil {
-				log.Printf("Error checking state: %v", err)
+				slog.Error("Error applying schedule", "err", err)
 				continue
 			}
 
-			if enabled {
-				log.Println("Refreshing blocked IPs...")
-				if err := d.updateRules(); err != nil {
-					log.Printf("Error updating rules: %v", err)
-				}
+			// A pending retry is superseded by this refresh
+			d.cancelRetry()
+			if d.blocking && !changed {
+				slog.Info("Refreshing blocked IPs")
+				d.refreshIPs()
 			}
+
+		case <-d.retryC():
+			d.retry = nil
+			if d.blocking {
+				slog.Info("Retrying refresh of blocked IPs", "attempt", d.retryAttempt)
+				d.refreshIPs()
+			} else {
+				d.cancelRetry()
+			}
+
+		case <-stateTicker.C:
+			if err := d.expireSnooze(time.Now()); err != nil {
+				slog.Error("Error ending snooze", "err", err)
+			}
+			if _, err := d.syncBlocking(); err != nil {
+				slog.Error("Error applying schedule", "err", err)
+			}
+
+		case <-d.metricsTicker.C():
+			d.writeMetrics()
+
+		case <-blockStatsC:
+			if err := d.blockStats.Flush(); err != nil {
+				slog.Warn("Error flushing block statistics", "err", err)
+			}
+
+		case <-d.keyPoll.C():
+			d.pollKey()
+
+		case req := <-controlC:
+			d.handleControl(req)
+		}
+	}
+}
+
+// resetMetricsTicker starts, retunes or stops writing the metrics textfile
+// to match the config, writing it straight away when started
+func (d *Daemon) resetMetricsTicker() {
+	var interval time.Duration
+	if d.cfg.MetricsTextfilePath != "" {
+		interval = time.Duration(d.cfg.MetricsTextfileIntervalSeconds) * time.Second
+	}
+	if !d.metricsTicker.reset(interval) {
+		return
+	}
+	if interval > 0 {
+		d.writeMetrics()
+		slog.Info("Writing metrics textfile", "path", d.cfg.MetricsTextfilePath, "interval", interval)
+	} else {
+		slog.Info("Stopped writing metrics textfile")
+	}
+}
+
+// writeMetrics writes the metrics textfile, logging any failure
+func (d *Daemon) writeMetrics() {
+	if err := metrics.WriteFile(d.cfg.MetricsTextfilePath); err != nil {
+		slog.Warn("Error writing metrics textfile", "err", err)
+	}
+}
+
+// startupEnabled determines whether blocking should be active when the daemon starts.
+// With RequireKeyToStartDisabled set, a persisted "disabled" state is only honoured
+// if a valid USB key is present; otherwise blocking is re-enabled (fail-closed).
+func (d *Daemon) startupEnabled() (bool, error) {
+	enabled, err := d.isEnabled(time.Now())
+	if err != nil {
+		return false, err
+	}
+
+	if enabled || !d.cfg.RequireKeyToStartDisabled {
+		return enabled, nil
+	}
+
+	if err := d.verifier.Verify(); err != nil {
+		slog.Warn("State is disabled but no valid USB key is present, starting enabled", "err", err)
+		if err := d.state.SetEnabledBecause(true, "no USB key at startup"); err != nil {
+			return false, fmt.Errorf("re-enabling state: %w", err)
+		}
+		return true, nil
+	}
+
+	slog.Info("State is disabled and a valid USB key is present, starting disabled")
+	return false, nil
+}
+
+// refreshInterval returns the configured periodic refresh interval
+func (d *Daemon) refreshInterval() time.Duration {
+	return time.Duration(d.cfg.RefreshIntervalMinutes) * time.Minute
+}
+
+// resetRefreshTimer starts, replaces or stops the periodic IP refresh
+// timer to match the configured interval, and reports whether it changed
+func (d *Daemon) resetRefreshTimer() bool {
+	var interval time.Duration
+	if !d.cfg.ManualRefresh() {
+		interval = d.refreshInterval()
+	}
+	if interval == d.refreshEvery {
+		return false
+	}
+
+	d.stopRefreshTimer()
+	d.refreshEvery = interval
+	if interval > 0 {
+		d.scheduleRefresh()
+	}
+	return true
+}
+
+// scheduleRefresh arms the refresh timer to fire one jittered interval
+// from now
+func (d *Daemon) scheduleRefresh() {
+	wait := jitter(d.refreshEvery, d.cfg.RefreshJitterPercent)
+	d.nextRefresh = time.Now().Add(wait)
+	if d.refresh == nil {
+		d.refresh = time.NewTimer(wait)
+	} else {
+		d.refresh.Reset(wait)
+	}
+}
+
+// stopRefreshTimer stops the periodic IP refresh timer, if any
+func (d *Daemon) stopRefreshTimer() {
+	if d.refresh != nil {
+		d.refresh.Stop()
+	}
+	d.refresh, d.refreshEvery, d.nextRefresh = nil, 0, time.Time{}
+}
+
+// refreshIPs re-resolves the blocked IPs and updates the rules. A failure
+// is retried with exponential backoff, up to RefreshRetries times, before
+// waiting for the next periodic refresh.
+func (d *Daemon) refreshIPs() {
+	err := d.updateRules()
+	if err == nil {
+		d.cancelRetry()
+		return
+	}
+	if d.retryAttempt >= d.cfg.RefreshRetries {
+		slog.Error("Error updating rules", "err", err)
+		d.cancelRetry()
+		return
+	}
+
+	delay := retryDelay(time.Duration(d.cfg.RefreshRetryBaseSeconds)*time.Second, d.retryAttempt)
+	d.retryAttempt++
+	slog.Warn("Error updating rules, retrying", "err", err, "attempt", d.retryAttempt, "of", d.cfg.RefreshRetries, "in", delay.Round(time.Second))
+	d.retry = time.NewTimer(delay)
+}
+
+// cancelRetry stops any pending retry of a failed refresh
+func (d *Daemon) cancelRetry() {
+	if d.retry != nil {
+		d.retry.Stop()
+	}
+	d.retry, d.retryAttempt = nil, 0
+}
+
+// retryC returns the channel a pending retry fires on, or nil, which never
+// fires, if none is pending
+func (d *Daemon) retryC() <-chan time.Time {
+	if d.retry == nil {
+		return nil
+	}
+	return d.retry.C
+}
+
+// retryDelay returns how long to wait before retry number attempt (from
+// 0): base doubled attempt times, give or take a quarter
+func retryDelay(base time.Duration, attempt int) time.Duration {
+	return jitter(base<<attempt, 25)
+}
+
+// jitter returns interval moved a random amount of up to percent of it
+// earlier or later. math/rand/v2 is seeded afresh in each process, so
+// daemons started together drift apart.
+func jitter(interval time.Duration, percent int) time.Duration {
+	spread := interval * time.Duration(percent) / 100
+	if spread <= 0 {
+		return interval
+	}
+	return interval - spread + rand.N(2*spread+1)
+}
+
+// refreshC returns the channel periodic IP refreshes are signalled on, or
+// nil, which never fires, in manual mode
+func (d *Daemon) refreshC() <-chan time.Time {
+	if d.refresh == nil {
+		return nil
+	}
+	return d.refresh.C
+}
+
+// loadDomains loads the blocklist for cfg with session overrides applied
+func (d *Daemon) loadDomains(cfg *config.Config) ([]string, error) {
+	domains, err := cfg.LoadBlocklist()
+	if err != nil {
+		return nil, err
+	}
+	if d.overrides == nil {
+		return domains, nil
+	}
+	return d.overrides.Apply(domains)
+}
+
+// withoutBudgeted returns domains that have no daily budget
+func withoutBudgeted(domains []string, budgets map[string]time.Duration) []string {
+	if len(budgets) == 0 {
+		return domains
+	}
+	result := make([]string, 0, len(domains))
+	for _, domain := range domains {
+		if _, ok := budgets[domain]; !ok {
+			result = append(result, domain)
 		}
 	}
+	return result
 }
 
 // applyRules applies DNS blocking, IP blocking, and transparent proxy
 func (d *Daemon) applyRules() error {
 	// Load blocklist (either from config or external file)
-	domains, err := d.cfg.LoadBlocklist()
+	domains, err := d.loadDomains(d.cfg)
 	if err != nil {
 		return fmt.Errorf("loading blocklist: %w", err)
 	}
-	log.Printf("Loaded %d domains from blocklist", len(domains))
+	return d.applyDomains(domains)
+}
+
+// applyDomains applies DNS blocking, IP blocking, and transparent proxy for
+// domains. If blocking is already active (a reload), only what changed is
+// updated: the proxy keeps running with its new blocklist swapped in, so
+// live connections aren't dropped.
+func (d *Daemon) applyDomains(domains []string) error {
+	slog.Info("Loaded blocklist", "domains", len(domains))
+	d.blockedDomains = len(domains)
+	metrics.BlockedDomains.Set(float64(len(domains)))
+
+	budgets, err := d.cfg.LoadBudgets()
+	if err != nil {
+		return fmt.Errorf("loading budgets: %w", err)
+	}
+
+	// Domains with a daily budget are only enforced by the proxy, which
+	// tracks the allowance; DNS and IP blocking would bypass it
+	networkDomains := withoutBudgeted(domains, budgets)
 
 	// Apply DNS rules (first line of defense)
-	if err := d.dnsMgr.ApplyRules(domains); err != nil {
+	changed, err := d.dnsMgr.Sync(networkDomains)
+	if err != nil {
 		return fmt.Errorf("applying DNS rules: %w", err)
 	}
-	log.Printf("DNS rules applied for %d domains", len(domains))
+	if changed {
+		slog.Info("DNS rules applied", "domains", len(networkDomains))
+		d.reloadDNS()
+	} else {
+		slog.Info("DNS rules unchanged", "domains", len(networkDomains))
+	}
+
+	if d.hostsMgr != nil {
+		if err := d.hostsMgr.ApplyRules(networkDomains); err != nil {
+			return fmt.Errorf("applying hosts file rules: %w", err)
+		}
+		slog.Info("Hosts file rules applied", "path", d.cfg.HostsFilePath)
+	}
 
 	// Resolve domains to IPs and apply IP blocking
 	// (This is optional - DNS + transparent proxy are the main defenses)
-	ips, err := d.resolver.Resolve(domains)
+	var ips []net.IP
+	if d.resolvePending {
+		// Startup goes on with the cached IPs; they're re-resolved once
+		// the daemon is up
+		slog.Info("Blocking cached IPs until the domains are re-resolved", "ips", len(d.resolvedIPs))
+		ips = d.resolvedIPs
+	} else {
+		ips, err = d.resolveBlocked(networkDomains)
+		if err != nil && len(d.resolvedIPs) > 0 {
+			// Keep enforcing the last known IPs until a refresh succeeds
+			slog.Warn("Error resolving domains; using previously resolved IPs", "err", err, "ips", len(d.resolvedIPs))
+			ips, err = d.resolvedIPs, nil
+		} else if err == nil {
+			d.recordResolved(ips)
+			slog.Info("Resolved blocked domains", "ips", len(ips))
+		}
+	}
 	if err != nil {
-		log.Printf("Warning: error resolving domains: %v", err)
+		slog.Warn("Error resolving domains", "err", err)
 	} else {
-		log.Printf("Resolved %d IP addresses", len(ips))
-
-		// Apply nftables IP blocking rules
-		if err := d.nftMgr.ApplyRules(ips); err != nil {
-			log.Printf("Warning: error applying nftables IP rules: %v", err)
+		// Apply nftables IP blocking rules. While blocking, the set is
+		// diffed so addresses of removed domains are dropped too.
+		apply := d.nftMgr.ApplyRules
+		if d.blocking {
+			apply = d.nftMgr.UpdateRules
+		}
+		if err := apply(ips); err != nil {
+			slog.Warn("Error applying nftables IP rules", "err", err)
 		} else {
-			log.Println("nftables IP blocking rules applied")
+			slog.Info("nftables IP blocking rules applied")
+			metrics.BlockedIPs.Set(float64(len(ips)))
+			metrics.LastRefresh.Set(float64(d.lastRefresh.Unix()))
 		}
 	}
 
 	// Start transparent proxy (catches DNS-over-HTTPS bypass attempts)
-	d.proxy = proxy.New(domains)
-	if err := d.proxy.Start(); err != nil {
-		return fmt.Errorf("starting transparent proxy: %w", err)
+	if err := d.syncProxy(domains, budgets); err != nil {
+		return err
 	}
-	log.Println("Transparent proxy started")
+	metrics.BlockingEnabled.Set(1)
+	d.blocking = true
+
+	return nil
+}
+
+// proxyConfig returns the transparent proxy settings for the current config
+func (d *Daemon) proxyConfig(budgets map[string]time.Duration) proxy.Config {
+	return proxy.Config{
+		ReverseDNSBlock:    d.cfg.ReverseDNSBlock,
+		IdleTimeout:        time.Duration(d.cfg.ProxyIdleTimeoutMinutes) * time.Minute,
+		UsageLogPath:       d.cfg.UsageLogPath,
+		UsageSampleRate:    d.cfg.UsageSampleRate,
+		BlockedLogPath:     d.cfg.BlockedLogPath,
+		BlockedLogMaxBytes: d.cfg.BlockedLogMaxBytes,
+		ListenAddr:         d.cfg.ProxyListenAddr,
+		HTTPPort:           d.cfg.ProxyHTTPPort,
+		HTTPSPort:          d.cfg.ProxyHTTPSPort,
+		Mark:               d.cfg.ProxyMark,
+		MaxConnections:     d.cfg.ProxyMaxConnections,
+		BlockStats:         d.blockStats,
+		Budgets:            budgets,
+		AllowedDomains:     d.cfg.AllowedDomains,
+		Redirects:          d.cfg.Redirects,
+		BlockPagePath:      d.cfg.BlockPagePath,
+		HTTPBlockMode:      proxy.HTTPBlockMode(d.cfg.HTTPBlockMode),
+		BlockRedirectURL:   d.cfg.BlockRedirectURL,
+		BudgetStatePath:    d.cfg.BudgetStatePath,
+		InspectQUIC:        d.cfg.InspectQUIC,
+		DoHResolvers:       d.cfg.DoHResolverIPs,
+	}
+}
+
+// syncProxy makes the transparent proxy and its nftables rules enforce
+// domains and the resolved IPs. A running proxy whose settings are
+// unchanged just gets the new blocklist; otherwise it is replaced. The TPROXY rules are only rewritten
+// when the ports, mark or bypassed networks change.
+func (d *Daemon) syncProxy(domains []string, budgets map[string]time.Duration) error {
+	cfg := d.proxyConfig(budgets)
+	if d.proxy != nil && reflect.DeepEqual(cfg, d.proxyCfg) {
+		d.proxy.SetBlockedDomains(domains)
+		slog.Info("Transparent proxy blocklist updated", "domains", len(domains))
+	} else {
+		if d.proxy != nil {
+			slog.Info("Proxy settings changed, restarting transparent proxy")
+			if err := d.proxy.Stop(); err != nil {
+				slog.Warn("Error stopping proxy", "err", err)
+			}
+			d.proxy = nil
+		}
+		p := proxy.New(domains, cfg)
+		if err := p.Start(); err != nil {
+			return fmt.Errorf("starting transparent proxy: %w", err)
+		}
+		d.proxy, d.proxyCfg = p, cfg
+		slog.Info("Transparent proxy started")
+	}
+	d.proxy.SetBlockedIPs(d.resolvedIPs)
 
 	// Enable transparent proxy nftables rules (TPROXY)
-	if err := d.nftMgr.EnableTransparentProxy(proxy.HTTPPort, proxy.HTTPSPort); err != nil {
+	httpPort, httpsPort := d.proxy.Ports()
+	rules := nft.ProxyRules{
+		HTTPPort:     httpPort,
+		HTTPSPort:    httpsPort,
+		Mark:         d.proxy.Mark(),
+		BypassCIDRs:  d.cfg.BypassCIDRs,
+		InspectQUIC:  d.proxy.InspectingQUIC(),
+		BlockQUIC:    d.cfg.BlockQUIC,
+		BlockDoT:     d.cfg.BlockDoT,
+		DoHResolvers: d.cfg.DoHResolverIPs,
+	}
+	if d.proxyRules != nil {
+		if reflect.DeepEqual(rules, *d.proxyRules) {
+			return nil
+		}
+		if err := d.nftMgr.DisableTransparentProxy(); err != nil {
+			slog.Warn("Error disabling transparent proxy rules", "err", err)
+		}
+		d.proxyRules = nil
+	}
+	if err := d.nftMgr.EnableTransparentProxy(rules); err != nil {
 		// Try to clean up proxy if nftables fails
 		d.proxy.Stop()
 		d.proxy = nil
 		return fmt.Errorf("enabling transparent proxy rules: %w", err)
 	}
-	log.Println("Transparent proxy nftables rules enabled")
-
+	d.proxyRules = &rules
+	slog.Info("Transparent proxy nftables rules enabled")
 	return nil
 }
 
-// removeRules removes DNS blocking, IP blocking, and transparent proxy
-func (d *Daemon) removeRules() error {
-	// Stop transparent proxy
+// shutdown stops the proxy and removes its rules as the daemon exits, so
+// traffic isn't left intercepted by a proxy that's gone. The DNS and IP
+// rules stay while blocking is enabled (which a commitment keeps it), so
+// stopping the daemon can't lift blocking without the key, and always with
+// PersistRulesOnExit; otherwise they are removed too.
+func (d *Daemon) shutdown() {
+	enabled, err := d.isEnabled(time.Now())
+	if err != nil {
+		// Without the state, err on the side of blocking
+		slog.Warn("Error checking state", "err", err)
+		enabled = true
+	}
+	if d.cfg.PersistRulesOnExit || enabled {
+		d.stopProxy()
+		slog.Info("Leaving DNS and IP blocking rules in place after exit")
+		return
+	}
+	if err := d.removeRules(); err != nil {
+		slog.Warn("Error removing rules", "err", err)
+	}
+}
+
+// stopProxy stops the transparent proxy and removes its nftables rules
+func (d *Daemon) stopProxy() {
 	if d.proxy != nil {
-		log.Println("Stopping transparent proxy...")
+		slog.Info("Stopping transparent proxy")
 		if err := d.proxy.Stop(); err != nil {
-			log.Printf("Warning: error stopping proxy: %v", err)
+			slog.Warn("Error stopping proxy", "err", err)
 		}
 		d.proxy = nil
 	}
 
 	// Disable transparent proxy nftables rules
 	if err := d.nftMgr.DisableTransparentProxy(); err != nil {
-		log.Printf("Warning: error disabling transparent proxy rules: %v", err)
+		slog.Warn("Error disabling transparent proxy rules", "err", err)
 	}
+	d.proxyRules = nil
+}
+
+// removeRules removes DNS blocking, IP blocking, and transparent proxy
+func (d *Daemon) removeRules() error {
+	d.stopProxy()
 
 	// Remove DNS rules
 	if err := d.dnsMgr.RemoveRules(); err != nil {
-		log.Printf("Warning: error removing DNS rules: %v", err)
+		slog.Warn("Error removing DNS rules", "err", err)
+	} else {
+		d.reloadDNS()
+	}
+
+	if d.hostsMgr != nil {
+		if err := d.hostsMgr.RemoveRules(); err != nil {
+			slog.Warn("Error removing hosts file rules", "err", err)
+		}
 	}
 
 	// Remove nftables IP blocking rules
 	if err := d.nftMgr.RemoveRules(); err != nil {
-		log.Printf("Warning: error removing nftables rules: %v", err)
+		slog.Warn("Error removing nftables rules", "err", err)
 	}
 
-	log.Println("All rules removed")
+	slog.Info("All rules removed")
+	metrics.BlockingEnabled.Set(0)
+	d.blocking = false
+	metrics.BlockedIPs.Set(0)
 	return nil
 }
 
 // updateRules updates the nftables rules with fresh IP resolutions
 func (d *Daemon) updateRules() error {
 	// Load blocklist (either from config or external file)
-	domains, err := d.cfg.LoadBlocklist()
+	domains, err := d.loadDomains(d.cfg)
 	if err != nil {
 		return fmt.Errorf("loading blocklist: %w", err)
 	}
 
+	budgets, err := d.cfg.LoadBudgets()
+	if err != nil {
+		return fmt.Errorf("loading budgets: %w", err)
+	}
+
 	// Resolve domains to IPs
-	ips, err := d.resolver.Resolve(domains)
+	ips, err := d.resolveBlocked(withoutBudgeted(domains, budgets))
 	if err != nil {
 		return fmt.Errorf("resolving domains: %w", err)
 	}
@@ -203,22 +825,154 @@ func (d *Daemon) updateRules() error {
 		return fmt.Errorf("updating nftables rules: %w", err)
 	}
 
-	log.Printf("Rules updated with %d IPs", len(ips))
+	d.recordResolved(ips)
+	if d.proxy != nil {
+		d.proxy.SetBlockedIPs(ips)
+	}
+	slog.Info("Rules updated", "ips", len(ips))
+	d.blockedDomains = len(domains)
+	metrics.BlockedDomains.Set(float64(len(domains)))
+	metrics.BlockedIPs.Set(float64(len(ips)))
+	metrics.LastRefresh.Set(float64(d.lastRefresh.Unix()))
 	return nil
 }
 
-// reload reloads the daemon's state and applies or removes rules accordingly
+// resolveBlocked resolves domains for IP blocking. IPs that allowlisted
+// domains also resolve to (e.g. a shared CDN) are left out so IP blocking
+// doesn't break allowed sites.
+func (d *Daemon) resolveBlocked(domains []string) ([]net.IP, error) {
+	ips, err := d.resolver.Resolve(domains)
+	if err != nil || len(d.cfg.AllowedDomains) == 0 {
+		return ips, err
+	}
+
+	allowedIPs, err := d.resolver.Resolve(d.cfg.AllowedDomains)
+	if err != nil {
+		slog.Warn("Error resolving allowed domains", "err", err)
+		return ips, nil
+	}
+	allowed := make(map[string]bool, len(allowedIPs))
+	for _, ip := range allowedIPs {
+		allowed[ip.String()] = true
+	}
+
+	blocked := ips[:0:0]
+	for _, ip := range ips {
+		if !allowed[ip.String()] {
+			blocked = append(blocked, ip)
+		}
+	}
+	return blocked, nil
+}
+
+// recordResolved remembers a freshly resolved IP set
+func (d *Daemon) recordResolved(ips []net.IP) {
+	d.resolvedIPs = ips
+	d.lastRefresh = time.Now()
+	d.saveIPCache()
+}
+
+// stagedConfig is a fully loaded and validated configuration awaiting swap-in
+type stagedConfig struct {
+	cfg     *config.Config
+	domains []string
+}
+
+// stageConfig loads and validates the config file and its blocklist without
+// touching the running configuration
+func (d *Daemon) stageConfig() (*stagedConfig, error) {
+	cfg, err := config.Load(d.configPath)
+	if err != nil {
+		return nil, fmt.Errorf("loading config: %w", err)
+	}
+	if d.categories != nil {
+		toggles, err := d.categories.Load()
+		if err != nil {
+			return nil, err
+		}
+		cfg.SetCategoryToggles(toggles)
+	}
+
+	domains, err := d.loadDomains(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("loading blocklist: %w", err)
+	}
+
+	return &stagedConfig{cfg: cfg, domains: domains}, nil
+}
+
+// ReloadError returns the error from the most recent reload, or nil if it succeeded
+func (d *Daemon) ReloadError() error {
+	return d.reloadErr
+}
+
+// releaseDNSFiles removes focusd's rules from the dnsmasq config and hosts
+// file that cfg no longer uses; the old files would otherwise keep their
+// entries for good, even once blocking is disabled
+func (d *Daemon) releaseDNSFiles(cfg *config.Config) {
+	if d.dnsMgr != nil && cfg.DnsmasqConfigPath != d.cfg.DnsmasqConfigPath {
+		if err := d.dnsMgr.RemoveRules(); err != nil {
+			slog.Warn("Error removing the previous dnsmasq config", "err", err)
+		} else {
+			d.reloadDNS()
+		}
+	}
+	if d.hostsMgr != nil && cfg.HostsFilePath != d.cfg.HostsFilePath {
+		if err := d.hostsMgr.RemoveRules(); err != nil {
+			slog.Warn("Error removing rules from the previous hosts file", "err", err)
+		}
+	}
+}
+
+// reload re-reads the config and state and applies or removes rules accordingly.
+// The new config is only swapped in if it and its blocklist load and validate
+// cleanly; otherwise the previous configuration stays in effect.
 func (d *Daemon) reload() error {
-	enabled, err := d.state.IsEnabled()
+	staged, err := d.stageConfig()
+	if err != nil {
+		d.reloadErr = err
+		return fmt.Errorf("keeping previous configuration: %w", err)
+	}
+
+	enabled, err := d.isEnabled(time.Now())
 	if err != nil {
+		d.reloadErr = err
 		return fmt.Errorf("checking state: %w", err)
 	}
 
+	d.releaseDNSFiles(staged.cfg)
+	d.cfg = staged.cfg
+	d.dnsMgr = newDNSManager(d.cfg)
+	d.hostsMgr = newHostsFile(d.cfg)
+	d.verifier = newVerifier(d.cfg)
+	d.nftMgr.SetAtomicReplace(d.cfg.AtomicRuleReplace)
+	d.state.SetAuditLog(d.cfg.AuditLogPath)
+	d.reloadErr = nil
+	if err := logging.Setup(os.Stderr, d.cfg.LogFormat, d.cfg.LogLevel); err != nil {
+		slog.Warn("Keeping previous log settings", "err", err)
+	}
+	if d.resetRefreshTimer() {
+		if d.refresh != nil {
+			slog.Info("IP refresh interval changed", "refresh", d.refreshInterval())
+		} else {
+			slog.Info("Periodic IP refresh disabled, refreshing only on reload")
+		}
+	}
+	d.resetMetricsTicker()
+	d.resetKeyPoll()
+
+	// A new resolver picks up changed resolver settings, and a reload is an
+	// explicit request for fresh lookups anyway
+	d.resolver = newResolver(d.cfg)
+
 	if enabled {
-		log.Println("Reloading: blocking is enabled")
-		return d.applyRules()
+		slog.Info("Reloading: blocking is enabled")
+		return d.applyDomains(staged.domains)
+	} else if d.scheduleActive(time.Now()) {
+		slog.Info("Reloading: blocking is disabled but a schedule is active")
+		return d.applyDomains(staged.domains)
 	} else {
-		log.Println("Reloading: blocking is disabled")
+		slog.Info("Reloading: blocking is disabled")
 		return d.removeRules()
 	}
 }
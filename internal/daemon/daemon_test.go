@@ -0,0 +1,521 @@
+package daemon
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"focusd/internal/config"
+	"focusd/internal/schedule"
+	"focusd/internal/state"
+)
+
+// fakeVerifier is a keyVerifier with a fixed result
+type fakeVerifier struct {
+	err error
+}
+
+func (f fakeVerifier) Verify() error {
+	return f.err
+}
+
+func TestStartupEnabled(t *testing.T) {
+	tests := []struct {
+		name        string
+		requireKey  bool
+		persisted   bool
+		keyErr      error
+		wantEnabled bool
+		wantState   bool
+	}{
+		{
+			name:        "enabled state",
+			requireKey:  true,
+			persisted:   true,
+			keyErr:      errors.New("no key"),
+			wantEnabled: true,
+			wantState:   true,
+		},
+		{
+			name:        "disabled without requirement",
+			requireKey:  false,
+			persisted:   false,
+			keyErr:      errors.New("no key"),
+			wantEnabled: false,
+			wantState:   false,
+		},
+		{
+			name:        "disabled with key present",
+			requireKey:  true,
+			persisted:   false,
+			wantEnabled: false,
+			wantState:   false,
+		},
+		{
+			name:        "disabled with key absent",
+			requireKey:  true,
+			persisted:   false,
+			keyErr:      errors.New("no key"),
+			wantEnabled: true,
+			wantState:   true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			st := state.New(filepath.Join(t.TempDir(), "state"))
+			if err := st.SetEnabled(tt.persisted); err != nil {
+				t.Fatalf("SetEnabled() error = %v", err)
+			}
+
+			cfg := config.DefaultConfig()
+			cfg.RequireKeyToStartDisabled = tt.requireKey
+			d := &Daemon{
+				cfg:      cfg,
+				state:    st,
+				verifier: fakeVerifier{err: tt.keyErr},
+			}
+
+			got, err := d.startupEnabled()
+			if err != nil {
+				t.Fatalf("startupEnabled() error = %v", err)
+			}
+			if got != tt.wantEnabled {
+				t.Errorf("startupEnabled() = %v, want %v", got, tt.wantEnabled)
+			}
+
+			persisted, err := st.IsEnabled()
+			if err != nil {
+				t.Fatalf("IsEnabled() error = %v", err)
+			}
+			if persisted != tt.wantState {
+				t.Errorf("persisted state = %v, want %v", persisted, tt.wantState)
+			}
+		})
+	}
+}
+
+func TestResetRefreshTimer(t *testing.T) {
+	cfg := config.DefaultConfig()
+	d := &Daemon{cfg: cfg}
+	defer d.stopRefreshTimer()
+
+	steps := []struct {
+		name        string
+		minutes     int
+		wantChanged bool
+		wantEvery   time.Duration
+	}{
+		{name: "start hourly", minutes: 60, wantChanged: true, wantEvery: time.Hour},
+		{name: "unchanged", minutes: 60, wantChanged: false, wantEvery: time.Hour},
+		{name: "interval changed", minutes: 15, wantChanged: true, wantEvery: 15 * time.Minute},
+		{name: "manual", minutes: 0, wantChanged: true, wantEvery: 0},
+		{name: "still manual", minutes: 0, wantChanged: false, wantEvery: 0},
+	}
+	for _, step := range steps {
+		cfg.RefreshIntervalMinutes = step.minutes
+		if changed := d.resetRefreshTimer(); changed != step.wantChanged {
+			t.Errorf("%s: resetRefreshTimer() = %v, want %v", step.name, changed, step.wantChanged)
+		}
+		if d.refreshEvery != step.wantEvery || (d.refresh != nil) != (step.wantEvery > 0) {
+			t.Errorf("%s: timer %v every %v, want every %v", step.name, d.refresh, d.refreshEvery, step.wantEvery)
+		}
+		if (d.refreshC() != nil) != (step.wantEvery > 0) {
+			t.Errorf("%s: refreshC() = %v", step.name, d.refreshC())
+		}
+	}
+}
+
+func TestResetKeyPoll(t *testing.T) {
+	cfg := config.DefaultConfig()
+	d := &Daemon{cfg: cfg, verifier: fakeVerifier{}}
+	defer d.keyPoll.stop()
+
+	steps := []struct {
+		name      string
+		require   bool
+		seconds   int
+		wantEvery time.Duration
+	}{
+		{name: "off", require: false, seconds: 5, wantEvery: 0},
+		{name: "started by reload", require: true, seconds: 5, wantEvery: 5 * time.Second},
+		{name: "interval changed", require: true, seconds: 2, wantEvery: 2 * time.Second},
+		{name: "stopped by reload", require: false, seconds: 2, wantEvery: 0},
+	}
+	for _, step := range steps {
+		cfg.RequireKeyWhileDisabled = step.require
+		cfg.KeyPollIntervalSeconds = step.seconds
+		d.resetKeyPoll()
+		if d.keyPoll.every != step.wantEvery || (d.keyPoll.C() != nil) != (step.wantEvery > 0) {
+			t.Errorf("%s: polling every %v (channel %v), want every %v", step.name, d.keyPoll.every, d.keyPoll.C(), step.wantEvery)
+		}
+	}
+	if !d.keyPresent {
+		t.Error("keyPresent = false after polling started with the key present")
+	}
+}
+
+func TestRetryDelay(t *testing.T) {
+	base := 10 * time.Second
+	for attempt, want := range []time.Duration{10 * time.Second, 20 * time.Second, 40 * time.Second} {
+		for range 20 {
+			if got := retryDelay(base, attempt); got < want*3/4 || got > want*5/4 {
+				t.Fatalf("retryDelay(%v, %d) = %v, want %v give or take a quarter", base, attempt, got, want)
+			}
+		}
+	}
+}
+
+func TestJitter(t *testing.T) {
+	if got := jitter(time.Hour, 0); got != time.Hour {
+		t.Errorf("jitter(1h, 0) = %v, want 1h", got)
+	}
+	for range 100 {
+		if got := jitter(time.Hour, 10); got < 54*time.Minute || got > 66*time.Minute {
+			t.Fatalf("jitter(1h, 10) = %v, want within 54m-66m", got)
+		}
+	}
+}
+
+func TestReloadInvalidConfigKeepsPrevious(t *testing.T) {
+	dir := t.TempDir()
+	configPath := filepath.Join(dir, "config.yaml")
+	if err := os.WriteFile(configPath, []byte("refreshIntervalMinutes: -1\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := config.DefaultConfig()
+	d := &Daemon{
+		cfg:        cfg,
+		configPath: configPath,
+		state:      state.New(filepath.Join(dir, "state")),
+	}
+
+	if err := d.reload(); err == nil {
+		t.Fatal("reload() expected error, got nil")
+	}
+	if d.cfg != cfg {
+		t.Error("reload() replaced config despite validation error")
+	}
+	if d.ReloadError() == nil {
+		t.Error("ReloadError() = nil, want error")
+	}
+}
+
+func TestStageConfig(t *testing.T) {
+	dir := t.TempDir()
+	configPath := filepath.Join(dir, "config.yaml")
+	contents := "refreshIntervalMinutes: 15\nblockedDomains:\n  - example.com\n"
+	if err := os.WriteFile(configPath, []byte(contents), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	d := &Daemon{cfg: config.DefaultConfig(), configPath: configPath}
+	staged, err := d.stageConfig()
+	if err != nil {
+		t.Fatalf("stageConfig() error = %v", err)
+	}
+	if staged.cfg.RefreshIntervalMinutes != 15 {
+		t.Errorf("RefreshIntervalMinutes = %d, want 15", staged.cfg.RefreshIntervalMinutes)
+	}
+	if len(staged.domains) != 1 || staged.domains[0] != "example.com" {
+		t.Errorf("domains = %v, want [example.com]", staged.domains)
+	}
+	if d.cfg.RefreshIntervalMinutes != 60 {
+		t.Error("stageConfig() modified the running config")
+	}
+}
+
+func TestReleaseDNSFiles(t *testing.T) {
+	dir := t.TempDir()
+	reloaded := filepath.Join(dir, "reloaded")
+
+	cfg := config.DefaultConfig()
+	cfg.DnsmasqConfigPath = filepath.Join(dir, "old.conf")
+	cfg.DnsmasqReloadCommand = []string{"touch", reloaded}
+	cfg.HostsFilePath = filepath.Join(dir, "hosts")
+	d := &Daemon{cfg: cfg, dnsMgr: newDNSManager(cfg), hostsMgr: newHostsFile(cfg)}
+	if _, err := d.dnsMgr.Sync([]string{"example.com"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.hostsMgr.ApplyRules([]string{"example.com"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Unchanged paths are left alone
+	d.releaseDNSFiles(cfg)
+	if _, err := os.Stat(cfg.DnsmasqConfigPath); err != nil {
+		t.Fatalf("dnsmasq config removed with an unchanged path: %v", err)
+	}
+
+	moved := *cfg
+	moved.DnsmasqConfigPath = filepath.Join(dir, "new.conf")
+	moved.HostsFilePath = filepath.Join(dir, "hosts.new")
+	d.releaseDNSFiles(&moved)
+
+	if _, err := os.Stat(cfg.DnsmasqConfigPath); !os.IsNotExist(err) {
+		t.Errorf("previous dnsmasq config still present: %v", err)
+	}
+	if _, err := os.Stat(reloaded); err != nil {
+		t.Errorf("dnsmasq not reloaded after removing its config: %v", err)
+	}
+	hosts, err := os.ReadFile(cfg.HostsFilePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(hosts), "example.com") {
+		t.Errorf("previous hosts file still blocks: %q", hosts)
+	}
+}
+
+// switchVerifier is a keyVerifier whose result can be changed between calls
+type switchVerifier struct {
+	err error
+}
+
+func (s *switchVerifier) Verify() error {
+	return s.err
+}
+
+func TestCheckKeyPresence(t *testing.T) {
+	st := state.New(filepath.Join(t.TempDir(), "state"))
+	if err := st.SetEnabled(false); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := config.DefaultConfig()
+	cfg.RequireKeyWhileDisabled = true
+	key := &switchVerifier{}
+	d := &Daemon{cfg: cfg, state: st, verifier: key}
+
+	// Key present while disabled: stay disabled
+	reenabled, err := d.checkKeyPresence()
+	if err != nil || reenabled {
+		t.Fatalf("checkKeyPresence() with key = %v, %v, want false, nil", reenabled, err)
+	}
+	if !d.keyPresent {
+		t.Error("keyPresent = false after poll with key inserted")
+	}
+
+	// Key removed: blocking comes back on
+	key.err = errors.New("no key")
+	reenabled, err = d.checkKeyPresence()
+	if err != nil || !reenabled {
+		t.Fatalf("checkKeyPresence() after removal = %v, %v, want true, nil", reenabled, err)
+	}
+	if d.keyPresent {
+		t.Error("keyPresent = true after removal")
+	}
+	if enabled, _ := st.IsEnabled(); !enabled {
+		t.Error("state still disabled after key removal")
+	}
+
+	// Already enabled: nothing more to do, even without the key
+	reenabled, err = d.checkKeyPresence()
+	if err != nil || reenabled {
+		t.Errorf("checkKeyPresence() while enabled = %v, %v, want false, nil", reenabled, err)
+	}
+}
+
+func TestWantBlocking(t *testing.T) {
+	// 2026-01-05 is a Monday
+	inside := time.Date(2026, 1, 5, 10, 0, 0, 0, time.UTC)
+	outside := time.Date(2026, 1, 5, 18, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name    string
+		enabled bool
+		now     time.Time
+		want    bool
+	}{
+		{name: "enabled outside schedule", enabled: true, now: outside, want: true},
+		{name: "disabled inside schedule", enabled: false, now: inside, want: true},
+		{name: "disabled outside schedule", enabled: false, now: outside, want: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			st := state.New(filepath.Join(t.TempDir(), "state"))
+			if err := st.SetEnabled(tt.enabled); err != nil {
+				t.Fatal(err)
+			}
+
+			cfg := config.DefaultConfig()
+			cfg.Schedules = []schedule.Entry{{Days: []string{"Mon"}, Start: "09:00", End: "17:00", Timezone: "UTC"}}
+			d := &Daemon{cfg: cfg, state: st}
+
+			got, err := d.wantBlocking(tt.now)
+			if err != nil {
+				t.Fatalf("wantBlocking() error = %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("wantBlocking() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestExpireSnooze(t *testing.T) {
+	st := state.New(filepath.Join(t.TempDir(), "state"))
+	until := time.Now().Add(15 * time.Minute)
+	if err := st.Snooze(until); err != nil {
+		t.Fatal(err)
+	}
+	d := &Daemon{cfg: config.DefaultConfig(), state: st}
+
+	// Before the deadline the snooze holds
+	if err := d.expireSnooze(until.Add(-time.Minute)); err != nil {
+		t.Fatalf("expireSnooze() error = %v", err)
+	}
+	if enabled, _ := st.IsEnabled(); enabled {
+		t.Fatal("state enabled before snooze deadline")
+	}
+
+	// After it, blocking is re-enabled and the snooze forgotten
+	if err := d.expireSnooze(until.Add(time.Second)); err != nil {
+		t.Fatalf("expireSnooze() error = %v", err)
+	}
+	if enabled, _ := st.IsEnabled(); !enabled {
+		t.Error("state still disabled after snooze deadline")
+	}
+	if snoozed, err := st.SnoozedUntil(); err != nil || !snoozed.IsZero() {
+		t.Errorf("SnoozedUntil() = %v, %v, want zero time", snoozed, err)
+	}
+
+	// A plain disable has no deadline and is left alone
+	if err := st.SetEnabled(false); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.expireSnooze(until.Add(time.Hour)); err != nil {
+		t.Fatalf("expireSnooze() error = %v", err)
+	}
+	if enabled, _ := st.IsEnabled(); enabled {
+		t.Error("plain disable re-enabled by expireSnooze()")
+	}
+}
+
+func TestTamperedDisableDuringCommitment(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state")
+	st := state.New(path)
+	if err := st.SetEnabled(true); err != nil {
+		t.Fatal(err)
+	}
+	until := time.Now().Add(time.Hour)
+	if err := st.CommitUntil(until); err != nil {
+		t.Fatal(err)
+	}
+
+	d := &Daemon{cfg: config.DefaultConfig(), state: st}
+	if enabled, err := d.isEnabled(time.Now()); err != nil || !enabled {
+		t.Fatalf("isEnabled() = %v, %v, want true, nil", enabled, err)
+	}
+
+	// Overwriting the file in the old format drops the deadline from it,
+	// but the daemon has already seen the commitment
+	if err := os.WriteFile(path, []byte("disabled\n"), 0o640); err != nil {
+		t.Fatal(err)
+	}
+	if enabled, err := d.isEnabled(time.Now()); err != nil || !enabled {
+		t.Fatalf("isEnabled() after tampering = %v, %v, want true, nil", enabled, err)
+	}
+	if enabled, _ := st.IsEnabled(); !enabled {
+		t.Error("state file not re-enabled")
+	}
+	if restored, _ := st.CommittedUntil(); restored.Before(until.Add(-time.Second)) {
+		t.Errorf("CommittedUntil() = %v, want the commitment restored to %v", restored, until)
+	}
+
+	// Once the commitment is over, a disable is honoured
+	if err := os.WriteFile(path, []byte(`{"enabled":false}`), 0o640); err != nil {
+		t.Fatal(err)
+	}
+	if enabled, err := d.isEnabled(until.Add(time.Hour)); err != nil || enabled {
+		t.Errorf("isEnabled() after the commitment = %v, %v, want false, nil", enabled, err)
+	}
+}
+
+func TestCommitmentRefusesKeyedDisable(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state")
+	st := state.New(path)
+	if err := st.SetEnabled(true); err != nil {
+		t.Fatal(err)
+	}
+	if err := st.CommitUntil(time.Now().Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+
+	// The key is present, but the commitment still refuses the snooze
+	d := &Daemon{cfg: config.DefaultConfig(), state: st, verifier: fakeVerifier{}}
+	if _, err := d.controlSnooze([]string{"10m"}); !errors.Is(err, state.ErrCommitted) {
+		t.Fatalf("controlSnooze() error = %v, want %v", err, state.ErrCommitted)
+	}
+	if enabled, _ := st.IsEnabled(); !enabled {
+		t.Error("state disabled during a commitment")
+	}
+
+	// The emergency path: root stops the daemon and rewrites the state
+	// file, and the daemon started afterwards honours it
+	if err := os.WriteFile(path, []byte(`{"enabled":false}`), 0o640); err != nil {
+		t.Fatal(err)
+	}
+	restarted := &Daemon{cfg: config.DefaultConfig(), state: state.New(path)}
+	if enabled, err := restarted.isEnabled(time.Now()); err != nil || enabled {
+		t.Errorf("isEnabled() after the emergency path = %v, %v, want false, nil", enabled, err)
+	}
+}
+
+func TestControlStatusJSON(t *testing.T) {
+	st := state.New(filepath.Join(t.TempDir(), "state"))
+	if err := st.SetEnabled(true); err != nil {
+		t.Fatal(err)
+	}
+	refreshed := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	next := refreshed.Add(57 * time.Minute)
+	d := &Daemon{
+		cfg:            config.DefaultConfig(),
+		state:          st,
+		blocking:       true,
+		blockedDomains: 3,
+		resolvedIPs:    []net.IP{net.ParseIP("192.0.2.1"), net.ParseIP("192.0.2.2")},
+		lastRefresh:    refreshed,
+		nextRefresh:    next,
+		startedAt:      time.Now().Add(-time.Hour),
+		reloadErr:      errors.New("bad config"),
+	}
+
+	output, err := d.controlStatus([]string{"json"})
+	if err != nil {
+		t.Fatalf("controlStatus() error = %v", err)
+	}
+	var got Status
+	if err := json.Unmarshal([]byte(output), &got); err != nil {
+		t.Fatalf("decoding %q: %v", output, err)
+	}
+	if got.State != "enabled" || !got.Blocking || got.ProxyRunning {
+		t.Errorf("state = %q, blocking = %v, proxy running = %v", got.State, got.Blocking, got.ProxyRunning)
+	}
+	if got.UptimeSeconds < 3600 || got.UptimeSeconds > 3700 {
+		t.Errorf("uptimeSeconds = %d, want about an hour", got.UptimeSeconds)
+	}
+	if got.BlockedDomains != 3 || got.BlockedAddresses != 2 {
+		t.Errorf("blocked = %d domains, %d addresses, want 3, 2", got.BlockedDomains, got.BlockedAddresses)
+	}
+	if got.LastRefresh == nil || !got.LastRefresh.Equal(refreshed) {
+		t.Errorf("lastRefresh = %v, want %v", got.LastRefresh, refreshed)
+	}
+	if got.NextRefresh == nil || !got.NextRefresh.Equal(next) {
+		t.Errorf("nextRefresh = %v, want %v", got.NextRefresh, next)
+	}
+	if got.LastReloadError != "bad config" {
+		t.Errorf("lastReloadError = %q", got.LastReloadError)
+	}
+
+	if _, err := d.controlStatus([]string{"yaml"}); err == nil {
+		t.Error("controlStatus(yaml) succeeded, want a usage error")
+	}
+}
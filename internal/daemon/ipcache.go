@@ -0,0 +1,77 @@
+package daemon
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"time"
+)
+
+// ipCache is the last resolved blocked IP set as written to disk
+type ipCache struct {
+	ResolvedAt time.Time `json:"resolvedAt"`
+	IPs        []string  `json:"ips"`
+}
+
+// saveIPCache writes the last resolved IPs to the IP cache, if enabled
+func (d *Daemon) saveIPCache() {
+	if d.cfg.IPCachePath == "" {
+		return
+	}
+	cache := ipCache{ResolvedAt: d.lastRefresh, IPs: make([]string, 0, len(d.resolvedIPs))}
+	for _, ip := range d.resolvedIPs {
+		cache.IPs = append(cache.IPs, ip.String())
+	}
+	data, err := json.Marshal(cache)
+	if err == nil {
+		err = writeStateFile(d.cfg.IPCachePath, data)
+	}
+	if err != nil {
+		slog.Warn("Error writing IP cache", "err", err)
+	}
+}
+
+// loadIPCache reads the IP cache into the last resolved IPs if it is
+// younger than IPCacheMaxAgeHours at now, and reports whether it was used
+func (d *Daemon) loadIPCache(now time.Time) bool {
+	if d.cfg.IPCachePath == "" {
+		return false
+	}
+	cache, err := readIPCache(d.cfg.IPCachePath)
+	if os.IsNotExist(err) {
+		return false
+	}
+	if err != nil {
+		slog.Warn("Ignoring IP cache", "err", err)
+		return false
+	}
+	if age := now.Sub(cache.ResolvedAt); age > time.Duration(d.cfg.IPCacheMaxAgeHours)*time.Hour {
+		slog.Info("Ignoring expired IP cache", "age", age.Round(time.Minute))
+		return false
+	}
+
+	ips := make([]net.IP, 0, len(cache.IPs))
+	for _, s := range cache.IPs {
+		if ip := net.ParseIP(s); ip != nil {
+			ips = append(ips, ip)
+		}
+	}
+	d.resolvedIPs, d.lastRefresh = ips, cache.ResolvedAt
+	slog.Info("Loaded cached IPs", "ips", len(ips), "resolved_at", cache.ResolvedAt.Format(time.RFC3339))
+	return true
+}
+
+// readIPCache reads and parses the IP cache at path
+func readIPCache(path string) (*ipCache, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var cache ipCache
+	if err := json.Unmarshal(data, &cache); err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", path, err)
+	}
+	return &cache, nil
+}
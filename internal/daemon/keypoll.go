@@ -0,0 +1,68 @@
+package daemon
+
+import (
+	"fmt"
+	"log/slog"
+	"time"
+)
+
+// resetKeyPoll starts, retunes or stops USB key polling to match the
+// config; it only runs with RequireKeyWhileDisabled set
+func (d *Daemon) resetKeyPoll() {
+	var interval time.Duration
+	if d.cfg.RequireKeyWhileDisabled {
+		interval = time.Duration(d.cfg.KeyPollIntervalSeconds) * time.Second
+	}
+	if !d.keyPoll.reset(interval) {
+		return
+	}
+	if interval > 0 {
+		d.keyPresent = d.verifier.Verify() == nil
+		slog.Info("Polling USB key; removing it while disabled re-enables blocking", "interval", interval)
+	} else {
+		slog.Info("Stopped polling USB key")
+	}
+}
+
+// pollKey re-applies blocking if the USB key was removed while disabled
+func (d *Daemon) pollKey() {
+	reenabled, err := d.checkKeyPresence()
+	if err != nil {
+		slog.Error("Error checking USB key presence", "err", err)
+		return
+	}
+	if reenabled {
+		if err := d.applyRules(); err != nil {
+			slog.Error("Error re-applying rules", "err", err)
+		}
+	}
+}
+
+// checkKeyPresence records whether the USB key is present, logging
+// transitions. If blocking is disabled and the key is absent, the persisted
+// state is switched back to enabled and true is returned.
+func (d *Daemon) checkKeyPresence() (bool, error) {
+	present := d.verifier.Verify() == nil
+	if present != d.keyPresent {
+		if present {
+			slog.Info("USB key inserted")
+		} else {
+			slog.Info("USB key removed")
+		}
+		d.keyPresent = present
+	}
+
+	enabled, err := d.isEnabled(time.Now())
+	if err != nil {
+		return false, fmt.Errorf("checking state: %w", err)
+	}
+	if enabled || present {
+		return false, nil
+	}
+
+	slog.Warn("Blocking is disabled but the USB key is absent, re-enabling blocking")
+	if err := d.state.SetEnabledBecause(true, "USB key absent while disabled"); err != nil {
+		return false, fmt.Errorf("re-enabling state: %w", err)
+	}
+	return true, nil
+}
@@ -0,0 +1,53 @@
+package daemon
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// sdNotify sends a state update to systemd over the NOTIFY_SOCKET datagram
+// protocol (see sd_notify(3)). Without NOTIFY_SOCKET, e.g. when not started
+// by a Type=notify unit, it does nothing.
+func sdNotify(state string) error {
+	path := os.Getenv("NOTIFY_SOCKET")
+	if path == "" {
+		return nil
+	}
+	// A leading @ names a socket in the abstract namespace
+	if strings.HasPrefix(path, "@") {
+		path = "\x00" + path[1:]
+	}
+
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		return fmt.Errorf("connecting to systemd notify socket: %w", err)
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte(state)); err != nil {
+		return fmt.Errorf("notifying systemd: %w", err)
+	}
+	return nil
+}
+
+// notifySystemd reports a state change to systemd, logging failures: the
+// daemon works the same whether or not systemd hears about it
+func notifySystemd(state string) {
+	if err := sdNotify(state); err != nil {
+		slog.Warn("Error notifying systemd", "state", state, "err", err)
+	}
+}
+
+// reloadingState is the notification sent when a reload starts. systemd
+// (Type=notify-reload) expects the monotonic time the reload began with it.
+func reloadingState() string {
+	var ts unix.Timespec
+	if err := unix.ClockGettime(unix.CLOCK_MONOTONIC, &ts); err != nil {
+		return "RELOADING=1"
+	}
+	return fmt.Sprintf("RELOADING=1\nMONOTONIC_USEC=%d", ts.Nano()/1000)
+}
@@ -0,0 +1,41 @@
+package daemon
+
+import (
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSdNotify(t *testing.T) {
+	t.Setenv("NOTIFY_SOCKET", "")
+	if err := sdNotify("READY=1"); err != nil {
+		t.Fatalf("sdNotify() without NOTIFY_SOCKET error = %v", err)
+	}
+
+	path := filepath.Join(t.TempDir(), "notify.sock")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	t.Setenv("NOTIFY_SOCKET", path)
+
+	for _, state := range []string{"READY=1", reloadingState(), "STOPPING=1"} {
+		if err := sdNotify(state); err != nil {
+			t.Fatalf("sdNotify(%q) error = %v", state, err)
+		}
+		buf := make([]byte, 256)
+		n, err := conn.Read(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := string(buf[:n]); got != state {
+			t.Errorf("received %q, want %q", got, state)
+		}
+	}
+
+	if state := reloadingState(); !strings.HasPrefix(state, "RELOADING=1\nMONOTONIC_USEC=") {
+		t.Errorf("reloadingState() = %q", state)
+	}
+}
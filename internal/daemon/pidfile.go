@@ -0,0 +1,120 @@
+package daemon
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"focusd/internal/control"
+	"golang.org/x/sys/unix"
+)
+
+// ErrAlreadyRunning is returned when another daemon holds the PID file lock
+var ErrAlreadyRunning = errors.New("another focusd daemon is already running")
+
+// pidFile is a PID file locked for as long as the daemon runs
+type pidFile struct {
+	path string
+	file *os.File
+}
+
+// lockPIDFile locks the PID file at path, creating it if needed, and writes
+// the current PID to it. A file left by a daemon that crashed is taken
+// over: the kernel drops a lock when its holder dies.
+func lockPIDFile(path string) (*pidFile, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return nil, fmt.Errorf("creating PID file directory: %w", err)
+	}
+	for {
+		f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0o644)
+		if err != nil {
+			return nil, fmt.Errorf("opening PID file: %w", err)
+		}
+		if err := unix.Flock(int(f.Fd()), unix.LOCK_EX|unix.LOCK_NB); err != nil {
+			f.Close()
+			if !errors.Is(err, unix.EWOULDBLOCK) {
+				return nil, fmt.Errorf("locking PID file: %w", err)
+			}
+			if pid, err := ReadPID(path); err == nil {
+				return nil, fmt.Errorf("%w (pid %d)", ErrAlreadyRunning, pid)
+			}
+			return nil, ErrAlreadyRunning
+		}
+
+		// A daemon that was exiting may have removed the file between the
+		// open and the lock; lock the one now at path instead
+		opened, err := f.Stat()
+		if err != nil {
+			f.Close()
+			return nil, fmt.Errorf("checking PID file: %w", err)
+		}
+		if current, err := os.Stat(path); err != nil || !os.SameFile(opened, current) {
+			f.Close()
+			continue
+		}
+
+		if err := writePID(f); err != nil {
+			f.Close()
+			return nil, fmt.Errorf("writing PID file: %w", err)
+		}
+		return &pidFile{path: path, file: f}, nil
+	}
+}
+
+// writePID replaces the contents of f with the current PID
+func writePID(f *os.File) error {
+	if err := f.Truncate(0); err != nil {
+		return err
+	}
+	if _, err := f.WriteAt([]byte(strconv.Itoa(os.Getpid())+"\n"), 0); err != nil {
+		return err
+	}
+	return f.Sync()
+}
+
+// release removes the PID file and drops the lock. The file is removed
+// first so that a daemon starting meanwhile never locks a file on its way
+// out.
+func (p *pidFile) release() error {
+	err := os.Remove(p.path)
+	if closeErr := p.file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// ReadPID returns the PID of the daemon holding the PID file at path. If
+// the file is missing, or nobody holds its lock because the daemon that
+// wrote it crashed, control.ErrDaemonNotRunning is returned.
+func ReadPID(path string) (int, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return 0, control.ErrDaemonNotRunning
+	}
+	if err != nil {
+		return 0, fmt.Errorf("opening PID file: %w", err)
+	}
+	defer f.Close()
+
+	// Taking a shared lock only succeeds if no daemon holds the file
+	switch err := unix.Flock(int(f.Fd()), unix.LOCK_SH|unix.LOCK_NB); {
+	case err == nil:
+		return 0, control.ErrDaemonNotRunning
+	case !errors.Is(err, unix.EWOULDBLOCK):
+		return 0, fmt.Errorf("checking PID file lock: %w", err)
+	}
+
+	data, err := io.ReadAll(f)
+	if err != nil {
+		return 0, fmt.Errorf("reading PID file: %w", err)
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil || pid <= 0 {
+		return 0, fmt.Errorf("PID file %s does not hold a PID", path)
+	}
+	return pid, nil
+}
@@ -0,0 +1,31 @@
+package daemon
+
+import (
+	"focusd/internal/nft"
+	"focusd/internal/proxy"
+)
+
+// Check is the result of one environment preflight check
+type Check struct {
+	Name string
+	Err  error
+}
+
+// Preflight runs the environment checks the daemon depends on
+func Preflight() []Check {
+	return []Check{
+		{Name: "nftables netlink", Err: nft.Preflight()},
+		{Name: "nft and ip commands", Err: nft.CheckCommands()},
+		{Name: "transparent proxy sockets", Err: proxy.Preflight()},
+	}
+}
+
+// preflight returns the first failed environment check, if any
+func preflight() error {
+	for _, check := range Preflight() {
+		if check.Err != nil {
+			return check.Err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,123 @@
+package daemon
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"time"
+
+	"focusd/internal/atomicfile"
+	"focusd/internal/metrics"
+)
+
+// runtimeState is the daemon state handed from a stopping process to its
+// replacement, so an in-place upgrade doesn't lose stats or enforcement.
+// Enabled/disabled state, session overrides, budgets and the resolved IPs
+// (see ipCache) have their own files; this covers what otherwise only lives
+// in memory.
+type runtimeState struct {
+	SavedAt time.Time `json:"savedAt"`
+
+	// CommittedUntil is the latest commitment deadline the daemon has seen,
+	// so a state file edited while the daemon was restarting can't end it
+	CommittedUntil time.Time `json:"committedUntil,omitempty"`
+
+	// Counters are metric counter values by metric name and label set
+	Counters map[string]map[string]float64 `json:"counters,omitempty"`
+}
+
+// loadRuntimeState reads a runtime state file. A missing file returns an
+// empty state and no error.
+func loadRuntimeState(path string) (*runtimeState, error) {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return &runtimeState{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var rs runtimeState
+	if err := json.Unmarshal(data, &rs); err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", path, err)
+	}
+	return &rs, nil
+}
+
+// save atomically writes the runtime state to path
+func (rs *runtimeState) save(path string) error {
+	data, err := json.MarshalIndent(rs, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return writeStateFile(path, data)
+}
+
+// writeStateFile atomically replaces the file at path with data, creating
+// its directory if needed
+func writeStateFile(path string, data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0o750); err != nil {
+		return fmt.Errorf("creating state directory: %w", err)
+	}
+	if err := atomicfile.Write(path, data, 0o640); err != nil {
+		return fmt.Errorf("writing %s: %w", path, err)
+	}
+	return nil
+}
+
+// saveRuntimeState persists the daemon's in-memory state at clean shutdown
+func (d *Daemon) saveRuntimeState() {
+	if d.proxy != nil {
+		if err := d.proxy.SaveState(); err != nil {
+			slog.Warn("Error saving proxy state", "err", err)
+		}
+	}
+
+	if err := d.blockStats.Flush(); err != nil {
+		slog.Warn("Error flushing block statistics", "err", err)
+	}
+
+	if d.cfg.RuntimeStatePath == "" {
+		return
+	}
+
+	rs := &runtimeState{
+		SavedAt:        time.Now(),
+		CommittedUntil: d.committedUntil,
+		Counters:       metrics.Snapshot(),
+	}
+	if err := rs.save(d.cfg.RuntimeStatePath); err != nil {
+		slog.Warn("Error saving runtime state", "err", err)
+		return
+	}
+	slog.Info("Runtime state saved", "path", d.cfg.RuntimeStatePath)
+}
+
+// restoreRuntimeState loads state saved by a previous process. The file is
+// removed afterwards so a later crash doesn't restore stale counters twice.
+func (d *Daemon) restoreRuntimeState() {
+	path := d.cfg.RuntimeStatePath
+	if path == "" {
+		return
+	}
+
+	rs, err := loadRuntimeState(path)
+	if err != nil {
+		slog.Warn("Ignoring runtime state", "err", err)
+		return
+	}
+	if rs.SavedAt.IsZero() {
+		return
+	}
+
+	d.committedUntil = rs.CommittedUntil
+	metrics.Restore(rs.Counters)
+
+	if err := os.Remove(path); err != nil {
+		slog.Warn("Error removing runtime state", "err", err)
+	}
+	slog.Info("Restored runtime state", "saved_at", rs.SavedAt.Format(time.RFC3339))
+}
@@ -0,0 +1,132 @@
+package daemon
+
+import (
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"focusd/internal/config"
+	"focusd/internal/control"
+)
+
+func TestRuntimeStateRoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state", "runtime.json")
+
+	want := &runtimeState{
+		SavedAt:        time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC),
+		CommittedUntil: time.Date(2026, 3, 1, 18, 0, 0, 0, time.UTC),
+		Counters: map[string]map[string]float64{
+			"focusd_proxy_connections_total": {`{protocol="https",verdict="blocked"}`: 42},
+		},
+	}
+	if err := want.save(path); err != nil {
+		t.Fatalf("save() error = %v", err)
+	}
+
+	got, err := loadRuntimeState(path)
+	if err != nil {
+		t.Fatalf("loadRuntimeState() error = %v", err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("loadRuntimeState() = %+v, want %+v", got, want)
+	}
+}
+
+func TestRestoreRuntimeState(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "runtime.json")
+
+	saved := &Daemon{cfg: &config.Config{RuntimeStatePath: path}}
+	saved.committedUntil = time.Now().Add(time.Hour)
+	saved.saveRuntimeState()
+
+	restored := &Daemon{cfg: &config.Config{RuntimeStatePath: path}}
+	restored.restoreRuntimeState()
+
+	if !restored.committedUntil.Equal(saved.committedUntil) {
+		t.Errorf("restored committedUntil = %v, want %v", restored.committedUntil, saved.committedUntil)
+	}
+
+	// The state is consumed so it isn't restored twice
+	again, err := loadRuntimeState(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !again.SavedAt.IsZero() {
+		t.Error("runtime state file still present after restore")
+	}
+}
+
+func TestPIDFileLock(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "focusd.pid")
+
+	if _, err := ReadPID(path); !errors.Is(err, control.ErrDaemonNotRunning) {
+		t.Fatalf("ReadPID() without a PID file error = %v, want %v", err, control.ErrDaemonNotRunning)
+	}
+
+	// A file left by a crashed daemon isn't locked and is taken over
+	if err := os.WriteFile(path, []byte("999999\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ReadPID(path); !errors.Is(err, control.ErrDaemonNotRunning) {
+		t.Fatalf("ReadPID() of a stale PID file error = %v, want %v", err, control.ErrDaemonNotRunning)
+	}
+	pid, err := lockPIDFile(path)
+	if err != nil {
+		t.Fatalf("lockPIDFile() error = %v", err)
+	}
+	if got, err := ReadPID(path); err != nil || got != os.Getpid() {
+		t.Errorf("ReadPID() = %d, %v, want %d", got, err, os.Getpid())
+	}
+
+	if _, err := lockPIDFile(path); !errors.Is(err, ErrAlreadyRunning) {
+		t.Errorf("second lockPIDFile() error = %v, want %v", err, ErrAlreadyRunning)
+	}
+
+	if err := pid.release(); err != nil {
+		t.Fatalf("release() error = %v", err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("PID file still exists after release: %v", err)
+	}
+}
+
+func TestIPCache(t *testing.T) {
+	cfg := &config.Config{IPCachePath: filepath.Join(t.TempDir(), "ips.json"), IPCacheMaxAgeHours: 24}
+	want := []net.IP{net.ParseIP("192.0.2.1"), net.ParseIP("2001:db8::1")}
+
+	saved := &Daemon{cfg: cfg}
+	saved.recordResolved(want)
+
+	tests := []struct {
+		name     string
+		now      time.Time
+		wantUsed bool
+	}{
+		{name: "fresh", now: saved.lastRefresh.Add(time.Hour), wantUsed: true},
+		{name: "expired", now: saved.lastRefresh.Add(25 * time.Hour), wantUsed: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			restored := &Daemon{cfg: cfg}
+			if used := restored.loadIPCache(tt.now); used != tt.wantUsed {
+				t.Fatalf("loadIPCache() = %v, want %v", used, tt.wantUsed)
+			}
+			if !tt.wantUsed {
+				if restored.resolvedIPs != nil {
+					t.Errorf("expired cache loaded %v", restored.resolvedIPs)
+				}
+				return
+			}
+			if !reflect.DeepEqual(restored.resolvedIPs, want) {
+				t.Errorf("resolvedIPs = %v, want %v", restored.resolvedIPs, want)
+			}
+			if !restored.lastRefresh.Equal(saved.lastRefresh) {
+				t.Errorf("lastRefresh = %v, want %v", restored.lastRefresh, saved.lastRefresh)
+			}
+		})
+	}
+}
@@ -0,0 +1,94 @@
+package daemon
+
+import (
+	"fmt"
+	"log/slog"
+	"time"
+)
+
+// scheduleActive reports whether a configured blocking schedule covers t
+func (d *Daemon) scheduleActive(t time.Time) bool {
+	sched, err := d.cfg.Schedule()
+	if err != nil {
+		slog.Warn("Ignoring invalid schedules", "err", err)
+		return false
+	}
+	return sched.Active(t)
+}
+
+// wantBlocking reports whether blocking should be applied now: when enabled,
+// or when disabled but inside a scheduled window
+func (d *Daemon) wantBlocking(now time.Time) (bool, error) {
+	enabled, err := d.isEnabled(now)
+	if err != nil {
+		return false, fmt.Errorf("checking state: %w", err)
+	}
+	return enabled || d.scheduleActive(now), nil
+}
+
+// isEnabled reads the persisted enabled state. The state file can only say
+// disabled during a commitment the daemon has already seen if it was edited
+// by hand, so such a disable is reverted rather than applied.
+func (d *Daemon) isEnabled(now time.Time) (bool, error) {
+	enabled, err := d.state.IsEnabled()
+	if err != nil {
+		return false, err
+	}
+	until, err := d.state.CommittedUntil()
+	if err != nil {
+		return false, err
+	}
+	if until.After(d.committedUntil) {
+		d.committedUntil = until
+	}
+	if enabled || !now.Before(d.committedUntil) {
+		return enabled, nil
+	}
+
+	slog.Warn("State file was disabled during a commitment, re-enabling blocking",
+		"committed_until", d.committedUntil.Local().Format(time.DateTime))
+	if err := d.state.SetEnabledBecause(true, "state file edited during a commitment"); err != nil {
+		return false, fmt.Errorf("re-enabling state: %w", err)
+	}
+	if err := d.state.CommitUntil(d.committedUntil); err != nil {
+		return false, fmt.Errorf("restoring commitment: %w", err)
+	}
+	return true, nil
+}
+
+// syncBlocking applies or removes rules if the desired blocking state has
+// changed, returning whether it did
+func (d *Daemon) syncBlocking() (bool, error) {
+	want, err := d.wantBlocking(time.Now())
+	if err != nil {
+		return false, err
+	}
+	if want == d.blocking {
+		return false, nil
+	}
+
+	if want {
+		slog.Info("Blocking is now required (enabled or inside a schedule), applying rules")
+		return true, d.applyRules()
+	}
+	slog.Info("Blocking is disabled and outside any schedule, removing rules")
+	return true, d.removeRules()
+}
+
+// expireSnooze re-enables blocking once a snooze deadline has passed. The
+// rules themselves are applied by the next syncBlocking.
+func (d *Daemon) expireSnooze(now time.Time) error {
+	until, err := d.state.SnoozedUntil()
+	if err != nil {
+		return err
+	}
+	if until.IsZero() || now.Before(until) {
+		return nil
+	}
+
+	slog.Info("Snooze ended, re-enabling blocking", "until", until.Local().Format(time.DateTime))
+	if err := d.state.SetEnabledBecause(true, "snooze ended"); err != nil {
+		return fmt.Errorf("re-enabling state: %w", err)
+	}
+	return d.state.ClearSnooze()
+}
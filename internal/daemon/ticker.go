@@ -0,0 +1,40 @@
+package daemon
+
+import "time"
+
+// ticker is a time.Ticker whose interval a reload can change. The zero
+// value is stopped.
+type ticker struct {
+	t     *time.Ticker
+	every time.Duration
+}
+
+// reset makes the ticker fire every interval, or stops it if interval is
+// 0, and reports whether that changed anything
+func (t *ticker) reset(interval time.Duration) bool {
+	if interval == t.every {
+		return false
+	}
+	t.stop()
+	if interval > 0 {
+		t.t, t.every = time.NewTicker(interval), interval
+	}
+	return true
+}
+
+// stop stops the ticker, if running
+func (t *ticker) stop() {
+	if t.t != nil {
+		t.t.Stop()
+	}
+	t.t, t.every = nil, 0
+}
+
+// C returns the ticker's channel, or nil (which blocks forever in a
+// select) while stopped
+func (t *ticker) C() <-chan time.Time {
+	if t.t == nil {
+		return nil
+	}
+	return t.t.C
+}
@@ -2,54 +2,239 @@ package dns
 
 import (
 	"fmt"
+	"log/slog"
+	"maps"
 	"os"
 	"path/filepath"
+	"regexp"
+	"slices"
 	"strings"
+	"syscall"
+
+	"focusd/internal/atomicfile"
+	"focusd/internal/matcher"
+)
+
+// BlockMode selects how blocked domains are answered
+type BlockMode string
+
+const (
+	// BlockModeSinkhole answers blocked domains with 0.0.0.0. Clients try to
+	// connect to the sinkhole address, which fails, but some apps retry or
+	// hang until a timeout.
+	BlockModeSinkhole BlockMode = "sinkhole"
+
+	// BlockModeNXDOMAIN answers blocked domains with NXDOMAIN, so clients
+	// fail fast with "host not found" and don't attempt a connection.
+	BlockModeNXDOMAIN BlockMode = "nxdomain"
 )
 
+// Config holds optional DNS manager settings
+type Config struct {
+	// Mode selects how blocked domains are answered (default: sinkhole)
+	Mode BlockMode
+
+	// AllowedDomains resolve normally even under a blocked parent domain
+	AllowedDomains []string
+
+	// ReloadCommand, if set, is run by Reload instead of sending dnsmasq
+	// SIGHUP (e.g. systemctl restart dnsmasq)
+	ReloadCommand []string
+
+	// PIDFile is where Reload looks for the dnsmasq PID
+	// (default: DefaultPIDFile)
+	PIDFile string
+}
+
+// hostnamePattern matches names that are safe to write into dnsmasq and
+// hosts files: labels of letters, digits, hyphens and underscores that
+// don't start or end with a hyphen, with an optional trailing dot
+var hostnamePattern = regexp.MustCompile(`^([A-Za-z0-9_]([A-Za-z0-9_-]{0,61}[A-Za-z0-9_])?\.)*[A-Za-z0-9_]([A-Za-z0-9_-]{0,61}[A-Za-z0-9_])?\.?$`)
+
+// validHostname reports whether name can be written into a generated file.
+// Anything else, such as an entry with a newline, could add directives of
+// its own.
+func validHostname(name string) bool {
+	return len(name) <= 254 && hostnamePattern.MatchString(name)
+}
+
 // Manager manages dnsmasq configuration for DNS-level blocking
 type Manager struct {
 	configPath string
+	mode       BlockMode
+	allowed    []string
+
+	reloadCommand []string
+	pidFile       string
+	kill          func(pid int, sig syscall.Signal) error
 }
 
 // New creates a new DNS Manager
-func New(configPath string) *Manager {
-	return &Manager{
-		configPath: configPath,
+func New(configPath string, cfg Config) *Manager {
+	mode := cfg.Mode
+	if mode == "" {
+		mode = BlockModeSinkhole
+	}
+	pidFile := cfg.PIDFile
+	if pidFile == "" {
+		pidFile = DefaultPIDFile
 	}
+	m := &Manager{
+		configPath:    configPath,
+		mode:          mode,
+		reloadCommand: cfg.ReloadCommand,
+		pidFile:       pidFile,
+		kill:          syscall.Kill,
+	}
+	for _, domain := range cfg.AllowedDomains {
+		if matcher.IsPattern(domain) {
+			// The proxy still honours the pattern; DNS can only forward
+			// whole domains
+			slog.Warn("Allowlist pattern can't be expressed in dnsmasq, skipping for DNS", "pattern", domain)
+			continue
+		}
+		if !validHostname(baseDomain(domain)) {
+			slog.Warn("Invalid allowlist entry, skipping for DNS", "entry", domain)
+			continue
+		}
+		m.allowed = append(m.allowed, baseDomain(domain))
+	}
+	return m
+}
+
+// baseDomain normalizes a list entry, dropping any *. prefix. A www. prefix
+// is kept: forwarding the bare domain for an allowed www.example.com would
+// unblock the whole of example.com.
+func baseDomain(domain string) string {
+	domain = strings.ToLower(strings.TrimSuffix(domain, "."))
+	return strings.TrimPrefix(domain, "*.")
+}
+
+// globSuffix returns the domain a glob of the form *.*.example.com blocks
+// in dnsmasq terms. The glob requires at least one label more than the
+// suffix, so the suffix itself is over-blocked, as with *.example.com.
+func globSuffix(pattern string) (string, bool) {
+	if strings.HasPrefix(pattern, matcher.RegexPrefix) {
+		return "", false
+	}
+	rest := strings.ToLower(strings.TrimSuffix(pattern, "."))
+	for {
+		next, ok := strings.CutPrefix(rest, "*.")
+		if !ok {
+			break
+		}
+		rest = next
+	}
+	if rest == "" || strings.Contains(rest, "*") {
+		return "", false
+	}
+	return rest, true
+}
+
+// directive returns the dnsmasq line that blocks domain and its subdomains
+func (m *Manager) directive(domain string) string {
+	if m.mode == BlockModeNXDOMAIN {
+		// An address directive without a target makes dnsmasq return NXDOMAIN
+		return fmt.Sprintf("address=/%s/\n", domain)
+	}
+	return fmt.Sprintf("address=/%s/0.0.0.0\n", domain)
 }
 
 // ApplyRules generates a dnsmasq configuration file that blocks the given domains
 // This includes wildcard blocking for all subdomains
 func (m *Manager) ApplyRules(domains []string) error {
+	_, err := m.Sync(domains)
+	return err
+}
+
+// Sync writes the dnsmasq configuration for domains like ApplyRules, but
+// leaves the file alone if it already has that content. It reports whether
+// the file changed, i.e. whether dnsmasq needs a reload.
+func (m *Manager) Sync(domains []string) (bool, error) {
+	config := m.render(domains)
+	if current, err := os.ReadFile(m.configPath); err == nil && string(current) == config {
+		return false, nil
+	}
+
 	// Ensure the directory exists
 	dir := filepath.Dir(m.configPath)
 	if err := os.MkdirAll(dir, 0o755); err != nil {
-		return fmt.Errorf("creating config directory: %w", err)
+		return false, fmt.Errorf("creating config directory: %w", err)
 	}
 
-	var sb strings.Builder
-	sb.WriteString("# focusd - DNS blocking configuration\n")
-	sb.WriteString("# Auto-generated - do not edit manually\n\n")
+	// Write the configuration file
+	if err := atomicfile.Write(m.configPath, []byte(config), 0o644); err != nil {
+		return false, fmt.Errorf("writing dnsmasq config: %w", err)
+	}
+	return true, nil
+}
+
+// render returns the dnsmasq configuration blocking domains. Names are
+// deduplicated case-insensitively and sorted, so the same blocklist always
+// renders the same file however it is ordered.
+func (m *Manager) render(domains []string) string {
+	blocked := make(map[string]bool)
+	block := func(name string) {
+		blocked[strings.ToLower(strings.TrimSuffix(name, "."))] = true
+	}
 
 	for _, domain := range domains {
+		// Allow wins ties, so an entry that is also allowed isn't blocked
+		if slices.Contains(m.allowed, baseDomain(domain)) {
+			continue
+		}
+
+		// dnsmasq matches whole domain suffixes only. A glob whose leading
+		// labels are all * (*.*.example.com) is still a suffix block; other
+		// patterns are left to the proxy and nftables.
+		if matcher.IsPattern(domain) {
+			if suffix, ok := globSuffix(domain); ok && validHostname(suffix) {
+				block(suffix)
+				continue
+			}
+			slog.Warn("Blocklist pattern can't be expressed in dnsmasq, skipping for DNS", "pattern", domain)
+			continue
+		}
+
+		if !validHostname(strings.TrimPrefix(domain, "*.")) {
+			slog.Warn("Invalid blocklist entry, skipping for DNS", "entry", domain)
+			continue
+		}
+
+		// Wildcard entries (*.ru) block the suffix and everything under it,
+		// which is exactly dnsmasq's /suffix/ semantics
+		if suffix, ok := strings.CutPrefix(domain, "*."); ok {
+			block(suffix)
+			continue
+		}
+
 		// Block the base domain
-		sb.WriteString(fmt.Sprintf("address=/%s/0.0.0.0\n", domain))
+		block(domain)
 
 		// Block all subdomains with wildcard
 		// Note: dnsmasq treats /domain.com/ as matching domain.com and all subdomains
-		// But we'll be explicit for clarity
-		if !strings.HasPrefix(domain, "www.") {
-			sb.WriteString(fmt.Sprintf("address=/www.%s/0.0.0.0\n", domain))
+		// But we'll be explicit for clarity. An explicit www. entry needs
+		// no second line.
+		if !strings.HasPrefix(strings.ToLower(domain), "www.") {
+			block("www." + domain)
 		}
 	}
 
-	// Write the configuration file
-	if err := os.WriteFile(m.configPath, []byte(sb.String()), 0o644); err != nil {
-		return fmt.Errorf("writing dnsmasq config: %w", err)
+	var sb strings.Builder
+	sb.WriteString("# focusd - DNS blocking configuration\n")
+	sb.WriteString("# Auto-generated - do not edit manually\n\n")
+	for _, name := range slices.Sorted(maps.Keys(blocked)) {
+		sb.WriteString(m.directive(name))
 	}
 
-	return nil
+	// Allowed domains are forwarded upstream. dnsmasq uses the most specific
+	// matching domain, so these override a blocked parent domain while a
+	// more specific blocked entry still wins.
+	for _, domain := range slices.Compact(slices.Sorted(slices.Values(m.allowed))) {
+		sb.WriteString(fmt.Sprintf("server=/%s/#\n", domain))
+	}
+
+	return sb.String()
 }
 
 // RemoveRules removes the dnsmasq configuration file
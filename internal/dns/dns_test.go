@@ -0,0 +1,462 @@
+package dns
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+)
+
+func TestApplyRulesAtomic(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "dnsmasq.conf")
+	m := New(path, Config{})
+
+	small := []string{"example.com"}
+	large := make([]string, 0, 2000)
+	for i := 0; i < 2000; i++ {
+		large = append(large, strings.Repeat("a", i%50+1)+".example.org")
+	}
+
+	if err := m.ApplyRules(small); err != nil {
+		t.Fatalf("ApplyRules() error = %v", err)
+	}
+	smallData, _ := os.ReadFile(path)
+	if err := m.ApplyRules(large); err != nil {
+		t.Fatalf("ApplyRules() error = %v", err)
+	}
+	largeData, _ := os.ReadFile(path)
+
+	// Readers must only ever observe one of the two complete files
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			data, err := os.ReadFile(path)
+			if err != nil {
+				t.Errorf("reading config: %v", err)
+				return
+			}
+			if string(data) != string(smallData) && string(data) != string(largeData) {
+				t.Errorf("observed partial config (%d bytes)", len(data))
+				return
+			}
+		}
+	}()
+
+	for i := 0; i < 50; i++ {
+		domains := small
+		if i%2 == 0 {
+			domains = large
+		}
+		if err := m.ApplyRules(domains); err != nil {
+			t.Fatalf("ApplyRules() error = %v", err)
+		}
+	}
+	close(stop)
+	wg.Wait()
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("expected only the config file in %s, found %d entries", dir, len(entries))
+	}
+}
+
+func TestApplyRulesReplacesFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dnsmasq.conf")
+	m := New(path, Config{})
+
+	if err := m.ApplyRules([]string{"example.com"}); err != nil {
+		t.Fatalf("ApplyRules() error = %v", err)
+	}
+	before, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := m.ApplyRules([]string{"example.org"}); err != nil {
+		t.Fatalf("ApplyRules() error = %v", err)
+	}
+	after, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A new file renamed into place, rather than the old one rewritten
+	// where dnsmasq could read it half-written
+	if os.SameFile(before, after) {
+		t.Error("ApplyRules() rewrote the config in place")
+	}
+	if after.Mode().Perm() != 0o644 {
+		t.Errorf("config mode = %v, want 0644", after.Mode().Perm())
+	}
+}
+
+func TestApplyRulesFailureLeavesTargetUntouched(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "dnsmasq.conf")
+
+	// A directory in place of the target makes the final rename fail
+	if err := os.Mkdir(path, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(path, "keep"), []byte("x"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := New(path, Config{}).ApplyRules([]string{"example.com"}); err == nil {
+		t.Fatal("ApplyRules() expected error, got nil")
+	}
+
+	if info, err := os.Stat(path); err != nil || !info.IsDir() {
+		t.Errorf("target was modified: %v", err)
+	}
+	entries, _ := os.ReadDir(dir)
+	if len(entries) != 1 {
+		t.Errorf("temp file was not cleaned up, found %d entries", len(entries))
+	}
+}
+
+func TestApplyRulesWildcard(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dnsmasq.conf")
+	if err := New(path, Config{}).ApplyRules([]string{"*.ru", "example.com"}); err != nil {
+		t.Fatalf("ApplyRules() error = %v", err)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := string(data)
+
+	for _, want := range []string{"address=/ru/0.0.0.0\n", "address=/example.com/0.0.0.0\n", "address=/www.example.com/0.0.0.0\n"} {
+		if !strings.Contains(got, want) {
+			t.Errorf("config missing %q:\n%s", want, got)
+		}
+	}
+	for _, unwanted := range []string{"*", "www.ru"} {
+		if strings.Contains(got, unwanted) {
+			t.Errorf("config unexpectedly contains %q:\n%s", unwanted, got)
+		}
+	}
+}
+
+func TestApplyRulesPatterns(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dnsmasq.conf")
+	domains := []string{"*.*.cdn.example.com", "ads-*.example.com", `re:^track\d+\.net$`, "example.org"}
+	if err := New(path, Config{}).ApplyRules(domains); err != nil {
+		t.Fatalf("ApplyRules() error = %v", err)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := string(data)
+
+	for _, want := range []string{"address=/cdn.example.com/0.0.0.0\n", "address=/example.org/0.0.0.0\n"} {
+		if !strings.Contains(got, want) {
+			t.Errorf("config missing %q:\n%s", want, got)
+		}
+	}
+	// Patterns dnsmasq can't express are skipped rather than mistranslated
+	for _, unwanted := range []string{"*", "ads", "track", "re:"} {
+		if strings.Contains(got, unwanted) {
+			t.Errorf("config unexpectedly contains %q:\n%s", unwanted, got)
+		}
+	}
+}
+
+func TestApplyRulesBlockMode(t *testing.T) {
+	tests := []struct {
+		name string
+		mode BlockMode
+		want string
+	}{
+		{
+			name: "default",
+			want: "address=/example.com/0.0.0.0\naddress=/ru/0.0.0.0\naddress=/www.example.com/0.0.0.0\n",
+		},
+		{
+			name: "sinkhole",
+			mode: BlockModeSinkhole,
+			want: "address=/example.com/0.0.0.0\naddress=/ru/0.0.0.0\naddress=/www.example.com/0.0.0.0\n",
+		},
+		{
+			name: "nxdomain",
+			mode: BlockModeNXDOMAIN,
+			want: "address=/example.com/\naddress=/ru/\naddress=/www.example.com/\n",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "dnsmasq.conf")
+			if err := New(path, Config{Mode: tt.mode}).ApplyRules([]string{"example.com", "*.ru"}); err != nil {
+				t.Fatalf("ApplyRules() error = %v", err)
+			}
+
+			data, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !strings.HasSuffix(string(data), "\n\n"+tt.want) {
+				t.Errorf("config = %q, want directives %q", data, tt.want)
+			}
+		})
+	}
+}
+
+func TestApplyRulesAllowlist(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dnsmasq.conf")
+	m := New(path, Config{AllowedDomains: []string{"docs.example.com", "*.yandex.ru", "Tie.org.", "www.example.net"}})
+	if err := m.ApplyRules([]string{"example.com", "*.ru", "tie.org", "example.net"}); err != nil {
+		t.Fatalf("ApplyRules() error = %v", err)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := string(data)
+
+	for _, want := range []string{
+		"address=/example.com/0.0.0.0\n",
+		"address=/ru/0.0.0.0\n",
+		"server=/docs.example.com/#\n",
+		"server=/yandex.ru/#\n",
+		"server=/tie.org/#\n",
+		// A www. allow entry forwards only that host, and the blocked
+		// domain stays
+		"address=/example.net/0.0.0.0\n",
+		"server=/www.example.net/#\n",
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("config missing %q:\n%s", want, got)
+		}
+	}
+
+	// Allow wins ties, so the identical entry isn't blocked at all
+	if strings.Contains(got, "address=/tie.org/") || strings.Contains(got, "address=/www.tie.org/") {
+		t.Errorf("config blocks an allowed domain:\n%s", got)
+	}
+	if strings.Contains(got, "server=/example.net/") {
+		t.Errorf("config forwards the domain of a www. allow entry:\n%s", got)
+	}
+}
+
+func TestApplyRulesDeterministic(t *testing.T) {
+	dir := t.TempDir()
+	inputs := [][]string{
+		{"example.com", "www.news.org", "*.ru", "Example.com.", "a.example.net"},
+		{"a.example.net", "*.ru", "WWW.NEWS.ORG", "example.com", "example.com", "*.ru"},
+	}
+	allowed := [][]string{
+		{"docs.example.com", "yandex.ru"},
+		{"Yandex.ru", "docs.example.com", "Docs.Example.com."},
+	}
+
+	var outputs []string
+	for i, domains := range inputs {
+		path := filepath.Join(dir, fmt.Sprintf("dnsmasq-%d.conf", i))
+		if err := New(path, Config{AllowedDomains: allowed[i]}).ApplyRules(domains); err != nil {
+			t.Fatalf("ApplyRules() error = %v", err)
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		outputs = append(outputs, string(data))
+	}
+
+	if outputs[0] != outputs[1] {
+		t.Errorf("configs differ:\n%s\nand:\n%s", outputs[0], outputs[1])
+	}
+	want := "address=/a.example.net/0.0.0.0\n" +
+		"address=/example.com/0.0.0.0\n" +
+		"address=/ru/0.0.0.0\n" +
+		"address=/www.a.example.net/0.0.0.0\n" +
+		"address=/www.example.com/0.0.0.0\n" +
+		"address=/www.news.org/0.0.0.0\n" +
+		"server=/docs.example.com/#\n" +
+		"server=/yandex.ru/#\n"
+	if !strings.HasSuffix(outputs[0], "\n\n"+want) {
+		t.Errorf("config = %q, want directives %q", outputs[0], want)
+	}
+}
+
+func TestApplyRulesRejectsInjection(t *testing.T) {
+	malicious := []string{
+		"evil.com\naddress=/good.com/1.2.3.4",
+		"evil.com address=/good.com/1.2.3.4",
+		"*.evil.com\nserver=8.8.8.8",
+		"*.*.evil.com\nconf-file=/tmp/x",
+		"evil.com/1.2.3.4",
+		"-evil.com",
+		"evil..com",
+	}
+
+	path := filepath.Join(t.TempDir(), "dnsmasq.conf")
+	m := New(path, Config{AllowedDomains: []string{"ok.example.org\nserver=/x/1.2.3.4"}})
+	if err := m.ApplyRules(append(malicious, "example.com")); err != nil {
+		t.Fatalf("ApplyRules() error = %v", err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := string(data)
+
+	if !strings.Contains(got, "address=/example.com/0.0.0.0\n") {
+		t.Errorf("config missing the valid entry:\n%s", got)
+	}
+	for _, unwanted := range []string{"evil", "good.com", "server=", "conf-file"} {
+		if strings.Contains(got, unwanted) {
+			t.Errorf("config contains %q:\n%s", unwanted, got)
+		}
+	}
+
+	hostsPath := filepath.Join(t.TempDir(), "hosts")
+	if err := NewHostsFile(hostsPath, nil).ApplyRules(append(malicious, "example.com")); err != nil {
+		t.Fatalf("HostsFile.ApplyRules() error = %v", err)
+	}
+	hosts, err := os.ReadFile(hostsPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(hosts), "evil") || !strings.Contains(string(hosts), "0.0.0.0 example.com\n") {
+		t.Errorf("hosts file:\n%s", hosts)
+	}
+}
+
+func TestReload(t *testing.T) {
+	tests := []struct {
+		name    string
+		command []string
+		pidFile string
+		killErr error
+		wantPID int
+		wantErr bool
+		errIs   error
+	}{
+		{name: "sighup from pid file", pidFile: "4242\n", wantPID: 4242},
+		{name: "stale pid file", pidFile: "4242\n", killErr: syscall.ESRCH, wantErr: true, errIs: ErrNotRunning},
+		{name: "invalid pid file", pidFile: "dnsmasq\n", wantErr: true},
+		{name: "reload command", command: []string{"true"}},
+		{name: "failing reload command", command: []string{"false"}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pidPath := filepath.Join(t.TempDir(), "dnsmasq.pid")
+			if err := os.WriteFile(pidPath, []byte(tt.pidFile), 0o644); err != nil {
+				t.Fatal(err)
+			}
+			m := New(filepath.Join(t.TempDir(), "dnsmasq.conf"), Config{ReloadCommand: tt.command, PIDFile: pidPath})
+			var gotPID int
+			m.kill = func(pid int, sig syscall.Signal) error {
+				if sig != syscall.SIGHUP {
+					t.Errorf("kill() signal = %v, want SIGHUP", sig)
+				}
+				gotPID = pid
+				return tt.killErr
+			}
+
+			err := m.Reload()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Reload() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.errIs != nil && !errors.Is(err, tt.errIs) {
+				t.Errorf("Reload() error = %v, want %v", err, tt.errIs)
+			}
+			if !tt.wantErr && gotPID != tt.wantPID {
+				t.Errorf("signalled pid %d, want %d", gotPID, tt.wantPID)
+			}
+		})
+	}
+}
+
+func TestHostsFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "hosts")
+	original := "127.0.0.1 localhost\n::1 localhost\n"
+	if err := os.WriteFile(path, []byte(original), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	h := NewHostsFile(path, []string{"docs.example.org"})
+	if err := h.ApplyRules([]string{"example.com", "*.ru", "docs.example.org", "re:^ads\\."}); err != nil {
+		t.Fatalf("ApplyRules() error = %v", err)
+	}
+	want := original + hostsBegin + "\n0.0.0.0 example.com\n0.0.0.0 www.example.com\n" + hostsEnd + "\n"
+	if got, _ := os.ReadFile(path); string(got) != want {
+		t.Errorf("after ApplyRules:\n%s\nwant:\n%s", got, want)
+	}
+
+	// Entries added after focusd's section survive an update
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString("192.168.1.5 nas\n")
+	f.Close()
+
+	if err := h.ApplyRules([]string{"example.net"}); err != nil {
+		t.Fatalf("ApplyRules() error = %v", err)
+	}
+	want = original + "192.168.1.5 nas\n" + hostsBegin + "\n0.0.0.0 example.net\n0.0.0.0 www.example.net\n" + hostsEnd + "\n"
+	if got, _ := os.ReadFile(path); string(got) != want {
+		t.Errorf("after update:\n%s\nwant:\n%s", got, want)
+	}
+
+	if err := h.RemoveRules(); err != nil {
+		t.Fatalf("RemoveRules() error = %v", err)
+	}
+	want = original + "192.168.1.5 nas\n"
+	if got, _ := os.ReadFile(path); string(got) != want {
+		t.Errorf("after RemoveRules:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestSync(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dnsmasq.conf")
+	m := New(path, Config{})
+
+	steps := []struct {
+		domains []string
+		want    bool
+	}{
+		{domains: []string{"example.com"}, want: true},
+		{domains: []string{"example.com"}, want: false},
+		{domains: []string{"example.com", "example.org"}, want: true},
+	}
+	for i, step := range steps {
+		changed, err := m.Sync(step.domains)
+		if err != nil {
+			t.Fatalf("step %d: Sync() error = %v", i, err)
+		}
+		if changed != step.want {
+			t.Errorf("step %d: Sync() changed = %v, want %v", i, changed, step.want)
+		}
+	}
+
+	// A config removed while disabled is written again
+	if err := m.RemoveRules(); err != nil {
+		t.Fatal(err)
+	}
+	if changed, err := m.Sync([]string{"example.com", "example.org"}); err != nil || !changed {
+		t.Errorf("Sync() after RemoveRules = %v, %v, want true", changed, err)
+	}
+}
@@ -0,0 +1,124 @@
+package dns
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"slices"
+	"strings"
+
+	"focusd/internal/atomicfile"
+	"focusd/internal/matcher"
+)
+
+// Sentinel comments around the section of a hosts file focusd manages
+const (
+	hostsBegin = "# BEGIN focusd - auto-generated, do not edit"
+	hostsEnd   = "# END focusd"
+)
+
+// HostsFile blocks domains through a hosts file, for machines without
+// dnsmasq. Only the section between focusd's sentinel comments is ever
+// rewritten; other entries in the file are kept as they are.
+type HostsFile struct {
+	path    string
+	allowed []string
+}
+
+// NewHostsFile creates a HostsFile managing its section of the file at path.
+// Allowed domains are never written, as with Manager.
+func NewHostsFile(path string, allowedDomains []string) *HostsFile {
+	h := &HostsFile{path: path}
+	for _, domain := range allowedDomains {
+		if !matcher.IsPattern(domain) {
+			h.allowed = append(h.allowed, baseDomain(domain))
+		}
+	}
+	return h
+}
+
+// ApplyRules replaces focusd's section of the hosts file with entries
+// sinkholing domains. A hosts file can only list exact names, so wildcard
+// entries and patterns are left to the proxy and nftables.
+func (h *HostsFile) ApplyRules(domains []string) error {
+	var sb strings.Builder
+	sb.WriteString(hostsBegin + "\n")
+	for _, domain := range domains {
+		if strings.HasPrefix(domain, "*.") || matcher.IsPattern(domain) {
+			continue
+		}
+		if slices.Contains(h.allowed, baseDomain(domain)) {
+			continue
+		}
+		if !validHostname(domain) {
+			slog.Warn("Invalid blocklist entry, skipping for the hosts file", "entry", domain)
+			continue
+		}
+		fmt.Fprintf(&sb, "0.0.0.0 %s\n", domain)
+		if !strings.HasPrefix(domain, "www.") {
+			fmt.Fprintf(&sb, "0.0.0.0 www.%s\n", domain)
+		}
+	}
+	sb.WriteString(hostsEnd + "\n")
+
+	return h.rewrite(sb.String())
+}
+
+// RemoveRules strips focusd's section from the hosts file
+func (h *HostsFile) RemoveRules() error {
+	return h.rewrite("")
+}
+
+// rewrite replaces focusd's section with section, appending it if the file
+// has none yet
+func (h *HostsFile) rewrite(section string) error {
+	perm := os.FileMode(0o644)
+	data, err := os.ReadFile(h.path)
+	switch {
+	case os.IsNotExist(err):
+		if section == "" {
+			return nil
+		}
+	case err != nil:
+		return fmt.Errorf("reading hosts file: %w", err)
+	default:
+		if info, err := os.Stat(h.path); err == nil {
+			perm = info.Mode().Perm()
+		}
+	}
+
+	content := stripSection(string(data))
+	if section != "" {
+		if content != "" && !strings.HasSuffix(content, "\n") {
+			content += "\n"
+		}
+		content += section
+	}
+	if content == string(data) {
+		return nil
+	}
+
+	if err := atomicfile.Write(h.path, []byte(content), perm); err != nil {
+		return fmt.Errorf("writing hosts file: %w", err)
+	}
+	return nil
+}
+
+// stripSection removes every focusd section from a hosts file's content. An
+// unterminated section runs to the end of the file.
+func stripSection(content string) string {
+	var sb strings.Builder
+	inSection := false
+	for line := range strings.SplitAfterSeq(content, "\n") {
+		trimmed := strings.TrimSpace(line)
+		switch {
+		case trimmed == hostsBegin:
+			inSection = true
+		case inSection && trimmed == hostsEnd:
+			inSection = false
+		case !inSection:
+			sb.WriteString(line)
+		}
+	}
+	return sb.String()
+}
@@ -0,0 +1,87 @@
+package dns
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// DefaultPIDFile is where dnsmasq writes its PID unless told otherwise
+const DefaultPIDFile = "/run/dnsmasq.pid"
+
+// ErrNotRunning is returned by Reload when no dnsmasq process was found
+var ErrNotRunning = errors.New("dnsmasq is not running")
+
+// Reload makes dnsmasq pick up the configuration written by ApplyRules or
+// RemoveRules. With a reload command configured it runs that command;
+// otherwise it sends SIGHUP to the dnsmasq process, found via its PID file
+// or pgrep. SIGHUP clears dnsmasq's cache but doesn't re-read address=
+// directives, so a restart command applies changes more reliably.
+func (m *Manager) Reload() error {
+	if len(m.reloadCommand) > 0 {
+		cmd := exec.Command(m.reloadCommand[0], m.reloadCommand[1:]...)
+		if output, err := cmd.CombinedOutput(); err != nil {
+			return fmt.Errorf("running %q: %w: %s", strings.Join(m.reloadCommand, " "), err, bytes.TrimSpace(output))
+		}
+		return nil
+	}
+
+	pids, err := m.findPIDs()
+	if err != nil {
+		return err
+	}
+	signalled := 0
+	for _, pid := range pids {
+		if err := m.kill(pid, syscall.SIGHUP); err != nil {
+			if errors.Is(err, syscall.ESRCH) {
+				// A stale PID file outlives its process
+				continue
+			}
+			return fmt.Errorf("signalling dnsmasq (pid %d): %w", pid, err)
+		}
+		signalled++
+	}
+	if signalled == 0 {
+		return ErrNotRunning
+	}
+	return nil
+}
+
+// findPIDs returns the dnsmasq PIDs from the PID file, falling back to
+// pgrep if the file doesn't exist
+func (m *Manager) findPIDs() ([]int, error) {
+	data, err := os.ReadFile(m.pidFile)
+	if err == nil {
+		pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+		if err != nil || pid <= 0 {
+			return nil, fmt.Errorf("invalid PID file %s", m.pidFile)
+		}
+		return []int{pid}, nil
+	}
+	if !os.IsNotExist(err) {
+		return nil, fmt.Errorf("reading PID file: %w", err)
+	}
+
+	output, err := exec.Command("pgrep", "-x", "dnsmasq").Output()
+	if err != nil {
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) && exitErr.ExitCode() == 1 {
+			// pgrep exits 1 when nothing matched
+			return nil, ErrNotRunning
+		}
+		return nil, fmt.Errorf("running pgrep: %w", err)
+	}
+
+	var pids []int
+	for _, field := range strings.Fields(string(output)) {
+		if pid, err := strconv.Atoi(field); err == nil {
+			pids = append(pids, pid)
+		}
+	}
+	return pids, nil
+}
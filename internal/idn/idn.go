@@ -0,0 +1,70 @@
+// Package idn converts internationalized domain names to their ASCII
+// (punycode) form, so a name written in Unicode and the same name as sent
+// on the wire compare equal.
+package idn
+
+import (
+	"fmt"
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/net/idna"
+)
+
+// profile maps names the way a browser does before a lookup, but allows
+// the characters blocklists contain that aren't valid in a hostname
+// (wildcards, underscores) and labels like r1---sn-abc that have hyphens
+// in the third and fourth positions
+var profile = idna.New(
+	idna.MapForLookup(),
+	idna.BidiRule(),
+	idna.Transitional(false),
+	idna.StrictDomainName(false),
+	idna.CheckHyphens(false),
+)
+
+// dots are the characters UTS #46 treats as label separators
+var dots = strings.NewReplacer("\u3002", ".", "\uff0e", ".", "\uff61", ".")
+
+// ToASCII returns name with every Unicode label converted to punycode and
+// lowercased. ASCII names without punycode labels are returned unchanged.
+// Malformed names, such as a punycode label that doesn't decode, are an
+// error.
+func ToASCII(name string) (string, error) {
+	if !needsConversion(name) {
+		return name, nil
+	}
+	if !utf8.ValidString(name) {
+		return "", fmt.Errorf("invalid internationalized name %q: not UTF-8", name)
+	}
+	ascii, err := profile.ToASCII(name)
+	if err != nil {
+		return "", fmt.Errorf("invalid internationalized name %q: %w", name, err)
+	}
+
+	// idna accepts punycode labels that aren't in canonical form, such as
+	// xn--abc- for plain abc, which would let one name be spelled two ways
+	in := strings.Split(strings.ToLower(dots.Replace(name)), ".")
+	out := strings.Split(ascii, ".")
+	if len(in) != len(out) {
+		return "", fmt.Errorf("invalid internationalized name %q", name)
+	}
+	for i, label := range in {
+		if strings.HasPrefix(label, "xn--") && label != out[i] {
+			return "", fmt.Errorf("invalid internationalized name %q: label %q is not canonical punycode", name, label)
+		}
+	}
+	return ascii, nil
+}
+
+// needsConversion reports whether name has a non-ASCII character or a
+// punycode label that must be validated
+func needsConversion(name string) bool {
+	for i := 0; i < len(name); i++ {
+		if name[i] >= utf8.RuneSelf {
+			return true
+		}
+	}
+	lower := strings.ToLower(name)
+	return strings.HasPrefix(lower, "xn--") || strings.Contains(lower, ".xn--")
+}
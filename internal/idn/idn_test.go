@@ -0,0 +1,39 @@
+package idn
+
+import "testing"
+
+func TestToASCII(t *testing.T) {
+	tests := []struct {
+		name    string
+		in      string
+		want    string
+		wantErr bool
+	}{
+		{name: "plain ASCII unchanged", in: "Example.com", want: "Example.com"},
+		{name: "unicode", in: "пример.рф", want: "xn--e1afmkfd.xn--p1ai"},
+		{name: "unicode mixed case", in: "Bücher.DE", want: "xn--bcher-kva.de"},
+		{name: "punycode", in: "xn--bcher-kva.de", want: "xn--bcher-kva.de"},
+		{name: "punycode upper case", in: "XN--BCHER-KVA.DE", want: "xn--bcher-kva.de"},
+		{name: "ideographic dot", in: "пример。рф", want: "xn--e1afmkfd.xn--p1ai"},
+		{name: "wildcard", in: "*.bücher.de", want: "*.xn--bcher-kva.de"},
+		{name: "underscore", in: "_dmarc.bücher.de", want: "_dmarc.xn--bcher-kva.de"},
+		{name: "double hyphen", in: "r1---sn-abc.bücher.de", want: "r1---sn-abc.xn--bcher-kva.de"},
+		{name: "trailing dot", in: "bücher.de.", want: "xn--bcher-kva.de."},
+		{name: "empty punycode label", in: "xn--.com", wantErr: true},
+		{name: "undecodable punycode", in: "xn--a.com", wantErr: true},
+		{name: "non-canonical punycode", in: "xn--abc-.com", wantErr: true},
+		{name: "invalid UTF-8", in: "\xff\xfe.com", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ToASCII(tt.in)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ToASCII(%q) error = %v, wantErr %v", tt.in, err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("ToASCII(%q) = %q, want %q", tt.in, got, tt.want)
+			}
+		})
+	}
+}
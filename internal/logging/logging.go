@@ -0,0 +1,64 @@
+// Package logging configures the process-wide structured logger
+package logging
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"log/slog"
+	"strings"
+)
+
+// Log formats accepted by NewHandler
+const (
+	FormatText = "text"
+	FormatJSON = "json"
+)
+
+// ParseLevel parses a level name: debug, info (the default for ""), warn or
+// error
+func ParseLevel(s string) (slog.Level, error) {
+	switch strings.ToLower(s) {
+	case "debug":
+		return slog.LevelDebug, nil
+	case "", "info":
+		return slog.LevelInfo, nil
+	case "warn", "warning":
+		return slog.LevelWarn, nil
+	case "error":
+		return slog.LevelError, nil
+	}
+	return 0, fmt.Errorf("invalid log level %q (must be debug, info, warn or error)", s)
+}
+
+// NewHandler returns a handler writing format ("text", the default for "",
+// or "json") records at level and above to w
+func NewHandler(w io.Writer, format, level string) (slog.Handler, error) {
+	lvl, err := ParseLevel(level)
+	if err != nil {
+		return nil, err
+	}
+	opts := &slog.HandlerOptions{Level: lvl}
+
+	switch format {
+	case "", FormatText:
+		return slog.NewTextHandler(w, opts), nil
+	case FormatJSON:
+		return slog.NewJSONHandler(w, opts), nil
+	}
+	return nil, fmt.Errorf("invalid log format %q (must be text or json)", format)
+}
+
+// Setup makes a handler from NewHandler the default logger. Output from the
+// standard log package is routed through it at info level.
+func Setup(w io.Writer, format, level string) error {
+	h, err := NewHandler(w, format, level)
+	if err != nil {
+		return err
+	}
+	slog.SetDefault(slog.New(h))
+	// slog.SetDefault points the log package at the handler; drop its own
+	// timestamp prefix, which the handler already records
+	log.SetFlags(0)
+	return nil
+}
@@ -0,0 +1,60 @@
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"strings"
+	"testing"
+)
+
+func TestNewHandler(t *testing.T) {
+	tests := []struct {
+		name    string
+		format  string
+		level   string
+		wantErr bool
+	}{
+		{name: "defaults"},
+		{name: "json debug", format: "json", level: "debug"},
+		{name: "text warn", format: "text", level: "WARN"},
+		{name: "bad format", format: "xml", wantErr: true},
+		{name: "bad level", level: "verbose", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := NewHandler(&bytes.Buffer{}, tt.format, tt.level)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("NewHandler() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestJSONRecords(t *testing.T) {
+	var buf bytes.Buffer
+	h, err := NewHandler(&buf, FormatJSON, "info")
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger := slog.New(h).With("conn", 7)
+
+	logger.Debug("hidden")
+	logger.Info("Connection", "domain", "example.com", "verdict", "blocked")
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 1 {
+		t.Fatalf("got %d records, want 1: %q", len(lines), buf.String())
+	}
+
+	var rec map[string]any
+	if err := json.Unmarshal([]byte(lines[0]), &rec); err != nil {
+		t.Fatalf("record is not JSON: %v", err)
+	}
+	for key, want := range map[string]any{"level": "INFO", "msg": "Connection", "conn": 7.0, "domain": "example.com", "verdict": "blocked"} {
+		if rec[key] != want {
+			t.Errorf("record[%q] = %v, want %v", key, rec[key], want)
+		}
+	}
+}
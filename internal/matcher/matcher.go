@@ -0,0 +1,319 @@
+// Package matcher decides whether a hostname is blocked by a blocklist and
+// allowlist. The proxy and the CLI share it so their decisions can't diverge.
+package matcher
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"focusd/internal/idn"
+)
+
+// Kind describes how a host matched
+type Kind string
+
+const (
+	// KindNone means no blocklist entry matched
+	KindNone Kind = ""
+	// KindExact means the host is the blocked domain itself
+	KindExact Kind = "exact"
+	// KindSubdomain means the host is below a blocked domain
+	KindSubdomain Kind = "subdomain"
+	// KindWWW means the host and the blocked entry differ only by "www."
+	KindWWW Kind = "www-variant"
+	// KindPattern means the host matched a regex or glob entry
+	KindPattern Kind = "pattern"
+	// KindAllowlist means a blocklist entry matched but an allowlist entry
+	// at least as specific overrides it
+	KindAllowlist Kind = "allowlist"
+)
+
+// RegexPrefix marks a list entry as a regular expression
+const RegexPrefix = "re:"
+
+// Match is the decision for one host
+type Match struct {
+	Blocked bool
+	Kind    Kind
+
+	// Entry is the blocklist entry that matched, as configured
+	Entry string
+
+	// Allow is the allowlist entry that overrode Entry, for KindAllowlist
+	Allow string
+}
+
+// entry is a configured domain and the suffix it matches (or, if exact, the
+// only name it matches), or a compiled pattern. index is its position in the
+// configured list, which breaks ties between equally specific entries.
+type entry struct {
+	raw   string
+	base  string
+	www   bool
+	exact bool
+	re    *regexp.Regexp
+	index int
+}
+
+// list holds entries for lookup: domains in a trie of reversed labels, so
+// finding the most specific one costs one step per label of the host
+// rather than one comparison per entry; patterns, which can match
+// anywhere, are tried in turn
+type list struct {
+	domains  *trieNode
+	patterns []*entry
+}
+
+// trieNode is a label in the domain trie, reached from the TLD down
+type trieNode struct {
+	children map[string]*trieNode
+
+	// entry is the first configured entry whose base ends at this node
+	entry *entry
+
+	// exact is the first configured entry matching this node's name only
+	exact *entry
+}
+
+// Matcher matches hosts against blocklist and allowlist entries.
+//
+// An entry matches its domain and every subdomain, on label boundaries.
+// Wildcard entries (*.ru) match the same way, so "*.ru" covers "yandex.ru"
+// but never "guru", and a blocklist entry with a www. prefix also covers the
+// bare domain. An allowlist entry with a www. prefix allows just that host
+// and the bare domain, not the rest of the domain. The most specific
+// matching entry wins, and allow wins ties, so allowing docs.example.com
+// carves it out of a blocked example.com.
+//
+// Pattern entries match whole hostnames: "re:" followed by a
+// case-insensitive regular expression, or a glob with a * anywhere but a leading "*." label, where
+// * matches within a single label (ads-*.example.com). A pattern counts
+// as specific as the host itself, so only an exact allow entry beats it.
+type Matcher struct {
+	blocked list
+	allowed list
+}
+
+// New creates a Matcher for the given blocklist and allowlist. Invalid
+// patterns are ignored; use Compile to have them reported.
+func New(blocked, allowed []string) *Matcher {
+	b, _ := newEntries(blocked, false)
+	a, _ := newEntries(allowed, true)
+	return &Matcher{blocked: b, allowed: a}
+}
+
+// Compile creates a Matcher like New, but fails on an invalid pattern
+func Compile(blocked, allowed []string) (*Matcher, error) {
+	b, err := newEntries(blocked, false)
+	if err != nil {
+		return nil, err
+	}
+	a, err := newEntries(allowed, true)
+	if err != nil {
+		return nil, err
+	}
+	return &Matcher{blocked: b, allowed: a}, nil
+}
+
+// IsPattern reports whether a list entry is a regex or glob pattern rather
+// than a domain. Patterns have no addresses to resolve.
+func IsPattern(raw string) bool {
+	raw = strings.TrimSpace(raw)
+	return strings.HasPrefix(raw, RegexPrefix) || strings.Contains(strings.TrimPrefix(raw, "*."), "*")
+}
+
+// newEntries normalizes configured domains for matching and compiles
+// patterns, returning the valid entries and the first error. For an
+// allowlist, a www. entry matches only its host and the bare domain.
+func newEntries(domains []string, allow bool) (list, error) {
+	l := list{domains: &trieNode{}}
+	var firstErr error
+	for i, raw := range domains {
+		if IsPattern(raw) {
+			re, err := compilePattern(raw)
+			if err != nil {
+				if firstErr == nil {
+					firstErr = err
+				}
+				continue
+			}
+			l.patterns = append(l.patterns, &entry{raw: raw, re: re, index: i})
+			continue
+		}
+
+		base := Normalize(raw)
+		wildcard := strings.HasPrefix(base, "*.")
+		base = strings.TrimPrefix(base, "*.")
+		www := strings.HasPrefix(base, "www.")
+		base = strings.TrimPrefix(base, "www.")
+		if base == "" {
+			// Matches nothing: no host is a subdomain of ""
+			continue
+		}
+		if allow && www && !wildcard {
+			l.domains.insert(&entry{raw: raw, base: "www." + base, exact: true, index: i})
+			l.domains.insert(&entry{raw: raw, base: base, exact: true, index: i})
+			continue
+		}
+		l.domains.insert(&entry{raw: raw, base: base, www: www, index: i})
+	}
+	return l, firstErr
+}
+
+// insert adds e under its base's labels, keeping an earlier entry of the
+// same kind for the same base
+func (n *trieNode) insert(e *entry) {
+	rest := e.base
+	for rest != "" {
+		label := rest
+		if i := strings.LastIndexByte(rest, '.'); i >= 0 {
+			label, rest = rest[i+1:], rest[:i]
+		} else {
+			rest = ""
+		}
+		child := n.children[label]
+		if child == nil {
+			if n.children == nil {
+				n.children = make(map[string]*trieNode)
+			}
+			child = &trieNode{}
+			n.children[label] = child
+		}
+		n = child
+	}
+	slot := &n.entry
+	if e.exact {
+		slot = &n.exact
+	}
+	if *slot == nil {
+		*slot = e
+	}
+}
+
+// deepest returns the entry for the longest base that is host or a parent
+// domain of it, counting exact entries only for host itself
+func (n *trieNode) deepest(host string) *entry {
+	var best *entry
+	rest := host
+	for {
+		label := rest
+		i := strings.LastIndexByte(rest, '.')
+		if i >= 0 {
+			label, rest = rest[i+1:], rest[:i]
+		}
+		n = n.children[label]
+		if n == nil {
+			return best
+		}
+		if n.entry != nil {
+			best = n.entry
+		}
+		if i < 0 {
+			if n.exact != nil && (n.entry == nil || n.exact.index < n.entry.index) {
+				best = n.exact
+			}
+			return best
+		}
+	}
+}
+
+// compilePattern compiles a regex or glob entry into a regular expression
+// anchored to the whole hostname. Hostnames are matched lowercased, so
+// regexes are case-insensitive, like every other entry.
+func compilePattern(raw string) (*regexp.Regexp, error) {
+	raw = strings.TrimSpace(raw)
+	expr, isRegex := strings.CutPrefix(raw, RegexPrefix)
+	if !isRegex {
+		parts := strings.Split(Normalize(raw), "*")
+		for i, part := range parts {
+			parts[i] = regexp.QuoteMeta(part)
+		}
+		expr = strings.Join(parts, "[^.]*")
+	}
+
+	re, err := regexp.Compile("(?i)^(?:" + expr + ")$")
+	if err != nil {
+		return nil, fmt.Errorf("invalid pattern %q: %w", raw, err)
+	}
+	return re, nil
+}
+
+// Normalize lowercases a hostname, strips surrounding space and any
+// trailing dot, and converts an internationalized name to punycode so it
+// matches whichever form the other side uses. A malformed name is left
+// as it is.
+func Normalize(host string) string {
+	host = strings.ToLower(strings.TrimSuffix(strings.TrimSpace(host), "."))
+	if ascii, err := idn.ToASCII(host); err == nil {
+		host = ascii
+	}
+	return host
+}
+
+// Blocked reports whether host is blocked
+func (m *Matcher) Blocked(host string) bool {
+	host = Normalize(host)
+	block, blockLen := longest(host, m.blocked)
+	if block == nil {
+		return false
+	}
+	_, allowLen := longest(host, m.allowed)
+	return blockLen > allowLen
+}
+
+// Match reports whether host is blocked and which rule decided it
+func (m *Matcher) Match(host string) Match {
+	host = Normalize(host)
+	block, blockLen := longest(host, m.blocked)
+	if block == nil {
+		return Match{}
+	}
+	if allow, allowLen := longest(host, m.allowed); allow != nil && allowLen >= blockLen {
+		return Match{Kind: KindAllowlist, Entry: block.raw, Allow: allow.raw}
+	}
+	if block.re != nil {
+		return Match{Blocked: true, Kind: KindPattern, Entry: block.raw}
+	}
+
+	kind := KindSubdomain
+	switch host {
+	case block.base:
+		kind = KindExact
+		if block.www {
+			// www.example.com also covers example.com
+			kind = KindWWW
+		}
+	case "www." + block.base:
+		kind = KindWWW
+		if block.www {
+			kind = KindExact
+		}
+	}
+	return Match{Blocked: true, Kind: kind, Entry: block.raw}
+}
+
+// longest returns the most specific entry matching host exactly or as a
+// parent domain and how specific it is (the length of the matched suffix),
+// or nil if none does. Of equally specific entries, the one listed first
+// wins.
+func longest(host string, l list) (*entry, int) {
+	if host == "" {
+		return nil, 0
+	}
+	var best *entry
+	bestLen := 0
+	if e := l.domains.deepest(host); e != nil {
+		best, bestLen = e, len(e.base)
+	}
+	for _, e := range l.patterns {
+		if len(host) < bestLen || (len(host) == bestLen && e.index > best.index) {
+			// Can't beat the current match
+			continue
+		}
+		if e.re.MatchString(host) {
+			best, bestLen = e, len(host)
+		}
+	}
+	return best, bestLen
+}
@@ -0,0 +1,234 @@
+package matcher
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"strings"
+	"testing"
+)
+
+func TestMatch(t *testing.T) {
+	m := New(
+		[]string{"example.com", "www.news.org", "*.ru", "example.net", "private.docs.example.com", "Tie.org.", "bücher.de", "xn--e1afmkfd.xn--p1ai"},
+		[]string{"docs.example.com", "tie.org", "xn--80aswg.xn--bcher-kva.de", "www.example.net"},
+	)
+
+	tests := []struct {
+		host string
+		want Match
+	}{
+		{host: "example.com", want: Match{Blocked: true, Kind: KindExact, Entry: "example.com"}},
+		{host: "EXAMPLE.com.", want: Match{Blocked: true, Kind: KindExact, Entry: "example.com"}},
+		{host: "www.example.com", want: Match{Blocked: true, Kind: KindWWW, Entry: "example.com"}},
+		{host: "m.example.com", want: Match{Blocked: true, Kind: KindSubdomain, Entry: "example.com"}},
+		{host: "news.org", want: Match{Blocked: true, Kind: KindWWW, Entry: "www.news.org"}},
+		{host: "www.news.org", want: Match{Blocked: true, Kind: KindExact, Entry: "www.news.org"}},
+		{host: "mail.yandex.ru", want: Match{Blocked: true, Kind: KindSubdomain, Entry: "*.ru"}},
+		{host: "guru", want: Match{}},
+		{host: "notexample.com", want: Match{}},
+
+		// Allowlist overrides and the more specific block beneath it
+		{host: "docs.example.com", want: Match{Kind: KindAllowlist, Entry: "example.com", Allow: "docs.example.com"}},
+		{host: "a.private.docs.example.com", want: Match{Blocked: true, Kind: KindSubdomain, Entry: "private.docs.example.com"}},
+		{host: "tie.org", want: Match{Kind: KindAllowlist, Entry: "Tie.org.", Allow: "tie.org"}},
+
+		// A www. allow entry allows its host and the bare domain only
+		{host: "www.example.net", want: Match{Kind: KindAllowlist, Entry: "example.net", Allow: "www.example.net"}},
+		{host: "example.net", want: Match{Kind: KindAllowlist, Entry: "example.net", Allow: "www.example.net"}},
+		{host: "m.example.net", want: Match{Blocked: true, Kind: KindSubdomain, Entry: "example.net"}},
+		{host: "a.www.example.net", want: Match{Blocked: true, Kind: KindSubdomain, Entry: "example.net"}},
+
+		// Internationalized names match in either form
+		{host: "xn--bcher-kva.de", want: Match{Blocked: true, Kind: KindExact, Entry: "bücher.de"}},
+		{host: "www.Bücher.de", want: Match{Blocked: true, Kind: KindWWW, Entry: "bücher.de"}},
+		{host: "пример.рф", want: Match{Blocked: true, Kind: KindExact, Entry: "xn--e1afmkfd.xn--p1ai"}},
+		{host: "сайт.bücher.de", want: Match{Kind: KindAllowlist, Entry: "bücher.de", Allow: "xn--80aswg.xn--bcher-kva.de"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.host, func(t *testing.T) {
+			if got := m.Match(tt.host); got != tt.want {
+				t.Errorf("Match(%q) = %+v, want %+v", tt.host, got, tt.want)
+			}
+			if got := m.Blocked(tt.host); got != tt.want.Blocked {
+				t.Errorf("Blocked(%q) = %v, want %v", tt.host, got, tt.want.Blocked)
+			}
+		})
+	}
+}
+
+func TestMatchPatterns(t *testing.T) {
+	m, err := Compile(
+		[]string{"ads-*.example.com", `re:^track[0-9]+\.net$`, "*.cdn.example.org", "video.example.net", `re:^Promo\.example\.com$`},
+		[]string{"ads-ok.example.com", "re:.*\\.example\\.net"},
+	)
+	if err != nil {
+		t.Fatalf("Compile() error = %v", err)
+	}
+
+	tests := []struct {
+		host string
+		want Match
+	}{
+		{host: "ads-1.example.com", want: Match{Blocked: true, Kind: KindPattern, Entry: "ads-*.example.com"}},
+		{host: "ADS-x.example.com.", want: Match{Blocked: true, Kind: KindPattern, Entry: "ads-*.example.com"}},
+		{host: "a.ads-1.example.com", want: Match{}},
+		{host: "ads-1.x.example.com", want: Match{}},
+		{host: "track42.net", want: Match{Blocked: true, Kind: KindPattern, Entry: `re:^track[0-9]+\.net$`}},
+		{host: "track.net", want: Match{}},
+		{host: "promo.example.com", want: Match{Blocked: true, Kind: KindPattern, Entry: `re:^Promo\.example\.com$`}},
+		{host: "img.cdn.example.org", want: Match{Blocked: true, Kind: KindSubdomain, Entry: "*.cdn.example.org"}},
+
+		// An exact allow beats a pattern; a pattern allow beats a domain
+		{host: "ads-ok.example.com", want: Match{Kind: KindAllowlist, Entry: "ads-*.example.com", Allow: "ads-ok.example.com"}},
+		{host: "video.example.net", want: Match{Kind: KindAllowlist, Entry: "video.example.net", Allow: "re:.*\\.example\\.net"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.host, func(t *testing.T) {
+			if got := m.Match(tt.host); got != tt.want {
+				t.Errorf("Match(%q) = %+v, want %+v", tt.host, got, tt.want)
+			}
+			if got := m.Blocked(tt.host); got != tt.want.Blocked {
+				t.Errorf("Blocked(%q) = %v, want %v", tt.host, got, tt.want.Blocked)
+			}
+		})
+	}
+}
+
+func TestCompileInvalidPattern(t *testing.T) {
+	tests := []struct {
+		name    string
+		blocked []string
+		allowed []string
+	}{
+		{name: "unbalanced regex", blocked: []string{"example.com", "re:(ads"}},
+		{name: "bad repetition", blocked: []string{"re:*.example.com"}},
+		{name: "invalid allow", allowed: []string{"re:[a-"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := Compile(tt.blocked, tt.allowed); err == nil {
+				t.Error("Compile() error = nil, want an invalid pattern error")
+			}
+			// New skips the bad entry and keeps the rest
+			m := New(tt.blocked, tt.allowed)
+			if len(tt.blocked) > 1 && !m.Blocked("example.com") {
+				t.Error("New() dropped the valid entries")
+			}
+		})
+	}
+}
+
+// linearEntries and linearLongest are the matcher's original linear scan,
+// kept as a reference for the trie
+func linearEntries(t testing.TB, domains []string) []*entry {
+	var entries []*entry
+	for i, raw := range domains {
+		if IsPattern(raw) {
+			re, err := compilePattern(raw)
+			if err != nil {
+				t.Fatal(err)
+			}
+			entries = append(entries, &entry{raw: raw, re: re, index: i})
+			continue
+		}
+		base := strings.TrimPrefix(Normalize(raw), "*.")
+		entries = append(entries, &entry{raw: raw, base: strings.TrimPrefix(base, "www."), index: i})
+	}
+	return entries
+}
+
+func linearLongest(host string, entries []*entry) (*entry, int) {
+	var best *entry
+	bestLen := 0
+	for _, e := range entries {
+		n := 0
+		switch {
+		case e.re != nil:
+			if e.re.MatchString(host) {
+				n = len(host)
+			}
+		case host == e.base || strings.HasSuffix(host, "."+e.base):
+			n = len(e.base)
+		}
+		if n > bestLen {
+			best, bestLen = e, n
+		}
+	}
+	return best, bestLen
+}
+
+func TestLongestMatchesLinearScan(t *testing.T) {
+	rng := rand.New(rand.NewPCG(1, 2))
+	labels := []string{"a", "b", "www", "example", "com", "org", "ru"}
+	name := func() string {
+		parts := make([]string, 1+rng.IntN(4))
+		for i := range parts {
+			parts[i] = labels[rng.IntN(len(labels))]
+		}
+		return strings.Join(parts, ".")
+	}
+
+	for round := range 200 {
+		var domains []string
+		for range 1 + rng.IntN(30) {
+			d := name()
+			switch rng.IntN(8) {
+			case 0:
+				d = "*." + d
+			case 1:
+				d = strings.ToUpper(d) + "."
+			case 2:
+				d = "a*." + d
+			case 3:
+				d = `re:^(www\.)?` + strings.ReplaceAll(d, ".", `\.`) + "$"
+			}
+			domains = append(domains, d)
+		}
+		l, err := newEntries(domains, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		reference := linearEntries(t, domains)
+
+		for range 50 {
+			host := name()
+			got, gotLen := longest(host, l)
+			want, wantLen := linearLongest(host, reference)
+			if gotLen != wantLen || (got == nil) != (want == nil) || (got != nil && got.index != want.index) {
+				t.Fatalf("round %d: longest(%q) in %q = %v (%d), linear scan = %v (%d)", round, host, domains, got, gotLen, want, wantLen)
+			}
+		}
+	}
+}
+
+// BenchmarkLongest compares the trie with a linear scan over a 10k-domain
+// blocklist, for hosts that match and hosts that don't
+func BenchmarkLongest(b *testing.B) {
+	var domains []string
+	for i := range 10000 {
+		domains = append(domains, fmt.Sprintf("site%d.example%d.com", i, i%100))
+	}
+	hosts := []string{"www.site1234.example34.com", "cdn.site9999.example99.com", "unrelated.example.org", "news.example5.com"}
+
+	l, err := newEntries(domains, false)
+	if err != nil {
+		b.Fatal(err)
+	}
+	reference := linearEntries(b, domains)
+
+	b.Run("linear", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; b.Loop(); i++ {
+			linearLongest(hosts[i%len(hosts)], reference)
+		}
+	})
+	b.Run("trie", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; b.Loop(); i++ {
+			longest(hosts[i%len(hosts)], l)
+		}
+	})
+}
@@ -0,0 +1,274 @@
+package metrics
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"focusd/internal/atomicfile"
+)
+
+// metric is anything that can write itself in Prometheus text format
+type metric interface {
+	write(w io.Writer) error
+}
+
+var (
+	registryMu sync.Mutex
+	registry   []metric
+)
+
+func register(m metric) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	registry = append(registry, m)
+}
+
+// focusd metrics
+var (
+	// ProxyConnections counts connections handled by the proxy by protocol and verdict
+	ProxyConnections = NewCounterVec("focusd_proxy_connections_total", "Connections handled by the transparent proxy.", "protocol", "verdict")
+
+	// ProxyInFlight is the number of connections the proxy is handling
+	ProxyInFlight = NewGauge("focusd_proxy_connections_in_flight", "Connections currently being handled by the transparent proxy.")
+
+	// BlockingEnabled is 1 while blocking rules are applied
+	BlockingEnabled = NewGauge("focusd_blocking_enabled", "Whether blocking rules are currently applied.")
+
+	// BlockedDomains is the number of domains in the effective blocklist
+	BlockedDomains = NewGauge("focusd_blocked_domains", "Number of domains in the effective blocklist.")
+
+	// BlockedIPs is the number of IPs in the nftables drop set
+	BlockedIPs = NewGauge("focusd_blocked_ips", "Number of IP addresses in the nftables drop set.")
+
+	// LastRefresh is the Unix time of the last successful IP refresh
+	LastRefresh = NewGauge("focusd_last_refresh_timestamp_seconds", "Unix time of the last successful IP refresh.")
+
+	// BuildInfo identifies the running build
+	BuildInfo = NewInfo("focusd_build_info", "Version of the running focusd build.", "version", "commit", "date")
+)
+
+// Gauge is a metric that can go up and down
+type Gauge struct {
+	name, help string
+	mu         sync.Mutex
+	value      float64
+}
+
+// NewGauge creates and registers a gauge
+func NewGauge(name, help string) *Gauge {
+	g := &Gauge{name: name, help: help}
+	register(g)
+	return g
+}
+
+// Set sets the gauge to v
+func (g *Gauge) Set(v float64) {
+	g.mu.Lock()
+	g.value = v
+	g.mu.Unlock()
+}
+
+// Value returns the current value
+func (g *Gauge) Value() float64 {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.value
+}
+
+func (g *Gauge) write(w io.Writer) error {
+	_, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n%s %s\n",
+		g.name, g.help, g.name, g.name, formatValue(g.Value()))
+	return err
+}
+
+// Info is a gauge fixed at 1 whose labels carry descriptive values, such
+// as the build version
+type Info struct {
+	name, help string
+	labels     []string
+	mu         sync.Mutex
+	values     []string
+}
+
+// NewInfo creates and registers an info metric with the given labels
+func NewInfo(name, help string, labels ...string) *Info {
+	i := &Info{name: name, help: help, labels: labels}
+	register(i)
+	return i
+}
+
+// Set sets the label values; the metric is only written once set
+func (i *Info) Set(labelValues ...string) {
+	i.mu.Lock()
+	i.values = labelValues
+	i.mu.Unlock()
+}
+
+func (i *Info) write(w io.Writer) error {
+	i.mu.Lock()
+	values := i.values
+	i.mu.Unlock()
+	if values == nil {
+		return nil
+	}
+	_, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n%s%s 1\n",
+		i.name, i.help, i.name, i.name, labelSet(i.labels, values))
+	return err
+}
+
+// CounterVec is a set of counters partitioned by label values
+type CounterVec struct {
+	name, help string
+	labels     []string
+	mu         sync.Mutex
+	values     map[string]float64
+}
+
+// NewCounterVec creates and registers a labelled counter
+func NewCounterVec(name, help string, labels ...string) *CounterVec {
+	c := &CounterVec{name: name, help: help, labels: labels, values: make(map[string]float64)}
+	register(c)
+	return c
+}
+
+// Inc increments the counter for the given label values
+func (c *CounterVec) Inc(labelValues ...string) {
+	key := c.key(labelValues)
+	c.mu.Lock()
+	c.values[key]++
+	c.mu.Unlock()
+}
+
+// Value returns the counter for the given label values
+func (c *CounterVec) Value(labelValues ...string) float64 {
+	key := c.key(labelValues)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.values[key]
+}
+
+// key renders label values as a Prometheus label set
+func (c *CounterVec) key(labelValues []string) string {
+	return labelSet(c.labels, labelValues)
+}
+
+// labelSet renders labels and their values as a Prometheus label set.
+// Missing values are empty.
+func labelSet(labels, values []string) string {
+	pairs := make([]string, len(labels))
+	for i, label := range labels {
+		value := ""
+		if i < len(values) {
+			value = values[i]
+		}
+		pairs[i] = label + "=" + strconv.Quote(value)
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func (c *CounterVec) write(w io.Writer) error {
+	c.mu.Lock()
+	keys := make([]string, 0, len(c.values))
+	for k := range c.values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	lines := make([]string, len(keys))
+	for i, k := range keys {
+		lines[i] = c.name + k + " " + formatValue(c.values[k])
+	}
+	c.mu.Unlock()
+
+	if _, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", c.name, c.help, c.name); err != nil {
+		return err
+	}
+	for _, line := range lines {
+		if _, err := fmt.Fprintln(w, line); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Snapshot returns the current value of every registered counter, keyed by
+// metric name and then by rendered label set
+func Snapshot() map[string]map[string]float64 {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+
+	snapshot := make(map[string]map[string]float64)
+	for _, m := range registry {
+		c, ok := m.(*CounterVec)
+		if !ok {
+			continue
+		}
+		c.mu.Lock()
+		values := make(map[string]float64, len(c.values))
+		for k, v := range c.values {
+			values[k] = v
+		}
+		c.mu.Unlock()
+		snapshot[c.name] = values
+	}
+	return snapshot
+}
+
+// Restore adds counter values from a Snapshot taken by a previous process, so
+// counters keep increasing across restarts. Unknown metrics are ignored.
+func Restore(snapshot map[string]map[string]float64) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+
+	for _, m := range registry {
+		c, ok := m.(*CounterVec)
+		if !ok {
+			continue
+		}
+		c.mu.Lock()
+		for k, v := range snapshot[c.name] {
+			c.values[k] += v
+		}
+		c.mu.Unlock()
+	}
+}
+
+// formatValue formats a sample value, keeping integers free of exponents
+func formatValue(v float64) string {
+	if v == math.Trunc(v) && math.Abs(v) < 1e15 {
+		return strconv.FormatInt(int64(v), 10)
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// WriteText writes all registered metrics in the Prometheus text exposition format
+func WriteText(w io.Writer) error {
+	registryMu.Lock()
+	metrics := append([]metric(nil), registry...)
+	registryMu.Unlock()
+
+	for _, m := range metrics {
+		if err := m.write(w); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// WriteFile atomically writes all metrics to path, for node_exporter's
+// textfile collector, which never sees a partial file
+func WriteFile(path string) error {
+	var buf bytes.Buffer
+	if err := WriteText(&buf); err != nil {
+		return fmt.Errorf("writing metrics: %w", err)
+	}
+	if err := atomicfile.Write(path, buf.Bytes(), 0o644); err != nil {
+		return fmt.Errorf("writing metrics file: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,46 @@
+package metrics
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestWriteFile(t *testing.T) {
+	ProxyConnections.Inc("https", "blocked")
+	ProxyConnections.Inc("https", "blocked")
+	ProxyConnections.Inc("http", "allowed")
+	BlockedDomains.Set(12)
+	LastRefresh.Set(1.5)
+	BuildInfo.Set("1.2.0", "abc123", "2026-01-02T03:04:05Z")
+
+	path := filepath.Join(t.TempDir(), "focusd.prom")
+	if err := WriteFile(path); err != nil {
+		t.Fatalf("WriteFile() error = %v", err)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := string(data)
+
+	for _, want := range []string{
+		"# TYPE focusd_proxy_connections_total counter\n",
+		`focusd_proxy_connections_total{protocol="http",verdict="allowed"} 1` + "\n",
+		`focusd_proxy_connections_total{protocol="https",verdict="blocked"} 2` + "\n",
+		"# TYPE focusd_blocked_domains gauge\nfocusd_blocked_domains 12\n",
+		"focusd_last_refresh_timestamp_seconds 1.5\n",
+		`focusd_build_info{version="1.2.0",commit="abc123",date="2026-01-02T03:04:05Z"} 1` + "\n",
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("metrics missing %q:\n%s", want, got)
+		}
+	}
+
+	entries, _ := os.ReadDir(filepath.Dir(path))
+	if len(entries) != 1 {
+		t.Errorf("temp file left behind, found %d entries", len(entries))
+	}
+}
@@ -4,7 +4,10 @@ import (
 	"bytes"
 	"fmt"
 	"net"
+	"net/netip"
 	"os/exec"
+	"slices"
+	"strings"
 
 	"github.com/google/nftables"
 	"github.com/google/nftables/expr"
@@ -12,25 +15,100 @@ import (
 )
 
 const (
-	tableName = "focusd"
-	setName   = "blocked_ips"
-	chainName = "output"
+	tableName      = "focusd"
+	proxyTableName = "focusd_proxy"
+	setName        = "blocked_ips"
+	set6Name       = "blocked_ips6"
+	chainName      = "output"
 )
 
+// conn is the subset of *nftables.Conn used by Manager. Queued operations are
+// sent to the kernel as a single transaction by Flush.
+type conn interface {
+	AddTable(t *nftables.Table) *nftables.Table
+	DelTable(t *nftables.Table)
+	ListTables() ([]*nftables.Table, error)
+	AddSet(s *nftables.Set, vals []nftables.SetElement) error
+	FlushSet(s *nftables.Set)
+	SetAddElements(s *nftables.Set, vals []nftables.SetElement) error
+	SetDeleteElements(s *nftables.Set, vals []nftables.SetElement) error
+	AddChain(c *nftables.Chain) *nftables.Chain
+	FlushChain(c *nftables.Chain)
+	AddRule(r *nftables.Rule) *nftables.Rule
+	Flush() error
+}
+
 // Manager manages nftables rules for blocking IPs
 type Manager struct {
-	conn *nftables.Conn
+	conn conn
+
+	// run runs a command such as ip(8) and returns its output
+	run func(args ...string) ([]byte, error)
+
+	// atomic makes UpdateRules replace the table contents in one transaction
+	atomic bool
+
+	// applied holds the addresses last written to each set, keyed by set name
+	// then address. nil means the kernel state is unknown.
+	applied map[string]map[string]net.IP
 }
 
 // New creates a new nftables Manager
 func New() *Manager {
 	return &Manager{
 		conn: &nftables.Conn{},
+		run:  runCommand,
 	}
 }
 
+// runCommand runs a command and returns its standard output
+func runCommand(args ...string) ([]byte, error) {
+	return exec.Command(args[0], args[1:]...).Output()
+}
+
+// SetAtomicReplace makes UpdateRules use ReplaceRules, rewriting the whole
+// set each time instead of only adding and deleting the changed addresses
+func (m *Manager) SetAtomicReplace(atomic bool) {
+	m.atomic = atomic
+}
+
 // ApplyRules creates or updates nftables rules to block the given IP addresses
 func (m *Manager) ApplyRules(ips []net.IP) error {
+	if err := m.queueRules(ips, false); err != nil {
+		return err
+	}
+
+	// Flush all changes
+	if err := m.conn.Flush(); err != nil {
+		m.applied = nil
+		return fmt.Errorf("flushing nftables changes: %w", err)
+	}
+
+	m.recordApplied(ips)
+	return nil
+}
+
+// ReplaceRules replaces the blocked IP list in a single transaction. The
+// table, set and chain are created if missing, and the set and chain are
+// flushed and repopulated in the same batch, so there is no moment where
+// nothing is blocked.
+func (m *Manager) ReplaceRules(ips []net.IP) error {
+	if err := m.queueRules(ips, true); err != nil {
+		return err
+	}
+
+	if err := m.conn.Flush(); err != nil {
+		m.applied = nil
+		return fmt.Errorf("replacing nftables rules: %w", err)
+	}
+
+	m.recordApplied(ips)
+	return nil
+}
+
+// queueRules queues the complete focusd table state without flushing it.
+// With replace set, existing set elements and chain rules are flushed first.
+func (m *Manager) queueRules(ips []net.IP, replace bool) error {
 	// Create or get the table
 	table := &nftables.Table{
 		Family: nftables.TableFamilyINet,
@@ -38,25 +116,15 @@ func (m *Manager) ApplyRules(ips []net.IP) error {
 	}
 	m.conn.AddTable(table)
 
-	// Create or get the set for blocked IPs
-	set := &nftables.Set{
-		Table:   table,
-		Name:    setName,
-		KeyType: nftables.TypeIPAddr,
-	}
-	if err := m.conn.AddSet(set, nil); err != nil {
-		return fmt.Errorf("creating IP set: %w", err)
-	}
-
-	// Add IP addresses to the set
-	elements := make([]nftables.SetElement, 0, len(ips))
-	for _, ip := range ips {
-		elements = append(elements, nftables.SetElement{
-			Key: ip,
-		})
+	// One set per address family; the kernel rejects keys of the wrong length
+	v4, v6 := partitionIPs(ips)
+	set, err := m.queueSet(table, setName, nftables.TypeIPAddr, v4, replace)
+	if err != nil {
+		return err
 	}
-	if err := m.conn.SetAddElements(set, elements); err != nil {
-		return fmt.Errorf("adding IP elements to set: %w", err)
+	set6, err := m.queueSet(table, set6Name, nftables.TypeIP6Addr, v6, replace)
+	if err != nil {
+		return err
 	}
 
 	// Create output chain if it doesn't exist
@@ -70,38 +138,88 @@ func (m *Manager) ApplyRules(ips []net.IP) error {
 		Policy:   &policy,
 	}
 	m.conn.AddChain(chain)
+	if replace {
+		m.conn.FlushChain(chain)
+	}
 
-	// Add rule to drop packets to blocked IPs
+	// Add rules to drop packets to blocked IPs
 	// Rule: ip daddr @blocked_ips drop
 	m.conn.AddRule(&nftables.Rule{
 		Table: table,
 		Chain: chain,
-		Exprs: []expr.Any{
-			// Load destination address into register 1
-			&expr.Payload{
-				DestRegister: 1,
-				Base:         expr.PayloadBaseNetworkHeader,
-				Offset:       16, // Destination IP offset in IP header
-				Len:          4,  // IPv4 address length (will handle IPv6 separately)
-			},
-			// Check if destination IP is in the blocked set
-			&expr.Lookup{
-				SourceRegister: 1,
-				SetName:        setName,
-			},
-			// Drop the packet if it matches
-			&expr.Verdict{
-				Kind: expr.VerdictDrop,
-			},
-		},
+		Exprs: dropToSet(unix.NFPROTO_IPV4, 16, net.IPv4len, set),
+	})
+	// Rule: ip6 daddr @blocked_ips6 drop
+	m.conn.AddRule(&nftables.Rule{
+		Table: table,
+		Chain: chain,
+		Exprs: dropToSet(unix.NFPROTO_IPV6, 24, net.IPv6len, set6),
 	})
 
-	// Flush all changes
-	if err := m.conn.Flush(); err != nil {
-		return fmt.Errorf("flushing nftables changes: %w", err)
+	return nil
+}
+
+// queueSet creates (or, with replace, flushes) a set of blocked addresses and
+// adds ips to it
+func (m *Manager) queueSet(table *nftables.Table, name string, keyType nftables.SetDatatype, ips []net.IP, replace bool) (*nftables.Set, error) {
+	set := &nftables.Set{
+		Table:   table,
+		Name:    name,
+		KeyType: keyType,
+	}
+	if err := m.conn.AddSet(set, nil); err != nil {
+		return nil, fmt.Errorf("creating IP set %s: %w", name, err)
+	}
+	if replace {
+		m.conn.FlushSet(set)
 	}
 
-	return nil
+	if err := m.conn.SetAddElements(set, setElements(ips)); err != nil {
+		return nil, fmt.Errorf("adding IP elements to set %s: %w", name, err)
+	}
+	return set, nil
+}
+
+// dropToSet builds a rule dropping packets of the given family whose
+// destination address (at offset in the network header) is in set
+func dropToSet(family byte, offset, length uint32, set *nftables.Set) []expr.Any {
+	return []expr.Any{
+		// Only match this address family; the table is inet
+		&expr.Meta{Key: expr.MetaKeyNFPROTO, Register: 1},
+		&expr.Cmp{
+			Op:       expr.CmpOpEq,
+			Register: 1,
+			Data:     []byte{family},
+		},
+		// Load destination address into register 1
+		&expr.Payload{
+			DestRegister: 1,
+			Base:         expr.PayloadBaseNetworkHeader,
+			Offset:       offset,
+			Len:          length,
+		},
+		// Check if destination IP is in the blocked set
+		&expr.Lookup{
+			SourceRegister: 1,
+			SetName:        set.Name,
+		},
+		// Drop the packet if it matches
+		&expr.Verdict{
+			Kind: expr.VerdictDrop,
+		},
+	}
+}
+
+// partitionIPs splits ips into 4-byte IPv4 and 16-byte IPv6 keys
+func partitionIPs(ips []net.IP) (v4, v6 []net.IP) {
+	for _, ip := range ips {
+		if ip4 := ip.To4(); ip4 != nil {
+			v4 = append(v4, ip4)
+		} else if ip16 := ip.To16(); ip16 != nil {
+			v6 = append(v6, ip16)
+		}
+	}
+	return v4, v6
 }
 
 // RemoveRules removes all focusd nftables rules
@@ -114,6 +232,7 @@ func (m *Manager) RemoveRules() error {
 
 	// Delete the entire table (this removes all chains, sets, and rules)
 	m.conn.DelTable(table)
+	m.applied = nil
 
 	// Flush changes
 	if err := m.conn.Flush(); err != nil {
@@ -126,168 +245,426 @@ func (m *Manager) RemoveRules() error {
 	return nil
 }
 
+// Reset deletes every focusd table, the transparent proxy's included, and
+// the routing rules for proxied traffic, whichever process created them. A
+// daemon that crashed or was killed leaves them behind, and rules added on
+// top of them would intercept traffic twice. It returns a description of
+// each thing it removed.
+func (m *Manager) Reset() ([]string, error) {
+	tables, err := m.conn.ListTables()
+	if err != nil {
+		return nil, fmt.Errorf("listing nftables tables: %w", err)
+	}
+
+	var removed []string
+	for _, t := range tables {
+		if t.Name != tableName && t.Name != proxyTableName {
+			continue
+		}
+		m.conn.DelTable(t)
+		removed = append(removed, "table "+familyName(t.Family)+" "+t.Name)
+	}
+	m.applied = nil
+	if len(removed) > 0 {
+		if err := m.conn.Flush(); err != nil {
+			return nil, fmt.Errorf("removing nftables tables: %w", err)
+		}
+	}
+
+	return append(removed, cleanupRouting(m.run)...), nil
+}
+
+// familyName returns the nft keyword for a table family
+func familyName(family nftables.TableFamily) string {
+	switch family {
+	case nftables.TableFamilyIPv4:
+		return "ip"
+	case nftables.TableFamilyIPv6:
+		return "ip6"
+	case nftables.TableFamilyINet:
+		return "inet"
+	default:
+		return fmt.Sprintf("family %d", family)
+	}
+}
+
 // UpdateRules updates the blocked IP list
-// This clears the old set and replaces it with new IPs
+// Only the addresses added or removed since the last update are sent, so the
+// table, chain and rules stay in place and blocking never lapses. If the
+// current contents are unknown (nothing applied yet, or a failed update), the
+// sets are replaced wholesale instead.
 func (m *Manager) UpdateRules(ips []net.IP) error {
-	// For simplicity, we remove and re-apply rules
-	// In production, you might want to do a more intelligent diff
-	if err := m.RemoveRules(); err != nil {
-		return err
+	if m.atomic || m.applied == nil {
+		return m.ReplaceRules(ips)
+	}
+
+	table := &nftables.Table{
+		Family: nftables.TableFamilyINet,
+		Name:   tableName,
+	}
+	v4, v6 := partitionIPs(ips)
+	sets := []struct {
+		set *nftables.Set
+		ips []net.IP
+	}{
+		{&nftables.Set{Table: table, Name: setName, KeyType: nftables.TypeIPAddr}, v4},
+		{&nftables.Set{Table: table, Name: set6Name, KeyType: nftables.TypeIP6Addr}, v6},
+	}
+
+	changed := false
+	for _, s := range sets {
+		added, removed := diffIPs(m.applied[s.set.Name], s.ips)
+		if len(removed) > 0 {
+			if err := m.conn.SetDeleteElements(s.set, setElements(removed)); err != nil {
+				return fmt.Errorf("removing IP elements from set %s: %w", s.set.Name, err)
+			}
+			changed = true
+		}
+		if len(added) > 0 {
+			if err := m.conn.SetAddElements(s.set, setElements(added)); err != nil {
+				return fmt.Errorf("adding IP elements to set %s: %w", s.set.Name, err)
+			}
+			changed = true
+		}
+	}
+	if !changed {
+		return nil
+	}
+
+	if err := m.conn.Flush(); err != nil {
+		m.applied = nil
+		return fmt.Errorf("updating nftables sets: %w", err)
+	}
+
+	m.recordApplied(ips)
+	return nil
+}
+
+// recordApplied remembers ips as the current contents of the sets
+func (m *Manager) recordApplied(ips []net.IP) {
+	v4, v6 := partitionIPs(ips)
+	m.applied = map[string]map[string]net.IP{
+		setName:  ipIndex(v4),
+		set6Name: ipIndex(v6),
+	}
+}
+
+// ipIndex keys ips by their string form
+func ipIndex(ips []net.IP) map[string]net.IP {
+	index := make(map[string]net.IP, len(ips))
+	for _, ip := range ips {
+		index[ip.String()] = ip
+	}
+	return index
+}
+
+// diffIPs returns the addresses in next but not current, and those in current
+// but not next. both are sorted so the emitted batch is deterministic.
+func diffIPs(current map[string]net.IP, next []net.IP) (added, removed []net.IP) {
+	nextIndex := ipIndex(next)
+	for key, ip := range nextIndex {
+		if _, ok := current[key]; !ok {
+			added = append(added, ip)
+		}
+	}
+	for key, ip := range current {
+		if _, ok := nextIndex[key]; !ok {
+			removed = append(removed, ip)
+		}
+	}
+	sortIPs(added)
+	sortIPs(removed)
+	return added, removed
+}
+
+// sortIPs orders ips bytewise
+func sortIPs(ips []net.IP) {
+	slices.SortFunc(ips, func(a, b net.IP) int {
+		return bytes.Compare(a, b)
+	})
+}
+
+// setElements wraps ips as set elements
+func setElements(ips []net.IP) []nftables.SetElement {
+	elements := make([]nftables.SetElement, 0, len(ips))
+	for _, ip := range ips {
+		elements = append(elements, nftables.SetElement{
+			Key: ip,
+		})
 	}
-	return m.ApplyRules(ips)
+	return elements
+}
+
+// DefaultBypassCIDRs are the private networks whose traffic skips the
+// transparent proxy unless ProxyRules.BypassCIDRs says otherwise
+var DefaultBypassCIDRs = []string{"10.0.0.0/8", "172.16.0.0/12", "192.168.0.0/16"}
+
+// loopbackCIDRs always skip the proxy, which itself listens on loopback
+var loopbackCIDRs = []string{"127.0.0.0/8", "::1/128"}
+
+// ProxyRules configures the transparent proxy ruleset
+type ProxyRules struct {
+	// HTTPPort and HTTPSPort are the ports the proxy listens on
+	HTTPPort  int
+	HTTPSPort int
+
+	// Mark is set on the proxy's own outbound connections, which are let
+	// through rather than intercepted again
+	Mark int
+
+	// BypassCIDRs are destination networks that skip the proxy, replacing
+	// DefaultBypassCIDRs if set. Loopback is always skipped.
+	BypassCIDRs []string
+
+	// InspectQUIC sends QUIC (UDP port 443) to the proxy's HTTPS port
+	InspectQUIC bool
+
+	// BlockQUIC drops QUIC that isn't inspected, forcing a TCP fallback;
+	// otherwise it is left alone
+	BlockQUIC bool
+
+	// BlockDoT drops DNS-over-TLS (TCP and UDP port 853)
+	BlockDoT bool
+
+	// DoHResolvers are addresses or networks of DNS-over-HTTPS resolvers
+	// whose port 443 is dropped
+	DoHResolvers []string
 }
 
 // EnableTransparentProxy sets up nftables rules for transparent proxying
 // This redirects HTTP and HTTPS traffic to the transparent proxy ports
-func (m *Manager) EnableTransparentProxy(httpPort, httpsPort int) error {
+func (m *Manager) EnableTransparentProxy(cfg ProxyRules) error {
 	// Use nft command-line tool for TPROXY setup as it's complex
 	// The nftables Go library doesn't have good TPROXY support
+	rules, err := proxyRuleset(cfg)
+	if err != nil {
+		return err
+	}
+
+	// Apply rules using nft -f. The script replaces any existing table in
+	// the same transaction, so applying it again changes nothing.
+	cmd := exec.Command("nft", "-f", "-")
+	cmd.Stdin = bytes.NewBufferString(rules)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("applying transparent proxy rules: %w (stderr: %s)", err, strings.TrimSpace(stderr.String()))
+	}
+
+	// Set up routing for marked packets
+	if err := setupRouting(m.run); err != nil {
+		return fmt.Errorf("setting up routing: %w", err)
+	}
+
+	return nil
+}
+
+// proxyRuleset renders the nft script for the transparent proxy table
+func proxyRuleset(cfg ProxyRules) (string, error) {
+	bypassCIDRs := cfg.BypassCIDRs
+	if len(bypassCIDRs) == 0 {
+		bypassCIDRs = DefaultBypassCIDRs
+	}
+
+	var bypass strings.Builder
+	bypass.WriteString("\t\t# Skip local traffic\n")
+	for _, cidr := range loopbackCIDRs {
+		bypass.WriteString(bypassRule(cidr))
+	}
+	bypass.WriteString("\n\t\t# Skip private networks\n")
+	for _, cidr := range bypassCIDRs {
+		if _, _, err := net.ParseCIDR(cidr); err != nil {
+			return "", fmt.Errorf("invalid bypass CIDR %q: %w", cidr, err)
+		}
+		bypass.WriteString(bypassRule(cidr))
+	}
+
+	encryptedDNS, err := encryptedDNSRules(cfg)
+	if err != nil {
+		return "", err
+	}
+
+	var quicPrerouting, quicOutput string
+	switch {
+	case cfg.InspectQUIC:
+		quicPrerouting = fmt.Sprintf("# Intercept QUIC (HTTP/3) traffic\n"+
+			"\t\tudp dport 443 tproxy ip to 127.0.0.1:%[1]d mark set 1 accept\n"+
+			"\t\tudp dport 443 tproxy ip6 to [::1]:%[1]d mark set 1 accept", cfg.HTTPSPort)
+		quicOutput = "# Intercept QUIC from local machine\n\t\tudp dport 443 mark set 1 accept"
+	case cfg.BlockQUIC:
+		quicPrerouting = "# Block QUIC (HTTP/3) to force TCP fallback\n\t\tudp dport 443 drop"
+		quicOutput = "# Block QUIC\n\t\tudp dport 443 drop"
+	}
+
+	// Declaring the table before deleting it makes the delete succeed
+	// whether or not it exists yet
+	return fmt.Sprintf(`
+table inet focusd_proxy
+delete table inet focusd_proxy
 
-	rules := fmt.Sprintf(`
 table inet focusd_proxy {
 	chain prerouting {
 		type filter hook prerouting priority mangle; policy accept;
 
-		# Skip local traffic
-		ip daddr 127.0.0.0/8 return
-		ip6 daddr ::1/128 return
-
-		# Skip private networks
-		ip daddr 10.0.0.0/8 return
-		ip daddr 172.16.0.0/12 return
-		ip daddr 192.168.0.0/16 return
-
+%[4]s%[7]s
 		# Intercept HTTP traffic
-		tcp dport 80 tproxy ip to 127.0.0.1:%d mark set 1 accept
-		tcp dport 80 tproxy ip6 to [::1]:%d mark set 1 accept
+		tcp dport 80 tproxy ip to 127.0.0.1:%[1]d mark set 1 accept
+		tcp dport 80 tproxy ip6 to [::1]:%[1]d mark set 1 accept
 
 		# Intercept HTTPS traffic
-		tcp dport 443 tproxy ip to 127.0.0.1:%d mark set 1 accept
-		tcp dport 443 tproxy ip6 to [::1]:%d mark set 1 accept
+		tcp dport 443 tproxy ip to 127.0.0.1:%[2]d mark set 1 accept
+		tcp dport 443 tproxy ip6 to [::1]:%[2]d mark set 1 accept
 
-		# Block QUIC (HTTP/3) to force TCP fallback
-		udp dport 443 drop
+		%[5]s
 	}
 
 	chain output {
 		type route hook output priority mangle; policy accept;
 
-		# Skip proxy's own outbound connections (marked with fwmark 50)
-		meta mark 50 return
-
-		# Skip local traffic
-		ip daddr 127.0.0.0/8 return
-		ip6 daddr ::1/128 return
-
-		# Skip private networks
-		ip daddr 10.0.0.0/8 return
-		ip daddr 172.16.0.0/12 return
-		ip daddr 192.168.0.0/16 return
+		# Skip proxy's own outbound connections (marked with the proxy mark)
+		meta mark %[3]d return
 
+%[4]s%[7]s
 		# Intercept HTTP from local machine
 		tcp dport 80 mark set 1 accept
 
 		# Intercept HTTPS from local machine
 		tcp dport 443 mark set 1 accept
 
-		# Block QUIC
-		udp dport 443 drop
+		%[6]s
 	}
 
 	chain output_nat {
 		type nat hook output priority -100; policy accept;
 
 		# Skip proxy's own outbound connections
-		meta mark 50 return
-
-		# Skip local traffic
-		ip daddr 127.0.0.0/8 return
-		ip6 daddr ::1/128 return
-
-		# Skip private networks
-		ip daddr 10.0.0.0/8 return
-		ip daddr 172.16.0.0/12 return
-		ip daddr 192.168.0.0/16 return
+		meta mark %[3]d return
 
+%[4]s
 		# Redirect locally-generated HTTP to proxy
-		tcp dport 80 redirect to :%d
+		tcp dport 80 redirect to :%[1]d
 
 		# Redirect locally-generated HTTPS to proxy
-		tcp dport 443 redirect to :%d
+		tcp dport 443 redirect to :%[2]d
 	}
 }
-`, httpPort, httpPort, httpsPort, httpsPort, httpPort, httpsPort)
-
-	// Apply rules using nft -f
-	cmd := exec.Command("nft", "-f", "-")
-	cmd.Stdin = bytes.NewBufferString(rules)
-	var stderr bytes.Buffer
-	cmd.Stderr = &stderr
+`, cfg.HTTPPort, cfg.HTTPSPort, cfg.Mark, bypass.String(), quicPrerouting, quicOutput, encryptedDNS), nil
+}
 
-	if err := cmd.Run(); err != nil {
-		return fmt.Errorf("applying transparent proxy rules: %w (stderr: %s)", err, stderr.String())
+// encryptedDNSRules returns the rules dropping DNS-over-TLS and traffic to
+// DNS-over-HTTPS resolvers, which would let clients bypass dnsmasq
+func encryptedDNSRules(cfg ProxyRules) (string, error) {
+	var b strings.Builder
+	if cfg.BlockDoT {
+		b.WriteString("\n\t\t# Block DNS-over-TLS\n")
+		b.WriteString("\t\tmeta l4proto { tcp, udp } th dport 853 drop\n")
 	}
 
-	// Set up routing for marked packets
-	if err := setupRouting(); err != nil {
-		return fmt.Errorf("setting up routing: %w", err)
+	var v4, v6 []string
+	for _, resolver := range cfg.DoHResolvers {
+		prefix, err := netip.ParsePrefix(resolver)
+		if err != nil {
+			addr, addrErr := netip.ParseAddr(resolver)
+			if addrErr != nil {
+				return "", fmt.Errorf("invalid DoH resolver address %q: %w", resolver, addrErr)
+			}
+			prefix = netip.PrefixFrom(addr, addr.BitLen())
+		}
+		prefix = prefix.Masked()
+		if prefix.Addr().Is4() {
+			v4 = append(v4, prefix.String())
+		} else {
+			v6 = append(v6, prefix.String())
+		}
+	}
+	if len(v4) > 0 || len(v6) > 0 {
+		b.WriteString("\n\t\t# Block DNS-over-HTTPS resolvers\n")
 	}
+	if len(v4) > 0 {
+		fmt.Fprintf(&b, "\t\tip daddr { %s } meta l4proto { tcp, udp } th dport 443 drop\n", strings.Join(v4, ", "))
+	}
+	if len(v6) > 0 {
+		fmt.Fprintf(&b, "\t\tip6 daddr { %s } meta l4proto { tcp, udp } th dport 443 drop\n", strings.Join(v6, ", "))
+	}
+	return b.String(), nil
+}
 
-	return nil
+// bypassRule returns the rule letting traffic to cidr skip the proxy
+func bypassRule(cidr string) string {
+	if strings.Contains(cidr, ":") {
+		return fmt.Sprintf("\t\tip6 daddr %s return\n", cidr)
+	}
+	return fmt.Sprintf("\t\tip daddr %s return\n", cidr)
 }
 
 // DisableTransparentProxy removes transparent proxy rules
 func (m *Manager) DisableTransparentProxy() error {
 	// Delete the proxy table
-	cmd := exec.Command("nft", "delete", "table", "inet", "focusd_proxy")
+	cmd := exec.Command("nft", "delete", "table", "inet", proxyTableName)
 	if err := cmd.Run(); err != nil {
 		// If table doesn't exist, that's OK
 		return nil
 	}
 
 	// Clean up routing
-	cleanupRouting()
+	cleanupRouting(m.run)
 
 	return nil
 }
 
-// setupRouting configures routing policy for marked packets
-func setupRouting() error {
-	// First, remove any existing rules to prevent duplicates
-	cleanupRouting()
-
-	// IPv4: Add routing rule and route for marked packets
-	commands := [][]string{
-		{"ip", "rule", "add", "fwmark", "1", "lookup", "100"},
-		{"ip", "route", "add", "local", "0.0.0.0/0", "dev", "lo", "table", "100"},
-		{"ip", "-6", "rule", "add", "fwmark", "1", "lookup", "100"},
-		{"ip", "-6", "route", "add", "local", "::/0", "dev", "lo", "table", "100"},
+// setupRouting configures routing policy for marked packets, leaving
+// anything already in place as it is so it can safely run again
+func setupRouting(run func(args ...string) ([]byte, error)) error {
+	rules := []struct {
+		list, add []string
+	}{
+		{
+			[]string{"ip", "rule", "list", "fwmark", "1", "lookup", "100"},
+			[]string{"ip", "rule", "add", "fwmark", "1", "lookup", "100"},
+		},
+		{
+			[]string{"ip", "-6", "rule", "list", "fwmark", "1", "lookup", "100"},
+			[]string{"ip", "-6", "rule", "add", "fwmark", "1", "lookup", "100"},
+		},
+	}
+	for _, rule := range rules {
+		if out, err := run(rule.list...); err == nil && len(bytes.TrimSpace(out)) > 0 {
+			continue
+		}
+		// Ignore errors - IPv6 may be disabled
+		run(rule.add...)
 	}
 
-	for _, cmdArgs := range commands {
-		cmd := exec.Command(cmdArgs[0], cmdArgs[1:]...)
-		// Ignore errors - rules might fail if table/device doesn't exist
-		cmd.Run()
+	// replace adds the route or leaves an identical one alone
+	routes := [][]string{
+		{"ip", "route", "replace", "local", "0.0.0.0/0", "dev", "lo", "table", "100"},
+		{"ip", "-6", "route", "replace", "local", "::/0", "dev", "lo", "table", "100"},
+	}
+	for _, cmdArgs := range routes {
+		run(cmdArgs...)
 	}
 
 	return nil
 }
 
-// cleanupRouting removes routing policy
+// cleanupRouting removes routing policy with run and returns the commands
+// that removed something
 // Runs multiple times to handle duplicate rules
-func cleanupRouting() {
+func cleanupRouting(run func(args ...string) ([]byte, error)) []string {
 	ruleCommands := [][]string{
 		{"ip", "rule", "del", "fwmark", "1", "lookup", "100"},
 		{"ip", "-6", "rule", "del", "fwmark", "1", "lookup", "100"},
 	}
 
+	var removed []string
 	// Remove rules (may be duplicates, so try multiple times)
 	for i := 0; i < 5; i++ {
 		anySuccess := false
 		for _, cmdArgs := range ruleCommands {
-			cmd := exec.Command(cmdArgs[0], cmdArgs[1:]...)
-			if cmd.Run() == nil {
+			if _, err := run(cmdArgs...); err == nil {
 				anySuccess = true
+				removed = append(removed, strings.Join(cmdArgs, " "))
 			}
 		}
 		// Stop if no rules were deleted
@@ -303,7 +680,9 @@ func cleanupRouting() {
 	}
 
 	for _, cmdArgs := range routeCommands {
-		cmd := exec.Command(cmdArgs[0], cmdArgs[1:]...)
-		cmd.Run() // Ignore errors
+		if _, err := run(cmdArgs...); err == nil {
+			removed = append(removed, strings.Join(cmdArgs, " "))
+		}
 	}
+	return removed
 }
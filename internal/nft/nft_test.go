@@ -0,0 +1,451 @@
+package nft
+
+import (
+	"errors"
+	"net"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/google/nftables"
+)
+
+// fakeConn records queued operations and flushes instead of talking to the kernel
+type fakeConn struct {
+	ops      []string
+	tables   []*nftables.Table
+	elements map[string][]nftables.SetElement
+	sets     map[string]*nftables.Set
+	rules    int
+	flushes  int
+}
+
+func newFakeConn() *fakeConn {
+	return &fakeConn{
+		elements: make(map[string][]nftables.SetElement),
+		sets:     make(map[string]*nftables.Set),
+	}
+}
+
+func (f *fakeConn) AddTable(t *nftables.Table) *nftables.Table {
+	f.ops = append(f.ops, "addtable")
+	return t
+}
+func (f *fakeConn) DelTable(t *nftables.Table) {
+	f.ops = append(f.ops, "deltable")
+	f.tables = slices.DeleteFunc(f.tables, func(table *nftables.Table) bool {
+		return table.Name == t.Name && table.Family == t.Family
+	})
+}
+func (f *fakeConn) ListTables() ([]*nftables.Table, error) { return slices.Clone(f.tables), nil }
+func (f *fakeConn) AddSet(s *nftables.Set, vals []nftables.SetElement) error {
+	f.ops = append(f.ops, "addset")
+	f.sets[s.Name] = s
+	f.elements[s.Name] = append(f.elements[s.Name], vals...)
+	return nil
+}
+func (f *fakeConn) FlushSet(s *nftables.Set) {
+	f.ops = append(f.ops, "flushset")
+	f.elements[s.Name] = nil
+}
+func (f *fakeConn) SetAddElements(s *nftables.Set, vals []nftables.SetElement) error {
+	f.ops = append(f.ops, "addelements")
+	f.elements[s.Name] = append(f.elements[s.Name], vals...)
+	return nil
+}
+func (f *fakeConn) SetDeleteElements(s *nftables.Set, vals []nftables.SetElement) error {
+	f.ops = append(f.ops, "delelements")
+	f.elements[s.Name] = slices.DeleteFunc(f.elements[s.Name], func(e nftables.SetElement) bool {
+		return slices.ContainsFunc(vals, func(v nftables.SetElement) bool {
+			return net.IP(v.Key).Equal(e.Key)
+		})
+	})
+	return nil
+}
+func (f *fakeConn) AddChain(c *nftables.Chain) *nftables.Chain {
+	f.ops = append(f.ops, "addchain")
+	return c
+}
+func (f *fakeConn) FlushChain(c *nftables.Chain) {
+	f.ops = append(f.ops, "flushchain")
+	f.rules = 0
+}
+func (f *fakeConn) AddRule(r *nftables.Rule) *nftables.Rule {
+	f.ops = append(f.ops, "addrule")
+	f.rules++
+	return r
+}
+func (f *fakeConn) Flush() error {
+	f.ops = append(f.ops, "flush")
+	f.flushes++
+	return nil
+}
+
+func TestUpdateRulesAtomicReplace(t *testing.T) {
+	fake := newFakeConn()
+	m := &Manager{conn: fake}
+	m.SetAtomicReplace(true)
+
+	if err := m.ApplyRules([]net.IP{net.ParseIP("192.0.2.1").To4()}); err != nil {
+		t.Fatalf("ApplyRules() error = %v", err)
+	}
+	fake.ops = nil
+	fake.flushes = 0
+
+	want := []net.IP{net.ParseIP("198.51.100.1").To4(), net.ParseIP("198.51.100.2").To4()}
+	if err := m.UpdateRules(want); err != nil {
+		t.Fatalf("UpdateRules() error = %v", err)
+	}
+
+	if fake.flushes != 1 {
+		t.Errorf("UpdateRules() flushed %d times, want 1", fake.flushes)
+	}
+	for _, op := range fake.ops {
+		if op == "deltable" {
+			t.Errorf("UpdateRules() deleted the table; ops = %v", fake.ops)
+		}
+	}
+	if fake.rules != 2 {
+		t.Errorf("chain has %d rules, want 2", fake.rules)
+	}
+
+	elements := fake.elements[setName]
+	if len(elements) != len(want) {
+		t.Fatalf("set has %d elements, want %d", len(elements), len(want))
+	}
+	for i, ip := range want {
+		if !net.IP(elements[i].Key).Equal(ip) {
+			t.Errorf("element %d = %v, want %v", i, net.IP(elements[i].Key), ip)
+		}
+	}
+}
+
+func TestApplyRulesPartitionsFamilies(t *testing.T) {
+	fake := newFakeConn()
+	m := &Manager{conn: fake}
+
+	ips := []net.IP{
+		net.ParseIP("192.0.2.1"), // 16-byte form, as returned by the resolver
+		net.ParseIP("2001:db8::1"),
+		net.ParseIP("198.51.100.7").To4(),
+		net.ParseIP("2001:db8::2"),
+	}
+	if err := m.ApplyRules(ips); err != nil {
+		t.Fatalf("ApplyRules() error = %v", err)
+	}
+
+	tests := []struct {
+		set     string
+		keyType nftables.SetDatatype
+		keyLen  int
+		want    []string
+	}{
+		{set: setName, keyType: nftables.TypeIPAddr, keyLen: net.IPv4len, want: []string{"192.0.2.1", "198.51.100.7"}},
+		{set: set6Name, keyType: nftables.TypeIP6Addr, keyLen: net.IPv6len, want: []string{"2001:db8::1", "2001:db8::2"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.set, func(t *testing.T) {
+			if got := fake.sets[tt.set].KeyType.Name; got != tt.keyType.Name {
+				t.Errorf("key type = %s, want %s", got, tt.keyType.Name)
+			}
+			elements := fake.elements[tt.set]
+			if len(elements) != len(tt.want) {
+				t.Fatalf("set has %d elements, want %d", len(elements), len(tt.want))
+			}
+			for i, want := range tt.want {
+				key := net.IP(elements[i].Key)
+				if len(key) != tt.keyLen || key.String() != want {
+					t.Errorf("element %d = %v (%d bytes), want %s", i, key, len(key), want)
+				}
+			}
+		})
+	}
+
+	if fake.rules != 2 {
+		t.Errorf("chain has %d rules, want 2", fake.rules)
+	}
+}
+
+func TestUpdateRulesIncremental(t *testing.T) {
+	ip := func(s string) net.IP { return net.ParseIP(s) }
+	fake := newFakeConn()
+	m := &Manager{conn: fake}
+
+	if err := m.ApplyRules([]net.IP{ip("192.0.2.1"), ip("192.0.2.2"), ip("2001:db8::1")}); err != nil {
+		t.Fatalf("ApplyRules() error = %v", err)
+	}
+
+	tests := []struct {
+		name    string
+		ips     []net.IP
+		wantOps []string
+		want    map[string][]string
+	}{
+		{
+			name:    "delta only",
+			ips:     []net.IP{ip("192.0.2.2"), ip("192.0.2.3"), ip("2001:db8::1")},
+			wantOps: []string{"delelements", "addelements", "flush"},
+			want:    map[string][]string{setName: {"192.0.2.2", "192.0.2.3"}, set6Name: {"2001:db8::1"}},
+		},
+		{
+			name:    "unchanged",
+			ips:     []net.IP{ip("192.0.2.3"), ip("2001:db8::1"), ip("192.0.2.2")},
+			wantOps: nil,
+			want:    map[string][]string{setName: {"192.0.2.2", "192.0.2.3"}, set6Name: {"2001:db8::1"}},
+		},
+		{
+			name:    "both families",
+			ips:     []net.IP{ip("192.0.2.2"), ip("192.0.2.3"), ip("2001:db8::2")},
+			wantOps: []string{"delelements", "addelements", "flush"},
+			want:    map[string][]string{setName: {"192.0.2.2", "192.0.2.3"}, set6Name: {"2001:db8::2"}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake.ops = nil
+			if err := m.UpdateRules(tt.ips); err != nil {
+				t.Fatalf("UpdateRules() error = %v", err)
+			}
+			if !reflect.DeepEqual(fake.ops, tt.wantOps) {
+				t.Errorf("UpdateRules() ops = %v, want %v", fake.ops, tt.wantOps)
+			}
+			for set, want := range tt.want {
+				var got []string
+				for _, e := range fake.elements[set] {
+					got = append(got, net.IP(e.Key).String())
+				}
+				slices.Sort(got)
+				if !reflect.DeepEqual(got, want) {
+					t.Errorf("set %s = %v, want %v", set, got, want)
+				}
+			}
+		})
+	}
+
+	// After removal the contents are unknown, so the next update rebuilds
+	if err := m.RemoveRules(); err != nil {
+		t.Fatalf("RemoveRules() error = %v", err)
+	}
+	fake.ops = nil
+	if err := m.UpdateRules([]net.IP{ip("192.0.2.9")}); err != nil {
+		t.Fatalf("UpdateRules() error = %v", err)
+	}
+	if !slices.Contains(fake.ops, "flushset") {
+		t.Errorf("UpdateRules() after RemoveRules ops = %v, want a full replace", fake.ops)
+	}
+}
+
+func TestReset(t *testing.T) {
+	fake := newFakeConn()
+	fake.tables = []*nftables.Table{
+		{Family: nftables.TableFamilyINet, Name: "filter"},
+		{Family: nftables.TableFamilyINet, Name: "focusd"},
+		{Family: nftables.TableFamilyINet, Name: "focusd_proxy"},
+	}
+	// One duplicate IPv4 rule and the IPv4 route are left over
+	leftover := map[string]int{
+		"ip rule del fwmark 1 lookup 100":               2,
+		"ip route del local 0.0.0.0/0 dev lo table 100": 1,
+		"ip -6 route del local ::/0 dev lo table 100":   0,
+		"ip -6 rule del fwmark 1 lookup 100":            0,
+	}
+	m := &Manager{conn: fake, run: func(args ...string) ([]byte, error) {
+		cmd := strings.Join(args, " ")
+		if leftover[cmd] == 0 {
+			return nil, errors.New("not found")
+		}
+		leftover[cmd]--
+		return nil, nil
+	}}
+	m.recordApplied([]net.IP{net.ParseIP("192.0.2.1")})
+
+	removed, err := m.Reset()
+	if err != nil {
+		t.Fatalf("Reset() error = %v", err)
+	}
+	want := []string{
+		"table inet focusd",
+		"table inet focusd_proxy",
+		"ip rule del fwmark 1 lookup 100",
+		"ip rule del fwmark 1 lookup 100",
+		"ip route del local 0.0.0.0/0 dev lo table 100",
+	}
+	if !slices.Equal(removed, want) {
+		t.Errorf("Reset() = %q, want %q", removed, want)
+	}
+	if len(fake.tables) != 1 || fake.tables[0].Name != "filter" {
+		t.Errorf("tables after Reset() = %v, want only the unrelated one", fake.tables)
+	}
+	if m.applied != nil {
+		t.Error("Reset() kept the applied addresses, want them unknown")
+	}
+
+	// Nothing left to clean up
+	removed, err = m.Reset()
+	if err != nil || len(removed) != 0 {
+		t.Errorf("Reset() again = %q, %v, want nothing removed", removed, err)
+	}
+}
+
+func TestSetupRoutingIdempotent(t *testing.T) {
+	var calls []string
+	installed := map[string]bool{}
+	run := func(args ...string) ([]byte, error) {
+		cmd := strings.Join(args, " ")
+		calls = append(calls, cmd)
+		switch {
+		case strings.Contains(cmd, " rule list "):
+			if installed[strings.Replace(cmd, " list ", " add ", 1)] {
+				return []byte("32765:	from all fwmark 0x1 lookup 100\n"), nil
+			}
+			return nil, nil
+		case strings.Contains(cmd, " rule add "):
+			installed[cmd] = true
+		}
+		return nil, nil
+	}
+
+	for range 2 {
+		if err := setupRouting(run); err != nil {
+			t.Fatalf("setupRouting() error = %v", err)
+		}
+	}
+
+	adds := 0
+	for _, cmd := range calls {
+		if strings.Contains(cmd, " rule add ") {
+			adds++
+		}
+	}
+	if adds != 2 {
+		t.Errorf("setupRouting() twice added %d rules, want one per family: %q", adds, calls)
+	}
+
+	rules, err := proxyRuleset(ProxyRules{HTTPPort: 8080, HTTPSPort: 8443, Mark: 77})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(strings.TrimSpace(rules), "table inet focusd_proxy\ndelete table inet focusd_proxy\n") {
+		t.Errorf("ruleset doesn't replace an existing table:\n%s", rules)
+	}
+}
+
+func TestCheckCommand(t *testing.T) {
+	ok := func(args ...string) ([]byte, error) { return nil, nil }
+	failing := func(args ...string) ([]byte, error) { return nil, errors.New("exec format error") }
+
+	tests := []struct {
+		name    string
+		command string
+		run     func(args ...string) ([]byte, error)
+		wantErr string
+	}{
+		{name: "runnable", command: "sh", run: ok},
+		{name: "missing", command: "focusd-no-such-command", run: ok, wantErr: "not found in PATH; install pkg"},
+		{name: "not runnable", command: "sh", run: failing, wantErr: "is not runnable (reinstall pkg?)"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := checkCommand(tt.run, tt.command, "pkg", "--version")
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Errorf("checkCommand() error = %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("checkCommand() error = %v, want one containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestProxyRulesetBypass(t *testing.T) {
+	tests := []struct {
+		name        string
+		cidrs       []string
+		inspectQUIC bool
+		blockQUIC   bool
+		blockDoT    bool
+		doh         []string
+		want        []string
+		wantNot     []string
+		wantErr     bool
+	}{
+		{
+			name:    "defaults",
+			want:    []string{"ip daddr 127.0.0.0/8 return", "ip6 daddr ::1/128 return", "ip daddr 192.168.0.0/16 return"},
+			wantNot: []string{"fd00::/8"},
+		},
+		{
+			name:    "replaced",
+			cidrs:   []string{"10.1.0.0/16", "fd00::/8"},
+			want:    []string{"ip daddr 127.0.0.0/8 return", "ip daddr 10.1.0.0/16 return", "ip6 daddr fd00::/8 return"},
+			wantNot: []string{"192.168.0.0/16"},
+		},
+		{
+			name:    "invalid",
+			cidrs:   []string{"10.1.0.0"},
+			wantErr: true,
+		},
+		{
+			name:      "quic dropped",
+			blockQUIC: true,
+			want:      []string{"udp dport 443 drop"},
+			wantNot:   []string{"udp dport 443 tproxy"},
+		},
+		{
+			name:    "quic allowed",
+			wantNot: []string{"udp dport 443"},
+		},
+		{
+			name:        "quic inspected",
+			inspectQUIC: true,
+			blockQUIC:   true,
+			want:        []string{"udp dport 443 tproxy ip to 127.0.0.1:8443", "udp dport 443 tproxy ip6 to [::1]:8443", "udp dport 443 mark set 1 accept"},
+			wantNot:     []string{"udp dport 443 drop"},
+		},
+		{
+			name:     "dot dropped",
+			blockDoT: true,
+			want:     []string{"meta l4proto { tcp, udp } th dport 853 drop"},
+			wantNot:  []string{"DNS-over-HTTPS"},
+		},
+		{
+			name:    "doh resolvers dropped",
+			doh:     []string{"1.1.1.1", "2606:4700:4700::1111", "8.8.8.0/24"},
+			want:    []string{"ip daddr { 1.1.1.1/32, 8.8.8.0/24 } meta l4proto { tcp, udp } th dport 443 drop", "ip6 daddr { 2606:4700:4700::1111/128 } meta l4proto { tcp, udp } th dport 443 drop"},
+			wantNot: []string{"dport 853"},
+		},
+		{
+			name:    "invalid doh resolver",
+			doh:     []string{"dns.google"},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rules, err := proxyRuleset(ProxyRules{HTTPPort: 8080, HTTPSPort: 8443, Mark: 77, BypassCIDRs: tt.cidrs, InspectQUIC: tt.inspectQUIC, BlockQUIC: tt.blockQUIC, BlockDoT: tt.blockDoT, DoHResolvers: tt.doh})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("proxyRuleset() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			for _, want := range append(tt.want, "redirect to :8443", "meta mark 77 return") {
+				if !strings.Contains(rules, want) {
+					t.Errorf("ruleset missing %q", want)
+				}
+			}
+			for _, unwanted := range tt.wantNot {
+				if strings.Contains(rules, unwanted) {
+					t.Errorf("ruleset contains %q", unwanted)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,59 @@
+package nft
+
+import (
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+
+	"github.com/google/nftables"
+	"golang.org/x/sys/unix"
+)
+
+// Preflight checks that the nftables netlink interface is usable. It
+// needs no Manager, so checks can run before the daemon sets one up.
+func Preflight() error {
+	conn := &nftables.Conn{}
+	if _, err := conn.ListTables(); err != nil {
+		return explainNetlinkError(err)
+	}
+	return nil
+}
+
+// CheckCommands checks that the nft and ip commands the transparent proxy
+// rules are applied with are installed and runnable
+func CheckCommands() error {
+	if err := checkCommand(runCommand, "nft", "nftables", "--version"); err != nil {
+		return err
+	}
+	return checkCommand(runCommand, "ip", "iproute2", "-V")
+}
+
+// checkCommand looks name up in PATH and runs it with versionArg, naming
+// pkg as the package that provides it if either fails
+func checkCommand(run func(args ...string) ([]byte, error), name, pkg, versionArg string) error {
+	path, err := exec.LookPath(name)
+	if err != nil {
+		return fmt.Errorf("%s command not found in PATH; install %s: %w", name, pkg, err)
+	}
+	if _, err := run(path, versionArg); err != nil {
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) && len(exitErr.Stderr) > 0 {
+			err = fmt.Errorf("%w: %s", err, strings.TrimSpace(string(exitErr.Stderr)))
+		}
+		return fmt.Errorf("%s command at %s is not runnable (reinstall %s?): %w", name, path, pkg, err)
+	}
+	return nil
+}
+
+// explainNetlinkError turns raw netlink errnos into actionable messages
+func explainNetlinkError(err error) error {
+	switch {
+	case errors.Is(err, unix.EPERM), errors.Is(err, unix.EACCES):
+		return fmt.Errorf("nftables netlink unavailable: permission denied; focusd needs root or CAP_NET_ADMIN (are you in a restricted container?): %w", err)
+	case errors.Is(err, unix.EPROTONOSUPPORT), errors.Is(err, unix.EAFNOSUPPORT):
+		return fmt.Errorf("nftables netlink unavailable: the kernel lacks nf_tables support (is the nf_tables module loaded?): %w", err)
+	default:
+		return fmt.Errorf("nftables netlink unavailable: %w", err)
+	}
+}
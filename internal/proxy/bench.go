@@ -0,0 +1,77 @@
+package proxy
+
+import (
+	"runtime"
+	"time"
+)
+
+// benchTime is roughly how long BenchMatch runs
+const benchTime = time.Second
+
+// BenchResult is the outcome of BenchMatch
+type BenchResult struct {
+	N         int           // number of block decisions timed
+	T         time.Duration // total time taken
+	MemAllocs uint64        // total number of allocations
+	MemBytes  uint64        // total number of bytes allocated
+}
+
+// NsPerOp returns the time taken by one block decision
+func (r BenchResult) NsPerOp() int64 {
+	if r.N <= 0 {
+		return 0
+	}
+	return r.T.Nanoseconds() / int64(r.N)
+}
+
+// AllocsPerOp returns the allocations made by one block decision
+func (r BenchResult) AllocsPerOp() int64 {
+	if r.N <= 0 {
+		return 0
+	}
+	return int64(r.MemAllocs) / int64(r.N)
+}
+
+// AllocedBytesPerOp returns the bytes allocated by one block decision
+func (r BenchResult) AllocedBytesPerOp() int64 {
+	if r.N <= 0 {
+		return 0
+	}
+	return int64(r.MemBytes) / int64(r.N)
+}
+
+// BenchMatch measures the proxy's per-connection block decision for hosts
+// against the given blocklist. It exists so users with large blocklists can
+// see what matching costs on the hot path.
+func BenchMatch(blockedDomains, hosts []string) BenchResult {
+	p := New(blockedDomains, Config{})
+	defer p.cancel()
+
+	// Double the run until it takes long enough to time reliably
+	var r BenchResult
+	for n := 1; r.T < benchTime && n < 1<<30; n *= 2 {
+		r = benchMatch(p, hosts, n)
+	}
+	return r
+}
+
+// benchMatch times n block decisions, cycling through hosts
+func benchMatch(p *TransparentProxy, hosts []string, n int) BenchResult {
+	var before, after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+
+	start := time.Now()
+	for i := 0; i < n; i++ {
+		p.isBlocked(hosts[i%len(hosts)])
+	}
+	elapsed := time.Since(start)
+
+	runtime.ReadMemStats(&after)
+	return BenchResult{
+		N:         n,
+		T:         elapsed,
+		MemAllocs: after.Mallocs - before.Mallocs,
+		MemBytes:  after.TotalAlloc - before.TotalAlloc,
+	}
+}
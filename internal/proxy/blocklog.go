@@ -0,0 +1,178 @@
+package proxy
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// DefaultBlockedLogMaxBytes is the size at which the blocked-attempt log is
+// rotated
+const DefaultBlockedLogMaxBytes = 10 << 20
+
+// blockedLogFlushInterval bounds how long a record may sit in the buffer
+const blockedLogFlushInterval = time.Second
+
+// BlockedAttempt describes one blocked connection attempt
+type BlockedAttempt struct {
+	Time     time.Time `json:"time"`
+	Host     string    `json:"host"`
+	Dest     string    `json:"dest"`
+	Protocol string    `json:"protocol"`
+}
+
+// blockedLog appends blocked attempts as buffered JSON lines. When the file
+// reaches maxBytes it is renamed to path.1 (replacing the previous one), so
+// at most about twice maxBytes is kept.
+type blockedLog struct {
+	mu       sync.Mutex
+	path     string
+	maxBytes int64
+	f        *os.File
+	w        *bufio.Writer
+	size     int64
+}
+
+// openBlockedLog opens (or creates) the blocked-attempt log at path.
+// maxBytes <= 0 uses DefaultBlockedLogMaxBytes.
+func openBlockedLog(path string, maxBytes int64) (*blockedLog, error) {
+	if maxBytes <= 0 {
+		maxBytes = DefaultBlockedLogMaxBytes
+	}
+	l := &blockedLog{path: path, maxBytes: maxBytes}
+	if err := l.open(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// open opens the current file for appending
+func (l *blockedLog) open() error {
+	f, err := os.OpenFile(l.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return fmt.Errorf("opening blocked log: %w", err)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("opening blocked log: %w", err)
+	}
+	l.f = f
+	l.w = bufio.NewWriter(f)
+	l.size = info.Size()
+	return nil
+}
+
+// record appends an attempt; it is safe for concurrent use and a nil log
+// records nothing
+func (l *blockedLog) record(a BlockedAttempt) error {
+	if l == nil {
+		return nil
+	}
+	line, err := json.Marshal(a)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.size > 0 && l.size+int64(len(line)) > l.maxBytes {
+		if err := l.rotate(); err != nil {
+			return err
+		}
+	}
+	n, err := l.w.Write(line)
+	l.size += int64(n)
+	return err
+}
+
+// rotate moves the full file to path.1 and starts a new one
+func (l *blockedLog) rotate() error {
+	if err := l.w.Flush(); err != nil {
+		return err
+	}
+	if err := l.f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(l.path, l.path+".1"); err != nil {
+		return fmt.Errorf("rotating blocked log: %w", err)
+	}
+	return l.open()
+}
+
+// flush writes buffered records to the file
+func (l *blockedLog) flush() error {
+	if l == nil {
+		return nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.w.Flush()
+}
+
+// flushLoop flushes the buffer periodically until the proxy stops, so
+// readers see recent attempts without a write per connection
+func (p *TransparentProxy) flushLoop() {
+	defer p.wg.Done()
+
+	ticker := time.NewTicker(blockedLogFlushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-p.ctx.Done():
+			return
+		case <-ticker.C:
+			p.blocked.flush()
+		}
+	}
+}
+
+// close flushes and closes the file
+func (l *blockedLog) close() error {
+	if l == nil {
+		return nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return errors.Join(l.w.Flush(), l.f.Close())
+}
+
+// ReadBlockedAttempts returns the last n attempts recorded at path
+// (including its rotated predecessor), oldest first. n <= 0 returns all.
+func ReadBlockedAttempts(path string, n int) ([]BlockedAttempt, error) {
+	var attempts []BlockedAttempt
+	for _, file := range []string{path + ".1", path} {
+		f, err := os.Open(file)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("reading blocked log: %w", err)
+		}
+
+		sc := bufio.NewScanner(f)
+		for sc.Scan() {
+			var a BlockedAttempt
+			// Skip a line cut short by a crash
+			if json.Unmarshal(sc.Bytes(), &a) == nil {
+				attempts = append(attempts, a)
+			}
+		}
+		err = sc.Err()
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("reading blocked log: %w", err)
+		}
+	}
+
+	if n > 0 && len(attempts) > n {
+		attempts = attempts[len(attempts)-n:]
+	}
+	return attempts, nil
+}
@@ -0,0 +1,82 @@
+package proxy
+
+import (
+	"fmt"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestBlockedLogRotation(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "blocked.jsonl")
+	l, err := openBlockedLog(path, 1024)
+	if err != nil {
+		t.Fatalf("openBlockedLog() error = %v", err)
+	}
+
+	start := time.Date(2026, 1, 5, 10, 0, 0, 0, time.UTC)
+	for i := range 100 {
+		a := BlockedAttempt{Time: start.Add(time.Duration(i) * time.Second), Host: fmt.Sprintf("site%d.example", i), Dest: "192.0.2.1:443", Protocol: "https"}
+		if err := l.record(a); err != nil {
+			t.Fatalf("record() error = %v", err)
+		}
+	}
+	if err := l.close(); err != nil {
+		t.Fatalf("close() error = %v", err)
+	}
+
+	all, err := ReadBlockedAttempts(path, 0)
+	if err != nil {
+		t.Fatalf("ReadBlockedAttempts() error = %v", err)
+	}
+	// Old records were rotated away, but no more than two files' worth
+	if len(all) == 0 || len(all) >= 100 {
+		t.Fatalf("ReadBlockedAttempts() returned %d records, want some but not all", len(all))
+	}
+	if last := all[len(all)-1].Host; last != "site99.example" {
+		t.Errorf("last record = %s, want site99.example", last)
+	}
+	for i := 1; i < len(all); i++ {
+		if !all[i].Time.After(all[i-1].Time) {
+			t.Fatalf("records out of order at %d", i)
+		}
+	}
+
+	tail, err := ReadBlockedAttempts(path, 3)
+	if err != nil {
+		t.Fatalf("ReadBlockedAttempts() error = %v", err)
+	}
+	if len(tail) != 3 || tail[0].Host != "site97.example" {
+		t.Errorf("ReadBlockedAttempts(3) = %v, want site97..site99", tail)
+	}
+}
+
+func TestBlockedLogConcurrent(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "blocked.jsonl")
+	l, err := openBlockedLog(path, 0)
+	if err != nil {
+		t.Fatalf("openBlockedLog() error = %v", err)
+	}
+
+	var wg sync.WaitGroup
+	for i := range 50 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			l.record(BlockedAttempt{Time: time.Now(), Host: fmt.Sprintf("site%d.example", i), Protocol: "http"})
+		}()
+	}
+	wg.Wait()
+	if err := l.close(); err != nil {
+		t.Fatal(err)
+	}
+
+	all, err := ReadBlockedAttempts(path, 0)
+	if err != nil {
+		t.Fatalf("ReadBlockedAttempts() error = %v", err)
+	}
+	if len(all) != 50 {
+		t.Errorf("ReadBlockedAttempts() returned %d records, want 50", len(all))
+	}
+}
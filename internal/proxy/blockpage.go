@@ -0,0 +1,55 @@
+package proxy
+
+import (
+	"bytes"
+	"html/template"
+	"log/slog"
+	"os"
+	"time"
+)
+
+// defaultBlockPage is the built-in body of the 403 response
+const defaultBlockPage = `<html><body><h1>403 Forbidden</h1><p>{{.Host}} is blocked by focusd</p></body></html>`
+
+var defaultBlockPageTemplate = template.Must(template.New("blockpage").Parse(defaultBlockPage))
+
+// blockPageData is what a block page template is rendered with
+type blockPageData struct {
+	Host string
+	Time string
+}
+
+// loadBlockPage parses the block page template at path, falling back to the
+// built-in page (with a warning) if it can't be read or parsed. An empty path
+// uses the built-in page.
+func loadBlockPage(path string) *template.Template {
+	if path == "" {
+		return defaultBlockPageTemplate
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		slog.Warn("Using the built-in block page", "path", path, "err", err)
+		return defaultBlockPageTemplate
+	}
+	tmpl, err := template.New("blockpage").Parse(string(data))
+	if err != nil {
+		slog.Warn("Using the built-in block page", "path", path, "err", err)
+		return defaultBlockPageTemplate
+	}
+	return tmpl
+}
+
+// renderBlockPage renders the block page for host. A template that fails at
+// execution time (e.g. referencing an unknown field) falls back to the
+// built-in page.
+func (p *TransparentProxy) renderBlockPage(host string, now time.Time) []byte {
+	data := blockPageData{Host: host, Time: now.Format(time.DateTime)}
+
+	var buf bytes.Buffer
+	if err := p.blockPage.Execute(&buf, data); err != nil {
+		slog.Warn("Rendering block page failed, using the built-in page", "err", err)
+		buf.Reset()
+		defaultBlockPageTemplate.Execute(&buf, data)
+	}
+	return buf.Bytes()
+}
@@ -0,0 +1,69 @@
+package proxy
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// splitResponse returns the headers and body of a raw HTTP response
+func splitResponse(t *testing.T, resp string) (string, string) {
+	t.Helper()
+	headers, body, ok := strings.Cut(resp, "\r\n\r\n")
+	if !ok {
+		t.Fatalf("response has no header terminator: %q", resp)
+	}
+	return headers, body
+}
+
+func TestBlockPageTemplate(t *testing.T) {
+	dir := t.TempDir()
+	custom := filepath.Join(dir, "blocked.html")
+	if err := os.WriteFile(custom, []byte("<p>{{.Host}} blocked at {{.Time}}</p>"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	invalid := filepath.Join(dir, "invalid.html")
+	if err := os.WriteFile(invalid, []byte("<p>{{.Host</p>"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	unknownField := filepath.Join(dir, "unknown.html")
+	if err := os.WriteFile(unknownField, []byte("<p>{{.Nope}}</p>"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		path string
+		want string
+	}{
+		{name: "custom", path: custom, want: "<p>reddit.com blocked at "},
+		{name: "built-in", path: "", want: "<h1>403 Forbidden</h1>"},
+		{name: "missing file", path: filepath.Join(dir, "missing.html"), want: "<h1>403 Forbidden</h1>"},
+		{name: "parse error", path: invalid, want: "<h1>403 Forbidden</h1>"},
+		{name: "execution error", path: unknownField, want: "<h1>403 Forbidden</h1>"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := New([]string{"reddit.com"}, Config{BlockPagePath: tt.path})
+			headers, body := splitResponse(t, p.blockedHTTPResponse("reddit.com"))
+
+			if !strings.Contains(body, tt.want) {
+				t.Errorf("body = %q, want it to contain %q", body, tt.want)
+			}
+			if want := "\r\nContent-Length: " + strconv.Itoa(len(body)); !strings.Contains(headers, want) {
+				t.Errorf("headers = %q, want Content-Length %d", headers, len(body))
+			}
+		})
+	}
+}
+
+func TestBlockPageEscapesHost(t *testing.T) {
+	p := New(nil, Config{})
+	_, body := splitResponse(t, p.blockedHTTPResponse("<script>.example"))
+	if strings.Contains(body, "<script>") {
+		t.Errorf("body does not escape the host: %q", body)
+	}
+}
@@ -0,0 +1,101 @@
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"focusd/internal/atomicfile"
+)
+
+// BlockStats counts blocked connections per hostname. It is owned by the
+// daemon rather than a proxy instance, so counts carry over when the proxy
+// is restarted on reload.
+type BlockStats struct {
+	path   string
+	mu     sync.Mutex
+	counts map[string]int64
+}
+
+// BlockCount is the number of blocked connections to one host
+type BlockCount struct {
+	Host  string `json:"host"`
+	Count int64  `json:"count"`
+}
+
+// NewBlockStats creates per-host block counters. If path is set, counts
+// flushed there by a previous run are loaded and Flush writes them back.
+func NewBlockStats(path string) *BlockStats {
+	s := &BlockStats{path: path, counts: make(map[string]int64)}
+	if path == "" {
+		return s
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			slog.Warn("Starting block statistics from zero", "err", err)
+		}
+		return s
+	}
+	var saved []BlockCount
+	if err := json.Unmarshal(data, &saved); err != nil {
+		slog.Warn("Starting block statistics from zero", "path", path, "err", err)
+		return s
+	}
+	for _, c := range saved {
+		s.counts[c.Host] += c.Count
+	}
+	return s
+}
+
+// inc records a blocked connection to host. A nil BlockStats is a no-op.
+func (s *BlockStats) inc(host string) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	s.counts[host]++
+	s.mu.Unlock()
+}
+
+// Counts returns the block count of every host, most blocked first
+func (s *BlockStats) Counts() []BlockCount {
+	s.mu.Lock()
+	counts := make([]BlockCount, 0, len(s.counts))
+	for host, n := range s.counts {
+		counts = append(counts, BlockCount{Host: host, Count: n})
+	}
+	s.mu.Unlock()
+
+	sort.Slice(counts, func(i, j int) bool {
+		if counts[i].Count != counts[j].Count {
+			return counts[i].Count > counts[j].Count
+		}
+		return counts[i].Host < counts[j].Host
+	})
+	return counts
+}
+
+// Flush atomically writes the counts to the stats file, if one is set
+func (s *BlockStats) Flush() error {
+	if s == nil || s.path == "" {
+		return nil
+	}
+	data, err := json.MarshalIndent(s.Counts(), "", "  ")
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(s.path), 0o750); err != nil {
+		return fmt.Errorf("creating block stats directory: %w", err)
+	}
+	if err := atomicfile.Write(s.path, data, 0o640); err != nil {
+		return fmt.Errorf("writing block stats: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,32 @@
+package proxy
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestBlockStats(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "block-stats.json")
+	s := NewBlockStats(path)
+	for _, host := range []string{"b.example", "a.example", "c.example", "c.example", "b.example", "c.example"} {
+		s.inc(host)
+	}
+
+	// Most blocked first, ties by name
+	want := []BlockCount{{"c.example", 3}, {"b.example", 2}, {"a.example", 1}}
+	if got := s.Counts(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Counts() = %v, want %v", got, want)
+	}
+
+	// Flushed counts are picked up by the next run
+	if err := s.Flush(); err != nil {
+		t.Fatalf("Flush() error = %v", err)
+	}
+	restored := NewBlockStats(path)
+	restored.inc("a.example")
+	want = []BlockCount{{"c.example", 3}, {"a.example", 2}, {"b.example", 2}}
+	if got := restored.Counts(); !reflect.DeepEqual(got, want) {
+		t.Errorf("restored Counts() = %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,233 @@
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"focusd/internal/atomicfile"
+)
+
+// budgetUsage tracks time spent on one budgeted blocklist entry today
+type budgetUsage struct {
+	consumed time.Duration
+	active   int
+	since    time.Time
+}
+
+// budgetFile is the persisted form of the day's consumed allowances
+type budgetFile struct {
+	Date     string                   `json:"date"`
+	Consumed map[string]time.Duration `json:"consumed"`
+}
+
+// budgetTracker lets blocked domains be used for a limited time each day.
+//
+// Time is counted while at least one connection to the domain is open, so
+// parallel connections (a browser typically opens several) don't multiply
+// the charge. Usage resets at local midnight.
+type budgetTracker struct {
+	mu      sync.Mutex
+	budgets map[string]time.Duration
+	usage   map[string]*budgetUsage
+	day     string
+	path    string
+	now     func() time.Time
+}
+
+// newBudgetTracker creates a tracker for the given per-entry budgets,
+// restoring today's consumption from path if present
+func newBudgetTracker(budgets map[string]time.Duration, path string) *budgetTracker {
+	b := &budgetTracker{
+		budgets: make(map[string]time.Duration, len(budgets)),
+		usage:   make(map[string]*budgetUsage),
+		path:    path,
+		now:     time.Now,
+	}
+	for domain, budget := range budgets {
+		b.budgets[normalizeHost(domain)] = budget
+	}
+	b.day = dayOf(b.now())
+	b.restore()
+	return b
+}
+
+// dayOf returns the local calendar day of t
+func dayOf(t time.Time) string {
+	return t.Format(time.DateOnly)
+}
+
+// entryFor returns the budgeted entry matching host, or "" if none
+func (b *budgetTracker) entryFor(host string) string {
+	host = normalizeHost(host)
+	best := ""
+	for entry := range b.budgets {
+		if (host == entry || strings.HasSuffix(host, "."+entry)) && len(entry) > len(best) {
+			best = entry
+		}
+	}
+	return best
+}
+
+// acquire starts charging a connection to host against its budget.
+// It returns the remaining allowance and a release func to call when the
+// connection closes, or ok=false if host has no budget or it is exhausted.
+func (b *budgetTracker) acquire(host string) (remaining time.Duration, release func(), ok bool) {
+	if b == nil {
+		return 0, nil, false
+	}
+
+	entry := b.entryFor(host)
+	if entry == "" {
+		return 0, nil, false
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := b.now()
+	b.rollover(now)
+
+	u := b.usageFor(entry)
+	remaining = b.budgets[entry] - u.spent(now)
+	if remaining <= 0 {
+		return 0, nil, false
+	}
+
+	if u.active == 0 {
+		u.since = now
+	}
+	u.active++
+
+	var once sync.Once
+	release = func() {
+		once.Do(func() { b.release(entry) })
+	}
+	return remaining, release, true
+}
+
+// release stops charging one connection to entry
+func (b *budgetTracker) release(entry string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := b.now()
+	u := b.usageFor(entry)
+	u.active--
+	if u.active == 0 {
+		u.consumed += now.Sub(u.since)
+	}
+	b.rollover(now)
+	b.persist()
+}
+
+// rollover resets consumption when the day changes. Callers must hold b.mu.
+func (b *budgetTracker) rollover(now time.Time) {
+	day := dayOf(now)
+	if day == b.day {
+		return
+	}
+	b.day = day
+	for _, u := range b.usage {
+		u.consumed = 0
+		if u.active > 0 {
+			u.since = now
+		}
+	}
+}
+
+// usageFor returns the usage record for entry. Callers must hold b.mu.
+func (b *budgetTracker) usageFor(entry string) *budgetUsage {
+	u, ok := b.usage[entry]
+	if !ok {
+		u = &budgetUsage{}
+		b.usage[entry] = u
+	}
+	return u
+}
+
+// spent returns the time consumed so far, including any open connections
+func (u *budgetUsage) spent(now time.Time) time.Duration {
+	if u.active > 0 {
+		return u.consumed + now.Sub(u.since)
+	}
+	return u.consumed
+}
+
+// restore loads today's consumption from disk, ignoring a file from another day
+func (b *budgetTracker) restore() {
+	if b.path == "" {
+		return
+	}
+	data, err := os.ReadFile(b.path)
+	if os.IsNotExist(err) {
+		return
+	}
+	if err != nil {
+		slog.Warn("Starting budgets from zero", "path", b.path, "err", err)
+		return
+	}
+	var f budgetFile
+	if err := json.Unmarshal(data, &f); err != nil {
+		slog.Warn("Starting budgets from zero", "path", b.path, "err", err)
+		return
+	}
+	if f.Date != b.day {
+		return
+	}
+	for entry, consumed := range f.Consumed {
+		if _, ok := b.budgets[entry]; ok {
+			b.usageFor(entry).consumed = consumed
+		}
+	}
+}
+
+// checkpoint charges open connections up to now and persists the result, so
+// a restarted process doesn't lose time used by connections still open
+func (b *budgetTracker) checkpoint() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := b.now()
+	for _, u := range b.usage {
+		if u.active > 0 {
+			u.consumed += now.Sub(u.since)
+			u.since = now
+		}
+	}
+	return b.persist()
+}
+
+// persist writes the day's consumption to disk. Callers must hold b.mu.
+func (b *budgetTracker) persist() error {
+	if b.path == "" {
+		return nil
+	}
+
+	f := budgetFile{Date: b.day, Consumed: make(map[string]time.Duration, len(b.usage))}
+	for entry, u := range b.usage {
+		f.Consumed[entry] = u.consumed
+	}
+	data, err := json.Marshal(f)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(b.path), 0o750); err != nil {
+		return fmt.Errorf("creating budget directory: %w", err)
+	}
+	if err := atomicfile.Write(b.path, data, 0o640); err != nil {
+		return fmt.Errorf("writing budget file: %w", err)
+	}
+	return nil
+}
+
+// normalizeHost lowercases a hostname and strips any trailing dot
+func normalizeHost(host string) string {
+	return strings.ToLower(strings.TrimSuffix(host, "."))
+}
@@ -0,0 +1,61 @@
+package proxy
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestBudgetTracker(t *testing.T) {
+	now := time.Date(2026, 1, 5, 10, 0, 0, 0, time.Local)
+	path := filepath.Join(t.TempDir(), "budget.json")
+
+	b := newBudgetTracker(map[string]time.Duration{"reddit.com": 30 * time.Minute}, path)
+	b.now = func() time.Time { return now }
+	b.day = dayOf(now)
+
+	if _, _, ok := b.acquire("example.com"); ok {
+		t.Fatal("acquire() allowed a domain without a budget")
+	}
+
+	// Two parallel connections for 20 minutes are charged once
+	remaining, release1, ok := b.acquire("www.reddit.com")
+	if !ok || remaining != 30*time.Minute {
+		t.Fatalf("acquire() = %v, %v, want 30m, true", remaining, ok)
+	}
+	_, release2, ok := b.acquire("reddit.com")
+	if !ok {
+		t.Fatal("acquire() refused second connection")
+	}
+	now = now.Add(20 * time.Minute)
+	release1()
+	release2()
+	release2() // releasing twice must not double count
+
+	remaining, release, ok := b.acquire("reddit.com")
+	if !ok || remaining != 10*time.Minute {
+		t.Fatalf("acquire() = %v, %v, want 10m, true", remaining, ok)
+	}
+	now = now.Add(10 * time.Minute)
+	release()
+
+	if _, _, ok := b.acquire("reddit.com"); ok {
+		t.Fatal("acquire() allowed an exhausted budget")
+	}
+
+	// Consumption survives a restart on the same day
+	restored := newBudgetTracker(map[string]time.Duration{"reddit.com": 30 * time.Minute}, path)
+	restored.now = func() time.Time { return now }
+	restored.day = dayOf(now)
+	restored.usage = map[string]*budgetUsage{}
+	restored.restore()
+	if _, _, ok := restored.acquire("reddit.com"); ok {
+		t.Fatal("restored tracker allowed an exhausted budget")
+	}
+
+	// The budget resets the next day
+	now = now.Add(24 * time.Hour)
+	if remaining, _, ok := b.acquire("reddit.com"); !ok || remaining != 30*time.Minute {
+		t.Fatalf("acquire() after midnight = %v, %v, want 30m, true", remaining, ok)
+	}
+}
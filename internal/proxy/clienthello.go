@@ -0,0 +1,44 @@
+package proxy
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+const (
+	// tlsRecordHeaderLen is the size of a TLS record header
+	tlsRecordHeaderLen = 5
+
+	// tlsContentTypeHandshake is the record type carrying a ClientHello
+	tlsContentTypeHandshake = 0x16
+
+	// maxTLSRecordLen is the largest record payload allowed by TLS (2^14
+	// plaintext plus the permitted expansion), capping what we buffer
+	maxTLSRecordLen = 16384 + 2048
+)
+
+// readClientHello reads the first TLS record from r, looping over short reads
+// until the whole record has arrived. It reads exactly one record, so
+// everything after it stays unread for forwarding. If the data isn't a TLS
+// handshake the bytes read so far are returned for the caller to reject.
+func readClientHello(r io.Reader) ([]byte, error) {
+	buf := make([]byte, tlsRecordHeaderLen, 1024)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return nil, fmt.Errorf("reading record header: %w", err)
+	}
+	if buf[0] != tlsContentTypeHandshake {
+		return buf, nil
+	}
+
+	recordLen := int(binary.BigEndian.Uint16(buf[3:5]))
+	if recordLen > maxTLSRecordLen {
+		return nil, fmt.Errorf("TLS record of %d bytes exceeds limit", recordLen)
+	}
+
+	buf = append(buf, make([]byte, recordLen)...)
+	if _, err := io.ReadFull(r, buf[tlsRecordHeaderLen:]); err != nil {
+		return nil, fmt.Errorf("reading %d-byte record: %w", recordLen, err)
+	}
+	return buf, nil
+}
@@ -0,0 +1,93 @@
+package proxy
+
+import (
+	"bytes"
+	"crypto/tls"
+	"io"
+	"net"
+	"testing"
+
+	"focusd/internal/sni"
+)
+
+// captureClientHello returns the first record a real TLS client sends
+func captureClientHello(t *testing.T, serverName string) []byte {
+	t.Helper()
+
+	client, server := net.Pipe()
+	defer server.Close()
+	go func() {
+		defer client.Close()
+		tls.Client(client, &tls.Config{ServerName: serverName}).Handshake()
+	}()
+
+	hello, err := readClientHello(server)
+	if err != nil {
+		t.Fatalf("capturing ClientHello: %v", err)
+	}
+	return hello
+}
+
+func TestReadClientHelloByteAtATime(t *testing.T) {
+	hello := captureClientHello(t, "example.com")
+	trailing := []byte("next record")
+
+	client, server := net.Pipe()
+	defer server.Close()
+	go func() {
+		defer client.Close()
+		for _, b := range append(bytes.Clone(hello), trailing...) {
+			if _, err := client.Write([]byte{b}); err != nil {
+				return
+			}
+		}
+	}()
+
+	got, err := readClientHello(server)
+	if err != nil {
+		t.Fatalf("readClientHello() error = %v", err)
+	}
+	if !bytes.Equal(got, hello) {
+		t.Fatalf("readClientHello() returned %d bytes, want the %d-byte record", len(got), len(hello))
+	}
+
+	host, err := sni.ExtractSNI(got)
+	if err != nil || host != "example.com" {
+		t.Errorf("ExtractSNI() = %q, %v, want example.com", host, err)
+	}
+
+	// Data after the record is left for forwarding
+	rest, err := io.ReadAll(server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(rest, trailing) {
+		t.Errorf("remaining data = %q, want %q", rest, trailing)
+	}
+}
+
+func TestReadClientHelloErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    []byte
+		want    []byte
+		wantErr bool
+	}{
+		{name: "truncated header", data: []byte{0x16, 0x03}, wantErr: true},
+		{name: "truncated record", data: []byte{0x16, 0x03, 0x01, 0x00, 0x10, 0x01}, wantErr: true},
+		{name: "oversized record", data: []byte{0x16, 0x03, 0x01, 0xff, 0xff}, wantErr: true},
+		{name: "not TLS", data: []byte("GET / HTTP/1.1\r\n"), want: []byte("GET /")},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := readClientHello(bytes.NewReader(tt.data))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("readClientHello() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !bytes.Equal(got, tt.want) {
+				t.Errorf("readClientHello() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
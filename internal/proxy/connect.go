@@ -0,0 +1,186 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+	"syscall"
+	"time"
+
+	"focusd/internal/metrics"
+	"focusd/internal/sni"
+)
+
+// connectTarget returns the host:port a CONNECT request asks to tunnel to
+func connectTarget(request []byte) (string, bool) {
+	line, _, _ := bytes.Cut(request, []byte("\n"))
+	method, rest, _ := strings.Cut(strings.TrimSpace(string(line)), " ")
+	if method != http.MethodConnect {
+		return "", false
+	}
+	target, _, _ := strings.Cut(rest, " ")
+	return target, true
+}
+
+// connectResponse returns a bodiless response to a CONNECT request
+func connectResponse(code int) string {
+	if code == http.StatusOK {
+		return "HTTP/1.1 200 Connection Established\r\n\r\n"
+	}
+	return fmt.Sprintf("HTTP/1.1 %d %s\r\nContent-Length: 0\r\nConnection: close\r\n\r\n", code, http.StatusText(code))
+}
+
+// connectPorts are the ports CONNECT may tunnel to: the ones the
+// transparent proxy inspects. The tunnel leaves with the proxy's mark and
+// skips the nftables rules, so any other port (DNS-over-TLS, say) would
+// get through unchecked.
+var connectPorts = map[string]bool{"80": true, "443": true}
+
+// errBlockedAddress is returned when a CONNECT target is an address that
+// IP blocking drops
+var errBlockedAddress = errors.New("destination address is blocked")
+
+// handleConnect serves a CONNECT request from a client using focusd as an
+// explicit proxy. The target host is checked against the blocklist like a
+// transparently proxied one; if allowed, it is dialed and the client's
+// connection tunneled to it. The first request or ClientHello sent through
+// the tunnel is checked as well, so an allowed target can't front for a
+// blocked host.
+func (p *TransparentProxy) handleConnect(clientConn net.Conn, reader *bufio.Reader, target string, logger *slog.Logger) {
+	start := time.Now()
+
+	host, port, err := net.SplitHostPort(target)
+	if err != nil || host == "" {
+		logger.Debug("Invalid CONNECT target", "target", target)
+		clientConn.Write([]byte(connectResponse(http.StatusBadRequest)))
+		return
+	}
+	logger = logger.With("domain", host, "dest", target)
+
+	refuse := func(host string) {
+		metrics.ProxyConnections.Inc("http", "blocked")
+		logger.Info("Connection", "verdict", "blocked")
+		p.recordBlocked(host, target, "connect", logger)
+	}
+
+	// Not counted towards storms: the original destination is focusd itself
+	if !connectPorts[port] {
+		refuse(host)
+		clientConn.Write([]byte(connectResponse(http.StatusForbidden)))
+		return
+	}
+	release, ok := p.admit(clientConn, host, target, logger)
+	if !ok {
+		refuse(host)
+		clientConn.Write([]byte(connectResponse(http.StatusForbidden)))
+		return
+	}
+	if release != nil {
+		defer release()
+	}
+
+	destConn, err := p.dialConnect(target)
+	if errors.Is(err, errBlockedAddress) {
+		refuse(host)
+		clientConn.Write([]byte(connectResponse(http.StatusForbidden)))
+		return
+	}
+	if err != nil {
+		logger.Warn("Failed to connect to destination", "err", err)
+		clientConn.Write([]byte(connectResponse(http.StatusBadGateway)))
+		return
+	}
+	if _, err := clientConn.Write([]byte(connectResponse(http.StatusOK))); err != nil {
+		destConn.Close()
+		return
+	}
+	tunnel := newBufferedConn(clientConn, reader)
+
+	// Check what the client sends through the tunnel like a transparently
+	// proxied connection to the same port
+	var initialData []byte
+	var send func(io.Writer) (int64, error)
+	inner := host
+	if port == "443" {
+		clientHello, err := readClientHello(tunnel)
+		if err != nil {
+			logger.Debug("Failed to read ClientHello", "err", err)
+			destConn.Close()
+			return
+		}
+		inner, err = sni.ExtractSNI(clientHello)
+		if err != nil {
+			logger.Info("Connection without SNI blocked by default", "err", err)
+			refuse("")
+			sendTLSAlert(clientConn)
+			destConn.Close()
+			return
+		}
+		initialData = clientHello
+	} else {
+		requestHost, request, err := readHTTPRequest(reader)
+		if err != nil || requestHost == "" {
+			logger.Debug("Failed to read request", "err", err)
+			destConn.Close()
+			return
+		}
+		inner, initialData = requestHost, request
+		if !bytes.HasPrefix(request, []byte(h2cPrefaceLine)) {
+			send = func(dst io.Writer) (int64, error) {
+				return p.relayHTTP(dst, reader, request, requestHost, target, logger)
+			}
+		}
+	}
+	if normalizeHost(inner) != normalizeHost(host) {
+		logger = logger.With("tunneled", inner)
+		release, ok := p.admit(clientConn, inner, target, logger)
+		if !ok {
+			refuse(inner)
+			if port == "443" {
+				sendTLSAlert(clientConn)
+			} else {
+				clientConn.Write([]byte(p.blockedHTTPResponse(inner)))
+			}
+			destConn.Close()
+			return
+		}
+		if release != nil {
+			defer release()
+		}
+	}
+
+	metrics.ProxyConnections.Inc("http", "allowed")
+	logger.Info("Connection", "verdict", "allowed")
+	p.relay(tunnel, destConn, start, initialData, send, inner, "connect", logger)
+}
+
+// admit reports whether a tunnel to host may go ahead: host isn't blocked,
+// or has daily budget left. A non-nil release must be called once the
+// tunnel closes.
+func (p *TransparentProxy) admit(conn net.Conn, host, dest string, logger *slog.Logger) (release func(), ok bool) {
+	if !p.blockedHost(host, dest) {
+		return nil, true
+	}
+	return p.useBudget(conn, host, logger)
+}
+
+// dialConnect connects to a CONNECT target like dialUpstream, but refuses
+// addresses that IP blocking drops
+func (p *TransparentProxy) dialConnect(target string) (net.Conn, error) {
+	dialer := p.upstreamDialer()
+	setMark := dialer.Control
+	dialer.Control = func(network, address string, c syscall.RawConn) error {
+		if addrPort, err := netip.ParseAddrPort(address); err == nil && p.blockedIPs.Load().contains(addrPort.Addr()) {
+			return errBlockedAddress
+		}
+		return setMark(network, address, c)
+	}
+	return dialer.Dial("tcp", target)
+}
@@ -0,0 +1,71 @@
+package proxy
+
+import (
+	"bufio"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"testing"
+)
+
+func TestConnectTarget(t *testing.T) {
+	tests := []struct {
+		request string
+		want    string
+		wantOK  bool
+	}{
+		{request: "CONNECT example.com:443 HTTP/1.1\r\nHost: example.com:443\r\n\r\n", want: "example.com:443", wantOK: true},
+		{request: "CONNECT [2001:db8::1]:443 HTTP/1.1\r\n\r\n", want: "[2001:db8::1]:443", wantOK: true},
+		{request: "GET / HTTP/1.1\r\nHost: example.com\r\n\r\n", wantOK: false},
+		{request: "connect example.com:443 HTTP/1.1\r\n\r\n", wantOK: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.want, func(t *testing.T) {
+			got, ok := connectTarget([]byte(tt.request))
+			if got != tt.want || ok != tt.wantOK {
+				t.Errorf("connectTarget(%q) = %q, %v, want %q, %v", tt.request, got, ok, tt.want, tt.wantOK)
+			}
+		})
+	}
+}
+
+func TestHandleConnectRefused(t *testing.T) {
+	p := New([]string{"example.com"}, Config{DoHResolvers: []string{"198.51.100.0/24"}})
+	p.SetBlockedIPs([]net.IP{net.ParseIP("192.0.2.1")})
+
+	tests := []struct {
+		target string
+		want   int
+	}{
+		{target: "www.example.com:443", want: http.StatusForbidden},
+		{target: "example.com", want: http.StatusBadRequest},
+		{target: "example.org:853", want: http.StatusForbidden},
+		{target: "192.0.2.1:443", want: http.StatusForbidden},
+		{target: "198.51.100.7:443", want: http.StatusForbidden},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.target, func(t *testing.T) {
+			client, server := net.Pipe()
+			defer client.Close()
+			go func() {
+				p.handleConnect(server, bufio.NewReader(server), tt.target, slog.New(slog.DiscardHandler))
+				server.Close()
+			}()
+
+			resp, err := http.ReadResponse(bufio.NewReader(client), nil)
+			if err != nil {
+				t.Fatalf("reading response: %v", err)
+			}
+			if resp.StatusCode != tt.want {
+				t.Errorf("handleConnect(%q) status = %d, want %d", tt.target, resp.StatusCode, tt.want)
+			}
+			// The connection is closed rather than tunneled
+			if _, err := client.Read(make([]byte, 1)); err != io.EOF {
+				t.Errorf("Read() after refusal = %v, want EOF", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,137 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"golang.org/x/net/http2/hpack"
+)
+
+const (
+	// h2cPrefaceLine is the first line of the HTTP/2 prior-knowledge preface
+	// ("PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n"), as seen by the line-based HTTP parser
+	h2cPrefaceLine = "PRI * HTTP/2.0\r\n"
+	h2cPrefaceRest = "\r\nSM\r\n\r\n"
+
+	h2FrameHeaders      = 0x1
+	h2FrameContinuation = 0x9
+
+	h2FlagEndHeaders = 0x4
+	h2FlagPadded     = 0x8
+	h2FlagPriority   = 0x20
+
+	// Limits on how much of the connection we inspect looking for HEADERS
+	h2MaxFrames    = 16
+	h2MaxFrameSize = 16384
+)
+
+var errNoAuthority = errors.New("no :authority in HTTP/2 HEADERS")
+
+// readH2CAuthority reads the remainder of an h2c preface and the frames up to
+// and including the first HEADERS block, returning its :authority (or host)
+// header. Everything read is appended to raw so it can be replayed upstream.
+func readH2CAuthority(r *bufio.Reader, raw *bytes.Buffer) (string, error) {
+	rest := make([]byte, len(h2cPrefaceRest))
+	if _, err := io.ReadFull(r, rest); err != nil {
+		return "", fmt.Errorf("reading preface: %w", err)
+	}
+	raw.Write(rest)
+	if string(rest) != h2cPrefaceRest {
+		return "", fmt.Errorf("invalid HTTP/2 preface")
+	}
+
+	var block []byte
+	inHeaders := false
+	for i := 0; i < h2MaxFrames; i++ {
+		var hdr [9]byte
+		if _, err := io.ReadFull(r, hdr[:]); err != nil {
+			return "", fmt.Errorf("reading frame header: %w", err)
+		}
+		raw.Write(hdr[:])
+
+		length := int(hdr[0])<<16 | int(hdr[1])<<8 | int(hdr[2])
+		frameType := hdr[3]
+		flags := hdr[4]
+		if length > h2MaxFrameSize {
+			return "", fmt.Errorf("frame too large: %d bytes", length)
+		}
+
+		payload := make([]byte, length)
+		if _, err := io.ReadFull(r, payload); err != nil {
+			return "", fmt.Errorf("reading frame payload: %w", err)
+		}
+		raw.Write(payload)
+
+		switch {
+		case frameType == h2FrameHeaders && !inHeaders:
+			fragment, err := headersFragment(payload, flags)
+			if err != nil {
+				return "", err
+			}
+			block = append(block, fragment...)
+			inHeaders = true
+		case frameType == h2FrameContinuation && inHeaders:
+			block = append(block, payload...)
+		case inHeaders:
+			return "", fmt.Errorf("unexpected frame type %d in header block", frameType)
+		default:
+			// SETTINGS, WINDOW_UPDATE etc. preceding the first request
+			continue
+		}
+
+		if flags&h2FlagEndHeaders != 0 {
+			return authorityFromBlock(block)
+		}
+	}
+
+	return "", errNoAuthority
+}
+
+// headersFragment strips padding and priority fields from a HEADERS payload
+func headersFragment(payload []byte, flags byte) ([]byte, error) {
+	padLen := 0
+	if flags&h2FlagPadded != 0 {
+		if len(payload) < 1 {
+			return nil, fmt.Errorf("short padded HEADERS frame")
+		}
+		padLen = int(payload[0])
+		payload = payload[1:]
+	}
+	if flags&h2FlagPriority != 0 {
+		if len(payload) < 5 {
+			return nil, fmt.Errorf("short HEADERS priority fields")
+		}
+		payload = payload[5:]
+	}
+	if padLen > len(payload) {
+		return nil, fmt.Errorf("HEADERS padding exceeds payload")
+	}
+	return payload[:len(payload)-padLen], nil
+}
+
+// authorityFromBlock decodes an HPACK header block and returns :authority,
+// falling back to a host header
+func authorityFromBlock(block []byte) (string, error) {
+	fields, err := hpack.NewDecoder(4096, nil).DecodeFull(block)
+	if err != nil {
+		return "", fmt.Errorf("decoding header block: %w", err)
+	}
+
+	var host string
+	for _, f := range fields {
+		switch strings.ToLower(f.Name) {
+		case ":authority":
+			return f.Value, nil
+		case "host":
+			host = f.Value
+		}
+	}
+	if host == "" {
+		return "", errNoAuthority
+	}
+	return host, nil
+}
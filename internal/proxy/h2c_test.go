@@ -0,0 +1,106 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"testing"
+
+	"golang.org/x/net/http2/hpack"
+)
+
+func TestReadH2CAuthority(t *testing.T) {
+	tests := []struct {
+		name    string
+		frames  [][]byte
+		want    string
+		wantErr bool
+	}{
+		{
+			name: "settings then headers",
+			frames: [][]byte{
+				h2Frame(0x4, 0, nil),
+				h2Frame(h2FrameHeaders, h2FlagEndHeaders, encodeHeaders(":method", "GET", ":authority", "blocked.example.com", ":path", "/")),
+			},
+			want: "blocked.example.com",
+		},
+		{
+			name: "padded headers with priority",
+			frames: [][]byte{
+				h2Frame(h2FrameHeaders, h2FlagEndHeaders|h2FlagPadded|h2FlagPriority,
+					append(append([]byte{2, 0, 0, 0, 0, 16}, encodeHeaders(":authority", "example.com")...), 0, 0)),
+			},
+			want: "example.com",
+		},
+		{
+			name: "continuation",
+			frames: func() [][]byte {
+				block := encodeHeaders(":method", "GET", ":authority", "split.example.com")
+				return [][]byte{
+					h2Frame(h2FrameHeaders, 0, block[:3]),
+					h2Frame(h2FrameContinuation, h2FlagEndHeaders, block[3:]),
+				}
+			}(),
+			want: "split.example.com",
+		},
+		{
+			name: "host header fallback",
+			frames: [][]byte{
+				h2Frame(h2FrameHeaders, h2FlagEndHeaders, encodeHeaders(":method", "GET", "host", "legacy.example.com")),
+			},
+			want: "legacy.example.com",
+		},
+		{
+			name: "no authority",
+			frames: [][]byte{
+				h2Frame(h2FrameHeaders, h2FlagEndHeaders, encodeHeaders(":method", "GET")),
+			},
+			wantErr: true,
+		},
+		{
+			name:    "truncated",
+			frames:  [][]byte{{0x00, 0x00}},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			input := []byte(h2cPrefaceLine + h2cPrefaceRest)
+			for _, f := range tt.frames {
+				input = append(input, f...)
+			}
+
+			// handleHTTP has already consumed the first preface line
+			r := bufio.NewReader(bytes.NewReader(input[len(h2cPrefaceLine):]))
+			raw := bytes.NewBufferString(h2cPrefaceLine)
+
+			got, err := readH2CAuthority(r, raw)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("readH2CAuthority() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("readH2CAuthority() = %q, want %q", got, tt.want)
+			}
+			if !tt.wantErr && !bytes.Equal(raw.Bytes(), input) {
+				t.Errorf("raw buffer does not match the bytes read from the client")
+			}
+		})
+	}
+}
+
+// h2Frame builds an HTTP/2 frame on stream 1
+func h2Frame(frameType, flags byte, payload []byte) []byte {
+	n := len(payload)
+	frame := []byte{byte(n >> 16), byte(n >> 8), byte(n), frameType, flags, 0, 0, 0, 1}
+	return append(frame, payload...)
+}
+
+// encodeHeaders HPACK-encodes name/value pairs
+func encodeHeaders(kv ...string) []byte {
+	var buf bytes.Buffer
+	enc := hpack.NewEncoder(&buf)
+	for i := 0; i < len(kv); i += 2 {
+		enc.WriteField(hpack.HeaderField{Name: kv[i], Value: kv[i+1]})
+	}
+	return buf.Bytes()
+}
@@ -0,0 +1,57 @@
+package proxy
+
+import (
+	"net"
+	"net/netip"
+)
+
+// ipBlocklist holds the addresses nftables drops. The proxy's own
+// connections carry its mark and skip those rules, so CONNECT tunnels are
+// checked against it instead.
+type ipBlocklist struct {
+	addrs    map[netip.Addr]bool
+	prefixes []netip.Prefix
+}
+
+// newIPBlocklist returns a blocklist of ips and every address in prefixes
+func newIPBlocklist(ips []net.IP, prefixes []netip.Prefix) *ipBlocklist {
+	b := &ipBlocklist{addrs: make(map[netip.Addr]bool, len(ips)), prefixes: prefixes}
+	for _, ip := range ips {
+		if addr, ok := netip.AddrFromSlice(ip); ok {
+			b.addrs[addr.Unmap()] = true
+		}
+	}
+	return b
+}
+
+// contains reports whether addr is blocked
+func (b *ipBlocklist) contains(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	if b.addrs[addr] {
+		return true
+	}
+	for _, prefix := range b.prefixes {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// parsePrefixes parses addresses and CIDRs, skipping invalid entries (the
+// config is validated before it gets here)
+func parsePrefixes(entries []string) []netip.Prefix {
+	var prefixes []netip.Prefix
+	for _, entry := range entries {
+		prefix, err := netip.ParsePrefix(entry)
+		if err != nil {
+			addr, err := netip.ParseAddr(entry)
+			if err != nil {
+				continue
+			}
+			prefix = netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen())
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	return prefixes
+}
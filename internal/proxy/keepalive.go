@@ -0,0 +1,157 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"focusd/internal/metrics"
+)
+
+// errBlockedRequest ends a persistent connection whose next request is for a
+// blocked host
+var errBlockedRequest = errors.New("request for a blocked host")
+
+// errNoHost ends a persistent connection whose next request has no host to
+// check, as the first request would have been
+var errNoHost = errors.New("request without a Host header")
+
+// relayHTTP forwards the requests of an HTTP/1.x connection to dst. head is
+// the first request's head, already sent upstream; each request after it is
+// checked against the blocklist before being relayed, so a connection reused
+// for another virtual host can't get past the proxy. Requests are relayed
+// verbatim. It stops after a request that asks to close the connection, and
+// falls back to tunneling the rest of the connection once a request can't be
+// parsed or switches protocols.
+//
+// A blocked request can't be answered with the block page while responses
+// to earlier ones may still be in flight, so errBlockedRequest is returned
+// and the connection torn down instead. The client retries on a new
+// connection, which gets the block page.
+func (p *TransparentProxy) relayHTTP(dst io.Writer, reader *bufio.Reader, head []byte, host, origDst string, logger *slog.Logger) (int64, error) {
+	var sent int64
+	first := normalizeHost(host)
+	for {
+		req, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(head)))
+		if err != nil || req.ProtoMajor != 1 || req.Method == http.MethodConnect || req.Header.Get("Upgrade") != "" {
+			n, err := copyPooled(dst, reader)
+			return sent + n, err
+		}
+
+		n, err := relayBody(dst, reader, req)
+		sent += n
+		if err != nil || req.Close {
+			return sent, err
+		}
+
+		host, head, err = readHTTPRequest(reader)
+		if errors.Is(err, io.EOF) {
+			return sent, nil
+		}
+		if err != nil {
+			return sent, err
+		}
+		if host == "" {
+			return sent, errNoHost
+		}
+
+		// Allowed hosts, and the one the connection was opened for (which may
+		// be using its daily budget), need no further check
+		if normalizeHost(host) != first && p.blockedHost(host, origDst) {
+			// Not counted towards storms: the destination also serves
+			// allowed hosts
+			metrics.ProxyConnections.Inc("http", "blocked")
+			logger.Info("Request", "domain", host, "verdict", "blocked")
+			p.recordBlocked(host, origDst, "http", logger)
+			return sent, errBlockedRequest
+		}
+		logger.Debug("Request", "domain", host)
+
+		m, err := dst.Write(head)
+		sent += int64(m)
+		if err != nil {
+			return sent, err
+		}
+	}
+}
+
+// blockedHost reports whether requests for host should be blocked, falling
+// back to the destination's PTR name for bare IPs
+func (p *TransparentProxy) blockedHost(host, origDst string) bool {
+	return p.isBlocked(host) || (net.ParseIP(host) != nil && p.isBlockedByPTR(origDst))
+}
+
+// relayBody forwards req's body from reader to dst, framed as the client
+// sent it. Requests without a length or chunked encoding have no body.
+func relayBody(dst io.Writer, reader *bufio.Reader, req *http.Request) (int64, error) {
+	// http.ReadRequest rejects every transfer coding but chunked
+	if len(req.TransferEncoding) > 0 {
+		return relayChunked(dst, reader)
+	}
+	if req.ContentLength <= 0 {
+		return 0, nil
+	}
+	n, err := copyPooled(dst, io.LimitReader(reader, req.ContentLength))
+	if err == nil && n < req.ContentLength {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+// relayChunked forwards a chunked body, including its trailer, verbatim
+func relayChunked(dst io.Writer, reader *bufio.Reader) (int64, error) {
+	var sent int64
+	relayLine := func() (string, error) {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return "", err
+		}
+		n, err := io.WriteString(dst, line)
+		sent += int64(n)
+		return line, err
+	}
+
+	for {
+		line, err := relayLine()
+		if err != nil {
+			return sent, err
+		}
+		sizeField, _, _ := strings.Cut(strings.TrimSpace(line), ";")
+		size, err := strconv.ParseInt(strings.TrimSpace(sizeField), 16, 64)
+		if err != nil || size < 0 || size > math.MaxInt64-2 {
+			return sent, fmt.Errorf("invalid chunk size %q", sizeField)
+		}
+		if size == 0 {
+			break
+		}
+
+		// Chunk data and its CRLF
+		n, err := copyPooled(dst, io.LimitReader(reader, size+2))
+		sent += n
+		if err != nil {
+			return sent, err
+		}
+		if n < size+2 {
+			return sent, io.ErrUnexpectedEOF
+		}
+	}
+
+	// Trailer fields, up to the empty line ending the body
+	for {
+		line, err := relayLine()
+		if err != nil {
+			return sent, err
+		}
+		if line == "\r\n" || line == "\n" {
+			return sent, nil
+		}
+	}
+}
@@ -0,0 +1,65 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"log/slog"
+	"strings"
+	"testing"
+)
+
+func TestRelayHTTP(t *testing.T) {
+	const (
+		first    = "GET / HTTP/1.1\r\nHost: news.example.org\r\n\r\n"
+		post     = "POST /form HTTP/1.1\r\nHost: news.example.org\r\nContent-Length: 5\r\n\r\nhello"
+		chunked  = "POST /up HTTP/1.1\r\nHost: cdn.example.org\r\nTransfer-Encoding: chunked\r\n\r\n5;ext=1\r\nhello\r\n0\r\nX-Sum: 1\r\n\r\n"
+		blocked  = "GET / HTTP/1.1\r\nHost: www.example.com\r\n\r\n"
+		closing  = "GET /bye HTTP/1.1\r\nHost: news.example.org\r\nConnection: close\r\n\r\n"
+		upgrade  = "GET /ws HTTP/1.1\r\nHost: news.example.org\r\nConnection: Upgrade\r\nUpgrade: websocket\r\n\r\n"
+		noHost   = "GET / HTTP/1.1\r\n\r\n"
+		garbage  = "\x16\x03\x01 not http\r\n\r\n"
+		frames   = "\x81\x05hello"
+		budgeted = "GET / HTTP/1.1\r\nHost: example.com\r\n\r\n"
+	)
+
+	tests := []struct {
+		name    string
+		head    string
+		rest    string
+		want    string
+		wantErr error
+	}{
+		{name: "persistent", head: first, rest: post + chunked, want: post + chunked},
+		{name: "blocked vhost", head: first, rest: post + blocked + first, want: post, wantErr: errBlockedRequest},
+		{name: "connection close", head: closing, rest: blocked, want: ""},
+		{name: "http/1.0", head: "GET / HTTP/1.0\r\nHost: news.example.org\r\n\r\n", rest: blocked, want: ""},
+		{name: "upgrade tunnels", head: upgrade, rest: frames + blocked, want: frames + blocked},
+		{name: "unparseable tunnels", head: garbage, rest: blocked, want: blocked},
+		{name: "no host", head: first, rest: noHost, want: "", wantErr: errNoHost},
+		{name: "same host as first", head: budgeted, rest: budgeted + budgeted, want: budgeted + budgeted},
+	}
+
+	p := New([]string{"example.com"}, Config{})
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var dst bytes.Buffer
+			reader := bufio.NewReader(strings.NewReader(tt.rest))
+			host, head, err := readHTTPRequest(bufio.NewReader(strings.NewReader(tt.head)))
+			if err != nil {
+				head = []byte(tt.head)
+			}
+
+			n, err := p.relayHTTP(&dst, reader, head, host, "192.0.2.1:80", slog.New(slog.DiscardHandler))
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("relayHTTP() error = %v, want %v", err, tt.wantErr)
+			}
+			if got := dst.String(); got != tt.want {
+				t.Errorf("relayHTTP() sent %q, want %q", got, tt.want)
+			}
+			if n != int64(dst.Len()) {
+				t.Errorf("relayHTTP() = %d, but sent %d bytes", n, dst.Len())
+			}
+		})
+	}
+}
@@ -0,0 +1,45 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"syscall"
+)
+
+// Preflight checks that the kernel allows transparent proxy sockets
+func Preflight() error {
+	fd, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_STREAM, 0)
+	if err != nil {
+		return fmt.Errorf("creating test socket: %w", err)
+	}
+	defer syscall.Close(fd)
+
+	if err := syscall.SetsockoptInt(fd, syscall.SOL_IP, IP_TRANSPARENT, 1); err != nil {
+		return explainTransparentError(err)
+	}
+	return nil
+}
+
+// explainTransparentError turns IP_TRANSPARENT failures into actionable messages
+func explainTransparentError(err error) error {
+	switch {
+	case errors.Is(err, syscall.EPERM):
+		return fmt.Errorf("cannot set IP_TRANSPARENT: focusd needs root or CAP_NET_ADMIN (are you in a restricted container?): %w", err)
+	case errors.Is(err, syscall.ENOPROTOOPT):
+		return fmt.Errorf("cannot set IP_TRANSPARENT: the kernel does not support transparent proxying: %w", err)
+	default:
+		return fmt.Errorf("setting IP_TRANSPARENT: %w", err)
+	}
+}
+
+// explainOriginalDstError turns SO_ORIGINAL_DST failures into actionable messages
+func explainOriginalDstError(errno syscall.Errno) error {
+	switch errno {
+	case syscall.ENOPROTOOPT:
+		return fmt.Errorf("getsockopt SO_ORIGINAL_DST unsupported (is the nf_conntrack module loaded?): %w", errno)
+	case syscall.ENOENT:
+		return fmt.Errorf("getsockopt SO_ORIGINAL_DST: no conntrack entry (was the connection redirected by nftables?): %w", errno)
+	default:
+		return fmt.Errorf("getsockopt SO_ORIGINAL_DST: %w", errno)
+	}
+}
@@ -4,33 +4,45 @@ import (
 	"bufio"
 	"bytes"
 	"context"
+	"encoding/binary"
 	"fmt"
+	"html/template"
 	"io"
-	"log"
+	"log/slog"
 	"net"
+	"net/netip"
 	"os"
+	"slices"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 	"unsafe"
 
+	"focusd/internal/matcher"
+	"focusd/internal/metrics"
 	"focusd/internal/sni"
 	"golang.org/x/sys/unix"
 )
 
 const (
 	// Socket options for transparent proxying
-	SO_ORIGINAL_DST = 80
-	IP_TRANSPARENT  = 19
-	SO_MARK         = 36
+	SO_ORIGINAL_DST  = 80
+	IP_TRANSPARENT   = 19
+	IPV6_TRANSPARENT = 75
+	SO_MARK          = 36
 
-	// Proxy ports
-	HTTPPort  = 50080
-	HTTPSPort = 50443
+	// Default proxy ports
+	DefaultHTTPPort  = 50080
+	DefaultHTTPSPort = 50443
 
-	// Firewall mark for proxy's own connections (prevents routing loops)
-	ProxyMark = 50
+	// Default firewall mark for proxy's own connections (prevents routing loops)
+	DefaultMark = 50
+
+	// DefaultMaxConnections is the default limit on connections handled at once
+	DefaultMaxConnections = 4096
 
 	// Timeouts
 	ReadTimeout    = 30 * time.Second
@@ -38,55 +50,281 @@ const (
 	ForwardTimeout = 5 * time.Minute
 )
 
+// Config holds optional transparent proxy settings
+type Config struct {
+	// ReverseDNSBlock blocks connections whose Host/SNI is a bare IP address
+	// if the destination's PTR record matches the blocklist
+	ReverseDNSBlock bool
+
+	// IdleTimeout is how long a connection may go without traffic before the
+	// reaper force-closes it (default: ForwardTimeout)
+	IdleTimeout time.Duration
+
+	// UsageLogPath, if set, records metadata (host, duration, bytes) of
+	// allowed connections as JSON lines when they close
+	UsageLogPath string
+
+	// UsageSampleRate is the fraction of allowed connections recorded (default: all)
+	UsageSampleRate float64
+
+	// HTTPPort and HTTPSPort are the ports intercepted HTTP and HTTPS
+	// traffic is redirected to (default: DefaultHTTPPort, DefaultHTTPSPort)
+	HTTPPort  int
+	HTTPSPort int
+
+	// Mark is the firewall mark set on the proxy's outbound connections so
+	// they aren't intercepted again (default: DefaultMark)
+	Mark int
+
+	// MaxConnections is how many connections are handled at once across
+	// both listeners; further connections are closed straight away
+	// (default: DefaultMaxConnections)
+	MaxConnections int
+
+	// ListenAddr is the IPv4 or IPv6 address the listeners bind to
+	// (default: all IPv4 interfaces). An IPv6 address such as "::" binds
+	// dual-stack and also accepts IPv4 connections.
+	ListenAddr string
+
+	// Budgets lets blocked entries be used for a limited time each day
+	Budgets map[string]time.Duration
+
+	// BudgetStatePath is where consumed budgets are persisted
+	BudgetStatePath string
+
+	// AllowedDomains are never blocked by the proxy, even under a blocked
+	// parent domain, unless a more specific entry blocks them again
+	AllowedDomains []string
+
+	// Redirects maps blocked domains to an alternative URL that blocked
+	// HTTP requests are redirected to
+	Redirects map[string]string
+
+	// BlockedLogPath, if set, is where blocked attempts are recorded
+	BlockedLogPath string
+
+	// BlockedLogMaxBytes is the size at which the blocked log is rotated
+	// (default: DefaultBlockedLogMaxBytes)
+	BlockedLogMaxBytes int64
+
+	// BlockStats, if set, counts blocked connections per host
+	BlockStats *BlockStats
+
+	// BlockPagePath is an HTML template for the 403 page shown for blocked
+	// HTTP requests, rendered with {{.Host}} and {{.Time}}
+	BlockPagePath string
+
+	// HTTPBlockMode selects how blocked HTTP requests are answered
+	// (default: HTTPBlockForbidden)
+	HTTPBlockMode HTTPBlockMode
+
+	// InspectQUIC relays QUIC (HTTP/3) sent to HTTPSPort over UDP, reading
+	// the SNI from each flow's Initial packets, instead of leaving it to be
+	// dropped so clients fall back to TCP
+	InspectQUIC bool
+
+	// BlockRedirectURL is where blocked HTTP requests are redirected in
+	// HTTPBlockRedirect mode, unless Redirects has an entry for the host
+	BlockRedirectURL string
+
+	// DoHResolvers are addresses or CIDRs of DNS-over-HTTPS resolvers,
+	// which CONNECT tunnels may not reach
+	DoHResolvers []string
+}
+
 // TransparentProxy implements a transparent HTTP/HTTPS proxy with SNI inspection
 type TransparentProxy struct {
-	blockedDomains []string
-	httpListener   net.Listener
-	httpsListener  net.Listener
-	ctx            context.Context
-	cancel         context.CancelFunc
-	wg             sync.WaitGroup
+	matcher        atomic.Pointer[matcher.Matcher]
+	allowed        []string
+	blockedIPs     atomic.Pointer[ipBlocklist]
+	dohResolvers   []netip.Prefix
+	ptr            *ptrCache
+	tracker        *connTracker
+	storms         *stormTracker
+	idleTimeout    time.Duration
+	usageLogPath   string
+	usageRate      float64
+	usage          *usageLog
+	blockedLogPath string
+	blockedLogMax  int64
+	blocked        *blockedLog
+	blockStats     *BlockStats
+	listenAddr     string
+	listenIP       net.IP
+	httpPort       int
+	httpsPort      int
+	mark           int
+	slots          chan struct{}
+	inFlight       atomic.Int64
+	connIDs        atomic.Uint64
+	budgets        *budgetTracker
+	redirects      map[string]string
+	blockPage      *template.Template
+
+	httpBlockMode    HTTPBlockMode
+	blockRedirectURL string
+	httpListener     net.Listener
+	httpsListener    net.Listener
+	inspectQUIC      bool
+	quicConn         *net.UDPConn
+	quicMu           sync.Mutex
+	quicFlows        map[quicFlowKey]*quicFlow
+	ctx              context.Context
+	cancel           context.CancelFunc
+	wg               sync.WaitGroup
 }
 
 // New creates a new transparent proxy
-func New(blockedDomains []string) *TransparentProxy {
+func New(blockedDomains []string, cfg Config) *TransparentProxy {
 	ctx, cancel := context.WithCancel(context.Background())
-	return &TransparentProxy{
-		blockedDomains: blockedDomains,
-		ctx:            ctx,
-		cancel:         cancel,
-	}
+	p := &TransparentProxy{
+		allowed:          cfg.AllowedDomains,
+		tracker:          newConnTracker(),
+		storms:           newStormTracker(),
+		idleTimeout:      cfg.IdleTimeout,
+		usageLogPath:     cfg.UsageLogPath,
+		usageRate:        cfg.UsageSampleRate,
+		blockedLogPath:   cfg.BlockedLogPath,
+		blockedLogMax:    cfg.BlockedLogMaxBytes,
+		blockStats:       cfg.BlockStats,
+		listenAddr:       cfg.ListenAddr,
+		listenIP:         net.ParseIP(cfg.ListenAddr),
+		httpPort:         cfg.HTTPPort,
+		httpsPort:        cfg.HTTPSPort,
+		mark:             cfg.Mark,
+		redirects:        newRedirects(cfg.Redirects),
+		blockPage:        loadBlockPage(cfg.BlockPagePath),
+		httpBlockMode:    cfg.HTTPBlockMode,
+		blockRedirectURL: cfg.BlockRedirectURL,
+		inspectQUIC:      cfg.InspectQUIC,
+		dohResolvers:     parsePrefixes(cfg.DoHResolvers),
+		quicFlows:        make(map[quicFlowKey]*quicFlow),
+		ctx:              ctx,
+		cancel:           cancel,
+	}
+	p.SetBlockedDomains(blockedDomains)
+	p.SetBlockedIPs(nil)
+	if p.idleTimeout <= 0 {
+		p.idleTimeout = ForwardTimeout
+	}
+	if p.httpPort <= 0 {
+		p.httpPort = DefaultHTTPPort
+	}
+	if p.httpsPort <= 0 {
+		p.httpsPort = DefaultHTTPSPort
+	}
+	if p.mark <= 0 {
+		p.mark = DefaultMark
+	}
+	maxConns := cfg.MaxConnections
+	if maxConns <= 0 {
+		maxConns = DefaultMaxConnections
+	}
+	p.slots = make(chan struct{}, maxConns)
+	if cfg.ReverseDNSBlock {
+		p.ptr = newPTRCache()
+	}
+	if len(cfg.Budgets) > 0 {
+		p.budgets = newBudgetTracker(cfg.Budgets, cfg.BudgetStatePath)
+	}
+	return p
+}
+
+// Ports returns the ports the proxy listens on for HTTP and HTTPS
+func (p *TransparentProxy) Ports() (httpPort, httpsPort int) {
+	return p.httpPort, p.httpsPort
+}
+
+// Mark returns the firewall mark of the proxy's outbound connections
+func (p *TransparentProxy) Mark() int {
+	return p.mark
+}
+
+// SetBlockedDomains replaces the blocklist while the proxy is running.
+// Connections already being handled keep the verdict they got; new ones
+// are matched against domains.
+func (p *TransparentProxy) SetBlockedDomains(domains []string) {
+	p.matcher.Store(matcher.New(domains, p.allowed))
+}
+
+// SetBlockedIPs replaces the IP-blocked addresses CONNECT tunnels are
+// refused to, on top of the DoH resolvers
+func (p *TransparentProxy) SetBlockedIPs(ips []net.IP) {
+	p.blockedIPs.Store(newIPBlocklist(ips, p.dohResolvers))
+}
+
+// InFlight returns the number of connections currently being handled
+func (p *TransparentProxy) InFlight() int {
+	return int(p.inFlight.Load())
 }
 
 // Start starts the transparent proxy servers
 func (p *TransparentProxy) Start() error {
+	// Open usage log if enabled
+	if p.usageLogPath != "" {
+		usage, err := openUsageLog(p.usageLogPath, p.usageRate)
+		if err != nil {
+			return err
+		}
+		p.usage = usage
+	}
+
+	// Open blocked-attempt log if enabled
+	if p.blockedLogPath != "" {
+		blocked, err := openBlockedLog(p.blockedLogPath, p.blockedLogMax)
+		if err != nil {
+			p.usage.close()
+			return err
+		}
+		p.blocked = blocked
+	}
+
 	// Start HTTP proxy
-	httpListener, err := p.createTransparentListener(HTTPPort)
+	httpListener, err := p.createTransparentListener(p.httpPort)
 	if err != nil {
+		p.usage.close()
+		p.blocked.close()
 		return fmt.Errorf("creating HTTP listener: %w", err)
 	}
 	p.httpListener = httpListener
 
 	// Start HTTPS proxy
-	httpsListener, err := p.createTransparentListener(HTTPSPort)
+	httpsListener, err := p.createTransparentListener(p.httpsPort)
 	if err != nil {
 		p.httpListener.Close()
+		p.usage.close()
+		p.blocked.close()
 		return fmt.Errorf("creating HTTPS listener: %w", err)
 	}
 	p.httpsListener = httpsListener
 
 	// Start accepting connections
-	p.wg.Add(2)
-	go p.acceptLoop(p.httpListener, p.handleHTTP)
-	go p.acceptLoop(p.httpsListener, p.handleHTTPS)
+	p.wg.Add(3)
+	go p.acceptLoop(p.httpListener, "http", p.handleHTTP)
+	go p.acceptLoop(p.httpsListener, "https", p.handleHTTPS)
+	go p.reapLoop()
+	if p.blocked != nil {
+		p.wg.Add(1)
+		go p.flushLoop()
+	}
+	p.startQUIC()
 
-	log.Printf("Transparent proxy started: HTTP=%d, HTTPS=%d", HTTPPort, HTTPSPort)
+	slog.Info("Transparent proxy started", "http_port", p.httpPort, "https_port", p.httpsPort, "quic", p.InspectingQUIC())
 	return nil
 }
 
+// SaveState persists runtime state (daily budget consumption, including
+// connections still open) so a replacement process can pick it up
+func (p *TransparentProxy) SaveState() error {
+	if p.budgets == nil {
+		return nil
+	}
+	return p.budgets.checkpoint()
+}
+
 // Stop stops the transparent proxy
 func (p *TransparentProxy) Stop() error {
-	log.Println("Stopping transparent proxy...")
+	slog.Info("Stopping transparent proxy")
 	p.cancel()
 
 	if p.httpListener != nil {
@@ -95,6 +333,7 @@ func (p *TransparentProxy) Stop() error {
 	if p.httpsListener != nil {
 		p.httpsListener.Close()
 	}
+	p.stopQUIC()
 
 	// Wait for all connections to finish (with timeout)
 	done := make(chan struct{})
@@ -105,9 +344,16 @@ func (p *TransparentProxy) Stop() error {
 
 	select {
 	case <-done:
-		log.Println("Transparent proxy stopped cleanly")
+		slog.Info("Transparent proxy stopped cleanly")
 	case <-time.After(10 * time.Second):
-		log.Println("Transparent proxy stopped (timeout waiting for connections)")
+		slog.Warn("Transparent proxy stopped (timeout waiting for connections)")
+	}
+
+	if err := p.usage.close(); err != nil {
+		slog.Warn("Error closing usage log", "err", err)
+	}
+	if err := p.blocked.close(); err != nil {
+		slog.Warn("Error closing blocked log", "err", err)
 	}
 
 	return nil
@@ -115,8 +361,20 @@ func (p *TransparentProxy) Stop() error {
 
 // createTransparentListener creates a transparent socket listener
 func (p *TransparentProxy) createTransparentListener(port int) (net.Listener, error) {
+	// Falling back to all interfaces would silently widen what's exposed
+	if p.listenAddr != "" && p.listenIP == nil {
+		return nil, fmt.Errorf("invalid listen address %q", p.listenAddr)
+	}
+
+	ipv6 := p.listenIP != nil && p.listenIP.To4() == nil
+
+	family := syscall.AF_INET
+	if ipv6 {
+		family = syscall.AF_INET6
+	}
+
 	// Create socket
-	fd, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_STREAM, 0)
+	fd, err := syscall.Socket(family, syscall.SOCK_STREAM, 0)
 	if err != nil {
 		return nil, fmt.Errorf("creating socket: %w", err)
 	}
@@ -127,14 +385,25 @@ func (p *TransparentProxy) createTransparentListener(port int) (net.Listener, er
 		return nil, fmt.Errorf("setting SO_REUSEADDR: %w", err)
 	}
 
-	if err := syscall.SetsockoptInt(fd, syscall.SOL_IP, IP_TRANSPARENT, 1); err != nil {
-		syscall.Close(fd)
-		return nil, fmt.Errorf("setting IP_TRANSPARENT: %w", err)
+	if ipv6 {
+		if err := syscall.SetsockoptInt(fd, syscall.SOL_IPV6, IPV6_TRANSPARENT, 1); err != nil {
+			syscall.Close(fd)
+			return nil, fmt.Errorf("setting IPV6_TRANSPARENT: %w", err)
+		}
+		// Accept IPv4-mapped connections too
+		if err := syscall.SetsockoptInt(fd, syscall.IPPROTO_IPV6, syscall.IPV6_V6ONLY, 0); err != nil {
+			syscall.Close(fd)
+			return nil, fmt.Errorf("clearing IPV6_V6ONLY: %w", err)
+		}
+	} else {
+		if err := syscall.SetsockoptInt(fd, syscall.SOL_IP, IP_TRANSPARENT, 1); err != nil {
+			syscall.Close(fd)
+			return nil, explainTransparentError(err)
+		}
 	}
 
 	// Bind to port
-	addr := syscall.SockaddrInet4{Port: port}
-	if err := syscall.Bind(fd, &addr); err != nil {
+	if err := syscall.Bind(fd, p.bindAddr(port)); err != nil {
 		syscall.Close(fd)
 		return nil, fmt.Errorf("binding to port %d: %w", port, err)
 	}
@@ -156,8 +425,27 @@ func (p *TransparentProxy) createTransparentListener(port int) (net.Listener, er
 	return listener, nil
 }
 
-// acceptLoop accepts connections and handles them
-func (p *TransparentProxy) acceptLoop(listener net.Listener, handler func(net.Conn)) {
+// bindAddr returns the sockaddr listeners bind to for the given port
+func (p *TransparentProxy) bindAddr(port int) syscall.Sockaddr {
+	if p.listenIP == nil {
+		return &syscall.SockaddrInet4{Port: port}
+	}
+	if ip4 := p.listenIP.To4(); ip4 != nil {
+		addr := &syscall.SockaddrInet4{Port: port}
+		copy(addr.Addr[:], ip4)
+		return addr
+	}
+	addr := &syscall.SockaddrInet6{Port: port}
+	copy(addr.Addr[:], p.listenIP.To16())
+	return addr
+}
+
+// acceptLoop accepts connections and handles them. Each connection gets a
+// logger tagged with a unique ID and its protocol, so the records of
+// concurrent connections can be correlated. Once MaxConnections are being
+// handled, new connections are closed immediately rather than queued, so a
+// flood can't pile up goroutines or stall shutdown.
+func (p *TransparentProxy) acceptLoop(listener net.Listener, protocol string, handler func(net.Conn, *slog.Logger)) {
 	defer p.wg.Done()
 
 	for {
@@ -167,151 +455,280 @@ func (p *TransparentProxy) acceptLoop(listener net.Listener, handler func(net.Co
 			case <-p.ctx.Done():
 				return
 			default:
-				log.Printf("Accept error: %v", err)
+				slog.Error("Accept error", "proto", protocol, "err", err)
 				continue
 			}
 		}
 
+		select {
+		case p.slots <- struct{}{}:
+		default:
+			conn.Close()
+			metrics.ProxyConnections.Inc(protocol, "rejected")
+			slog.Debug("Connection limit reached, rejecting connection", "proto", protocol, "limit", cap(p.slots))
+			continue
+		}
+		metrics.ProxyInFlight.Set(float64(p.inFlight.Add(1)))
+
+		tc := newTrackedConn(conn)
+		p.tracker.add(tc)
+		logger := slog.With("conn", p.connIDs.Add(1), "proto", protocol)
+
 		p.wg.Add(1)
 		go func() {
 			defer p.wg.Done()
-			handler(conn)
+			defer p.release()
+			defer p.tracker.remove(tc)
+			handler(tc, logger)
 		}()
 	}
 }
 
+// release frees the connection slot taken in acceptLoop
+func (p *TransparentProxy) release() {
+	metrics.ProxyInFlight.Set(float64(p.inFlight.Add(-1)))
+	<-p.slots
+}
+
 // handleHTTP handles HTTP connections
-func (p *TransparentProxy) handleHTTP(clientConn net.Conn) {
+func (p *TransparentProxy) handleHTTP(clientConn net.Conn, logger *slog.Logger) {
 	defer clientConn.Close()
 
 	// Set timeouts
 	clientConn.SetReadDeadline(time.Now().Add(ReadTimeout))
 
+	timing := newTiming(logger)
+
 	// Get original destination
 	origDst, err := getOriginalDst(clientConn)
 	if err != nil {
-		log.Printf("HTTP: Failed to get original destination: %v", err)
+		logger.Warn("Failed to get original destination", "err", err)
 		return
 	}
+	timing.mark("origdst")
 
 	// Read HTTP request
 	reader := bufio.NewReader(clientConn)
-	requestLine, err := reader.ReadString('\n')
+	host, request, err := readHTTPRequest(reader)
 	if err != nil {
-		log.Printf("HTTP: Failed to read request line: %v", err)
+		logger.Debug("Failed to read request", "dest", origDst, "err", err)
+		return
+	}
+	if target, ok := connectTarget(request); ok {
+		// A client using focusd as an explicit proxy
+		p.handleConnect(clientConn, reader, target, logger)
+		return
+	}
+	if host == "" {
+		logger.Info("No Host header found", "dest", origDst)
+		return
+	}
+
+	// Drop retry storms against a recently blocked destination without
+	// matching or answering them
+	if p.storms.cooling(origDst, host) {
+		metrics.ProxyConnections.Inc("http", "dropped")
 		return
 	}
 
+	timing.mark("read")
+
+	logger = logger.With("domain", host, "dest", origDst)
+	logger.Debug("Request")
+
+	// Check if blocked
+	blocked := p.blockedHost(host, origDst)
+	if blocked {
+		if release, ok := p.useBudget(clientConn, host, logger); ok {
+			defer release()
+			blocked = false
+		}
+	}
+	timing.mark("match")
+	if blocked {
+		timing.log(host, origDst, "blocked")
+		metrics.ProxyConnections.Inc("http", "blocked")
+		p.storms.reject(origDst, host)
+		logger.Info("Connection", "verdict", "blocked")
+		p.recordBlocked(host, origDst, "http", logger)
+		clientConn.Write([]byte(p.blockedHTTPResponse(host)))
+		return
+	}
+
+	// Forward connection
+	timing.log(host, origDst, "allowed")
+	metrics.ProxyConnections.Inc("http", "allowed")
+	logger.Info("Connection", "verdict", "allowed")
+	bufferedConn := newBufferedConn(clientConn, reader)
+	var send func(io.Writer) (int64, error)
+	if !bytes.HasPrefix(request, []byte(h2cPrefaceLine)) {
+		// Re-check each request of a persistent connection
+		send = func(dst io.Writer) (int64, error) {
+			return p.relayHTTP(dst, reader, request, host, origDst, logger)
+		}
+	}
+	p.forwardConnection(bufferedConn, origDst, request, send, host, "http", logger)
+}
+
+// readHTTPRequest reads a request's head (request line and headers, or
+// an h2c preface and first HEADERS frame) and returns its host without any
+// port. The head is returned verbatim so it can be replayed upstream; any
+// body bytes read past it stay buffered in reader and are forwarded from
+// there.
+func readHTTPRequest(reader *bufio.Reader) (string, []byte, error) {
+	requestLine, err := reader.ReadString('\n')
+	if err != nil {
+		return "", nil, fmt.Errorf("reading request line: %w", err)
+	}
+
 	var requestBuffer bytes.Buffer
 	requestBuffer.WriteString(requestLine)
 
 	// Parse HTTP headers to find Host
 	var host string
-	for {
-		line, err := reader.ReadString('\n')
+	if requestLine == h2cPrefaceLine {
+		// HTTP/2 with prior knowledge: take the host from the first HEADERS frame
+		host, err = readH2CAuthority(reader, &requestBuffer)
 		if err != nil {
-			log.Printf("HTTP: Failed to read header line: %v", err)
-			return
+			return "", nil, fmt.Errorf("parsing h2c request: %w", err)
 		}
+	} else {
+		for {
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				return "", nil, fmt.Errorf("reading header line: %w", err)
+			}
 
-		requestBuffer.WriteString(line)
+			requestBuffer.WriteString(line)
 
-		if line == "\r\n" || line == "\n" {
-			break
-		}
-		if host == "" && strings.HasPrefix(strings.ToLower(line), "host:") {
-			host = strings.TrimSpace(strings.SplitN(line, ":", 2)[1])
+			if line == "\r\n" || line == "\n" {
+				break
+			}
+			if host == "" && strings.HasPrefix(strings.ToLower(line), "host:") {
+				host = strings.TrimSpace(strings.SplitN(line, ":", 2)[1])
+			}
 		}
 	}
 
-	if host == "" {
-		log.Printf("HTTP: No Host header found")
-		return
-	}
-
 	// Remove port from host if present
 	if idx := strings.Index(host, ":"); idx != -1 {
 		host = host[:idx]
 	}
-
-	log.Printf("HTTP: %s -> %s", host, origDst)
-
-	// Check if blocked
-	if p.isBlocked(host) {
-		log.Printf("HTTP: Blocked %s", host)
-		// Send 403 Forbidden
-		response := "HTTP/1.1 403 Forbidden\r\n" +
-			"Content-Type: text/html\r\n" +
-			"Connection: close\r\n" +
-			"\r\n" +
-			"<html><body><h1>403 Forbidden</h1><p>Blocked by focusd</p></body></html>"
-		clientConn.Write([]byte(response))
-		return
-	}
-
-	// Forward connection
-	log.Printf("HTTP: Allowed %s", host)
-	bufferedConn := newBufferedConn(clientConn, reader)
-	p.forwardConnection(bufferedConn, origDst, requestBuffer.Bytes())
+	return host, requestBuffer.Bytes(), nil
 }
 
 // handleHTTPS handles HTTPS connections with SNI inspection
-func (p *TransparentProxy) handleHTTPS(clientConn net.Conn) {
+func (p *TransparentProxy) handleHTTPS(clientConn net.Conn, logger *slog.Logger) {
 	defer clientConn.Close()
 
 	// Set timeouts
 	clientConn.SetReadDeadline(time.Now().Add(ReadTimeout))
 
+	timing := newTiming(logger)
+
 	// Get original destination
 	origDst, err := getOriginalDst(clientConn)
 	if err != nil {
-		log.Printf("HTTPS: Failed to get original destination: %v", err)
+		logger.Warn("Failed to get original destination", "err", err)
 		return
 	}
+	timing.mark("origdst")
 
-	// Read TLS ClientHello (usually < 1KB, but can be up to 16KB)
-	buf := make([]byte, 16384)
-	n, err := clientConn.Read(buf)
+	// Read TLS ClientHello (usually < 1KB, but can be up to 16KB and span
+	// several TCP segments)
+	clientHello, err := readClientHello(clientConn)
 	if err != nil {
-		log.Printf("HTTPS: Failed to read ClientHello: %v", err)
+		logger.Debug("Failed to read ClientHello", "dest", origDst, "err", err)
 		return
 	}
-
-	clientHello := buf[:n]
+	timing.mark("read")
 
 	// Extract SNI
 	hostname, err := sni.ExtractSNI(clientHello)
+	timing.mark("sni")
 	if err != nil {
-		log.Printf("HTTPS: Failed to extract SNI: %v (blocking by default)", err)
+		timing.log("", origDst, "blocked")
+		metrics.ProxyConnections.Inc("https", "blocked")
+		logger.Info("Connection without SNI blocked by default", "dest", origDst, "verdict", "blocked", "err", err)
+		p.recordBlocked("", origDst, "https", logger)
 		// Without SNI, we can't make a decision - block by default
 		sendTLSAlert(clientConn)
 		return
 	}
 
-	log.Printf("HTTPS: %s -> %s", hostname, origDst)
+	// Drop retry storms against a recently blocked destination without
+	// matching or answering them
+	if p.storms.cooling(origDst, hostname) {
+		metrics.ProxyConnections.Inc("https", "dropped")
+		return
+	}
+
+	logger = logger.With("domain", hostname, "dest", origDst)
+	logger.Debug("Request")
+	if logger.Enabled(context.Background(), slog.LevelDebug) {
+		logTLSVersions(logger, clientHello)
+	}
 
 	// Check if blocked
-	if p.isBlocked(hostname) {
-		log.Printf("HTTPS: Blocked %s", hostname)
+	blocked := p.blockedHost(hostname, origDst)
+	if blocked {
+		if release, ok := p.useBudget(clientConn, hostname, logger); ok {
+			defer release()
+			blocked = false
+		}
+	}
+	timing.mark("match")
+	if blocked {
+		timing.log(hostname, origDst, "blocked")
+		metrics.ProxyConnections.Inc("https", "blocked")
+		p.storms.reject(origDst, hostname)
+		logger.Info("Connection", "verdict", "blocked")
+		p.recordBlocked(hostname, origDst, "https", logger)
+		// The TLS session can't be answered with a page, so the suggested
+		// alternative is only logged
+		if target, ok := p.redirectFor(hostname); ok {
+			logger.Info("Suggested alternative", "redirect", target)
+		}
 		sendTLSAlert(clientConn)
 		return
 	}
 
 	// Forward connection
-	log.Printf("HTTPS: Allowed %s", hostname)
-	p.forwardConnection(clientConn, origDst, clientHello)
+	timing.log(hostname, origDst, "allowed")
+	metrics.ProxyConnections.Inc("https", "allowed")
+	logger.Info("Connection", "verdict", "allowed")
+	p.forwardConnection(clientConn, origDst, clientHello, nil, hostname, "https", logger)
 }
 
 // forwardConnection forwards the connection to the original destination
-func (p *TransparentProxy) forwardConnection(clientConn net.Conn, destAddr string, initialData []byte) {
-	// Create outbound connection with SO_MARK to prevent routing loop
-	dialer := &net.Dialer{
+// send relays the client's data after initialData upstream; nil copies it as is
+// host and protocol are only used to describe the connection in the usage log
+func (p *TransparentProxy) forwardConnection(clientConn net.Conn, destAddr string, initialData []byte, send func(io.Writer) (int64, error), host, protocol string, logger *slog.Logger) {
+	start := time.Now()
+	destConn, err := p.dialUpstream(destAddr)
+	if err != nil {
+		logger.Warn("Failed to connect to destination", "err", err)
+		return
+	}
+	p.relay(clientConn, destConn, start, initialData, send, host, protocol, logger)
+}
+
+// dialUpstream connects to destAddr, marking the connection so it isn't
+// intercepted again
+func (p *TransparentProxy) dialUpstream(destAddr string) (net.Conn, error) {
+	return p.upstreamDialer().Dial("tcp", destAddr)
+}
+
+// upstreamDialer returns a dialer for outbound connections, which sets
+// SO_MARK to prevent a routing loop
+func (p *TransparentProxy) upstreamDialer() *net.Dialer {
+	return &net.Dialer{
 		Timeout: 30 * time.Second,
 		Control: func(network, address string, c syscall.RawConn) error {
 			var sockErr error
 			err := c.Control(func(fd uintptr) {
 				// Set SO_MARK to bypass nftables interception
-				sockErr = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, SO_MARK, ProxyMark)
+				sockErr = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, SO_MARK, p.mark)
 			})
 			if err != nil {
 				return err
@@ -319,41 +736,103 @@ func (p *TransparentProxy) forwardConnection(clientConn net.Conn, destAddr strin
 			return sockErr
 		},
 	}
+}
 
-	destConn, err := dialer.Dial("tcp", destAddr)
-	if err != nil {
-		log.Printf("Failed to connect to %s: %v", destAddr, err)
-		return
-	}
+// relay copies data both ways between the client and destConn until both
+// sides are done, then closes destConn and writes the usage record for a
+// connection that started at start
+func (p *TransparentProxy) relay(clientConn, destConn net.Conn, start time.Time, initialData []byte, send func(io.Writer) (int64, error), host, protocol string, logger *slog.Logger) {
 	defer destConn.Close()
+	destAddr := destConn.RemoteAddr().String()
 
 	// Send initial data (HTTP request line or TLS ClientHello)
 	if len(initialData) > 0 {
 		if _, err := destConn.Write(initialData); err != nil {
-			log.Printf("Failed to write initial data: %v", err)
+			logger.Warn("Failed to write initial data", "err", err)
 			return
 		}
 	}
 
 	// Bidirectional copy
 	var wg sync.WaitGroup
+	var sent, received int64
 	wg.Add(2)
 
 	// Client -> Destination
 	go func() {
 		defer wg.Done()
-		io.Copy(destConn, clientConn)
+		var n int64
+		var err error
+		if send != nil {
+			n, err = send(destConn)
+		} else {
+			n, err = copyPooled(destConn, clientConn)
+		}
+		sent = n
+		if err != nil {
+			// Client side failed, was reaped or sent a blocked request;
+			// tear down the upstream too
+			destConn.Close()
+			return
+		}
 		closeWrite(destConn)
 	}()
 
 	// Destination -> Client
 	go func() {
 		defer wg.Done()
-		io.Copy(clientConn, destConn)
+		received, _ = copyPooled(clientConn, destConn)
 		closeWrite(clientConn)
 	}()
 
 	wg.Wait()
+
+	if p.usage.sampled() {
+		rec := usageRecord{
+			Start:         start,
+			Host:          host,
+			Dest:          destAddr,
+			Protocol:      protocol,
+			DurationMs:    time.Since(start).Milliseconds(),
+			BytesSent:     sent + int64(len(initialData)),
+			BytesReceived: received,
+		}
+		if err := p.usage.write(rec); err != nil {
+			logger.Warn("Error writing usage log", "err", err)
+		}
+	}
+}
+
+// recordBlocked counts a blocked attempt and appends it to the blocked log,
+// if enabled
+func (p *TransparentProxy) recordBlocked(host, dest, protocol string, logger *slog.Logger) {
+	p.blockStats.inc(host)
+	attempt := BlockedAttempt{Time: time.Now(), Host: host, Dest: dest, Protocol: protocol}
+	if err := p.blocked.record(attempt); err != nil {
+		logger.Warn("Error writing blocked log", "err", err)
+	}
+}
+
+// copyBuffers holds forwarding buffers for reuse across connections. Each
+// copy takes its own buffer, so none is shared between concurrent copies.
+var copyBuffers = sync.Pool{
+	New: func() any {
+		buf := make([]byte, copyBufferSize)
+		return &buf
+	},
+}
+
+// copyBufferSize matches the buffer io.Copy would allocate
+const copyBufferSize = 32 * 1024
+
+// copyPooled copies src to dst like io.Copy, but through a pooled buffer.
+// The conns are wrapped so io.CopyBuffer can't hand off to ReadFrom or
+// WriteTo, which for a client conn (never spliceable) would allocate a
+// buffer of their own.
+func copyPooled(dst io.Writer, src io.Reader) (int64, error) {
+	buf := copyBuffers.Get().(*[]byte)
+	defer copyBuffers.Put(buf)
+	return io.CopyBuffer(struct{ io.Writer }{dst}, struct{ io.Reader }{src}, *buf)
 }
 
 // closeWrite attempts to half-close the connection if supported
@@ -397,37 +876,42 @@ func (c *bufferedConn) CloseWrite() error {
 	return nil
 }
 
-// isBlocked checks if a domain is in the blocklist
-func (p *TransparentProxy) isBlocked(host string) bool {
-	host = strings.ToLower(strings.TrimSuffix(host, "."))
-
-	for _, blocked := range p.blockedDomains {
-		blocked = strings.ToLower(strings.TrimSuffix(blocked, "."))
-
-		// Exact match or subdomain match
-		if host == blocked || strings.HasSuffix(host, "."+blocked) {
-			return true
-		}
-
-		// Also check if blocked domain has www. prefix
-		if strings.HasPrefix(blocked, "www.") {
-			bareBlocked := strings.TrimPrefix(blocked, "www.")
-			if host == bareBlocked || strings.HasSuffix(host, "."+bareBlocked) {
-				return true
-			}
-		}
+// useBudget allows a blocked host if it has daily allowance left. The
+// connection is cut off when the allowance runs out; call release when it closes.
+func (p *TransparentProxy) useBudget(conn net.Conn, host string, logger *slog.Logger) (release func(), ok bool) {
+	remaining, release, ok := p.budgets.acquire(host)
+	if !ok {
+		return nil, false
 	}
+	logger.Info("Allowing from daily budget", "remaining", remaining.Round(time.Second))
+	conn.SetDeadline(time.Now().Add(remaining))
+	return release, true
+}
 
-	return false
+// isBlocked checks if a domain is in the blocklist
+func (p *TransparentProxy) isBlocked(host string) bool {
+	return p.matcher.Load().Blocked(host)
 }
 
 // getOriginalDst gets the original destination address using SO_ORIGINAL_DST
+// (IP6T_SO_ORIGINAL_DST for IPv6 connections, which shares its value)
 func getOriginalDst(conn net.Conn) (string, error) {
+	if nc, ok := conn.(interface{ NetConn() net.Conn }); ok {
+		conn = nc.NetConn()
+	}
+
 	tcpConn, ok := conn.(*net.TCPConn)
 	if !ok {
 		return "", fmt.Errorf("not a TCP connection")
 	}
 
+	// IPv4 clients of a dual-stack listener are reported as IPv4 here and
+	// are tracked by the IPv4 conntrack table
+	level := unix.SOL_IP
+	if local, ok := tcpConn.LocalAddr().(*net.TCPAddr); ok && local.IP.To4() == nil {
+		level = unix.SOL_IPV6
+	}
+
 	file, err := tcpConn.File()
 	if err != nil {
 		return "", fmt.Errorf("getting file descriptor: %w", err)
@@ -436,36 +920,55 @@ func getOriginalDst(conn net.Conn) (string, error) {
 
 	fd := int(file.Fd())
 
-	// Get original destination (IPv4)
-	// Read raw sockaddr structure
-	var addr syscall.RawSockaddrInet4
-	addrLen := uint32(syscall.SizeofSockaddrInet4)
+	// Read the raw sockaddr structure, large enough for either family
+	var buf [syscall.SizeofSockaddrInet6]byte
+	addrLen := uint32(len(buf))
 	_, _, errno := unix.Syscall6(
 		unix.SYS_GETSOCKOPT,
 		uintptr(fd),
-		uintptr(unix.SOL_IP),
+		uintptr(level),
 		uintptr(SO_ORIGINAL_DST),
-		uintptr(unsafe.Pointer(&addr)),
+		uintptr(unsafe.Pointer(&buf[0])),
 		uintptr(unsafe.Pointer(&addrLen)),
 		0,
 	)
 	if errno != 0 {
-		return "", fmt.Errorf("getsockopt SO_ORIGINAL_DST: %w", errno)
+		return "", explainOriginalDstError(errno)
 	}
 
-	// Parse sockaddr_in structure
-	// Port is in network byte order (big-endian)
-	ip := net.IPv4(
-		addr.Addr[0],
-		addr.Addr[1],
-		addr.Addr[2],
-		addr.Addr[3],
-	)
+	return parseSockaddr(buf[:addrLen])
+}
+
+// parseSockaddr formats a raw sockaddr_in or sockaddr_in6 as host:port,
+// bracketing IPv6 addresses. The family is in host byte order; the port is
+// in network byte order.
+func parseSockaddr(b []byte) (string, error) {
+	if len(b) < 4 {
+		return "", fmt.Errorf("sockaddr too short (%d bytes)", len(b))
+	}
+
+	family := binary.NativeEndian.Uint16(b[0:2])
+	port := binary.BigEndian.Uint16(b[2:4])
 
-	// Port is stored as uint16 in network byte order, swap bytes to get host byte order
-	port := (addr.Port >> 8) | (addr.Port << 8)
+	var ip net.IP
+	switch family {
+	case syscall.AF_INET:
+		// sockaddr_in: family, port, 4-byte address
+		if len(b) < 8 {
+			return "", fmt.Errorf("sockaddr_in too short (%d bytes)", len(b))
+		}
+		ip = net.IP(slices.Clone(b[4:8]))
+	case syscall.AF_INET6:
+		// sockaddr_in6: family, port, flow info, 16-byte address, scope ID
+		if len(b) < 24 {
+			return "", fmt.Errorf("sockaddr_in6 too short (%d bytes)", len(b))
+		}
+		ip = net.IP(slices.Clone(b[8:24]))
+	default:
+		return "", fmt.Errorf("unsupported address family %d", family)
+	}
 
-	return fmt.Sprintf("%s:%d", ip.String(), port), nil
+	return net.JoinHostPort(ip.String(), strconv.Itoa(int(port))), nil
 }
 
 // sendTLSAlert sends a TLS alert to close the connection gracefully
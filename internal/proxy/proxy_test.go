@@ -0,0 +1,358 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"slices"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestIsBlocked(t *testing.T) {
+	p := New([]string{"*.ru", "Example.com.", "www.news.org", "*.cdn.example.net"}, Config{})
+
+	tests := []struct {
+		host string
+		want bool
+	}{
+		{host: "example.com", want: true},
+		{host: "www.example.com", want: true},
+		{host: "EXAMPLE.COM.", want: true},
+		{host: "notexample.com", want: false},
+		{host: "news.org", want: true},
+		{host: "m.news.org", want: true},
+
+		// TLD boundaries
+		{host: "yandex.ru", want: true},
+		{host: "mail.yandex.ru", want: true},
+		{host: "yandex.ru.", want: true},
+		{host: "guru", want: false},
+		{host: "example.guru", want: false},
+		{host: "ru.com", want: false},
+		{host: "fooru", want: false},
+
+		// Wildcard below a registered domain
+		{host: "a.cdn.example.net", want: true},
+		{host: "cdn.example.net", want: true},
+		{host: "example.net", want: false},
+		{host: "xcdn.example.net", want: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.host, func(t *testing.T) {
+			if got := p.isBlocked(tt.host); got != tt.want {
+				t.Errorf("isBlocked(%q) = %v, want %v", tt.host, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSetBlockedDomainsConcurrent(t *testing.T) {
+	p := New([]string{"example.com"}, Config{AllowedDomains: []string{"docs.example.org"}})
+	lists := [][]string{{"example.com"}, {"example.com", "example.org"}}
+
+	var wg sync.WaitGroup
+	stop := make(chan struct{})
+	for range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				// example.com is in every list, so it must never be let through
+				if !p.isBlocked("www.example.com") {
+					t.Error("isBlocked(www.example.com) = false during an update")
+					return
+				}
+				// The allowlist is kept across updates
+				if p.isBlocked("docs.example.org") {
+					t.Error("isBlocked(docs.example.org) = true during an update")
+					return
+				}
+				p.isBlocked("example.org")
+			}
+		}()
+	}
+
+	for i := range 1000 {
+		p.SetBlockedDomains(lists[i%len(lists)])
+	}
+	close(stop)
+	wg.Wait()
+
+	p.SetBlockedDomains([]string{"example.org"})
+	if p.isBlocked("example.com") || !p.isBlocked("example.org") {
+		t.Error("SetBlockedDomains() did not replace the blocklist")
+	}
+}
+
+func TestIsBlockedAllowlist(t *testing.T) {
+	p := New(
+		[]string{"example.com", "private.docs.example.com", "*.ru", "tie.org"},
+		Config{AllowedDomains: []string{"docs.example.com", "yandex.ru", "tie.org"}},
+	)
+
+	tests := []struct {
+		host string
+		want bool
+	}{
+		{host: "example.com", want: true},
+		{host: "www.example.com", want: true},
+
+		// Allow carves a subtree out of a broader block
+		{host: "docs.example.com", want: false},
+		{host: "api.docs.example.com", want: false},
+		{host: "yandex.ru", want: false},
+		{host: "mail.yandex.ru", want: false},
+		{host: "mail.ru", want: true},
+
+		// A more specific block wins over the allow again
+		{host: "private.docs.example.com", want: true},
+		{host: "a.private.docs.example.com", want: true},
+
+		// Allow wins ties
+		{host: "tie.org", want: false},
+		{host: "www.tie.org", want: false},
+
+		// Allowlisted but never blocked
+		{host: "unrelated.net", want: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.host, func(t *testing.T) {
+			if got := p.isBlocked(tt.host); got != tt.want {
+				t.Errorf("isBlocked(%q) = %v, want %v", tt.host, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestReadHTTPRequestForwardsVerbatim(t *testing.T) {
+	head := "POST /cart?id=7 HTTP/1.1\r\n" +
+		"Host: shop.example.com:8080\r\n" +
+		"User-Agent: Mozilla/5.0 (X11; Linux x86_64; rv:128.0) Gecko/20100101 Firefox/128.0\r\n" +
+		"Accept: text/html,application/xhtml+xml;q=0.9\r\n" +
+		"Cookie: session=abc123; theme=dark\r\n" +
+		"Content-Length: 11\r\n" +
+		"\r\n"
+	body := "qty=2&sku=9"
+
+	client, server := net.Pipe()
+	go func() {
+		client.Write([]byte(head + body))
+		client.Close()
+	}()
+
+	reader := bufio.NewReader(server)
+	host, request, err := readHTTPRequest(reader)
+	if err != nil {
+		t.Fatalf("readHTTPRequest() error = %v", err)
+	}
+	if host != "shop.example.com" {
+		t.Errorf("readHTTPRequest() host = %q, want %q", host, "shop.example.com")
+	}
+	if string(request) != head {
+		t.Errorf("readHTTPRequest() request = %q, want %q", request, head)
+	}
+
+	// Upstream gets the replayed head followed by what's left on the conn
+	var upstream bytes.Buffer
+	upstream.Write(request)
+	if _, err := copyPooled(&upstream, newBufferedConn(server, reader)); err != nil {
+		t.Fatalf("copyPooled() error = %v", err)
+	}
+	if got := upstream.String(); got != head+body {
+		t.Errorf("upstream received %q, want %q", got, head+body)
+	}
+}
+
+func TestParseSockaddr(t *testing.T) {
+	// sockaddr_in for 203.0.113.7:443
+	inet4 := make([]byte, syscall.SizeofSockaddrInet4)
+	binary.NativeEndian.PutUint16(inet4[0:2], syscall.AF_INET)
+	binary.BigEndian.PutUint16(inet4[2:4], 443)
+	copy(inet4[4:8], []byte{203, 0, 113, 7})
+
+	// sockaddr_in6 for [2001:db8::1]:8080 with flow info and scope ID set
+	inet6 := make([]byte, syscall.SizeofSockaddrInet6)
+	binary.NativeEndian.PutUint16(inet6[0:2], syscall.AF_INET6)
+	binary.BigEndian.PutUint16(inet6[2:4], 8080)
+	binary.BigEndian.PutUint32(inet6[4:8], 0xdeadbeef)
+	copy(inet6[8:24], net.ParseIP("2001:db8::1"))
+	binary.NativeEndian.PutUint32(inet6[24:28], 3)
+
+	// sockaddr_in6 carrying an IPv4-mapped address
+	mapped := slices.Clone(inet6)
+	copy(mapped[8:24], net.ParseIP("192.0.2.1").To16())
+
+	unknown := slices.Clone(inet4)
+	binary.NativeEndian.PutUint16(unknown[0:2], syscall.AF_UNIX)
+
+	tests := []struct {
+		name    string
+		b       []byte
+		want    string
+		wantErr bool
+	}{
+		{name: "ipv4", b: inet4, want: "203.0.113.7:443"},
+		{name: "ipv6", b: inet6, want: "[2001:db8::1]:8080"},
+		{name: "ipv4-mapped ipv6", b: mapped, want: "192.0.2.1:8080"},
+		{name: "truncated ipv6", b: inet6[:16], wantErr: true},
+		{name: "truncated header", b: inet4[:2], wantErr: true},
+		{name: "unknown family", b: unknown, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseSockaddr(tt.b)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseSockaddr() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("parseSockaddr() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCopyPooled(t *testing.T) {
+	data := bytes.Repeat([]byte("focusd"), 20000)
+	var dst bytes.Buffer
+	n, err := copyPooled(&dst, bytes.NewReader(data))
+	if err != nil || n != int64(len(data)) {
+		t.Fatalf("copyPooled() = %d, %v, want %d", n, err, len(data))
+	}
+	if !bytes.Equal(dst.Bytes(), data) {
+		t.Error("copyPooled() corrupted the data")
+	}
+}
+
+// BenchmarkForwardCopy compares a plain io.Copy, which allocates a buffer
+// per call for conns without ReadFrom/WriteTo, with copyPooled
+func BenchmarkForwardCopy(b *testing.B) {
+	data := bytes.Repeat([]byte{0xa5}, 256*1024)
+	copies := map[string]func(io.Writer, io.Reader) (int64, error){
+		"io.Copy": func(dst io.Writer, src io.Reader) (int64, error) {
+			return io.Copy(struct{ io.Writer }{dst}, struct{ io.Reader }{src})
+		},
+		"pooled": copyPooled,
+	}
+
+	for _, name := range []string{"io.Copy", "pooled"} {
+		copyFn := copies[name]
+		b.Run(name, func(b *testing.B) {
+			b.ReportAllocs()
+			b.SetBytes(int64(len(data)))
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					if _, err := copyFn(io.Discard, bytes.NewReader(data)); err != nil {
+						b.Error(err)
+						return
+					}
+				}
+			})
+		})
+	}
+}
+
+func TestAcceptLoopLimit(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := New(nil, Config{MaxConnections: 1})
+	handling := make(chan struct{})
+	done := make(chan struct{})
+	p.wg.Add(1)
+	go p.acceptLoop(ln, "http", func(conn net.Conn, _ *slog.Logger) {
+		defer conn.Close()
+		close(handling)
+		<-done
+	})
+
+	first, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer first.Close()
+	<-handling
+	if got := p.InFlight(); got != 1 {
+		t.Errorf("InFlight() = %d, want 1", got)
+	}
+
+	// Over the limit, the connection is closed without being handled
+	second, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer second.Close()
+	second.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := second.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("Read() on rejected connection = %v, want EOF", err)
+	}
+
+	// Shutdown drains the handled connection and frees its slot
+	close(done)
+	p.cancel()
+	ln.Close()
+	p.wg.Wait()
+	if got := p.InFlight(); got != 0 {
+		t.Errorf("InFlight() after shutdown = %d, want 0", got)
+	}
+}
+
+func TestCreateTransparentListener(t *testing.T) {
+	tests := []struct {
+		name     string
+		addr     string
+		wantErr  bool
+		wantIPv6 bool
+	}{
+		{name: "hostname", addr: "localhost", wantErr: true},
+		{name: "address with port", addr: "127.0.0.1:8080", wantErr: true},
+		{name: "garbage", addr: "::1::2", wantErr: true},
+		{name: "ipv6 loopback", addr: "::1", wantIPv6: true},
+		{name: "ipv4 loopback", addr: "127.0.0.1"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := New(nil, Config{ListenAddr: tt.addr})
+			ln, err := p.createTransparentListener(0)
+			if tt.wantErr {
+				if err == nil {
+					ln.Close()
+					t.Fatal("createTransparentListener() succeeded, want error")
+				}
+				return
+			}
+			if errors.Is(err, syscall.EPERM) || errors.Is(err, syscall.ENOPROTOOPT) {
+				t.Skipf("transparent sockets unavailable: %v", err)
+			}
+			if err != nil {
+				t.Fatalf("createTransparentListener() error = %v", err)
+			}
+			defer ln.Close()
+
+			addr := ln.Addr().(*net.TCPAddr)
+			if !addr.IP.Equal(net.ParseIP(tt.addr)) {
+				t.Errorf("listener bound to %v, want %s", addr.IP, tt.addr)
+			}
+			if isIPv6 := addr.IP.To4() == nil; isIPv6 != tt.wantIPv6 {
+				t.Errorf("listener IPv6 = %v, want %v", isIPv6, tt.wantIPv6)
+			}
+		})
+	}
+}
@@ -0,0 +1,116 @@
+package proxy
+
+import (
+	"context"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// PTR lookups are bounded so a slow resolver can't stall connection handling
+	ptrLookupTimeout = 2 * time.Second
+
+	// Cached PTR results (including failures) are reused for this long
+	ptrCacheTTL = 10 * time.Minute
+
+	// Maximum number of cached PTR results
+	ptrCacheSize = 1024
+)
+
+// ptrEntry is a cached reverse DNS result
+type ptrEntry struct {
+	names   []string
+	expires time.Time
+}
+
+// ptrCache caches reverse DNS lookups for destination IPs.
+//
+// A PTR lookup adds up to ptrLookupTimeout of latency to the first connection
+// to an IP, so results (including failures) are cached for ptrCacheTTL. When
+// the cache is full, expired entries are evicted first and then, if still
+// full, an arbitrary entry is dropped.
+type ptrCache struct {
+	mu      sync.Mutex
+	entries map[string]ptrEntry
+	lookup  func(ctx context.Context, addr string) ([]string, error)
+	timeout time.Duration
+}
+
+func newPTRCache() *ptrCache {
+	return &ptrCache{
+		entries: make(map[string]ptrEntry),
+		lookup:  net.DefaultResolver.LookupAddr,
+		timeout: ptrLookupTimeout,
+	}
+}
+
+// names returns the PTR hostnames for ip, consulting the cache first
+func (c *ptrCache) names(ip string) []string {
+	now := time.Now()
+
+	c.mu.Lock()
+	if e, ok := c.entries[ip]; ok && now.Before(e.expires) {
+		c.mu.Unlock()
+		return e.names
+	}
+	c.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), c.timeout)
+	defer cancel()
+
+	names, err := c.lookup(ctx, ip)
+	if err != nil {
+		names = nil
+	}
+	for i, name := range names {
+		names[i] = strings.TrimSuffix(name, ".")
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.entries) >= ptrCacheSize {
+		c.evict(now)
+	}
+	c.entries[ip] = ptrEntry{names: names, expires: now.Add(ptrCacheTTL)}
+
+	return names
+}
+
+// evict removes expired entries, or an arbitrary one if none have expired.
+// Callers must hold c.mu.
+func (c *ptrCache) evict(now time.Time) {
+	for ip, e := range c.entries {
+		if now.After(e.expires) {
+			delete(c.entries, ip)
+		}
+	}
+	if len(c.entries) < ptrCacheSize {
+		return
+	}
+	for ip := range c.entries {
+		delete(c.entries, ip)
+		return
+	}
+}
+
+// isBlockedByPTR reports whether the destination's reverse DNS name is blocked.
+// It is a last resort for connections whose Host/SNI is a bare IP address.
+func (p *TransparentProxy) isBlockedByPTR(destAddr string) bool {
+	if p.ptr == nil {
+		return false
+	}
+
+	ip, _, err := net.SplitHostPort(destAddr)
+	if err != nil {
+		return false
+	}
+
+	for _, name := range p.ptr.names(ip) {
+		if p.isBlocked(name) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,119 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestPTRCacheHit(t *testing.T) {
+	c := newPTRCache()
+	calls := 0
+	c.lookup = func(ctx context.Context, addr string) ([]string, error) {
+		calls++
+		return []string{"host.reddit.com."}, nil
+	}
+
+	for i := 0; i < 3; i++ {
+		names := c.names("192.0.2.1")
+		if len(names) != 1 || names[0] != "host.reddit.com" {
+			t.Fatalf("names() = %v, want [host.reddit.com]", names)
+		}
+	}
+	if calls != 1 {
+		t.Errorf("lookup called %d times, want 1", calls)
+	}
+
+	// An expired entry is looked up again
+	c.entries["192.0.2.1"] = ptrEntry{names: []string{"stale.example"}, expires: time.Now().Add(-time.Second)}
+	if names := c.names("192.0.2.1"); len(names) != 1 || names[0] != "host.reddit.com" {
+		t.Errorf("names() after expiry = %v, want [host.reddit.com]", names)
+	}
+	if calls != 2 {
+		t.Errorf("lookup called %d times after expiry, want 2", calls)
+	}
+}
+
+func TestPTRCacheEvictsExpired(t *testing.T) {
+	c := newPTRCache()
+	c.lookup = func(ctx context.Context, addr string) ([]string, error) {
+		return nil, nil
+	}
+
+	now := time.Now()
+	for i := 0; i < ptrCacheSize; i++ {
+		expires := now.Add(ptrCacheTTL)
+		if i%2 == 0 {
+			expires = now.Add(-time.Second)
+		}
+		c.entries[fmt.Sprintf("198.51.100.%d", i)] = ptrEntry{expires: expires}
+	}
+
+	c.names("192.0.2.1")
+
+	if _, ok := c.entries["192.0.2.1"]; !ok {
+		t.Error("new entry missing after eviction")
+	}
+	for ip, e := range c.entries {
+		if !now.Before(e.expires) {
+			t.Errorf("expired entry %s still cached", ip)
+		}
+	}
+	if want := ptrCacheSize/2 + 1; len(c.entries) != want {
+		t.Errorf("cache holds %d entries, want %d", len(c.entries), want)
+	}
+}
+
+func TestPTRCacheFullWithoutExpired(t *testing.T) {
+	c := newPTRCache()
+	c.lookup = func(ctx context.Context, addr string) ([]string, error) {
+		return nil, nil
+	}
+
+	expires := time.Now().Add(ptrCacheTTL)
+	for i := 0; i < ptrCacheSize; i++ {
+		c.entries[fmt.Sprintf("198.51.100.%d", i)] = ptrEntry{expires: expires}
+	}
+
+	c.names("192.0.2.1")
+
+	if len(c.entries) != ptrCacheSize {
+		t.Errorf("cache holds %d entries, want %d", len(c.entries), ptrCacheSize)
+	}
+	if _, ok := c.entries["192.0.2.1"]; !ok {
+		t.Error("new entry missing after eviction")
+	}
+}
+
+func TestPTRLookupTimeoutFailsOpen(t *testing.T) {
+	p := New([]string{"reddit.com"}, Config{ReverseDNSBlock: true})
+	defer p.cancel()
+
+	calls := 0
+	p.ptr.timeout = 10 * time.Millisecond
+	p.ptr.lookup = func(ctx context.Context, addr string) ([]string, error) {
+		calls++
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+
+	if p.isBlockedByPTR("192.0.2.1:443") {
+		t.Error("isBlockedByPTR() = true after a lookup timeout, want false")
+	}
+	// The failure is cached so later connections don't wait again
+	if p.isBlockedByPTR("192.0.2.1:443") {
+		t.Error("isBlockedByPTR() = true on the cached failure, want false")
+	}
+	if calls != 1 {
+		t.Errorf("lookup called %d times, want 1", calls)
+	}
+
+	// A successful lookup of a blocked name still blocks
+	p.ptr.lookup = func(ctx context.Context, addr string) ([]string, error) {
+		return []string{"edge.reddit.com."}, nil
+	}
+	if !p.isBlockedByPTR("192.0.2.2:443") {
+		t.Error("isBlockedByPTR() = false for a blocked PTR name")
+	}
+}
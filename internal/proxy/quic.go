@@ -0,0 +1,506 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/netip"
+	"os"
+	"slices"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"focusd/internal/metrics"
+	"focusd/internal/sni"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// quicIdleTimeout closes a relayed QUIC flow after this long without a
+	// datagram either way; QUIC endpoints usually give up well before
+	quicIdleTimeout = 2 * time.Minute
+
+	// quicInspectTimeout is how long a new flow has to send its whole
+	// ClientHello
+	quicInspectTimeout = 5 * time.Second
+
+	// quicMaxPending is how many datagrams are held back while a flow's
+	// ClientHello is read
+	quicMaxPending = 8
+
+	// quicBlockedTTL is how long later datagrams of a blocked flow are
+	// dropped without being inspected again
+	quicBlockedTTL = time.Minute
+
+	// quicMaxDatagram is the largest UDP payload relayed
+	quicMaxDatagram = 65535
+)
+
+// quicFlowKey identifies a QUIC flow by its client and original destination
+type quicFlowKey struct {
+	client, dest netip.AddrPort
+}
+
+// quicFlow is a client's QUIC flow to one destination. Its datagrams are
+// held back until its ClientHello has been read; then it is either relayed
+// or dropped. Only quicLoop's goroutine touches the fields above
+// lastActive.
+type quicFlow struct {
+	key     quicFlowKey
+	started time.Time
+	logger  *slog.Logger
+
+	// hello and pending collect the ClientHello before the verdict
+	hello   sni.QUICClientHello
+	pending [][]byte
+
+	host     string
+	blocked  bool
+	upstream *net.UDPConn // connected to dest, set once allowed
+	reply    *net.UDPConn // bound to dest and connected to client
+
+	lastActive     atomic.Int64
+	sent, received atomic.Int64
+}
+
+// touch records traffic on the flow
+func (f *quicFlow) touch() {
+	f.lastActive.Store(time.Now().UnixNano())
+}
+
+// inspect adds a datagram to the flow's ClientHello and returns its server
+// name once all of it has arrived. sni.ErrQUICIncomplete means more
+// datagrams are needed.
+func (f *quicFlow) inspect(datagram []byte) (string, error) {
+	if err := f.hello.Add(datagram); err != nil {
+		// Clients may send 0-RTT data in datagrams of its own once the
+		// first Initial is out
+		if errors.Is(err, sni.ErrNotQUICInitial) && len(f.pending) > 1 {
+			return "", sni.ErrQUICIncomplete
+		}
+		return "", err
+	}
+	info, err := f.hello.Info()
+	if err != nil {
+		return "", err
+	}
+	if info.ServerName == "" {
+		return "", sni.ErrNoSNI
+	}
+	return info.ServerName, nil
+}
+
+// block drops the flow's held datagrams and any that follow
+func (f *quicFlow) block(now time.Time) {
+	f.blocked = true
+	f.started = now
+	f.pending = nil
+	f.hello = sni.QUICClientHello{}
+}
+
+// forward relays a datagram from the client upstream
+func (f *quicFlow) forward(datagram []byte) {
+	if n, err := f.upstream.Write(datagram); err == nil {
+		f.sent.Add(int64(n))
+		f.touch()
+	}
+}
+
+// InspectingQUIC reports whether the proxy is relaying QUIC on its HTTPS
+// port, so UDP traffic to port 443 should be sent to it rather than dropped
+func (p *TransparentProxy) InspectingQUIC() bool {
+	return p.quicConn != nil
+}
+
+// startQUIC starts relaying QUIC if enabled. Without it QUIC is dropped as
+// before, which browsers survive by falling back to TCP, so a socket that
+// can't be created is only a warning.
+func (p *TransparentProxy) startQUIC() {
+	if !p.inspectQUIC {
+		return
+	}
+	conn, err := p.createTransparentUDP(p.httpsPort)
+	if err != nil {
+		slog.Warn("QUIC inspection unavailable, QUIC will be dropped", "err", err)
+		return
+	}
+	p.quicConn = conn
+	p.wg.Add(1)
+	go p.quicLoop(conn)
+}
+
+// stopQUIC closes the QUIC socket and every relayed flow
+func (p *TransparentProxy) stopQUIC() {
+	if p.quicConn == nil {
+		return
+	}
+	p.quicConn.Close()
+
+	p.quicMu.Lock()
+	defer p.quicMu.Unlock()
+	for _, f := range p.quicFlows {
+		if f.upstream != nil {
+			f.upstream.Close()
+		}
+	}
+}
+
+// createTransparentUDP creates a transparent UDP socket that receives
+// TPROXY'd datagrams along with their original destination
+func (p *TransparentProxy) createTransparentUDP(port int) (*net.UDPConn, error) {
+	ipv6 := p.listenIP != nil && p.listenIP.To4() == nil
+
+	family := syscall.AF_INET
+	if ipv6 {
+		family = syscall.AF_INET6
+	}
+
+	fd, err := syscall.Socket(family, syscall.SOCK_DGRAM, 0)
+	if err != nil {
+		return nil, fmt.Errorf("creating socket: %w", err)
+	}
+
+	if err := syscall.SetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_REUSEADDR, 1); err != nil {
+		syscall.Close(fd)
+		return nil, fmt.Errorf("setting SO_REUSEADDR: %w", err)
+	}
+
+	if ipv6 {
+		if err := syscall.SetsockoptInt(fd, syscall.SOL_IPV6, IPV6_TRANSPARENT, 1); err != nil {
+			syscall.Close(fd)
+			return nil, fmt.Errorf("setting IPV6_TRANSPARENT: %w", err)
+		}
+		if err := syscall.SetsockoptInt(fd, syscall.IPPROTO_IPV6, syscall.IPV6_V6ONLY, 0); err != nil {
+			syscall.Close(fd)
+			return nil, fmt.Errorf("clearing IPV6_V6ONLY: %w", err)
+		}
+		if err := syscall.SetsockoptInt(fd, syscall.SOL_IPV6, unix.IPV6_RECVORIGDSTADDR, 1); err != nil {
+			syscall.Close(fd)
+			return nil, fmt.Errorf("setting IPV6_RECVORIGDSTADDR: %w", err)
+		}
+	} else {
+		if err := syscall.SetsockoptInt(fd, syscall.SOL_IP, IP_TRANSPARENT, 1); err != nil {
+			syscall.Close(fd)
+			return nil, explainTransparentError(err)
+		}
+	}
+	// IPv4 datagrams reach a dual-stack socket too
+	if err := syscall.SetsockoptInt(fd, syscall.SOL_IP, unix.IP_RECVORIGDSTADDR, 1); err != nil {
+		syscall.Close(fd)
+		return nil, fmt.Errorf("setting IP_RECVORIGDSTADDR: %w", err)
+	}
+
+	if err := syscall.Bind(fd, p.bindAddr(port)); err != nil {
+		syscall.Close(fd)
+		return nil, fmt.Errorf("binding to UDP port %d: %w", port, err)
+	}
+
+	file := os.NewFile(uintptr(fd), fmt.Sprintf("transparent-udp-%d", port))
+	conn, err := net.FilePacketConn(file)
+	file.Close()
+	if err != nil {
+		return nil, fmt.Errorf("creating UDP conn from fd: %w", err)
+	}
+	return conn.(*net.UDPConn), nil
+}
+
+// quicLoop reads intercepted QUIC datagrams and hands each to its flow
+func (p *TransparentProxy) quicLoop(conn *net.UDPConn) {
+	defer p.wg.Done()
+
+	buf := make([]byte, quicMaxDatagram)
+	oob := make([]byte, 128)
+	lastSweep := time.Now()
+	for {
+		n, oobn, _, client, err := conn.ReadMsgUDPAddrPort(buf, oob)
+		if err != nil {
+			select {
+			case <-p.ctx.Done():
+				return
+			default:
+				slog.Error("QUIC read error", "err", err)
+				continue
+			}
+		}
+		dest, err := origDstFromControl(oob[:oobn])
+		if err != nil {
+			slog.Debug("QUIC datagram without original destination", "err", err)
+			continue
+		}
+
+		now := time.Now()
+		if now.Sub(lastSweep) > quicInspectTimeout {
+			p.sweepQUIC(now)
+			lastSweep = now
+		}
+		client = netip.AddrPortFrom(client.Addr().Unmap(), client.Port())
+		p.handleQUIC(quicFlowKey{client: client, dest: dest}, buf[:n], now)
+	}
+}
+
+// handleQUIC handles one datagram from a client: held back while the flow's
+// ClientHello is read, then relayed or dropped according to its verdict
+func (p *TransparentProxy) handleQUIC(key quicFlowKey, datagram []byte, now time.Time) {
+	p.quicMu.Lock()
+	f := p.quicFlows[key]
+	if f == nil {
+		if len(p.quicFlows) >= cap(p.slots) {
+			p.quicMu.Unlock()
+			metrics.ProxyConnections.Inc("quic", "rejected")
+			return
+		}
+		f = &quicFlow{
+			key:     key,
+			started: now,
+			logger:  slog.With("conn", p.connIDs.Add(1), "proto", "quic", "dest", key.dest.String()),
+		}
+		p.quicFlows[key] = f
+	}
+	p.quicMu.Unlock()
+
+	switch {
+	case f.blocked:
+		return
+	case f.upstream != nil:
+		f.forward(datagram)
+		return
+	}
+
+	f.pending = append(f.pending, slices.Clone(datagram))
+	host, err := f.inspect(datagram)
+	if errors.Is(err, sni.ErrQUICIncomplete) {
+		if len(f.pending) < quicMaxPending {
+			return
+		}
+		err = fmt.Errorf("ClientHello incomplete after %d datagrams", quicMaxPending)
+	}
+	if err != nil {
+		// Without SNI, we can't make a decision - block by default. The
+		// client falls back to TCP, where the attempt is recorded.
+		metrics.ProxyConnections.Inc("quic", "blocked")
+		f.logger.Info("QUIC flow without readable SNI blocked by default", "verdict", "blocked", "err", err)
+		f.block(now)
+		return
+	}
+
+	f.host = host
+	f.logger = f.logger.With("domain", host)
+	if p.blockedHost(host, key.dest.String()) {
+		// Budgets are metered per TCP connection, so a budgeted host is
+		// dropped here too and uses its budget on the TCP retry. That
+		// retry is also where a block is recorded, so it isn't counted
+		// twice.
+		metrics.ProxyConnections.Inc("quic", "blocked")
+		f.logger.Info("Connection", "verdict", "blocked")
+		f.block(now)
+		return
+	}
+	p.allowQUIC(f, now)
+}
+
+// allowQUIC starts relaying an allowed flow, sending the datagrams held
+// while it was inspected
+func (p *TransparentProxy) allowQUIC(f *quicFlow, now time.Time) {
+	select {
+	case p.slots <- struct{}{}:
+	default:
+		metrics.ProxyConnections.Inc("quic", "rejected")
+		f.block(now)
+		return
+	}
+	metrics.ProxyInFlight.Set(float64(p.inFlight.Add(1)))
+
+	upstream, err := p.dialUpstreamUDP(f.key.dest)
+	if err != nil {
+		p.release()
+		f.logger.Warn("Failed to connect to destination", "err", err)
+		f.block(now)
+		return
+	}
+	reply, err := p.dialQUICClient(f.key.dest, f.key.client)
+	if err != nil {
+		upstream.Close()
+		p.release()
+		f.logger.Warn("Failed to create QUIC reply socket", "err", err)
+		f.block(now)
+		return
+	}
+
+	// stopQUIC closes the upstream sockets it finds under the lock, so a
+	// flow allowed after it ran must not start
+	p.quicMu.Lock()
+	if p.ctx.Err() != nil {
+		p.quicMu.Unlock()
+		upstream.Close()
+		reply.Close()
+		p.release()
+		return
+	}
+	f.upstream, f.reply = upstream, reply
+	p.quicMu.Unlock()
+
+	metrics.ProxyConnections.Inc("quic", "allowed")
+	f.logger.Info("Connection", "verdict", "allowed")
+	f.started = now
+	for _, datagram := range f.pending {
+		f.forward(datagram)
+	}
+	f.pending = nil
+	f.hello = sni.QUICClientHello{}
+	f.touch()
+
+	p.wg.Add(2)
+	go p.relayQUICUpstream(f)
+	go p.relayQUICClient(f)
+}
+
+// relayQUICUpstream relays datagrams from upstream back to the client until
+// the flow goes idle or the proxy stops, then tears the flow down
+func (p *TransparentProxy) relayQUICUpstream(f *quicFlow) {
+	defer p.wg.Done()
+	defer p.release()
+
+	buf := make([]byte, quicMaxDatagram)
+	for {
+		f.upstream.SetReadDeadline(time.Now().Add(quicIdleTimeout / 4))
+		n, err := f.upstream.Read(buf)
+		if err != nil {
+			var netErr net.Error
+			idle := time.Since(time.Unix(0, f.lastActive.Load())) > quicIdleTimeout
+			if errors.As(err, &netErr) && netErr.Timeout() && !idle {
+				continue
+			}
+			break
+		}
+		if n, err := f.reply.Write(buf[:n]); err == nil {
+			f.received.Add(int64(n))
+			f.touch()
+		}
+	}
+
+	f.upstream.Close()
+	f.reply.Close()
+	p.quicMu.Lock()
+	delete(p.quicFlows, f.key)
+	p.quicMu.Unlock()
+
+	if p.usage.sampled() {
+		rec := usageRecord{
+			Start:         f.started,
+			Host:          f.host,
+			Dest:          f.key.dest.String(),
+			Protocol:      "quic",
+			DurationMs:    time.Since(f.started).Milliseconds(),
+			BytesSent:     f.sent.Load(),
+			BytesReceived: f.received.Load(),
+		}
+		if err := p.usage.write(rec); err != nil {
+			f.logger.Warn("Error writing usage log", "err", err)
+		}
+	}
+}
+
+// relayQUICClient relays any datagrams from the client the kernel delivers
+// to the reply socket rather than the TPROXY socket, until
+// relayQUICUpstream closes it
+func (p *TransparentProxy) relayQUICClient(f *quicFlow) {
+	defer p.wg.Done()
+
+	buf := make([]byte, quicMaxDatagram)
+	for {
+		n, err := f.reply.Read(buf)
+		if err != nil {
+			return
+		}
+		f.forward(buf[:n])
+	}
+}
+
+// sweepQUIC forgets flows that never completed their ClientHello and
+// blocked flows whose datagrams have stopped mattering
+func (p *TransparentProxy) sweepQUIC(now time.Time) {
+	p.quicMu.Lock()
+	defer p.quicMu.Unlock()
+	for key, f := range p.quicFlows {
+		switch {
+		case f.upstream != nil:
+		case f.blocked && now.Sub(f.started) > quicBlockedTTL:
+			delete(p.quicFlows, key)
+		case !f.blocked && now.Sub(f.started) > quicInspectTimeout:
+			metrics.ProxyConnections.Inc("quic", "dropped")
+			f.logger.Debug("QUIC flow dropped before its ClientHello completed")
+			delete(p.quicFlows, key)
+		}
+	}
+}
+
+// dialUpstreamUDP connects a UDP socket to dest, marked so it isn't
+// intercepted again
+func (p *TransparentProxy) dialUpstreamUDP(dest netip.AddrPort) (*net.UDPConn, error) {
+	conn, err := p.upstreamDialer().Dial("udp", dest.String())
+	if err != nil {
+		return nil, err
+	}
+	return conn.(*net.UDPConn), nil
+}
+
+// dialQUICClient creates the socket replies to client are sent from. It
+// is bound to the flow's original destination, which isn't a local
+// address, so the client sees replies come from the server it sent to.
+func (p *TransparentProxy) dialQUICClient(dest, client netip.AddrPort) (*net.UDPConn, error) {
+	dialer := &net.Dialer{
+		LocalAddr: net.UDPAddrFromAddrPort(dest),
+		Control: func(network, address string, c syscall.RawConn) error {
+			level, opt := syscall.SOL_IP, IP_TRANSPARENT
+			if network == "udp6" {
+				level, opt = syscall.SOL_IPV6, IPV6_TRANSPARENT
+			}
+			var sockErr error
+			err := c.Control(func(fd uintptr) {
+				// Other clients' flows to the same server bind the same address
+				if sockErr = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_REUSEADDR, 1); sockErr != nil {
+					return
+				}
+				if sockErr = syscall.SetsockoptInt(int(fd), level, opt, 1); sockErr != nil {
+					return
+				}
+				sockErr = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, SO_MARK, p.mark)
+			})
+			if err != nil {
+				return err
+			}
+			return sockErr
+		},
+	}
+	conn, err := dialer.Dial("udp", client.String())
+	if err != nil {
+		return nil, err
+	}
+	return conn.(*net.UDPConn), nil
+}
+
+// origDstFromControl returns the original destination of a TPROXY'd
+// datagram from the control messages it was read with
+func origDstFromControl(oob []byte) (netip.AddrPort, error) {
+	msgs, err := unix.ParseSocketControlMessage(oob)
+	if err != nil {
+		return netip.AddrPort{}, fmt.Errorf("parsing control messages: %w", err)
+	}
+	for _, msg := range msgs {
+		if (msg.Header.Level == unix.SOL_IP && msg.Header.Type == unix.IP_ORIGDSTADDR) ||
+			(msg.Header.Level == unix.SOL_IPV6 && msg.Header.Type == unix.IPV6_ORIGDSTADDR) {
+			addr, err := parseSockaddr(msg.Data)
+			if err != nil {
+				return netip.AddrPort{}, err
+			}
+			dest, err := netip.ParseAddrPort(addr)
+			if err != nil {
+				return netip.AddrPort{}, err
+			}
+			return netip.AddrPortFrom(dest.Addr().Unmap(), dest.Port()), nil
+		}
+	}
+	return netip.AddrPort{}, fmt.Errorf("no original destination")
+}
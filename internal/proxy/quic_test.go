@@ -0,0 +1,89 @@
+package proxy
+
+import (
+	"encoding/binary"
+	"net/netip"
+	"syscall"
+	"testing"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestOrigDstFromControl(t *testing.T) {
+	// An IP_ORIGDSTADDR control message carrying sockaddr_in for 203.0.113.7:443
+	inet4 := make([]byte, syscall.SizeofSockaddrInet4)
+	binary.NativeEndian.PutUint16(inet4[0:2], syscall.AF_INET)
+	binary.BigEndian.PutUint16(inet4[2:4], 443)
+	copy(inet4[4:8], []byte{203, 0, 113, 7})
+	origDst := controlMessage(unix.SOL_IP, unix.IP_ORIGDSTADDR, inet4)
+	other := controlMessage(unix.SOL_IP, unix.IP_TTL, []byte{64, 0, 0, 0})
+
+	tests := []struct {
+		name    string
+		oob     []byte
+		want    netip.AddrPort
+		wantErr bool
+	}{
+		{name: "original destination", oob: origDst, want: netip.MustParseAddrPort("203.0.113.7:443")},
+		{name: "after another message", oob: append(other, origDst...), want: netip.MustParseAddrPort("203.0.113.7:443")},
+		{name: "missing", oob: other, wantErr: true},
+		{name: "empty", oob: nil, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := origDstFromControl(tt.oob)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("origDstFromControl() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("origDstFromControl() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHandleQUICUnreadableFlow(t *testing.T) {
+	p := New(nil, Config{InspectQUIC: true})
+	key := quicFlowKey{
+		client: netip.MustParseAddrPort("192.0.2.10:50000"),
+		dest:   netip.MustParseAddrPort("203.0.113.7:443"),
+	}
+	now := time.Now()
+
+	// A short header packet can't start a flow, so there's no SNI to
+	// allow it by
+	p.handleQUIC(key, []byte{0x40, 0x01, 0x02, 0x03, 0x04, 0x05}, now)
+	f := p.quicFlows[key]
+	if f == nil || !f.blocked || f.upstream != nil {
+		t.Fatalf("flow = %+v, want blocked", f)
+	}
+
+	// Later datagrams are dropped without another verdict
+	p.handleQUIC(key, []byte{0xc0, 0, 0, 0, 1}, now)
+	if p.quicFlows[key] != f || len(f.pending) != 0 {
+		t.Errorf("blocked flow changed by a later datagram: %+v", f)
+	}
+
+	p.sweepQUIC(now.Add(quicBlockedTTL / 2))
+	if p.quicFlows[key] == nil {
+		t.Error("blocked flow forgotten before its TTL")
+	}
+	p.sweepQUIC(now.Add(quicBlockedTTL + time.Second))
+	if p.quicFlows[key] != nil {
+		t.Error("blocked flow still remembered after its TTL")
+	}
+}
+
+// controlMessage builds a socket control message as recvmsg returns it
+func controlMessage(level, typ int32, data []byte) []byte {
+	b := make([]byte, unix.CmsgSpace(len(data)))
+	h := (*unix.Cmsghdr)(unsafe.Pointer(&b[0]))
+	h.Level = level
+	h.Type = typ
+	h.SetLen(unix.CmsgLen(len(data)))
+	copy(b[unix.CmsgLen(0):], data)
+	return b
+}
@@ -0,0 +1,118 @@
+package proxy
+
+import (
+	"log/slog"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// trackedConn records the time of the last successful read or write
+type trackedConn struct {
+	net.Conn
+	lastActive atomic.Int64
+}
+
+func newTrackedConn(conn net.Conn) *trackedConn {
+	c := &trackedConn{Conn: conn}
+	c.touch()
+	return c
+}
+
+func (c *trackedConn) touch() {
+	c.lastActive.Store(time.Now().UnixNano())
+}
+
+func (c *trackedConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if n > 0 {
+		c.touch()
+	}
+	return n, err
+}
+
+func (c *trackedConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	if n > 0 {
+		c.touch()
+	}
+	return n, err
+}
+
+func (c *trackedConn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return nil
+}
+
+// NetConn returns the underlying connection
+func (c *trackedConn) NetConn() net.Conn {
+	return c.Conn
+}
+
+// idleSince returns how long the connection has been idle
+func (c *trackedConn) idleSince(now time.Time) time.Duration {
+	return now.Sub(time.Unix(0, c.lastActive.Load()))
+}
+
+// connTracker keeps the set of active client connections
+type connTracker struct {
+	mu    sync.Mutex
+	conns map[*trackedConn]struct{}
+}
+
+func newConnTracker() *connTracker {
+	return &connTracker{conns: make(map[*trackedConn]struct{})}
+}
+
+func (t *connTracker) add(c *trackedConn) {
+	t.mu.Lock()
+	t.conns[c] = struct{}{}
+	t.mu.Unlock()
+}
+
+func (t *connTracker) remove(c *trackedConn) {
+	t.mu.Lock()
+	delete(t.conns, c)
+	t.mu.Unlock()
+}
+
+// reap closes connections idle for longer than timeout and returns how many it closed
+func (t *connTracker) reap(now time.Time, timeout time.Duration) int {
+	t.mu.Lock()
+	var idle []*trackedConn
+	for c := range t.conns {
+		if c.idleSince(now) > timeout {
+			idle = append(idle, c)
+			delete(t.conns, c)
+		}
+	}
+	t.mu.Unlock()
+
+	for _, c := range idle {
+		c.Close()
+	}
+	return len(idle)
+}
+
+// reapLoop periodically force-closes idle connections until the proxy stops.
+// This catches connections leaked by half-closed peers that never send FIN.
+func (p *TransparentProxy) reapLoop() {
+	defer p.wg.Done()
+
+	ticker := time.NewTicker(p.idleTimeout / 5)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-p.ctx.Done():
+			return
+		case now := <-ticker.C:
+			if n := p.tracker.reap(now, p.idleTimeout); n > 0 {
+				slog.Info("Reaped idle connections", "count", n)
+			}
+		}
+	}
+}
@@ -0,0 +1,85 @@
+package proxy
+
+import (
+	"io"
+	"log/slog"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestReapIdle(t *testing.T) {
+	tracker := newConnTracker()
+
+	idleClient, idlePeer := net.Pipe()
+	defer idlePeer.Close()
+	idle := newTrackedConn(idleClient)
+	tracker.add(idle)
+
+	activeClient, activePeer := net.Pipe()
+	defer activePeer.Close()
+	active := newTrackedConn(activeClient)
+	tracker.add(active)
+	defer active.Close()
+
+	// Nothing has been idle for ForwardTimeout yet
+	if n := tracker.reap(time.Now(), ForwardTimeout); n != 0 {
+		t.Fatalf("reap() = %d before the timeout, want 0", n)
+	}
+
+	// The active connection keeps exchanging data, the idle one doesn't
+	idle.lastActive.Store(time.Now().Add(-ForwardTimeout - time.Second).UnixNano())
+	go activePeer.Write([]byte("x"))
+	if _, err := active.Read(make([]byte, 1)); err != nil {
+		t.Fatal(err)
+	}
+
+	if n := tracker.reap(time.Now(), ForwardTimeout); n != 1 {
+		t.Fatalf("reap() = %d, want 1", n)
+	}
+	if _, ok := tracker.conns[idle]; ok {
+		t.Error("reaped connection still tracked")
+	}
+	if _, ok := tracker.conns[active]; !ok {
+		t.Error("active connection no longer tracked")
+	}
+
+	// The reaped connection is closed, so its peer sees EOF
+	idlePeer.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := idlePeer.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("Read() on reaped connection's peer = %v, want EOF", err)
+	}
+}
+
+func TestAcceptLoopUntracksClosedConn(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := New(nil, Config{})
+	handled := make(chan struct{})
+	p.wg.Add(1)
+	go p.acceptLoop(ln, "http", func(conn net.Conn, _ *slog.Logger) {
+		defer close(handled)
+		conn.Close()
+	})
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	<-handled
+
+	p.cancel()
+	ln.Close()
+	p.wg.Wait()
+
+	p.tracker.mu.Lock()
+	n := len(p.tracker.conns)
+	p.tracker.mu.Unlock()
+	if n != 0 {
+		t.Errorf("tracker holds %d connections after a normal close, want 0", n)
+	}
+}
@@ -0,0 +1,78 @@
+package proxy
+
+import (
+	"fmt"
+	"html"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// HTTPBlockMode selects how blocked HTTP requests are answered
+type HTTPBlockMode string
+
+const (
+	// HTTPBlockForbidden answers blocked requests with a 403 and the block page
+	HTTPBlockForbidden HTTPBlockMode = "forbidden"
+
+	// HTTPBlockRedirect answers blocked requests with a 302 to the
+	// configured BlockRedirectURL
+	HTTPBlockRedirect HTTPBlockMode = "redirect"
+)
+
+// newRedirects normalizes configured redirect entries so they can be
+// matched against request hosts
+func newRedirects(redirects map[string]string) map[string]string {
+	if len(redirects) == 0 {
+		return nil
+	}
+	m := make(map[string]string, len(redirects))
+	for domain, target := range redirects {
+		m[strings.TrimPrefix(normalizeHost(domain), "*.")] = target
+	}
+	return m
+}
+
+// redirectFor returns the redirect URL for a blocked host. When several
+// entries match (e.g. twitter.com and mobile.twitter.com) the most specific
+// one wins.
+func (p *TransparentProxy) redirectFor(host string) (string, bool) {
+	host = normalizeHost(host)
+	best := ""
+	for entry := range p.redirects {
+		if (host == entry || strings.HasSuffix(host, "."+entry)) && len(entry) > len(best) {
+			best = entry
+		}
+	}
+	if best == "" {
+		return "", false
+	}
+	return p.redirects[best], true
+}
+
+// blockedHTTPResponse returns the response sent for a blocked HTTP request:
+// a redirect to the host's configured alternative, else to BlockRedirectURL
+// in redirect mode, or a 403 with the block page
+func (p *TransparentProxy) blockedHTTPResponse(host string) string {
+	target, ok := p.redirectFor(host)
+	if !ok && p.httpBlockMode == HTTPBlockRedirect && p.blockRedirectURL != "" {
+		target, ok = p.blockRedirectURL, true
+	}
+	if ok {
+		body := fmt.Sprintf("<html><body><h1>Blocked by focusd</h1><p>Try <a href=\"%[1]s\">%[1]s</a> instead.</p></body></html>", html.EscapeString(target))
+		return "HTTP/1.1 302 Found\r\n" +
+			"Location: " + target + "\r\n" +
+			"Content-Type: text/html\r\n" +
+			"Content-Length: " + strconv.Itoa(len(body)) + "\r\n" +
+			"Connection: close\r\n" +
+			"\r\n" +
+			body
+	}
+	body := p.renderBlockPage(host, time.Now())
+	return "HTTP/1.1 403 Forbidden\r\n" +
+		"Content-Type: text/html; charset=utf-8\r\n" +
+		"Content-Length: " + strconv.Itoa(len(body)) + "\r\n" +
+		"Connection: close\r\n" +
+		"\r\n" +
+		string(body)
+}
@@ -0,0 +1,78 @@
+package proxy
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRedirectFor(t *testing.T) {
+	p := New([]string{"twitter.com", "reddit.com"}, Config{
+		Redirects: map[string]string{
+			"Twitter.com":        "https://tasks.example.com",
+			"mobile.twitter.com": "https://m.tasks.example.com",
+			"*.reddit.com":       "https://read.example.com",
+		},
+	})
+
+	tests := []struct {
+		host   string
+		want   string
+		wantOK bool
+	}{
+		{host: "twitter.com", want: "https://tasks.example.com", wantOK: true},
+		{host: "www.twitter.com", want: "https://tasks.example.com", wantOK: true},
+		{host: "mobile.twitter.com", want: "https://m.tasks.example.com", wantOK: true},
+		{host: "api.mobile.twitter.com.", want: "https://m.tasks.example.com", wantOK: true},
+		{host: "old.reddit.com", want: "https://read.example.com", wantOK: true},
+		{host: "nottwitter.com", wantOK: false},
+		{host: "example.com", wantOK: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.host, func(t *testing.T) {
+			got, ok := p.redirectFor(tt.host)
+			if got != tt.want || ok != tt.wantOK {
+				t.Errorf("redirectFor(%q) = %q, %v, want %q, %v", tt.host, got, ok, tt.want, tt.wantOK)
+			}
+		})
+	}
+}
+
+func TestBlockedHTTPResponse(t *testing.T) {
+	p := New([]string{"twitter.com", "reddit.com"}, Config{
+		Redirects: map[string]string{"twitter.com": "https://tasks.example.com/?a=1&b=2"},
+	})
+
+	resp := p.blockedHTTPResponse("twitter.com")
+	if !strings.HasPrefix(resp, "HTTP/1.1 302 Found\r\n") {
+		t.Errorf("response status = %q, want 302", strings.SplitN(resp, "\r\n", 2)[0])
+	}
+	if !strings.Contains(resp, "\r\nLocation: https://tasks.example.com/?a=1&b=2\r\n") {
+		t.Errorf("response missing Location header: %q", resp)
+	}
+	if !strings.Contains(resp, "a=1&amp;b=2") {
+		t.Errorf("response body doesn't escape the URL: %q", resp)
+	}
+
+	resp = p.blockedHTTPResponse("reddit.com")
+	if !strings.HasPrefix(resp, "HTTP/1.1 403 Forbidden\r\n") || strings.Contains(resp, "Location:") {
+		t.Errorf("response without redirect = %q, want plain 403", resp)
+	}
+
+	// In redirect mode, hosts without their own entry go to BlockRedirectURL
+	p = New([]string{"twitter.com", "reddit.com"}, Config{
+		Redirects:        map[string]string{"twitter.com": "https://tasks.example.com"},
+		HTTPBlockMode:    HTTPBlockRedirect,
+		BlockRedirectURL: "http://focus.local/why",
+	})
+	tests := map[string]string{
+		"twitter.com": "https://tasks.example.com",
+		"reddit.com":  "http://focus.local/why",
+	}
+	for host, want := range tests {
+		resp := p.blockedHTTPResponse(host)
+		if !strings.HasPrefix(resp, "HTTP/1.1 302 Found\r\n") || !strings.Contains(resp, "\r\nLocation: "+want+"\r\n") {
+			t.Errorf("blockedHTTPResponse(%q) in redirect mode = %q, want 302 to %s", host, resp, want)
+		}
+	}
+}
@@ -0,0 +1,124 @@
+package proxy
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	// A destination rejected this many times within stormWindow is put on cooldown
+	stormThreshold = 10
+	stormWindow    = 10 * time.Second
+
+	// While on cooldown, connections to the destination are dropped as soon
+	// as their host is read, without matching, logging or answering them
+	stormCooldown = 30 * time.Second
+
+	// Maximum number of tracked destinations
+	stormTrackerSize = 4096
+)
+
+// stormKey identifies a destination: the host requested from an IP
+type stormKey struct {
+	ip   string
+	host string
+}
+
+// stormEntry counts recent rejections of a single destination
+type stormEntry struct {
+	count         int
+	windowStart   time.Time
+	cooldownUntil time.Time
+}
+
+// expired reports whether the entry no longer affects any decision
+func (e *stormEntry) expired(now time.Time) bool {
+	return now.After(e.cooldownUntil) && now.Sub(e.windowStart) > stormWindow
+}
+
+// stormTracker detects apps stuck retrying a blocked destination.
+//
+// Destinations are keyed by original destination IP and the requested
+// host, so retries of a blocked host don't cut off allowed hosts sharing its
+// IP (a CDN, say). This is per destination, not per client: every client
+// retrying the same blocked server contributes to the same count.
+type stormTracker struct {
+	mu      sync.Mutex
+	entries map[stormKey]*stormEntry
+	now     func() time.Time
+}
+
+func newStormTracker() *stormTracker {
+	return &stormTracker{
+		entries: make(map[stormKey]*stormEntry),
+		now:     time.Now,
+	}
+}
+
+// cooling reports whether connections for host to destAddr should be dropped
+func (s *stormTracker) cooling(destAddr, host string) bool {
+	key := newStormKey(destAddr, host)
+	now := s.now()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e, ok := s.entries[key]
+	return ok && now.Before(e.cooldownUntil)
+}
+
+// reject records a blocked connection for host to destAddr, starting a
+// cooldown once stormThreshold rejections have been seen within stormWindow
+func (s *stormTracker) reject(destAddr, host string) {
+	key := newStormKey(destAddr, host)
+	now := s.now()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	e, ok := s.entries[key]
+	if !ok {
+		if len(s.entries) >= stormTrackerSize {
+			s.evict(now)
+		}
+		e = &stormEntry{windowStart: now}
+		s.entries[key] = e
+	}
+	if now.Sub(e.windowStart) > stormWindow {
+		e.count = 0
+		e.windowStart = now
+	}
+
+	e.count++
+	if e.count >= stormThreshold {
+		e.cooldownUntil = now.Add(stormCooldown)
+		e.count = 0
+		e.windowStart = now
+	}
+}
+
+// evict removes expired entries, or an arbitrary one if none have expired.
+// Callers must hold s.mu.
+func (s *stormTracker) evict(now time.Time) {
+	for key, e := range s.entries {
+		if e.expired(now) {
+			delete(s.entries, key)
+		}
+	}
+	if len(s.entries) < stormTrackerSize {
+		return
+	}
+	for key := range s.entries {
+		delete(s.entries, key)
+		return
+	}
+}
+
+// newStormKey reduces an address to its IP so all ports share one count
+func newStormKey(destAddr, host string) stormKey {
+	ip, _, err := net.SplitHostPort(destAddr)
+	if err != nil {
+		ip = destAddr
+	}
+	return stormKey{ip: ip, host: normalizeHost(host)}
+}
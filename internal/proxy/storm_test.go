@@ -0,0 +1,61 @@
+package proxy
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestStormTracker(t *testing.T) {
+	now := time.Date(2026, 1, 5, 10, 0, 0, 0, time.UTC)
+	s := newStormTracker()
+	s.now = func() time.Time { return now }
+
+	dest, host := "203.0.113.7:443", "blocked.example"
+	for i := 0; i < stormThreshold-1; i++ {
+		s.reject(dest, host)
+	}
+	if s.cooling(dest, host) {
+		t.Fatal("cooling() = true before threshold")
+	}
+
+	// Rejections spread beyond the window don't accumulate
+	now = now.Add(stormWindow + time.Second)
+	s.reject(dest, host)
+	if s.cooling(dest, host) {
+		t.Fatal("cooling() = true after window reset")
+	}
+
+	for i := 0; i < stormThreshold-1; i++ {
+		s.reject(dest, host)
+	}
+	if !s.cooling(dest, host) {
+		t.Fatal("cooling() = false after threshold")
+	}
+	// Other ports on the same IP share the cooldown, other IPs and other
+	// hosts on the same IP don't
+	if !s.cooling("203.0.113.7:80", "Blocked.Example.") {
+		t.Error("cooling() = false for another port on the same IP")
+	}
+	if s.cooling("203.0.113.8:443", host) {
+		t.Error("cooling() = true for an unrelated destination")
+	}
+	if s.cooling(dest, "allowed.example") {
+		t.Error("cooling() = true for another host on the same IP")
+	}
+
+	now = now.Add(stormCooldown + time.Second)
+	if s.cooling(dest, host) {
+		t.Error("cooling() = true after cooldown expired")
+	}
+}
+
+func TestStormTrackerBounded(t *testing.T) {
+	s := newStormTracker()
+	for i := 0; i < stormTrackerSize+100; i++ {
+		s.reject(fmt.Sprintf("10.%d.%d.%d:443", i>>16&0xff, i>>8&0xff, i&0xff), "blocked.example")
+	}
+	if len(s.entries) > stormTrackerSize {
+		t.Errorf("tracker holds %d entries, want at most %d", len(s.entries), stormTrackerSize)
+	}
+}
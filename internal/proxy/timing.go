@@ -0,0 +1,77 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"slices"
+	"time"
+
+	"focusd/internal/sni"
+)
+
+// timingStep is the duration of one phase of connection handling
+type timingStep struct {
+	name string
+	d    time.Duration
+}
+
+// connTiming records how long each phase of a block decision takes.
+// A nil *connTiming is valid and records nothing, so callers don't need to
+// check whether debug logging is on.
+type connTiming struct {
+	logger *slog.Logger
+	start  time.Time
+	last   time.Time
+	steps  []timingStep
+}
+
+// newTiming returns a timer for a new connection, or nil if debug logging is off
+func newTiming(logger *slog.Logger) *connTiming {
+	if !logger.Enabled(context.Background(), slog.LevelDebug) {
+		return nil
+	}
+	now := time.Now()
+	return &connTiming{logger: logger, start: now, last: now, steps: make([]timingStep, 0, 4)}
+}
+
+// mark records the time elapsed since the previous mark under name
+func (t *connTiming) mark(name string) {
+	if t == nil {
+		return
+	}
+	now := time.Now()
+	t.steps = append(t.steps, timingStep{name: name, d: now.Sub(t.last)})
+	t.last = now
+}
+
+// log writes a single debug record for the connection
+func (t *connTiming) log(host, dest, verdict string) {
+	if t == nil {
+		return
+	}
+
+	attrs := make([]any, 0, 2*len(t.steps)+8)
+	attrs = append(attrs, "domain", host, "dest", dest, "verdict", verdict)
+	for _, step := range t.steps {
+		attrs = append(attrs, step.name, step.d)
+	}
+	attrs = append(attrs, "total", time.Since(t.start))
+	t.logger.Debug("Timing", attrs...)
+}
+
+// logTLSVersions records the TLS versions a client offers, flagging clients
+// that can't negotiate TLS 1.3, which is unusual for a modern browser
+func logTLSVersions(logger *slog.Logger, clientHello []byte) {
+	versions, err := sni.ExtractSupportedVersions(clientHello)
+	if err != nil {
+		logger.Debug("TLS versions: legacy client without supported_versions")
+		return
+	}
+	offered := fmt.Sprintf("%#04x", versions)
+	if !slices.Contains(versions, sni.VersionTLS13) {
+		logger.Debug("TLS versions: TLS 1.3 not offered", "versions", offered)
+		return
+	}
+	logger.Debug("TLS versions", "versions", offered)
+}
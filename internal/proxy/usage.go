@@ -0,0 +1,69 @@
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand/v2"
+	"os"
+	"sync"
+	"time"
+)
+
+// usageRecord describes one allowed connection, written when it closes
+type usageRecord struct {
+	Start         time.Time `json:"start"`
+	Host          string    `json:"host"`
+	Dest          string    `json:"dest"`
+	Protocol      string    `json:"protocol"`
+	DurationMs    int64     `json:"durationMs"`
+	BytesSent     int64     `json:"bytesSent"`
+	BytesReceived int64     `json:"bytesReceived"`
+}
+
+// usageLog appends allowed-connection records as JSON lines
+type usageLog struct {
+	mu         sync.Mutex
+	f          *os.File
+	sampleRate float64
+}
+
+// openUsageLog opens (or creates) the usage log at path.
+// sampleRate is the fraction of connections recorded; values <= 0 record all.
+func openUsageLog(path string, sampleRate float64) (*usageLog, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("opening usage log: %w", err)
+	}
+	if sampleRate <= 0 || sampleRate > 1 {
+		sampleRate = 1
+	}
+	return &usageLog{f: f, sampleRate: sampleRate}, nil
+}
+
+// sampled decides whether a new connection should be recorded
+func (u *usageLog) sampled() bool {
+	return u != nil && (u.sampleRate >= 1 || rand.Float64() < u.sampleRate)
+}
+
+// write appends a record to the log
+func (u *usageLog) write(rec usageRecord) error {
+	line, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	_, err = u.f.Write(append(line, '\n'))
+	return err
+}
+
+// close closes the underlying file
+func (u *usageLog) close() error {
+	if u == nil {
+		return nil
+	}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.f.Close()
+}
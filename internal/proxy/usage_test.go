@@ -0,0 +1,160 @@
+package proxy
+
+import (
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestUsageLogOptIn(t *testing.T) {
+	// Without a path no log is opened, and a nil log records nothing
+	p := New(nil, Config{})
+	if p.usage != nil {
+		t.Fatal("usage log opened without UsageLogPath")
+	}
+	if p.usage.sampled() {
+		t.Error("sampled() = true for a disabled usage log")
+	}
+	if err := p.usage.close(); err != nil {
+		t.Errorf("close() on a disabled usage log = %v", err)
+	}
+}
+
+func TestUsageLogSampling(t *testing.T) {
+	tests := []struct {
+		name     string
+		rate     float64
+		wantRate float64
+	}{
+		{name: "unset records all", rate: 0, wantRate: 1},
+		{name: "negative records all", rate: -0.5, wantRate: 1},
+		{name: "above one records all", rate: 2, wantRate: 1},
+		{name: "fraction", rate: 0.25, wantRate: 0.25},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			u, err := openUsageLog(filepath.Join(t.TempDir(), "usage.jsonl"), tt.rate)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer u.close()
+			if u.sampleRate != tt.wantRate {
+				t.Fatalf("sampleRate = %v, want %v", u.sampleRate, tt.wantRate)
+			}
+
+			const n = 10000
+			hits := 0
+			for i := 0; i < n; i++ {
+				if u.sampled() {
+					hits++
+				}
+			}
+			if tt.wantRate == 1 && hits != n {
+				t.Errorf("sampled() %d of %d connections, want all", hits, n)
+			}
+			if got := float64(hits) / n; got < tt.wantRate-0.05 || got > tt.wantRate+0.05 {
+				t.Errorf("sampled() %.3f of connections, want about %v", got, tt.wantRate)
+			}
+		})
+	}
+}
+
+func TestRelayWritesUsageRecord(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "usage.jsonl")
+	u, err := openUsageLog(path, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := New(nil, Config{})
+	p.usage = u
+
+	// Upstream reads the request, then replies and hangs up
+	upstream, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer upstream.Close()
+	go func() {
+		conn, err := upstream.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		io.Copy(io.Discard, conn)
+		time.Sleep(20 * time.Millisecond)
+		conn.Write([]byte("response"))
+	}()
+	destConn, err := net.Dial("tcp", upstream.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	clientLn, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer clientLn.Close()
+	peer, err := net.Dial("tcp", clientLn.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer peer.Close()
+	clientConn, err := clientLn.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer clientConn.Close()
+
+	go func() {
+		peer.Write([]byte("body"))
+		peer.(*net.TCPConn).CloseWrite()
+	}()
+
+	start := time.Now()
+	p.relay(clientConn, destConn, start, []byte("head"), nil, "news.example.org", "http", slog.New(slog.DiscardHandler))
+	if err := p.usage.close(); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(lines) != 1 {
+		t.Fatalf("usage log holds %d records, want 1", len(lines))
+	}
+	var rec usageRecord
+	if err := json.Unmarshal([]byte(lines[0]), &rec); err != nil {
+		t.Fatal(err)
+	}
+
+	if rec.Host != "news.example.org" {
+		t.Errorf("Host = %q, want news.example.org", rec.Host)
+	}
+	if rec.Dest != upstream.Addr().String() {
+		t.Errorf("Dest = %q, want %q", rec.Dest, upstream.Addr())
+	}
+	if rec.Protocol != "http" {
+		t.Errorf("Protocol = %q, want http", rec.Protocol)
+	}
+	if !rec.Start.Equal(start) {
+		t.Errorf("Start = %v, want %v", rec.Start, start)
+	}
+	if rec.DurationMs < 20 {
+		t.Errorf("DurationMs = %d, want at least 20", rec.DurationMs)
+	}
+	if want := int64(len("head") + len("body")); rec.BytesSent != want {
+		t.Errorf("BytesSent = %d, want %d", rec.BytesSent, want)
+	}
+	if want := int64(len("response")); rec.BytesReceived != want {
+		t.Errorf("BytesReceived = %d, want %d", rec.BytesReceived, want)
+	}
+}
@@ -0,0 +1,114 @@
+package resolver
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+)
+
+// DNS record types and response codes used by the DoH JSON API
+const (
+	dohTypeA    = 1
+	dohTypeAAAA = 28
+
+	dohStatusNXDOMAIN = 3
+)
+
+// dohMaxBytes bounds a DoH response body
+const dohMaxBytes = 1 << 20
+
+// dohResponse is the subset of the DNS JSON API response (as served by
+// Cloudflare and Google) that focusd uses
+type dohResponse struct {
+	Status int `json:"Status"`
+	Answer []struct {
+		Type int    `json:"type"`
+		Data string `json:"data"`
+	} `json:"Answer"`
+}
+
+// lookupDoH resolves host's A and AAAA records through the DoH endpoint.
+// A name that doesn't exist is reported as a not-found *net.DNSError, like
+// the system resolver does.
+func (r *Resolver) lookupDoH(ctx context.Context, host string) ([]net.IP, error) {
+	type result struct {
+		ips []net.IP
+		err error
+	}
+	aaaaC := make(chan result, 1)
+	go func() {
+		ips, err := r.queryDoH(ctx, host, dohTypeAAAA)
+		aaaaC <- result{ips, err}
+	}()
+
+	ips, err := r.queryDoH(ctx, host, dohTypeA)
+	aaaa := <-aaaaC
+	if err != nil {
+		return nil, err
+	}
+	if aaaa.err != nil {
+		return nil, aaaa.err
+	}
+
+	ips = append(ips, aaaa.ips...)
+	if len(ips) == 0 {
+		return nil, &net.DNSError{Err: "no such host", Name: host, Server: r.dohURL, IsNotFound: true}
+	}
+	return ips, nil
+}
+
+// queryDoH asks the DoH endpoint for one record type of host
+func (r *Resolver) queryDoH(ctx context.Context, host string, qtype int) ([]net.IP, error) {
+	u, err := url.Parse(r.dohURL)
+	if err != nil {
+		return nil, fmt.Errorf("parsing DoH URL: %w", err)
+	}
+	q := u.Query()
+	q.Set("name", host)
+	q.Set("type", fmt.Sprint(qtype))
+	u.RawQuery = q.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/dns-json")
+
+	resp, err := r.dohClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("DoH query for %s: HTTP %s", host, resp.Status)
+	}
+
+	var body dohResponse
+	if err := json.NewDecoder(io.LimitReader(resp.Body, dohMaxBytes)).Decode(&body); err != nil {
+		return nil, fmt.Errorf("parsing DoH response for %s: %w", host, err)
+	}
+
+	switch body.Status {
+	case 0:
+	case dohStatusNXDOMAIN:
+		return nil, &net.DNSError{Err: "no such host", Name: host, Server: r.dohURL, IsNotFound: true}
+	default:
+		return nil, fmt.Errorf("DoH query for %s: DNS status %d", host, body.Status)
+	}
+
+	// CNAMEs in the chain are skipped; their targets' records follow them
+	var ips []net.IP
+	for _, answer := range body.Answer {
+		if answer.Type != qtype {
+			continue
+		}
+		if ip := net.ParseIP(answer.Data); ip != nil {
+			ips = append(ips, ip)
+		}
+	}
+	return ips, nil
+}
@@ -0,0 +1,77 @@
+package resolver
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestResolveDoH(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Accept") != "application/dns-json" {
+			http.Error(w, "bad accept header", http.StatusBadRequest)
+			return
+		}
+		name, qtype := r.URL.Query().Get("name"), r.URL.Query().Get("type")
+		switch name {
+		case "example.com", "www.example.com":
+			data := "192.0.2.1"
+			if qtype == "28" {
+				data = "2001:db8::1"
+			}
+			fmt.Fprintf(w, `{"Status":0,"Answer":[{"type":5,"data":"cdn.example.net."},{"type":%s,"data":%q}]}`, qtype, data)
+		case "broken.example", "www.broken.example":
+			http.Error(w, "upstream failure", http.StatusBadGateway)
+		default:
+			json.NewEncoder(w).Encode(map[string]int{"Status": dohStatusNXDOMAIN})
+		}
+	}))
+	defer srv.Close()
+
+	tests := []struct {
+		name    string
+		domains []string
+		want    []string
+	}{
+		{
+			name:    "A and AAAA answers",
+			domains: []string{"example.com"},
+			want:    []string{"192.0.2.1", "2001:db8::1"},
+		},
+		{
+			name:    "nxdomain does not fall back",
+			domains: []string{"missing.example"},
+		},
+		{
+			name:    "failure falls back to DNS",
+			domains: []string{"broken.example"},
+			want:    []string{"198.51.100.7"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := New(Config{Servers: []string{"10.0.0.1"}, DoHURL: srv.URL + "/dns-query"})
+			r.dohClient = srv.Client()
+			r.lookup = fakeServers(map[string]map[string][]net.IP{"10.0.0.1:53": {
+				"broken.example":  {net.ParseIP("198.51.100.7")},
+				"missing.example": {net.ParseIP("198.51.100.8")},
+			}})
+
+			ips, err := r.Resolve(tt.domains)
+			if err != nil {
+				t.Fatalf("Resolve() error = %v", err)
+			}
+			var got []string
+			for _, ip := range ips {
+				got = append(got, ip.String())
+			}
+			if fmt.Sprint(got) != fmt.Sprint(tt.want) {
+				t.Errorf("Resolve() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
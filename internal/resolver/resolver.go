@@ -1,49 +1,306 @@
 package resolver
 
 import (
+	"bytes"
+	"context"
+	"errors"
 	"fmt"
+	"log/slog"
+	"maps"
 	"net"
+	"net/http"
+	"net/netip"
+	"slices"
 	"strings"
+	"sync"
+	"time"
+
+	"focusd/internal/matcher"
 )
 
+// DefaultTimeout is the per-resolver query timeout
+const DefaultTimeout = 5 * time.Second
+
+// DefaultConcurrency is the number of domains resolved in parallel
+const DefaultConcurrency = 16
+
+// DefaultSkipCIDRs are the addresses left out of resolved results unless
+// Config.SkipCIDRs says otherwise: blocking them would cut off the machine
+// itself or its local network, and blocked domains often resolve to them
+// when a hosts file or DNS sinkhole already blocks them
+var DefaultSkipCIDRs = []string{
+	"0.0.0.0/8",
+	"127.0.0.0/8",
+	"10.0.0.0/8",
+	"172.16.0.0/12",
+	"192.168.0.0/16",
+	"169.254.0.0/16",
+	"::/128",
+	"::1/128",
+	"fc00::/7",
+	"fe80::/10",
+}
+
+// SharedCDNCIDRs are the published ranges of CDNs whose addresses are
+// shared by many unrelated sites (Cloudflare and Fastly), so dropping one
+// blocked site's address takes others down with it. Blocking such sites is
+// left to DNS and the proxy when Config.SharedCIDRs includes these.
+var SharedCDNCIDRs = []string{
+	// Cloudflare
+	"173.245.48.0/20",
+	"103.21.244.0/22",
+	"103.22.200.0/22",
+	"103.31.4.0/22",
+	"141.101.64.0/18",
+	"108.162.192.0/18",
+	"190.93.240.0/20",
+	"188.114.96.0/20",
+	"197.234.240.0/22",
+	"198.41.128.0/17",
+	"162.158.0.0/15",
+	"104.16.0.0/13",
+	"104.24.0.0/14",
+	"172.64.0.0/13",
+	"131.0.72.0/22",
+	"2400:cb00::/32",
+	"2606:4700::/32",
+	"2803:f800::/32",
+	"2405:b500::/32",
+	"2405:8100::/32",
+	"2a06:98c0::/29",
+	"2c0f:f248::/32",
+
+	// Fastly
+	"23.235.32.0/20",
+	"43.249.72.0/22",
+	"103.244.50.0/24",
+	"103.245.222.0/23",
+	"103.245.224.0/24",
+	"104.156.80.0/20",
+	"140.248.64.0/18",
+	"140.248.128.0/17",
+	"146.75.0.0/17",
+	"151.101.0.0/16",
+	"157.52.64.0/18",
+	"167.82.0.0/17",
+	"167.82.128.0/20",
+	"167.82.160.0/20",
+	"167.82.224.0/20",
+	"172.111.64.0/18",
+	"185.31.16.0/22",
+	"199.27.72.0/21",
+	"199.232.0.0/16",
+	"2a04:4e40::/32",
+	"2a04:4e42::/32",
+}
+
+// ErrAllResolversFailed is returned when no configured resolver could answer.
+// It is distinct from a domain not existing (NXDOMAIN).
+var ErrAllResolversFailed = errors.New("all resolvers failed")
+
+// Config holds optional resolver settings
+type Config struct {
+	// Servers are upstream DNS servers ("host" or "host:port") tried in order
+	// for each query. Empty uses the system resolver.
+	Servers []string
+
+	// Timeout bounds each query to a single server (default: DefaultTimeout)
+	Timeout time.Duration
+
+	// Concurrency is the number of domains resolved in parallel
+	// (default: DefaultConcurrency)
+	Concurrency int
+
+	// CacheTTL is how long successful lookups are reused before querying
+	// again. Zero disables the cache.
+	CacheTTL time.Duration
+
+	// DoHURL is a DNS-over-HTTPS endpoint speaking the JSON API (e.g.
+	// https://cloudflare-dns.com/dns-query). When set, domains are resolved
+	// through it first, falling back to Servers if it fails.
+	DoHURL string
+
+	// SkipCIDRs are networks whose addresses are left out of Resolve's
+	// result, replacing DefaultSkipCIDRs if set. Invalid entries are
+	// ignored; config validation reports them.
+	SkipCIDRs []string
+
+	// SharedCIDRs are networks of addresses shared by many sites, such as
+	// SharedCDNCIDRs, which are left out of Resolve's result too. Unlike
+	// SkipCIDRs, each address skipped for being shared is logged with the
+	// domains that resolved to it.
+	SharedCIDRs []string
+}
+
+// lookupFunc resolves host using the given server ("" means the system resolver)
+type lookupFunc func(ctx context.Context, server, host string) ([]net.IP, error)
+
 // Resolver resolves domain names to IP addresses
-type Resolver struct{}
+type Resolver struct {
+	servers     []string
+	timeout     time.Duration
+	concurrency int
+	lookup      lookupFunc
+
+	dohURL    string
+	dohClient *http.Client
+
+	skip   []netip.Prefix
+	shared []netip.Prefix
+
+	cacheTTL time.Duration
+	now      func() time.Time
+	cacheMu  sync.Mutex
+	cache    map[string]cacheEntry
+}
+
+// cacheEntry holds a domain's addresses until expires
+type cacheEntry struct {
+	ips     []net.IP
+	expires time.Time
+}
 
 // New creates a new Resolver
-func New() *Resolver {
-	return &Resolver{}
+func New(cfg Config) *Resolver {
+	r := &Resolver{
+		timeout:     cfg.Timeout,
+		concurrency: cfg.Concurrency,
+		lookup:      lookupIP,
+		cacheTTL:    cfg.CacheTTL,
+		now:         time.Now,
+		cache:       make(map[string]cacheEntry),
+		dohURL:      cfg.DoHURL,
+		dohClient:   &http.Client{},
+	}
+	if r.timeout <= 0 {
+		r.timeout = DefaultTimeout
+	}
+	if r.concurrency <= 0 {
+		r.concurrency = DefaultConcurrency
+	}
+	for _, server := range cfg.Servers {
+		r.servers = append(r.servers, ServerAddr(server))
+	}
+	skipCIDRs := cfg.SkipCIDRs
+	if len(skipCIDRs) == 0 {
+		skipCIDRs = DefaultSkipCIDRs
+	}
+	r.skip = parsePrefixes(skipCIDRs)
+	r.shared = parsePrefixes(cfg.SharedCIDRs)
+	return r
+}
+
+// parsePrefixes parses CIDRs, ignoring invalid ones
+func parsePrefixes(cidrs []string) []netip.Prefix {
+	var prefixes []netip.Prefix
+	for _, cidr := range cidrs {
+		if prefix, err := netip.ParsePrefix(cidr); err == nil {
+			prefixes = append(prefixes, prefix.Masked())
+		}
+	}
+	return prefixes
+}
+
+// inPrefixes reports whether ip is in one of prefixes. Addresses that
+// aren't IPs at all count as in every set, so they are never blocked.
+func inPrefixes(ip net.IP, prefixes []netip.Prefix) bool {
+	addr, ok := netip.AddrFromSlice(ip)
+	if !ok {
+		return true
+	}
+	addr = addr.Unmap()
+	for _, prefix := range prefixes {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// ServerAddr adds the default DNS port to a server address that lacks one
+func ServerAddr(server string) string {
+	if _, _, err := net.SplitHostPort(server); err == nil {
+		return server
+	}
+	return net.JoinHostPort(strings.Trim(server, "[]"), "53")
 }
 
 // Resolve resolves a list of domains to their IP addresses
 // For each domain, it also resolves the www. subdomain variant
-// Returns a deduplicated list of IP addresses (both IPv4 and IPv6)
+// Domains are resolved concurrently by a bounded pool of workers
+// Returns a deduplicated list of IP addresses (both IPv4 and IPv6), sorted so
+// the result does not depend on lookup order. Loopback, private and other
+// local addresses (see Config.SkipCIDRs) are left out, as dropping them
+// would cut off the machine or its network rather than the domain, and so
+// are shared addresses in Config.SharedCIDRs.
+// If every lookup failed because no resolver was reachable, it returns
+// ErrAllResolversFailed rather than an empty list.
 func (r *Resolver) Resolve(domains []string) ([]net.IP, error) {
-	ipSet := make(map[string]net.IP)
+	var (
+		mu          sync.Mutex
+		ipSet       = make(map[string]net.IP)
+		skipped     = make(map[string][]string)
+		shared      = make(map[string][]string)
+		attempted   int
+		unreachable int
+	)
+
+	jobs := make(chan string)
+	var wg sync.WaitGroup
+	for range min(r.concurrency, len(domains)) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for domain := range jobs {
+				ips, err := r.resolveWithWWW(domain)
+
+				mu.Lock()
+				attempted++
+				if err != nil {
+					if errors.Is(err, ErrAllResolversFailed) {
+						unreachable++
+					}
+					mu.Unlock()
+					// Log the error but continue with other domains
+					slog.Warn("Failed to resolve domain", "domain", domain, "err", err)
+					continue
+				}
+				for _, ip := range ips {
+					switch {
+					case inPrefixes(ip, r.skip):
+						skipped[ip.String()] = append(skipped[ip.String()], domain)
+					case inPrefixes(ip, r.shared):
+						shared[ip.String()] = append(shared[ip.String()], domain)
+					default:
+						ipSet[ip.String()] = ip
+					}
+				}
+				mu.Unlock()
+			}
+		}()
+	}
 
 	for _, domain := range domains {
-		// Resolve the base domain
-		ips, err := r.resolveDomain(domain)
-		if err != nil {
-			// Log the error but continue with other domains
-			fmt.Printf("Warning: failed to resolve %s: %v\n", domain, err)
+		// Wildcard entries (*.ru) and patterns have no addresses of their own
+		if strings.HasPrefix(domain, "*.") || matcher.IsPattern(domain) {
 			continue
 		}
-		for _, ip := range ips {
-			ipSet[ip.String()] = ip
-		}
+		jobs <- domain
+	}
+	close(jobs)
+	wg.Wait()
 
-		// Also resolve www. subdomain if not already included
-		if !strings.HasPrefix(domain, "www.") {
-			wwwDomain := "www." + domain
-			ips, err := r.resolveDomain(wwwDomain)
-			if err != nil {
-				// It's OK if www subdomain doesn't exist
-				continue
-			}
-			for _, ip := range ips {
-				ipSet[ip.String()] = ip
-			}
-		}
+	if attempted > 0 && unreachable == attempted {
+		return nil, ErrAllResolversFailed
+	}
+
+	for _, ip := range slices.Sorted(maps.Keys(skipped)) {
+		domains := slices.Compact(slices.Sorted(slices.Values(skipped[ip])))
+		slog.Debug("Skipped local address of blocked domain", "ip", ip, "domains", domains)
+	}
+	for _, ip := range slices.Sorted(maps.Keys(shared)) {
+		domains := slices.Compact(slices.Sorted(slices.Values(shared[ip])))
+		slog.Info("Skipped shared CDN address of blocked domain, relying on DNS and the proxy", "ip", ip, "domains", domains)
 	}
 
 	// Convert map to slice
@@ -51,19 +308,127 @@ func (r *Resolver) Resolve(domains []string) ([]net.IP, error) {
 	for _, ip := range ipSet {
 		result = append(result, ip)
 	}
+	slices.SortFunc(result, func(a, b net.IP) int {
+		return bytes.Compare(a.To16(), b.To16())
+	})
 
 	return result, nil
 }
 
-// resolveDomain resolves a single domain to its IP addresses
+// resolveWithWWW resolves domain and, concurrently, its www. variant. The
+// variant's addresses are only kept if the domain itself resolved; it's OK if
+// the www subdomain doesn't exist.
+func (r *Resolver) resolveWithWWW(domain string) ([]net.IP, error) {
+	if strings.HasPrefix(domain, "www.") {
+		return r.resolveDomain(domain)
+	}
+
+	wwwC := make(chan []net.IP, 1)
+	go func() {
+		ips, _ := r.resolveDomain("www." + domain)
+		wwwC <- ips
+	}()
+
+	ips, err := r.resolveDomain(domain)
+	wwwIPs := <-wwwC
+	if err != nil {
+		return nil, err
+	}
+	return append(ips, wwwIPs...), nil
+}
+
+// Flush discards all cached lookups so the next Resolve queries every domain
+func (r *Resolver) Flush() {
+	r.cacheMu.Lock()
+	defer r.cacheMu.Unlock()
+	clear(r.cache)
+}
+
+// resolveDomain resolves a single domain, serving it from the cache while the
+// cached entry is fresh
 func (r *Resolver) resolveDomain(domain string) ([]net.IP, error) {
-	ips, err := net.LookupIP(domain)
+	if r.cacheTTL <= 0 {
+		return r.lookupDomain(domain)
+	}
+
+	now := r.now()
+	r.cacheMu.Lock()
+	entry, ok := r.cache[domain]
+	r.cacheMu.Unlock()
+	if ok && now.Before(entry.expires) {
+		return slices.Clone(entry.ips), nil
+	}
+
+	ips, err := r.lookupDomain(domain)
 	if err != nil {
 		return nil, err
 	}
+
+	r.cacheMu.Lock()
+	r.cache[domain] = cacheEntry{ips: slices.Clone(ips), expires: now.Add(r.cacheTTL)}
+	r.cacheMu.Unlock()
 	return ips, nil
 }
 
+// lookupDomain resolves a single domain to its IP addresses, through DoH if
+// configured and then each configured server in order. NXDOMAIN is
+// authoritative and is not retried.
+func (r *Resolver) lookupDomain(domain string) ([]net.IP, error) {
+	if r.dohURL != "" {
+		ctx, cancel := context.WithTimeout(context.Background(), r.timeout)
+		ips, err := r.lookupDoH(ctx, domain)
+		cancel()
+		if err == nil {
+			return ips, nil
+		}
+		var dnsErr *net.DNSError
+		if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+			return nil, err
+		}
+		slog.Warn("DoH lookup failed, falling back to DNS", "host", domain, "err", err)
+	}
+
+	if len(r.servers) == 0 {
+		ctx, cancel := context.WithTimeout(context.Background(), r.timeout)
+		defer cancel()
+		return r.lookup(ctx, "", domain)
+	}
+
+	var errs []error
+	for _, server := range r.servers {
+		ctx, cancel := context.WithTimeout(context.Background(), r.timeout)
+		ips, err := r.lookup(ctx, server, domain)
+		cancel()
+		if err == nil {
+			return ips, nil
+		}
+
+		var dnsErr *net.DNSError
+		if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+			return nil, err
+		}
+		errs = append(errs, fmt.Errorf("%s: %w", server, err))
+	}
+
+	return nil, fmt.Errorf("%w: %w", ErrAllResolversFailed, errors.Join(errs...))
+}
+
+// lookupIP queries server (or the system resolver if empty) for host's addresses
+func lookupIP(ctx context.Context, server, host string) ([]net.IP, error) {
+	if server == "" {
+		return net.DefaultResolver.LookupIP(ctx, "ip", host)
+	}
+
+	res := &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, network, server)
+		},
+	}
+	return res.LookupIP(ctx, "ip", host)
+}
+
 // GetDomainVariants returns all variants of a domain that should be blocked
 // For example, "example.com" -> ["example.com", "www.example.com"]
 func GetDomainVariants(domain string) []string {
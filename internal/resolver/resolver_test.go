@@ -0,0 +1,327 @@
+package resolver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"net"
+	"net/netip"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeServers returns a lookupFunc answering from per-server tables.
+// Servers missing from the map behave as unreachable.
+func fakeServers(answers map[string]map[string][]net.IP) lookupFunc {
+	return func(ctx context.Context, server, host string) ([]net.IP, error) {
+		table, ok := answers[server]
+		if !ok {
+			return nil, &net.DNSError{Err: "i/o timeout", Name: host, Server: server, IsTimeout: true}
+		}
+		ips, ok := table[host]
+		if !ok {
+			return nil, &net.DNSError{Err: "no such host", Name: host, Server: server, IsNotFound: true}
+		}
+		return ips, nil
+	}
+}
+
+func TestResolveFallback(t *testing.T) {
+	healthy := map[string][]net.IP{
+		"example.com": {net.ParseIP("192.0.2.1")},
+	}
+
+	tests := []struct {
+		name    string
+		servers []string
+		answers map[string]map[string][]net.IP
+		domains []string
+		want    int
+		wantErr error
+	}{
+		{
+			name:    "failing primary, healthy secondary",
+			servers: []string{"10.0.0.1", "10.0.0.2"},
+			answers: map[string]map[string][]net.IP{"10.0.0.2:53": healthy},
+			domains: []string{"example.com"},
+			want:    1,
+		},
+		{
+			name:    "nxdomain is not retried",
+			servers: []string{"10.0.0.2", "10.0.0.3"},
+			answers: map[string]map[string][]net.IP{
+				"10.0.0.2:53": healthy,
+				"10.0.0.3:53": {"missing.example": {net.ParseIP("192.0.2.9")}},
+			},
+			domains: []string{"example.com", "missing.example"},
+			want:    1,
+		},
+		{
+			name:    "all resolvers down",
+			servers: []string{"10.0.0.1", "10.0.0.4"},
+			answers: map[string]map[string][]net.IP{},
+			domains: []string{"example.com"},
+			wantErr: ErrAllResolversFailed,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := New(Config{Servers: tt.servers})
+			r.lookup = fakeServers(tt.answers)
+
+			ips, err := r.Resolve(tt.domains)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("Resolve() error = %v, want %v", err, tt.wantErr)
+			}
+			if len(ips) != tt.want {
+				t.Errorf("Resolve() returned %d IPs, want %d", len(ips), tt.want)
+			}
+		})
+	}
+}
+
+func TestResolveDomainDistinguishesNXDOMAIN(t *testing.T) {
+	r := New(Config{Servers: []string{"10.0.0.2"}})
+	r.lookup = fakeServers(map[string]map[string][]net.IP{"10.0.0.2:53": {}})
+
+	_, err := r.resolveDomain("missing.example")
+	if err == nil || errors.Is(err, ErrAllResolversFailed) {
+		t.Errorf("resolveDomain() error = %v, want NXDOMAIN", err)
+	}
+}
+
+func TestServerAddr(t *testing.T) {
+	tests := map[string]string{
+		"1.1.1.1":         "1.1.1.1:53",
+		"1.1.1.1:5353":    "1.1.1.1:5353",
+		"2606:4700::1111": "[2606:4700::1111]:53",
+		"[::1]:53":        "[::1]:53",
+	}
+	for in, want := range tests {
+		if got := ServerAddr(in); got != want {
+			t.Errorf("ServerAddr(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+// manyDomains returns n domains with one address each, plus www. variants
+func manyDomains(n int) ([]string, map[string][]net.IP) {
+	domains := make([]string, 0, n)
+	table := make(map[string][]net.IP, 2*n)
+	for i := range n {
+		domain := fmt.Sprintf("site%d.example", i)
+		domains = append(domains, domain)
+		table[domain] = []net.IP{net.IPv4(192, 0, 2, byte(i))}
+		table["www."+domain] = []net.IP{net.IPv4(198, 51, 100, byte(i)), net.IPv4(192, 0, 2, byte(i))}
+	}
+	return domains, table
+}
+
+func TestResolveDeterministic(t *testing.T) {
+	domains, table := manyDomains(200)
+	// A domain that fails is skipped without affecting the others
+	domains = append(domains, "missing.example", "*.wildcard.example")
+
+	var want []net.IP
+	for _, concurrency := range []int{1, 4, 16, 64} {
+		for range 5 {
+			r := New(Config{Servers: []string{"10.0.0.2"}, Concurrency: concurrency})
+			r.lookup = fakeServers(map[string]map[string][]net.IP{"10.0.0.2:53": table})
+
+			ips, err := r.Resolve(domains)
+			if err != nil {
+				t.Fatalf("Resolve() error = %v", err)
+			}
+			if len(ips) != 400 {
+				t.Fatalf("Resolve() returned %d IPs, want 400", len(ips))
+			}
+			if want == nil {
+				want = ips
+				continue
+			}
+			if !slices.EqualFunc(ips, want, net.IP.Equal) {
+				t.Fatalf("Resolve() with concurrency %d returned a different order", concurrency)
+			}
+		}
+	}
+}
+
+func BenchmarkResolve(b *testing.B) {
+	domains, table := manyDomains(200)
+	lookup := fakeServers(map[string]map[string][]net.IP{"10.0.0.2:53": table})
+	slow := func(ctx context.Context, server, host string) ([]net.IP, error) {
+		time.Sleep(100 * time.Microsecond)
+		return lookup(ctx, server, host)
+	}
+
+	for _, concurrency := range []int{1, DefaultConcurrency} {
+		b.Run(fmt.Sprintf("concurrency=%d", concurrency), func(b *testing.B) {
+			r := New(Config{Servers: []string{"10.0.0.2"}, Concurrency: concurrency})
+			r.lookup = slow
+			for b.Loop() {
+				if _, err := r.Resolve(domains); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestResolveCache(t *testing.T) {
+	var mu sync.Mutex
+	queries := make(map[string]int)
+	lookup := fakeServers(map[string]map[string][]net.IP{"10.0.0.2:53": {
+		"example.com": {net.ParseIP("192.0.2.1")},
+	}})
+
+	now := time.Date(2026, 1, 5, 10, 0, 0, 0, time.UTC)
+	r := New(Config{Servers: []string{"10.0.0.2"}, CacheTTL: 10 * time.Minute})
+	r.now = func() time.Time { return now }
+	r.lookup = func(ctx context.Context, server, host string) ([]net.IP, error) {
+		mu.Lock()
+		queries[host]++
+		mu.Unlock()
+		return lookup(ctx, server, host)
+	}
+
+	resolve := func() {
+		t.Helper()
+		if ips, err := r.Resolve([]string{"example.com"}); err != nil || len(ips) != 1 {
+			t.Fatalf("Resolve() = %v, %v", ips, err)
+		}
+	}
+
+	tests := []struct {
+		name    string
+		advance time.Duration
+		flush   bool
+		want    int
+	}{
+		{name: "first lookup", want: 1},
+		{name: "fresh entry is cached", advance: 5 * time.Minute, want: 1},
+		{name: "expired entry is looked up", advance: 5 * time.Minute, want: 2},
+		{name: "flush forces a lookup", flush: true, want: 3},
+	}
+
+	for _, tt := range tests {
+		now = now.Add(tt.advance)
+		if tt.flush {
+			r.Flush()
+		}
+		resolve()
+		if got := queries["example.com"]; got != tt.want {
+			t.Errorf("%s: %d lookups, want %d", tt.name, got, tt.want)
+		}
+	}
+
+	// Failed lookups are not cached
+	if got := queries["www.example.com"]; got != 4 {
+		t.Errorf("www.example.com looked up %d times, want 4", got)
+	}
+}
+
+func TestResolveSkipsLocalAddresses(t *testing.T) {
+	table := map[string][]net.IP{
+		"sunk.example":    {net.ParseIP("0.0.0.0"), net.ParseIP("::")},
+		"loopback.test":   {net.ParseIP("127.0.0.1"), net.ParseIP("::1")},
+		"mixed.example":   {net.ParseIP("192.168.1.10"), net.ParseIP("198.51.100.7")},
+		"mapped.example":  {net.ParseIP("::ffff:10.1.2.3")},
+		"linklocal.test":  {net.ParseIP("169.254.1.1"), net.ParseIP("fe80::1")},
+		"public.example":  {net.ParseIP("203.0.113.5"), net.ParseIP("2001:db8::5")},
+		"ula.example":     {net.ParseIP("fd12::1")},
+		"internal.corp":   {net.ParseIP("10.20.0.4")},
+		"carrier.example": {net.ParseIP("100.64.0.1")},
+	}
+	domains := slices.Collect(maps.Keys(table))
+
+	tests := []struct {
+		name      string
+		skipCIDRs []string
+		want      []string
+	}{
+		{
+			name: "defaults",
+			want: []string{"100.64.0.1", "198.51.100.7", "203.0.113.5", "2001:db8::5"},
+		},
+		{
+			name:      "replaced",
+			skipCIDRs: []string{"127.0.0.0/8", "0.0.0.0/32", "100.64.0.0/10", "not a cidr"},
+			want:      []string{"::", "::1", "10.1.2.3", "10.20.0.4", "169.254.1.1", "192.168.1.10", "198.51.100.7", "203.0.113.5", "2001:db8::5", "fd12::1", "fe80::1"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := New(Config{Servers: []string{"10.0.0.2"}, SkipCIDRs: tt.skipCIDRs})
+			r.lookup = fakeServers(map[string]map[string][]net.IP{"10.0.0.2:53": table})
+			ips, err := r.Resolve(domains)
+			if err != nil {
+				t.Fatalf("Resolve() error = %v", err)
+			}
+			got := make([]string, len(ips))
+			for i, ip := range ips {
+				got[i] = ip.String()
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("Resolve() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestResolveSkipsSharedAddresses(t *testing.T) {
+	table := map[string][]net.IP{
+		"blocked.example": {net.ParseIP("104.16.1.1"), net.ParseIP("2606:4700::1"), net.ParseIP("203.0.113.5")},
+		"fastly.example":  {net.ParseIP("151.101.1.1")},
+		"custom.example":  {net.ParseIP("198.51.100.7")},
+	}
+	domains := slices.Collect(maps.Keys(table))
+	for _, cidr := range SharedCDNCIDRs {
+		if _, err := netip.ParsePrefix(cidr); err != nil {
+			t.Errorf("SharedCDNCIDRs entry %q: %v", cidr, err)
+		}
+	}
+
+	tests := []struct {
+		name        string
+		sharedCIDRs []string
+		want        []string
+	}{
+		{
+			name: "none",
+			want: []string{"104.16.1.1", "151.101.1.1", "198.51.100.7", "203.0.113.5", "2606:4700::1"},
+		},
+		{
+			name:        "shared CDNs",
+			sharedCIDRs: SharedCDNCIDRs,
+			want:        []string{"198.51.100.7", "203.0.113.5"},
+		},
+		{
+			name:        "custom",
+			sharedCIDRs: []string{"198.51.100.0/24"},
+			want:        []string{"104.16.1.1", "151.101.1.1", "203.0.113.5", "2606:4700::1"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := New(Config{Servers: []string{"10.0.0.2"}, SharedCIDRs: tt.sharedCIDRs})
+			r.lookup = fakeServers(map[string]map[string][]net.IP{"10.0.0.2:53": table})
+			ips, err := r.Resolve(domains)
+			if err != nil {
+				t.Fatalf("Resolve() error = %v", err)
+			}
+			got := make([]string, len(ips))
+			for i, ip := range ips {
+				got[i] = ip.String()
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("Resolve() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,188 @@
+package schedule
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Entry is a blocking window as written in the config file, e.g.
+// {days: [Mon, Tue], start: "09:00", end: "17:00"}
+type Entry struct {
+	// Days the window starts on (Mon, Tue, ...). Empty means every day.
+	Days []string `json:"days,omitempty" yaml:"days,omitempty"`
+
+	// Start and End are HH:MM times. An End at or before Start crosses
+	// midnight into the next day; "24:00" means the end of the day.
+	Start string `json:"start" yaml:"start"`
+	End   string `json:"end" yaml:"end"`
+
+	// Timezone is an IANA zone name such as "Europe/Berlin" (default: local time)
+	Timezone string `json:"timezone,omitempty" yaml:"timezone,omitempty"`
+}
+
+// window is a parsed Entry
+type window struct {
+	days  [7]bool
+	start time.Duration // offset from midnight
+	end   time.Duration // offset from midnight, greater than start
+	loc   *time.Location
+}
+
+// Schedule is a set of blocking windows. Overlapping windows are merged: the
+// schedule is active whenever any window is.
+type Schedule struct {
+	windows []window
+}
+
+var dayNames = map[string]time.Weekday{
+	"sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday, "wed": time.Wednesday,
+	"thu": time.Thursday, "fri": time.Friday, "sat": time.Saturday,
+}
+
+// Parse validates config entries and returns the schedule they describe
+func Parse(entries []Entry) (*Schedule, error) {
+	s := &Schedule{}
+	for i, e := range entries {
+		w, err := parseEntry(e)
+		if err != nil {
+			return nil, fmt.Errorf("schedule %d: %w", i+1, err)
+		}
+		s.windows = append(s.windows, w)
+	}
+	return s, nil
+}
+
+func parseEntry(e Entry) (window, error) {
+	var w window
+
+	if len(e.Days) == 0 {
+		for i := range w.days {
+			w.days[i] = true
+		}
+	}
+	for _, day := range e.Days {
+		key := strings.ToLower(day)
+		if len(key) > 3 {
+			key = key[:3]
+		}
+		wd, ok := dayNames[key]
+		if !ok {
+			return w, fmt.Errorf("invalid day %q", day)
+		}
+		w.days[wd] = true
+	}
+
+	var err error
+	if w.start, err = parseClock(e.Start); err != nil {
+		return w, fmt.Errorf("invalid start: %w", err)
+	}
+	if w.end, err = parseClock(e.End); err != nil {
+		return w, fmt.Errorf("invalid end: %w", err)
+	}
+	if w.start == 24*time.Hour {
+		return w, fmt.Errorf("invalid start: 24:00 is only valid as an end time")
+	}
+	if w.end <= w.start {
+		// Crosses midnight
+		w.end += 24 * time.Hour
+	}
+
+	w.loc = time.Local
+	if e.Timezone != "" {
+		if w.loc, err = time.LoadLocation(e.Timezone); err != nil {
+			return w, fmt.Errorf("invalid timezone: %w", err)
+		}
+	}
+
+	return w, nil
+}
+
+// parseClock parses an HH:MM time of day into an offset from midnight
+func parseClock(s string) (time.Duration, error) {
+	var h, m int
+	if _, err := fmt.Sscanf(s, "%d:%d", &h, &m); err != nil || len(s) != 5 {
+		return 0, fmt.Errorf("%q is not HH:MM", s)
+	}
+	if h < 0 || m < 0 || m > 59 || h > 24 || (h == 24 && m != 0) {
+		return 0, fmt.Errorf("%q is out of range", s)
+	}
+	return time.Duration(h)*time.Hour + time.Duration(m)*time.Minute, nil
+}
+
+// Empty reports whether the schedule has no windows
+func (s *Schedule) Empty() bool {
+	return s == nil || len(s.windows) == 0
+}
+
+// Active reports whether t falls inside any window
+func (s *Schedule) Active(t time.Time) bool {
+	if s == nil {
+		return false
+	}
+	for _, w := range s.windows {
+		if w.active(t) {
+			return true
+		}
+	}
+	return false
+}
+
+// active reports whether t falls inside the window started today or, for a
+// window crossing midnight, yesterday
+func (w window) active(t time.Time) bool {
+	local := t.In(w.loc)
+	for offset := 0; offset >= -1; offset-- {
+		day := time.Date(local.Year(), local.Month(), local.Day()+offset, 0, 0, 0, 0, w.loc)
+		if !w.days[day.Weekday()] {
+			continue
+		}
+		start, end := w.bounds(day)
+		if !t.Before(start) && t.Before(end) {
+			return true
+		}
+	}
+	return false
+}
+
+// bounds returns the window's start and end for a window starting on day
+func (w window) bounds(day time.Time) (time.Time, time.Time) {
+	at := func(offset time.Duration) time.Time {
+		// Wall-clock times (normalized past 24:00) so DST changes don't
+		// shift the window
+		h, m := int(offset/time.Hour), int(offset%time.Hour/time.Minute)
+		return time.Date(day.Year(), day.Month(), day.Day(), h, m, 0, 0, w.loc)
+	}
+	return at(w.start), at(w.end)
+}
+
+// NextTransition returns the first time after t at which Active changes,
+// or false if it never changes within the next week
+func (s *Schedule) NextTransition(t time.Time) (time.Time, bool) {
+	if s.Empty() {
+		return time.Time{}, false
+	}
+
+	var candidates []time.Time
+	for _, w := range s.windows {
+		local := t.In(w.loc)
+		for offset := -1; offset <= 8; offset++ {
+			day := time.Date(local.Year(), local.Month(), local.Day()+offset, 0, 0, 0, 0, w.loc)
+			if !w.days[day.Weekday()] {
+				continue
+			}
+			start, end := w.bounds(day)
+			candidates = append(candidates, start, end)
+		}
+	}
+	sort.Slice(candidates, func(i, j int) bool { return candidates[i].Before(candidates[j]) })
+
+	current := s.Active(t)
+	for _, c := range candidates {
+		if c.After(t) && s.Active(c) != current {
+			return c, true
+		}
+	}
+	return time.Time{}, false
+}
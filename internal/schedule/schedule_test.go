@@ -0,0 +1,137 @@
+package schedule
+
+import (
+	"testing"
+	"time"
+)
+
+func mustParse(t *testing.T, entries ...Entry) *Schedule {
+	t.Helper()
+	s, err := Parse(entries)
+	if err != nil {
+		t.Fatalf("Parse() error = %v", err)
+	}
+	return s
+}
+
+func TestParseInvalid(t *testing.T) {
+	tests := []struct {
+		name  string
+		entry Entry
+	}{
+		{name: "bad day", entry: Entry{Days: []string{"Funday"}, Start: "09:00", End: "17:00"}},
+		{name: "bad start", entry: Entry{Start: "9am", End: "17:00"}},
+		{name: "hour out of range", entry: Entry{Start: "09:00", End: "25:00"}},
+		{name: "minute out of range", entry: Entry{Start: "09:60", End: "17:00"}},
+		{name: "start at 24:00", entry: Entry{Start: "24:00", End: "01:00"}},
+		{name: "bad timezone", entry: Entry{Start: "09:00", End: "17:00", Timezone: "Mars/Olympus"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := Parse([]Entry{tt.entry}); err == nil {
+				t.Error("Parse() expected error, got nil")
+			}
+		})
+	}
+}
+
+func TestActive(t *testing.T) {
+	utc := time.UTC
+	// 2026-01-05 is a Monday
+	at := func(day, hour, min int) time.Time { return time.Date(2026, 1, day, hour, min, 0, 0, utc) }
+
+	workday := Entry{Days: []string{"Mon", "Tue", "Wed", "Thu", "Fri"}, Start: "09:00", End: "17:00", Timezone: "UTC"}
+	lateNight := Entry{Days: []string{"Friday"}, Start: "22:00", End: "02:00", Timezone: "UTC"}
+	everyDay := Entry{Start: "12:00", End: "24:00", Timezone: "UTC"}
+
+	tests := []struct {
+		name    string
+		entries []Entry
+		t       time.Time
+		want    bool
+	}{
+		{name: "inside workday", entries: []Entry{workday}, t: at(5, 10, 0), want: true},
+		{name: "at start", entries: []Entry{workday}, t: at(5, 9, 0), want: true},
+		{name: "at end", entries: []Entry{workday}, t: at(5, 17, 0), want: false},
+		{name: "before start", entries: []Entry{workday}, t: at(5, 8, 59), want: false},
+		{name: "weekend", entries: []Entry{workday}, t: at(10, 10, 0), want: false},
+
+		// Crossing midnight belongs to the start day
+		{name: "friday night", entries: []Entry{lateNight}, t: at(9, 23, 0), want: true},
+		{name: "saturday early morning", entries: []Entry{lateNight}, t: at(10, 1, 30), want: true},
+		{name: "saturday after end", entries: []Entry{lateNight}, t: at(10, 2, 0), want: false},
+		{name: "thursday night", entries: []Entry{lateNight}, t: at(8, 23, 0), want: false},
+		{name: "sunday early morning", entries: []Entry{lateNight}, t: at(11, 1, 0), want: false},
+
+		// No days means every day; 24:00 ends at midnight
+		{name: "every day until midnight", entries: []Entry{everyDay}, t: at(11, 23, 59), want: true},
+		{name: "every day after midnight", entries: []Entry{everyDay}, t: at(12, 0, 0), want: false},
+
+		// Overlapping windows are merged
+		{name: "overlap", entries: []Entry{workday, everyDay}, t: at(5, 16, 0), want: true},
+		{name: "overlap extends", entries: []Entry{workday, everyDay}, t: at(5, 20, 0), want: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := mustParse(t, tt.entries...).Active(tt.t); got != tt.want {
+				t.Errorf("Active(%v) = %v, want %v", tt.t, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestActiveTimezone(t *testing.T) {
+	tokyo, err := time.LoadLocation("Asia/Tokyo")
+	if err != nil {
+		t.Skipf("timezone data unavailable: %v", err)
+	}
+
+	s := mustParse(t, Entry{Start: "09:00", End: "17:00", Timezone: "Asia/Tokyo"})
+
+	// 09:30 in Tokyo is 00:30 UTC
+	if !s.Active(time.Date(2026, 1, 5, 0, 30, 0, 0, time.UTC)) {
+		t.Error("Active() = false at 09:30 Tokyo time")
+	}
+	if s.Active(time.Date(2026, 1, 5, 9, 30, 0, 0, time.UTC)) {
+		t.Error("Active() = true at 18:30 Tokyo time")
+	}
+	if !s.Active(time.Date(2026, 1, 5, 16, 59, 0, 0, tokyo)) {
+		t.Error("Active() = false at 16:59 Tokyo time")
+	}
+}
+
+func TestNextTransition(t *testing.T) {
+	at := func(day, hour, min int) time.Time { return time.Date(2026, 1, day, hour, min, 0, 0, time.UTC) }
+
+	workday := Entry{Days: []string{"Mon", "Tue", "Wed", "Thu", "Fri"}, Start: "09:00", End: "17:00", Timezone: "UTC"}
+	evening := Entry{Days: []string{"Mon"}, Start: "16:00", End: "20:00", Timezone: "UTC"}
+
+	tests := []struct {
+		name    string
+		entries []Entry
+		t       time.Time
+		want    time.Time
+	}{
+		{name: "to start", entries: []Entry{workday}, t: at(5, 8, 0), want: at(5, 9, 0)},
+		{name: "to end", entries: []Entry{workday}, t: at(5, 10, 0), want: at(5, 17, 0)},
+		{name: "over weekend", entries: []Entry{workday}, t: at(9, 18, 0), want: at(12, 9, 0)},
+		{name: "overlap skips inner end", entries: []Entry{workday, evening}, t: at(5, 10, 0), want: at(5, 20, 0)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := mustParse(t, tt.entries...).NextTransition(tt.t)
+			if !ok || !got.Equal(tt.want) {
+				t.Errorf("NextTransition(%v) = %v, %v, want %v", tt.t, got, ok, tt.want)
+			}
+		})
+	}
+
+	// A window covering all day every day never changes
+	always := mustParse(t, Entry{Start: "00:00", End: "24:00", Timezone: "UTC"})
+	if got, ok := always.NextTransition(at(5, 10, 0)); ok {
+		t.Errorf("NextTransition() for permanent window = %v, want none", got)
+	}
+}
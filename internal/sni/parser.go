@@ -3,6 +3,8 @@ package sni
 import (
 	"encoding/binary"
 	"errors"
+
+	"focusd/internal/idn"
 )
 
 // TLS constants
@@ -11,6 +13,12 @@ const (
 	handshakeTypeClientHello = 0x01
 	extensionTypeSNI = 0x0000
 	sniNameTypeHostname = 0x00
+
+	extensionTypeALPN = 0x0010
+	extensionTypeSupportedVersions = 0x002b
+
+	maxHostnameLength = 253
+	maxLabelLength = 63
 )
 
 var (
@@ -18,14 +26,114 @@ var (
 	ErrNotClientHello = errors.New("not a ClientHello message")
 	ErrNoSNI = errors.New("no SNI extension found")
 	ErrInvalidData = errors.New("invalid TLS data")
+	ErrNoSupportedVersions = errors.New("no supported_versions extension found")
+)
+
+// TLS protocol versions as they appear on the wire
+const (
+	VersionTLS10 = 0x0301
+	VersionTLS11 = 0x0302
+	VersionTLS12 = 0x0303
+	VersionTLS13 = 0x0304
 )
 
+// ClientHelloInfo is what a TLS ClientHello reveals about the connection
+type ClientHelloInfo struct {
+	// ServerName is the SNI hostname, or "" if the ClientHello has none
+	ServerName string
+
+	// ALPNProtocols is the ALPN protocol list (e.g. "h2", "http/1.1") in the
+	// client's order of preference, or nil if the extension is absent
+	ALPNProtocols []string
+}
+
 // ExtractSNI extracts the Server Name Indication from a TLS ClientHello message.
 // It parses the TLS record without decryption, reading the plaintext ClientHello.
 func ExtractSNI(data []byte) (string, error) {
+	info, err := ExtractClientHelloInfo(data)
+	if err != nil {
+		return "", err
+	}
+	if info.ServerName == "" {
+		return "", ErrNoSNI
+	}
+	return info.ServerName, nil
+}
+
+// ExtractClientHelloInfo extracts the SNI hostname and ALPN protocols from a
+// TLS ClientHello message in a single pass over its extensions
+func ExtractClientHelloInfo(data []byte) (ClientHelloInfo, error) {
+	var info ClientHelloInfo
+	err := walkExtensions(data, func(extType uint16, ext []byte) error {
+		switch extType {
+		case extensionTypeSNI:
+			name, err := parseSNIExtension(ext)
+			if err != nil && err != ErrNoSNI {
+				return err
+			}
+			info.ServerName = name
+		case extensionTypeALPN:
+			protocols, err := parseALPNExtension(ext)
+			if err != nil {
+				return err
+			}
+			info.ALPNProtocols = protocols
+		}
+		return nil
+	})
+	return info, err
+}
+
+// ExtractSupportedVersions returns the TLS versions offered in a ClientHello's
+// supported_versions extension, in the client's order of preference.
+// Clients that only speak TLS 1.2 or older usually omit the extension, in
+// which case ErrNoSupportedVersions is returned.
+func ExtractSupportedVersions(data []byte) ([]uint16, error) {
+	ext, err := findExtension(data, extensionTypeSupportedVersions)
+	if err != nil {
+		return nil, err
+	}
+	if ext == nil {
+		return nil, ErrNoSupportedVersions
+	}
+
+	// supported_versions format (ClientHello):
+	// - Versions Length (1 byte)
+	// - Versions (2 bytes each)
+	if len(ext) < 1 {
+		return nil, ErrInvalidData
+	}
+	length := int(ext[0])
+	if length%2 != 0 || 1+length > len(ext) {
+		return nil, ErrInvalidData
+	}
+
+	versions := make([]uint16, 0, length/2)
+	for pos := 1; pos < 1+length; pos += 2 {
+		versions = append(versions, binary.BigEndian.Uint16(ext[pos:pos+2]))
+	}
+	return versions, nil
+}
+
+// findExtension returns the body of the given extension from a TLS
+// ClientHello, or nil if the ClientHello doesn't carry it
+func findExtension(data []byte, extensionType uint16) ([]byte, error) {
+	var found []byte
+	err := walkExtensions(data, func(extType uint16, ext []byte) error {
+		if extType == extensionType && found == nil {
+			found = ext
+		}
+		return nil
+	})
+	return found, err
+}
+
+// walkExtensions parses a TLS ClientHello and calls visit for each extension
+// in order, stopping at the first error
+func walkExtensions(data []byte, visit func(extType uint16, ext []byte) error) error {
 	// Need at least 5 bytes for TLS record header
 	if len(data) < 5 {
-		return "", ErrInvalidData
+		return ErrInvalidData
 	}
 
 	// Parse TLS Record Header (5 bytes)
@@ -37,24 +145,24 @@ func ExtractSNI(data []byte) (string, error) {
 
 	// Check if this is a handshake record
 	if contentType != contentTypeHandshake {
-		return "", ErrNotHandshake
+		return ErrNotHandshake
 	}
 
 	// Check if we have enough data for the full record
 	if len(data) < int(5+recordLength) {
-		return "", ErrInvalidData
+		return ErrInvalidData
 	}
 
 	// Parse Handshake Header (4 bytes)
 	// Byte 5: Handshake Type
 	// Bytes 6-8: Handshake Length (24-bit)
 	if len(data) < 9 {
-		return "", ErrInvalidData
+		return ErrInvalidData
 	}
 
 	handshakeType := data[5]
 	if handshakeType != handshakeTypeClientHello {
-		return "", ErrNotClientHello
+		return ErrNotClientHello
 	}
 
 	// Start parsing ClientHello
@@ -67,7 +175,7 @@ func ExtractSNI(data []byte) (string, error) {
 	pos += 32
 
 	if pos >= len(data) {
-		return "", ErrInvalidData
+		return ErrInvalidData
 	}
 
 	// Session ID Length (1 byte) + Session ID
@@ -75,7 +183,7 @@ func ExtractSNI(data []byte) (string, error) {
 	pos += 1 + sessionIDLength
 
 	if pos+2 > len(data) {
-		return "", ErrInvalidData
+		return ErrInvalidData
 	}
 
 	// Cipher Suites Length (2 bytes) + Cipher Suites
@@ -83,7 +191,7 @@ func ExtractSNI(data []byte) (string, error) {
 	pos += 2 + cipherSuitesLength
 
 	if pos >= len(data) {
-		return "", ErrInvalidData
+		return ErrInvalidData
 	}
 
 	// Compression Methods Length (1 byte) + Compression Methods
@@ -91,7 +199,7 @@ func ExtractSNI(data []byte) (string, error) {
 	pos += 1 + compressionMethodsLength
 
 	if pos+2 > len(data) {
-		return "", ErrInvalidData
+		return ErrInvalidData
 	}
 
 	// Extensions Length (2 bytes)
@@ -101,24 +209,27 @@ func ExtractSNI(data []byte) (string, error) {
 	// Parse Extensions
 	extensionsEnd := pos + extensionsLength
 	for pos+4 <= extensionsEnd {
+		if pos+4 > len(data) {
+			return ErrInvalidData
+		}
+
 		// Extension Type (2 bytes) + Extension Length (2 bytes)
 		extType := binary.BigEndian.Uint16(data[pos : pos+2])
 		extLength := int(binary.BigEndian.Uint16(data[pos+2 : pos+4]))
 		pos += 4
 
 		if pos+extLength > len(data) {
-			return "", ErrInvalidData
+			return ErrInvalidData
 		}
 
-		// Check if this is SNI extension
-		if extType == extensionTypeSNI {
-			return parseSNIExtension(data[pos : pos+extLength])
+		if err := visit(extType, data[pos:pos+extLength]); err != nil {
+			return err
 		}
 
 		pos += extLength
 	}
 
-	return "", ErrNoSNI
+	return nil
 }
 
 // parseSNIExtension parses the SNI extension data to extract the hostname.
@@ -169,9 +280,80 @@ func parseSNIExtension(data []byte) (string, error) {
 		return "", ErrNoSNI
 	}
 
+	// Clients should send punycode, but compare in one form whatever they
+	// send; a name that isn't a valid IDN can't be matched reliably
+	hostname, err := idn.ToASCII(hostname)
+	if err != nil {
+		return "", ErrInvalidData
+	}
+
+	// The name is logged and matched, so a crafted one mustn't smuggle in
+	// control characters or anything else a hostname can't contain
+	if !validHostname(hostname) {
+		return "", ErrInvalidData
+	}
+
 	return hostname, nil
 }
 
+// validHostname reports whether name is at most 253 bytes of non-empty
+// labels of at most 63 letters, digits, hyphens or underscores each.
+// Underscores aren't valid in a hostname but appear in real names.
+func validHostname(name string) bool {
+	if len(name) > maxHostnameLength {
+		return false
+	}
+	labelLength := 0
+	for i := 0; i < len(name); i++ {
+		c := name[i]
+		switch {
+		case c == '.':
+			if labelLength == 0 {
+				return false
+			}
+			labelLength = 0
+			continue
+		case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9', c == '-', c == '_':
+		default:
+			return false
+		}
+		labelLength++
+		if labelLength > maxLabelLength {
+			return false
+		}
+	}
+	return labelLength > 0
+}
+
+// parseALPNExtension parses the ALPN extension data into protocol names.
+//
+// ALPN extension format:
+// - Protocol Name List Length (2 bytes)
+// - Protocol Name Length (1 byte) + Protocol Name, repeated
+func parseALPNExtension(data []byte) ([]string, error) {
+	if len(data) < 2 {
+		return nil, ErrInvalidData
+	}
+
+	listLength := int(binary.BigEndian.Uint16(data[0:2]))
+	if listLength == 0 || 2+listLength != len(data) {
+		return nil, ErrInvalidData
+	}
+
+	var protocols []string
+	for pos := 2; pos < len(data); {
+		nameLength := int(data[pos])
+		pos++
+		if nameLength == 0 || pos+nameLength > len(data) {
+			return nil, ErrInvalidData
+		}
+		protocols = append(protocols, string(data[pos:pos+nameLength]))
+		pos += nameLength
+	}
+
+	return protocols, nil
+}
+
 // IsClientHello performs a quick check if data looks like a TLS ClientHello.
 // This can be used as a fast pre-filter before calling ExtractSNI.
 func IsClientHello(data []byte) bool {
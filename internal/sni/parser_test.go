@@ -2,6 +2,8 @@ package sni
 
 import (
 	"encoding/hex"
+	"slices"
+	"strings"
 	"testing"
 )
 
@@ -64,6 +66,66 @@ func TestExtractSNI(t *testing.T) {
 			data: buildSimpleClientHello("www.example.com"),
 			want: "www.example.com",
 		},
+		{
+			name: "punycode SNI",
+			data: buildSimpleClientHello("xn--e1afmkfd.xn--p1ai"),
+			want: "xn--e1afmkfd.xn--p1ai",
+		},
+		{
+			name: "unicode SNI",
+			data: buildSimpleClientHello("пример.рф"),
+			want: "xn--e1afmkfd.xn--p1ai",
+		},
+		{
+			name:    "malformed punycode SNI",
+			data:    buildSimpleClientHello("xn--a.com"),
+			wantErr: true,
+		},
+		{
+			name:    "embedded null byte",
+			data:    buildSimpleClientHello("example.com\x00.evil.com"),
+			wantErr: true,
+		},
+		{
+			name:    "control characters",
+			data:    buildSimpleClientHello("example.com\r\nverdict=allowed"),
+			wantErr: true,
+		},
+		{
+			name:    "space",
+			data:    buildSimpleClientHello("example .com"),
+			wantErr: true,
+		},
+		{
+			name:    "empty label",
+			data:    buildSimpleClientHello("example..com"),
+			wantErr: true,
+		},
+		{
+			name:    "trailing dot",
+			data:    buildSimpleClientHello("example.com."),
+			wantErr: true,
+		},
+		{
+			name:    "oversized name",
+			data:    buildSimpleClientHello(strings.Repeat("a.", 127) + "com"),
+			wantErr: true,
+		},
+		{
+			name:    "oversized label",
+			data:    buildSimpleClientHello(strings.Repeat("a", 64) + ".com"),
+			wantErr: true,
+		},
+		{
+			name: "longest allowed name",
+			data: buildSimpleClientHello(strings.Repeat("a.", 125) + "com"),
+			want: strings.Repeat("a.", 125) + "com",
+		},
+		{
+			name: "underscore",
+			data: buildSimpleClientHello("_acme.example.com"),
+			want: "_acme.example.com",
+		},
 	}
 
 	for _, tt := range tests {
@@ -122,12 +184,19 @@ func buildSimpleClientHello(hostname string) []byte {
 	// This is a simplified ClientHello for testing
 	// In reality, ClientHello messages are more complex
 
-	sniExt := buildSNIExtension(hostname)
-
 	// Extensions: just SNI
+	return buildClientHello(buildSNIExtension(hostname))
+}
+
+// buildClientHello builds a minimal TLS ClientHello carrying the given extensions
+func buildClientHello(exts ...[]byte) []byte {
+	var extData []byte
+	for _, ext := range exts {
+		extData = append(extData, ext...)
+	}
 	extensions := append([]byte{
-		0x00, byte(len(sniExt)), // Extensions length
-	}, sniExt...)
+		byte(len(extData) >> 8), byte(len(extData)), // Extensions length
+	}, extData...)
 
 	// ClientHello body (simplified)
 	clientHello := []byte{
@@ -185,3 +254,177 @@ func buildSNIExtension(hostname string) []byte {
 
 	return sniExtension
 }
+
+// buildSupportedVersionsExtension builds a supported_versions extension
+func buildSupportedVersionsExtension(versions ...uint16) []byte {
+	body := []byte{byte(2 * len(versions))}
+	for _, v := range versions {
+		body = append(body, byte(v>>8), byte(v))
+	}
+	ext := []byte{
+		0x00, 0x2b, // Extension Type: supported_versions
+		byte(len(body) >> 8), byte(len(body)), // Extension Length
+	}
+	return append(ext, body...)
+}
+
+func TestExtractSupportedVersions(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    []byte
+		want    []uint16
+		wantErr error
+	}{
+		{
+			name: "TLS 1.3 and 1.2",
+			data: buildClientHello(buildSNIExtension("example.com"), buildSupportedVersionsExtension(VersionTLS13, VersionTLS12)),
+			want: []uint16{VersionTLS13, VersionTLS12},
+		},
+		{
+			name: "TLS 1.3 only with GREASE",
+			data: buildClientHello(buildSupportedVersionsExtension(0x0a0a, VersionTLS13)),
+			want: []uint16{0x0a0a, VersionTLS13},
+		},
+		{
+			name:    "legacy client without extension",
+			data:    buildSimpleClientHello("example.com"),
+			wantErr: ErrNoSupportedVersions,
+		},
+		{
+			name:    "odd length",
+			data:    buildClientHello([]byte{0x00, 0x2b, 0x00, 0x02, 0x01, 0x03}),
+			wantErr: ErrInvalidData,
+		},
+		{
+			name:    "length beyond extension",
+			data:    buildClientHello([]byte{0x00, 0x2b, 0x00, 0x03, 0x04, 0x03, 0x04}),
+			wantErr: ErrInvalidData,
+		},
+		{
+			name:    "not handshake",
+			data:    []byte{0x17, 0x03, 0x03, 0x00, 0x10, 0x00, 0x00, 0x00, 0x00},
+			wantErr: ErrNotHandshake,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ExtractSupportedVersions(tt.data)
+			if err != tt.wantErr {
+				t.Fatalf("ExtractSupportedVersions() error = %v, want %v", err, tt.wantErr)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("ExtractSupportedVersions() = %#04x, want %#04x", got, tt.want)
+			}
+		})
+	}
+
+	// SNI extraction is unaffected by the other extension
+	host, err := ExtractSNI(buildClientHello(buildSupportedVersionsExtension(VersionTLS13), buildSNIExtension("example.com")))
+	if err != nil || host != "example.com" {
+		t.Errorf("ExtractSNI() = %q, %v, want example.com", host, err)
+	}
+}
+
+// buildALPNExtension builds an ALPN extension from a raw protocol-name-list
+// body, so tests can corrupt its lengths
+func buildALPNExtension(body []byte) []byte {
+	ext := []byte{
+		0x00, 0x10, // Extension Type: ALPN
+		byte(len(body) >> 8), byte(len(body)), // Extension Length
+	}
+	return append(ext, body...)
+}
+
+// alpnList encodes protocol names as an ALPN protocol-name-list
+func alpnList(protocols ...string) []byte {
+	var names []byte
+	for _, p := range protocols {
+		names = append(names, byte(len(p)))
+		names = append(names, p...)
+	}
+	return append([]byte{byte(len(names) >> 8), byte(len(names))}, names...)
+}
+
+func TestExtractClientHelloInfo(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    []byte
+		want    ClientHelloInfo
+		wantErr error
+	}{
+		{
+			name: "SNI and ALPN",
+			data: buildClientHello(buildSNIExtension("example.com"), buildALPNExtension(alpnList("h2", "http/1.1"))),
+			want: ClientHelloInfo{ServerName: "example.com", ALPNProtocols: []string{"h2", "http/1.1"}},
+		},
+		{
+			name: "ALPN before SNI",
+			data: buildClientHello(buildALPNExtension(alpnList("h2")), buildSNIExtension("example.com")),
+			want: ClientHelloInfo{ServerName: "example.com", ALPNProtocols: []string{"h2"}},
+		},
+		{
+			name: "ALPN without SNI",
+			data: buildClientHello(buildALPNExtension(alpnList("http/1.1"))),
+			want: ClientHelloInfo{ALPNProtocols: []string{"http/1.1"}},
+		},
+		{
+			name: "SNI without ALPN",
+			data: buildSimpleClientHello("example.com"),
+			want: ClientHelloInfo{ServerName: "example.com"},
+		},
+		{
+			name:    "list length exceeds extension",
+			data:    buildClientHello(buildALPNExtension([]byte{0x00, 0x09, 0x02, 'h', '2'})),
+			wantErr: ErrInvalidData,
+		},
+		{
+			name:    "list length short of extension",
+			data:    buildClientHello(buildALPNExtension([]byte{0x00, 0x01, 0x02, 'h', '2'})),
+			wantErr: ErrInvalidData,
+		},
+		{
+			name:    "name length exceeds list",
+			data:    buildClientHello(buildALPNExtension([]byte{0x00, 0x03, 0x05, 'h', '2'})),
+			wantErr: ErrInvalidData,
+		},
+		{
+			name:    "empty name",
+			data:    buildClientHello(buildALPNExtension([]byte{0x00, 0x01, 0x00})),
+			wantErr: ErrInvalidData,
+		},
+		{
+			name:    "empty list",
+			data:    buildClientHello(buildALPNExtension([]byte{0x00, 0x00})),
+			wantErr: ErrInvalidData,
+		},
+		{
+			name:    "truncated extension",
+			data:    buildClientHello(buildALPNExtension([]byte{0x00})),
+			wantErr: ErrInvalidData,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ExtractClientHelloInfo(tt.data)
+			if err != tt.wantErr {
+				t.Fatalf("ExtractClientHelloInfo() error = %v, want %v", err, tt.wantErr)
+			}
+			if got.ServerName != tt.want.ServerName || !slices.Equal(got.ALPNProtocols, tt.want.ALPNProtocols) {
+				t.Errorf("ExtractClientHelloInfo() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestExtractSNIExtensionsLengthBeyondData(t *testing.T) {
+	data := buildSimpleClientHello("example.com")
+	// Claim more extension bytes than the record holds
+	extLenPos := len(data) - len(buildSNIExtension("example.com")) - 2
+	data[extLenPos], data[extLenPos+1] = 0x7f, 0xff
+
+	if _, err := ExtractSNI(data); err != ErrInvalidData {
+		t.Errorf("ExtractSNI() error = %v, want %v", err, ErrInvalidData)
+	}
+}
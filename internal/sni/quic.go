@@ -0,0 +1,371 @@
+package sni
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hkdf"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"slices"
+)
+
+// QUIC versions whose Initial packets can be read (RFC 9000, RFC 9369)
+const (
+	QUICVersion1 = 0x00000001
+	QUICVersion2 = 0x6b3343cf
+)
+
+// maxQUICClientHello bounds the CRYPTO data buffered for one ClientHello.
+// Post-quantum key shares push a ClientHello past one packet, but nothing
+// legitimate comes close to this.
+const maxQUICClientHello = 16 * 1024
+
+var (
+	ErrNotQUICInitial = errors.New("not a QUIC Initial packet")
+	ErrQUICVersion    = errors.New("unsupported QUIC version")
+	ErrQUICIncomplete = errors.New("QUIC ClientHello incomplete")
+)
+
+// quicVersion holds what differs between QUIC versions in how Initial
+// packets are protected (RFC 9001 section 5, RFC 9369 section 3.3)
+type quicVersion struct {
+	initialType                byte
+	salt                       []byte
+	keyLabel, ivLabel, hpLabel string
+}
+
+var quicVersions = map[uint32]quicVersion{
+	QUICVersion1: {
+		initialType: 0,
+		salt:        []byte{0x38, 0x76, 0x2c, 0xf7, 0xf5, 0x59, 0x34, 0xb3, 0x4d, 0x17, 0x9a, 0xe6, 0xa4, 0xc8, 0x0c, 0xad, 0xcc, 0xbb, 0x7f, 0x0a},
+		keyLabel:    "quic key",
+		ivLabel:     "quic iv",
+		hpLabel:     "quic hp",
+	},
+	QUICVersion2: {
+		initialType: 1,
+		salt:        []byte{0x0d, 0xed, 0xe3, 0xde, 0xf7, 0x00, 0xa6, 0xdb, 0x81, 0x93, 0x81, 0xbe, 0x6e, 0x26, 0x9d, 0xcb, 0xf9, 0xbd, 0x2e, 0xd9},
+		keyLabel:    "quicv2 key",
+		ivLabel:     "quicv2 iv",
+		hpLabel:     "quicv2 hp",
+	},
+}
+
+// QUIC frame types that may appear in a client's Initial packets
+const (
+	frameTypePadding         = 0x00
+	frameTypePing            = 0x01
+	frameTypeAck             = 0x02
+	frameTypeAckECN          = 0x03
+	frameTypeCrypto          = 0x06
+	frameTypeConnectionClose = 0x1c
+)
+
+// IsQUICInitial performs a quick check if a UDP datagram starts with a QUIC
+// Initial packet of a version whose ClientHello can be read
+func IsQUICInitial(datagram []byte) bool {
+	if len(datagram) < 5 || datagram[0]&0xc0 != 0xc0 {
+		return false
+	}
+	v, ok := quicVersions[binary.BigEndian.Uint32(datagram[1:5])]
+	return ok && (datagram[0]>>4)&0x03 == v.initialType
+}
+
+// QUICClientHello reassembles the TLS ClientHello a QUIC client sends in
+// the CRYPTO frames of its Initial packets. The ClientHello may span
+// several packets and datagrams, and its frames may arrive in any order.
+// Initial packets are encrypted, but with keys anyone can derive from the
+// packet itself (RFC 9001 section 5.2).
+type QUICClientHello struct {
+	chunks []cryptoChunk
+}
+
+// cryptoChunk is the data of one CRYPTO frame at its offset in the stream
+type cryptoChunk struct {
+	offset int
+	data   []byte
+}
+
+// ExtractQUICSNI extracts the Server Name Indication from a UDP datagram
+// carrying a client's first QUIC Initial packet. If the ClientHello
+// continues in later datagrams, ErrQUICIncomplete is returned; use
+// QUICClientHello to collect them.
+func ExtractQUICSNI(datagram []byte) (string, error) {
+	var hello QUICClientHello
+	if err := hello.Add(datagram); err != nil {
+		return "", err
+	}
+	info, err := hello.Info()
+	if err != nil {
+		return "", err
+	}
+	if info.ServerName == "" {
+		return "", ErrNoSNI
+	}
+	return info.ServerName, nil
+}
+
+// Add decrypts the Initial packets in a datagram and collects their CRYPTO
+// data. Packets coalesced after them (0-RTT, Handshake) are ignored.
+func (q *QUICClientHello) Add(datagram []byte) error {
+	if !IsQUICInitial(datagram) {
+		if len(datagram) >= 5 && datagram[0]&0x80 != 0 {
+			if _, ok := quicVersions[binary.BigEndian.Uint32(datagram[1:5])]; !ok {
+				return ErrQUICVersion
+			}
+		}
+		return ErrNotQUICInitial
+	}
+	for len(datagram) > 0 && IsQUICInitial(datagram) {
+		payload, rest, err := openInitial(datagram)
+		if err != nil {
+			return err
+		}
+		if err := q.addFrames(payload); err != nil {
+			return err
+		}
+		datagram = rest
+	}
+	return nil
+}
+
+// Info parses the ClientHello once all of it has arrived, returning
+// ErrQUICIncomplete until then
+func (q *QUICClientHello) Info() (ClientHelloInfo, error) {
+	data := q.contiguous()
+
+	// CRYPTO data is the bare handshake message: type (1 byte) and length
+	// (3 bytes), then the ClientHello
+	if len(data) < 4 {
+		return ClientHelloInfo{}, ErrQUICIncomplete
+	}
+	if data[0] != handshakeTypeClientHello {
+		return ClientHelloInfo{}, ErrNotClientHello
+	}
+	length := 4 + (int(data[1])<<16 | int(data[2])<<8 | int(data[3]))
+	if length > maxQUICClientHello {
+		return ClientHelloInfo{}, ErrInvalidData
+	}
+	if len(data) < length {
+		return ClientHelloInfo{}, ErrQUICIncomplete
+	}
+
+	// The TLS parser expects a record, so wrap the message in one
+	record := append([]byte{contentTypeHandshake, 0x03, 0x03, byte(length >> 8), byte(length)}, data[:length]...)
+	return ExtractClientHelloInfo(record)
+}
+
+// contiguous returns the CRYPTO data received without gaps from offset 0
+func (q *QUICClientHello) contiguous() []byte {
+	slices.SortFunc(q.chunks, func(a, b cryptoChunk) int {
+		return a.offset - b.offset
+	})
+	var data []byte
+	for _, c := range q.chunks {
+		if c.offset > len(data) {
+			break
+		}
+		if end := c.offset + len(c.data); end > len(data) {
+			data = append(data, c.data[len(data)-c.offset:]...)
+		}
+	}
+	return data
+}
+
+// addFrames collects the CRYPTO frames of a decrypted Initial payload
+func (q *QUICClientHello) addFrames(payload []byte) error {
+	for len(payload) > 0 {
+		frameType, n := readVarint(payload)
+		if n == 0 {
+			return ErrInvalidData
+		}
+		payload = payload[n:]
+
+		switch frameType {
+		case frameTypePadding, frameTypePing:
+		case frameTypeAck, frameTypeAckECN:
+			// Largest acknowledged, delay, range count, first range, then
+			// a gap and length per further range, and three ECN counts
+			var fields [4]uint64
+			for i := range fields {
+				if fields[i], n = readVarint(payload); n == 0 {
+					return ErrInvalidData
+				}
+				payload = payload[n:]
+			}
+			skip := 2 * fields[2]
+			if frameType == frameTypeAckECN {
+				skip += 3
+			}
+			for ; skip > 0; skip-- {
+				if _, n = readVarint(payload); n == 0 {
+					return ErrInvalidData
+				}
+				payload = payload[n:]
+			}
+		case frameTypeCrypto:
+			offset, n := readVarint(payload)
+			if n == 0 {
+				return ErrInvalidData
+			}
+			payload = payload[n:]
+			length, n := readVarint(payload)
+			if n == 0 || length > uint64(len(payload)-n) {
+				return ErrInvalidData
+			}
+			payload = payload[n:]
+			if offset+length > maxQUICClientHello {
+				return ErrInvalidData
+			}
+			q.chunks = append(q.chunks, cryptoChunk{offset: int(offset), data: slices.Clone(payload[:length])})
+			payload = payload[length:]
+		case frameTypeConnectionClose:
+			return ErrNotClientHello
+		default:
+			// No other frame is allowed in an Initial packet
+			return ErrInvalidData
+		}
+	}
+	return nil
+}
+
+// openInitial removes the protection from the Initial packet at the start
+// of datagram, returning its decrypted payload and the rest of the
+// datagram
+func openInitial(datagram []byte) (payload, rest []byte, err error) {
+	v := quicVersions[binary.BigEndian.Uint32(datagram[1:5])]
+
+	// Long header: flags (1), version (4), destination and source
+	// connection IDs (length-prefixed), token (varint length-prefixed),
+	// then the length (varint) of the packet number and payload
+	pos := 5
+	if pos >= len(datagram) {
+		return nil, nil, ErrInvalidData
+	}
+	dcidLen := int(datagram[pos])
+	pos++
+	if dcidLen > 20 || pos+dcidLen >= len(datagram) {
+		return nil, nil, ErrInvalidData
+	}
+	dcid := datagram[pos : pos+dcidLen]
+	pos += dcidLen
+	scidLen := int(datagram[pos])
+	pos += 1 + scidLen
+	if scidLen > 20 || pos >= len(datagram) {
+		return nil, nil, ErrInvalidData
+	}
+	tokenLen, n := readVarint(datagram[pos:])
+	if n == 0 || tokenLen > uint64(len(datagram)-pos-n) {
+		return nil, nil, ErrInvalidData
+	}
+	pos += n + int(tokenLen)
+	length, n := readVarint(datagram[pos:])
+	if n == 0 || length > uint64(len(datagram)-pos-n) {
+		return nil, nil, ErrInvalidData
+	}
+	pos += n
+	pnOffset := pos
+	end := pnOffset + int(length)
+
+	key, iv, hp, err := initialKeys(v, dcid)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Header protection: a mask from a sample of the ciphertext, taken as
+	// if the packet number were 4 bytes long, hides the packet number and
+	// its length (RFC 9001 section 5.4)
+	if pnOffset+4+aes.BlockSize > end {
+		return nil, nil, ErrInvalidData
+	}
+	block, err := aes.NewCipher(hp)
+	if err != nil {
+		return nil, nil, err
+	}
+	var mask [aes.BlockSize]byte
+	block.Encrypt(mask[:], datagram[pnOffset+4:pnOffset+4+aes.BlockSize])
+
+	header := slices.Clone(datagram[:pnOffset+4])
+	header[0] ^= mask[0] & 0x0f
+	pnLen := int(header[0]&0x03) + 1
+	var pn uint64
+	for i := 0; i < pnLen; i++ {
+		header[pnOffset+i] ^= mask[1+i]
+		pn = pn<<8 | uint64(header[pnOffset+i])
+	}
+	header = header[:pnOffset+pnLen]
+
+	// The nonce is the IV XORed with the packet number. A client's first
+	// packet numbers are small, so the truncated number is the full one.
+	aesKey, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	aead, err := cipher.NewGCM(aesKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	nonce := slices.Clone(iv)
+	for i := 0; i < 8; i++ {
+		nonce[len(nonce)-1-i] ^= byte(pn >> (8 * i))
+	}
+	payload, err = aead.Open(nil, nonce, datagram[pnOffset+pnLen:end], header)
+	if err != nil {
+		return nil, nil, ErrInvalidData
+	}
+	return payload, datagram[end:], nil
+}
+
+// initialKeys derives the key, IV and header protection key that protect
+// a client's Initial packets from the destination connection ID the client
+// chose
+func initialKeys(v quicVersion, dcid []byte) (key, iv, hp []byte, err error) {
+	initial, err := hkdf.Extract(sha256.New, dcid, v.salt)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	client, err := expandLabel(initial, "client in", sha256.Size)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if key, err = expandLabel(client, v.keyLabel, 16); err != nil {
+		return nil, nil, nil, err
+	}
+	if iv, err = expandLabel(client, v.ivLabel, 12); err != nil {
+		return nil, nil, nil, err
+	}
+	if hp, err = expandLabel(client, v.hpLabel, 16); err != nil {
+		return nil, nil, nil, err
+	}
+	return key, iv, hp, nil
+}
+
+// expandLabel is TLS 1.3's HKDF-Expand-Label with an empty context
+// (RFC 8446 section 7.1)
+func expandLabel(secret []byte, label string, length int) ([]byte, error) {
+	label = "tls13 " + label
+	info := make([]byte, 0, 4+len(label))
+	info = binary.BigEndian.AppendUint16(info, uint16(length))
+	info = append(info, byte(len(label)))
+	info = append(info, label...)
+	info = append(info, 0)
+	return hkdf.Expand(sha256.New, secret, string(info), length)
+}
+
+// readVarint decodes a QUIC variable-length integer, returning it and the
+// number of bytes it took, or 0 bytes if data is too short
+func readVarint(data []byte) (uint64, int) {
+	if len(data) == 0 {
+		return 0, 0
+	}
+	n := 1 << (data[0] >> 6)
+	if len(data) < n {
+		return 0, 0
+	}
+	v := uint64(data[0] & 0x3f)
+	for i := 1; i < n; i++ {
+		v = v<<8 | uint64(data[i])
+	}
+	return v, n
+}
@@ -0,0 +1,225 @@
+package sni
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"slices"
+	"testing"
+)
+
+func TestInitialKeys(t *testing.T) {
+	// RFC 9001 appendix A.1 and RFC 9369 appendix A.1
+	dcid := []byte{0x83, 0x94, 0xc8, 0xf0, 0x3e, 0x51, 0x57, 0x08}
+	tests := []struct {
+		version     uint32
+		key, iv, hp string
+	}{
+		{QUICVersion1, "1f369613dd76d5467730efcbe3b1a22d", "fa044b2f42a3fd3b46fb255c", "9f50449e04a0e810283a1e9933adedd2"},
+		{QUICVersion2, "8b1a0bc121284290a29e0971b5cd045d", "91f73e2351d8fa91660e909f", "45b95e15235d6f45a6b19cbcb0294ba9"},
+	}
+	for _, tt := range tests {
+		key, iv, hp, err := initialKeys(quicVersions[tt.version], dcid)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := []string{hex.EncodeToString(key), hex.EncodeToString(iv), hex.EncodeToString(hp)}
+		if want := []string{tt.key, tt.iv, tt.hp}; !slices.Equal(got, want) {
+			t.Errorf("initialKeys(%#x) = %v, want %v", tt.version, got, want)
+		}
+	}
+}
+
+func TestExtractQUICSNI(t *testing.T) {
+	hello := quicClientHello(t, "example.com")
+	dcid := []byte{0x83, 0x94, 0xc8, 0xf0, 0x3e, 0x51, 0x57, 0x08}
+
+	tests := []struct {
+		name     string
+		datagram []byte
+		want     string
+		wantErr  error
+	}{
+		{
+			name:     "version 1",
+			datagram: sealInitial(QUICVersion1, dcid, 0, cryptoFrame(0, hello)),
+			want:     "example.com",
+		},
+		{
+			name:     "version 2",
+			datagram: sealInitial(QUICVersion2, dcid, 0, cryptoFrame(0, hello)),
+			want:     "example.com",
+		},
+		{
+			name:     "frames out of order",
+			datagram: sealInitial(QUICVersion1, dcid, 1, append(cryptoFrame(100, hello[100:]), cryptoFrame(0, hello[:100])...)),
+			want:     "example.com",
+		},
+		{
+			name:     "coalesced with a later packet",
+			datagram: append(sealInitial(QUICVersion1, dcid, 0, cryptoFrame(0, hello)), 0xd0, 0, 0, 0, 1, 0),
+			want:     "example.com",
+		},
+		{
+			name:     "continued in another datagram",
+			datagram: sealInitial(QUICVersion1, dcid, 0, cryptoFrame(0, hello[:100])),
+			wantErr:  ErrQUICIncomplete,
+		},
+		{
+			name:     "tampered",
+			datagram: tamper(sealInitial(QUICVersion1, dcid, 0, cryptoFrame(0, hello))),
+			wantErr:  ErrInvalidData,
+		},
+		{
+			name:     "unknown version",
+			datagram: []byte{0xc0, 0xff, 0x00, 0x00, 0x1d, 0x00},
+			wantErr:  ErrQUICVersion,
+		},
+		{
+			name:     "short header",
+			datagram: []byte{0x40, 0x01, 0x02, 0x03, 0x04, 0x05},
+			wantErr:  ErrNotQUICInitial,
+		},
+		{
+			name:     "truncated",
+			datagram: sealInitial(QUICVersion1, dcid, 0, cryptoFrame(0, hello))[:40],
+			wantErr:  ErrInvalidData,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ExtractQUICSNI(tt.datagram)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("ExtractQUICSNI() error = %v, want %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("ExtractQUICSNI() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestQUICClientHelloAcrossDatagrams(t *testing.T) {
+	hello := quicClientHello(t, "www.example.org")
+	dcid := []byte{0x00, 0x11, 0x22, 0x33, 0x44, 0x55, 0x66, 0x77}
+	half := len(hello) / 2
+
+	var q QUICClientHello
+	// The second half arrives first
+	if err := q.Add(sealInitial(QUICVersion1, dcid, 1, cryptoFrame(half, hello[half:]))); err != nil {
+		t.Fatalf("Add() error = %v", err)
+	}
+	if _, err := q.Info(); !errors.Is(err, ErrQUICIncomplete) {
+		t.Fatalf("Info() with half the ClientHello error = %v, want %v", err, ErrQUICIncomplete)
+	}
+	if err := q.Add(sealInitial(QUICVersion1, dcid, 0, cryptoFrame(0, hello[:half]))); err != nil {
+		t.Fatalf("Add() error = %v", err)
+	}
+	info, err := q.Info()
+	if err != nil {
+		t.Fatalf("Info() error = %v", err)
+	}
+	if info.ServerName != "www.example.org" || !slices.Equal(info.ALPNProtocols, []string{"h3"}) {
+		t.Errorf("Info() = %+v, want www.example.org offering h3", info)
+	}
+}
+
+// quicClientHello returns the ClientHello crypto/tls sends for a QUIC
+// connection to serverName
+func quicClientHello(t *testing.T, serverName string) []byte {
+	t.Helper()
+	conn := tls.QUICClient(&tls.QUICConfig{TLSConfig: &tls.Config{
+		ServerName: serverName,
+		NextProtos: []string{"h3"},
+		MinVersion: tls.VersionTLS13,
+	}})
+	conn.SetTransportParameters([]byte{})
+	if err := conn.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	for {
+		e := conn.NextEvent()
+		switch e.Kind {
+		case tls.QUICNoEvent:
+			t.Fatal("no ClientHello written")
+		case tls.QUICWriteData:
+			if e.Level == tls.QUICEncryptionLevelInitial {
+				return e.Data
+			}
+		}
+	}
+}
+
+// cryptoFrame builds a CRYPTO frame carrying data at offset
+func cryptoFrame(offset int, data []byte) []byte {
+	frame := []byte{frameTypeCrypto}
+	frame = appendVarint(frame, uint64(offset))
+	frame = appendVarint(frame, uint64(len(data)))
+	return append(frame, data...)
+}
+
+// appendVarint appends v as a QUIC variable-length integer
+func appendVarint(b []byte, v uint64) []byte {
+	switch {
+	case v < 1<<6:
+		return append(b, byte(v))
+	case v < 1<<14:
+		return binary.BigEndian.AppendUint16(b, uint16(v)|0x4000)
+	default:
+		return binary.BigEndian.AppendUint32(b, uint32(v)|0x80000000)
+	}
+}
+
+// sealInitial builds a client Initial packet carrying frames, protected as
+// RFC 9001 describes, with a 2-byte packet number
+func sealInitial(version uint32, dcid []byte, pn uint16, frames []byte) []byte {
+	v := quicVersions[version]
+	key, iv, hp, err := initialKeys(v, dcid)
+	if err != nil {
+		panic(err)
+	}
+
+	// Pad the payload so there is ciphertext to sample
+	for len(frames) < 32 {
+		frames = append(frames, frameTypePadding)
+	}
+	const pnLen = 2
+	header := []byte{0xc0 | v.initialType<<4 | (pnLen - 1)}
+	header = binary.BigEndian.AppendUint32(header, version)
+	header = append(header, byte(len(dcid)))
+	header = append(header, dcid...)
+	header = append(header, 0) // source connection ID
+	header = append(header, 0) // token
+	header = appendVarint(header, uint64(pnLen+len(frames)+16))
+	pnOffset := len(header)
+	header = binary.BigEndian.AppendUint16(header, pn)
+
+	block, _ := aes.NewCipher(key)
+	aead, _ := cipher.NewGCM(block)
+	nonce := bytes.Clone(iv)
+	nonce[len(nonce)-2] ^= byte(pn >> 8)
+	nonce[len(nonce)-1] ^= byte(pn)
+	packet := aead.Seal(bytes.Clone(header), nonce, frames, header)
+
+	hpBlock, _ := aes.NewCipher(hp)
+	var mask [aes.BlockSize]byte
+	hpBlock.Encrypt(mask[:], packet[pnOffset+4:pnOffset+4+aes.BlockSize])
+	packet[0] ^= mask[0] & 0x0f
+	for i := 0; i < pnLen; i++ {
+		packet[pnOffset+i] ^= mask[1+i]
+	}
+	return packet
+}
+
+// tamper flips a bit in the last byte of a packet's authentication tag
+func tamper(packet []byte) []byte {
+	packet[len(packet)-1] ^= 0x01
+	return packet
+}
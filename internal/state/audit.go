@@ -0,0 +1,139 @@
+package state
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/user"
+	"path/filepath"
+	"time"
+)
+
+// Ways a state change can be authorized, as recorded in AuditEntry.Auth
+const (
+	AuthUSBKey = "usb-key"
+	AuthTOTP   = "totp"
+)
+
+// AuditEntry is one change of the enabled state, stored as a JSON line
+type AuditEntry struct {
+	Time    time.Time `json:"time"`
+	Enabled bool      `json:"enabled"`
+
+	// User is the login that ran the command (the sudo caller, if any)
+	User string `json:"user"`
+
+	// Auth is how the change was authorized: AuthUSBKey, AuthTOTP or empty
+	// if no verification took place
+	Auth string `json:"auth,omitempty"`
+
+	// Reason describes changes not made by an explicit enable or disable,
+	// such as a snooze or the daemon re-enabling blocking
+	Reason string `json:"reason,omitempty"`
+
+	// Domain is set for a session override toggled for one domain, in
+	// which case Enabled is whether the domain is now blocked
+	Domain string `json:"domain,omitempty"`
+}
+
+// SetAuditLog makes every change of the enabled state append an entry to
+// the audit log at path. An empty path disables auditing.
+func (s *State) SetAuditLog(path string) {
+	s.auditPath = path
+}
+
+// SetAuth records how the caller authorized the changes it is about to
+// make, for their audit entries
+func (s *State) SetAuth(auth string) {
+	s.auth = auth
+}
+
+// AuditOverride records a session override making domain blocked or
+// allowed. An unblock must be on record before it takes effect, so call
+// it before changing the override.
+func (s *State) AuditOverride(domain string, blocked bool) error {
+	return s.writeAudit(AuditEntry{Enabled: blocked, Domain: domain})
+}
+
+// audit appends an entry for a change to enabled
+func (s *State) audit(enabled bool, reason string) error {
+	return s.writeAudit(AuditEntry{Enabled: enabled, Reason: reason})
+}
+
+// writeAudit appends entry, stamped with the time, user and auth method.
+// The entry is synced to disk before returning, so a toggle is never
+// applied without its record.
+func (s *State) writeAudit(entry AuditEntry) error {
+	if s.auditPath == "" {
+		return nil
+	}
+
+	entry.Time = time.Now().UTC()
+	entry.User = currentUser()
+	entry.Auth = s.auth
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(s.auditPath), 0o750); err != nil {
+		return fmt.Errorf("creating audit log directory: %w", err)
+	}
+	f, err := os.OpenFile(s.auditPath, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o640)
+	if err != nil {
+		return fmt.Errorf("opening audit log: %w", err)
+	}
+	if _, err := f.Write(append(data, '\n')); err != nil {
+		f.Close()
+		return fmt.Errorf("writing audit log: %w", err)
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return fmt.Errorf("syncing audit log: %w", err)
+	}
+	return f.Close()
+}
+
+// ReadAuditLog returns the last n entries of the audit log at path, oldest
+// first, or all of them if n <= 0. A missing log has no entries.
+func ReadAuditLog(path string, n int) ([]AuditEntry, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("opening audit log: %w", err)
+	}
+	defer f.Close()
+
+	var entries []AuditEntry
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		var entry AuditEntry
+		if err := json.Unmarshal(sc.Bytes(), &entry); err != nil {
+			// A line torn by a crash mid-write is skipped
+			continue
+		}
+		entries = append(entries, entry)
+		if n > 0 && len(entries) > n {
+			entries = entries[1:]
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return nil, fmt.Errorf("reading audit log: %w", err)
+	}
+	return entries, nil
+}
+
+// currentUser returns the login behind the current process, preferring the
+// user who invoked sudo over root
+func currentUser() string {
+	if name := os.Getenv("SUDO_USER"); name != "" {
+		return name
+	}
+	if u, err := user.Current(); err == nil {
+		return u.Username
+	}
+	return fmt.Sprintf("uid %d", os.Getuid())
+}
@@ -0,0 +1,72 @@
+package state
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"focusd/internal/atomicfile"
+)
+
+// DefaultCategoriesPath is the default location for category toggles.
+// Unlike session overrides, they persist across reboots.
+const DefaultCategoriesPath = "/var/lib/focusd/categories.json"
+
+// Categories stores blocklist categories switched on or off at runtime,
+// taking precedence over activeCategories in the config
+type Categories struct {
+	path string
+}
+
+// NewCategories creates a category toggle store with the given path
+func NewCategories(path string) *Categories {
+	if path == "" {
+		path = DefaultCategoriesPath
+	}
+	return &Categories{path: path}
+}
+
+// Load returns the toggled categories, mapping each name to whether it is active
+func (c *Categories) Load() (map[string]bool, error) {
+	data, err := os.ReadFile(c.path)
+	if os.IsNotExist(err) {
+		return map[string]bool{}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("reading categories file: %w", err)
+	}
+
+	toggles := map[string]bool{}
+	if len(data) == 0 {
+		return toggles, nil
+	}
+	if err := json.Unmarshal(data, &toggles); err != nil {
+		return nil, fmt.Errorf("parsing categories file: %w", err)
+	}
+	return toggles, nil
+}
+
+// Set records whether the named category is active
+func (c *Categories) Set(name string, active bool) error {
+	unlock, err := lockFile(c.path)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	toggles, err := c.Load()
+	if err != nil {
+		return err
+	}
+	toggles[name] = active
+
+	data, err := json.MarshalIndent(toggles, "", "  ")
+	if err != nil {
+		return fmt.Errorf("encoding categories: %w", err)
+	}
+
+	if err := atomicfile.Write(c.path, append(data, '\n'), 0o640); err != nil {
+		return fmt.Errorf("writing categories file: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,116 @@
+package state
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"focusd/internal/atomicfile"
+)
+
+// DefaultOverridesPath is the default location for session overrides.
+// It lives under /run so overrides are cleared on reboot.
+const DefaultOverridesPath = "/run/focusd/overrides.json"
+
+// Overrides stores per-domain block/allow decisions for the current session
+// that take precedence over the persistent blocklist
+type Overrides struct {
+	path string
+}
+
+// NewOverrides creates a new session overrides store with the given path
+func NewOverrides(path string) *Overrides {
+	if path == "" {
+		path = DefaultOverridesPath
+	}
+	return &Overrides{path: path}
+}
+
+// Load returns the current overrides, mapping each domain to whether it is blocked
+func (o *Overrides) Load() (map[string]bool, error) {
+	data, err := os.ReadFile(o.path)
+	if os.IsNotExist(err) {
+		return map[string]bool{}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("reading overrides file: %w", err)
+	}
+
+	overrides := map[string]bool{}
+	if len(data) == 0 {
+		return overrides, nil
+	}
+	if err := json.Unmarshal(data, &overrides); err != nil {
+		return nil, fmt.Errorf("parsing overrides file: %w", err)
+	}
+	return overrides, nil
+}
+
+// Set records a session override for domain
+func (o *Overrides) Set(domain string, blocked bool) error {
+	overrides, err := o.Load()
+	if err != nil {
+		return err
+	}
+	overrides[NormalizeDomain(domain)] = blocked
+
+	data, err := json.MarshalIndent(overrides, "", "  ")
+	if err != nil {
+		return fmt.Errorf("encoding overrides: %w", err)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(o.path), 0o750); err != nil {
+		return fmt.Errorf("creating overrides directory: %w", err)
+	}
+	if err := atomicfile.Write(o.path, append(data, '\n'), 0o640); err != nil {
+		return fmt.Errorf("writing overrides file: %w", err)
+	}
+	return nil
+}
+
+// Apply returns domains with session overrides applied: blocked overrides are
+// added and allowed overrides are removed
+func (o *Overrides) Apply(domains []string) ([]string, error) {
+	overrides, err := o.Load()
+	if err != nil {
+		return nil, err
+	}
+	return ApplyOverrides(domains, overrides), nil
+}
+
+// ApplyOverrides adds blocked and removes allowed override entries from domains
+func ApplyOverrides(domains []string, overrides map[string]bool) []string {
+	if len(overrides) == 0 {
+		return domains
+	}
+
+	result := make([]string, 0, len(domains)+len(overrides))
+	seen := make(map[string]bool, len(domains))
+	for _, domain := range domains {
+		norm := NormalizeDomain(domain)
+		if blocked, ok := overrides[norm]; ok && !blocked {
+			continue
+		}
+		seen[norm] = true
+		result = append(result, domain)
+	}
+
+	// Add blocked overrides in a stable order
+	added := make([]string, 0, len(overrides))
+	for domain, blocked := range overrides {
+		if blocked && !seen[domain] {
+			added = append(added, domain)
+		}
+	}
+	sort.Strings(added)
+
+	return append(result, added...)
+}
+
+// NormalizeDomain lowercases a domain and strips any trailing dot
+func NormalizeDomain(domain string) string {
+	return strings.ToLower(strings.TrimSuffix(strings.TrimSpace(domain), "."))
+}
@@ -1,10 +1,16 @@
 package state
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
 	"strings"
+	"syscall"
+	"time"
+
+	"focusd/internal/atomicfile"
 )
 
 const (
@@ -18,6 +24,20 @@ const (
 // State represents the current state of focusd
 type State struct {
 	path string
+
+	// auditPath and auth are used for audit log entries; see SetAuditLog
+	auditPath string
+	auth      string
+}
+
+// stateFile is the JSON content of the state file. Older versions wrote a
+// bare "enabled" or "disabled", which is still accepted.
+type stateFile struct {
+	Enabled bool `json:"enabled"`
+
+	// EnabledUntil is the end of a commitment from enable --commit, before
+	// which blocking can't be disabled
+	EnabledUntil time.Time `json:"enabledUntil,omitzero"`
 }
 
 // New creates a new State manager with the given path
@@ -28,41 +48,129 @@ func New(path string) *State {
 	return &State{path: path}
 }
 
-// IsEnabled returns true if blocking is currently enabled
-func (s *State) IsEnabled() (bool, error) {
+// load reads the state file, defaulting to enabled if it doesn't exist
+func (s *State) load() (stateFile, error) {
 	data, err := os.ReadFile(s.path)
 	if os.IsNotExist(err) {
-		// Default to enabled if state file doesn't exist
-		return true, nil
+		return stateFile{Enabled: true}, nil
 	}
 	if err != nil {
-		return false, fmt.Errorf("reading state file: %w", err)
+		return stateFile{}, fmt.Errorf("reading state file: %w", err)
 	}
 
-	state := strings.TrimSpace(string(data))
-	return state == stateEnabled, nil
+	switch strings.TrimSpace(string(data)) {
+	case "":
+		// Left empty by a crash in an older version; treat as missing
+		return stateFile{Enabled: true}, nil
+	case stateEnabled:
+		return stateFile{Enabled: true}, nil
+	case stateDisabled:
+		return stateFile{Enabled: false}, nil
+	}
+
+	var sf stateFile
+	if err := json.Unmarshal(data, &sf); err != nil {
+		return stateFile{}, fmt.Errorf("parsing state file: %w", err)
+	}
+	return sf, nil
 }
 
-// SetEnabled sets the blocking state
-func (s *State) SetEnabled(enabled bool) error {
+// save atomically replaces the state file
+func (s *State) save(sf stateFile) error {
 	// Ensure the directory exists
 	dir := filepath.Dir(s.path)
 	if err := os.MkdirAll(dir, 0o750); err != nil {
 		return fmt.Errorf("creating state directory: %w", err)
 	}
 
-	value := stateDisabled
-	if enabled {
-		value = stateEnabled
+	data, err := json.Marshal(sf)
+	if err != nil {
+		return err
 	}
 
-	if err := os.WriteFile(s.path, []byte(value+"\n"), 0o640); err != nil {
+	if err := atomicfile.Write(s.path, append(data, '\n'), 0o640); err != nil {
 		return fmt.Errorf("writing state file: %w", err)
 	}
-
 	return nil
 }
 
+// lock takes an exclusive advisory lock on the state file, so that the
+// daemon and CLI don't interleave read-modify-write cycles. Readers don't
+// need it since writes replace the file atomically. The returned function
+// releases the lock; locks must not be nested.
+func (s *State) lock() (func(), error) {
+	return lockFile(s.path)
+}
+
+// lockFile takes an exclusive advisory lock on path, through a ".lock"
+// file next to it since path itself is replaced on every write
+func lockFile(path string) (func(), error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0o750); err != nil {
+		return nil, fmt.Errorf("creating state directory: %w", err)
+	}
+	f, err := os.OpenFile(path+".lock", os.O_RDWR|os.O_CREATE, 0o640)
+	if err != nil {
+		return nil, fmt.Errorf("opening state lock: %w", err)
+	}
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("locking state: %w", err)
+	}
+	return func() {
+		syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+		f.Close()
+	}, nil
+}
+
+// IsEnabled returns true if blocking is currently enabled. A state file
+// that says disabled before its own commitment has ended is treated as
+// enabled.
+func (s *State) IsEnabled() (bool, error) {
+	sf, err := s.load()
+	if err != nil {
+		return false, err
+	}
+	return sf.Enabled || time.Now().Before(sf.EnabledUntil), nil
+}
+
+// SetEnabled sets the blocking state, keeping any commitment
+func (s *State) SetEnabled(enabled bool) error {
+	return s.SetEnabledBecause(enabled, "")
+}
+
+// SetEnabledBecause sets the blocking state like SetEnabled, recording
+// reason in the audit log
+func (s *State) SetEnabledBecause(enabled bool, reason string) error {
+	unlock, err := s.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	return s.setEnabled(enabled, reason)
+}
+
+// setEnabled is SetEnabledBecause for callers holding the lock
+func (s *State) setEnabled(enabled bool, reason string) error {
+	// A disable must be on record before it takes effect, while enabling
+	// is never held up by the audit log
+	auditErr := s.audit(enabled, reason)
+	if auditErr != nil && !enabled {
+		return auditErr
+	}
+
+	sf, err := s.load()
+	if err != nil {
+		// Rewriting a damaged file is how it gets repaired
+		sf = stateFile{}
+	}
+	sf.Enabled = enabled
+	if err := s.save(sf); err != nil {
+		return err
+	}
+	return auditErr
+}
+
 // String returns the current state as a string
 func (s *State) String() (string, error) {
 	enabled, err := s.IsEnabled()
@@ -75,3 +183,140 @@ func (s *State) String() (string, error) {
 	}
 	return "disabled", nil
 }
+
+// CommitUntil records that blocking must stay enabled until the given time.
+// An existing later commitment is never shortened.
+func (s *State) CommitUntil(until time.Time) error {
+	unlock, err := s.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	sf, err := s.load()
+	if err != nil {
+		return err
+	}
+	if sf.EnabledUntil.After(until) {
+		until = sf.EnabledUntil
+	}
+	sf.EnabledUntil = until.UTC().Truncate(time.Second)
+	return s.save(sf)
+}
+
+// CommittedUntil returns the end of the current commitment, or the zero time if none
+func (s *State) CommittedUntil() (time.Time, error) {
+	sf, err := s.load()
+	if err != nil {
+		return time.Time{}, err
+	}
+	return sf.EnabledUntil, nil
+}
+
+// ErrCommitted is returned by CheckCommitment while a commitment is active
+var ErrCommitted = errors.New("blocking is committed")
+
+// CheckCommitment refuses disabling while a commitment from enable --commit
+// is active, however the disable is authorized
+func (s *State) CheckCommitment() error {
+	remaining, err := s.CommitmentRemaining()
+	if err != nil {
+		return fmt.Errorf("reading commitment: %w", err)
+	}
+	if remaining > 0 {
+		return fmt.Errorf("%w for another %s; disabling is refused until then", ErrCommitted, remaining.Round(time.Second))
+	}
+	return nil
+}
+
+// CommitmentRemaining returns how long the current commitment still runs, or 0 if none
+func (s *State) CommitmentRemaining() (time.Duration, error) {
+	until, err := s.CommittedUntil()
+	if err != nil {
+		return 0, err
+	}
+	if remaining := time.Until(until); remaining > 0 {
+		return remaining, nil
+	}
+	return 0, nil
+}
+
+// snoozePath returns the path of the file recording the snooze deadline
+func (s *State) snoozePath() string {
+	return s.path + ".snooze"
+}
+
+// Snooze disables blocking until the given time, after which the daemon
+// re-enables it
+func (s *State) Snooze(until time.Time) error {
+	unlock, err := s.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	if err := writeDeadline(s.snoozePath(), until); err != nil {
+		return fmt.Errorf("writing snooze file: %w", err)
+	}
+	return s.setEnabled(false, "snooze until "+until.Local().Format(time.DateTime))
+}
+
+// SnoozedUntil returns the end of the current snooze, or the zero time if none
+func (s *State) SnoozedUntil() (time.Time, error) {
+	until, err := readDeadline(s.snoozePath())
+	if err != nil {
+		return time.Time{}, fmt.Errorf("reading snooze file: %w", err)
+	}
+	return until, nil
+}
+
+// SnoozeRemaining returns how long the current snooze still runs, or 0 if none
+func (s *State) SnoozeRemaining() (time.Duration, error) {
+	until, err := s.SnoozedUntil()
+	if err != nil {
+		return 0, err
+	}
+	if remaining := time.Until(until); remaining > 0 {
+		return remaining, nil
+	}
+	return 0, nil
+}
+
+// ClearSnooze forgets any snooze, e.g. when blocking is enabled or disabled explicitly
+func (s *State) ClearSnooze() error {
+	unlock, err := s.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	if err := os.Remove(s.snoozePath()); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("removing snooze file: %w", err)
+	}
+	return nil
+}
+
+// writeDeadline writes an RFC3339 timestamp file next to the state file
+func writeDeadline(path string, t time.Time) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0o750); err != nil {
+		return fmt.Errorf("creating state directory: %w", err)
+	}
+	return atomicfile.Write(path, []byte(t.UTC().Format(time.RFC3339)+"\n"), 0o640)
+}
+
+// readDeadline reads a timestamp written by writeDeadline, returning the zero
+// time if the file doesn't exist
+func readDeadline(path string) (time.Time, error) {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return time.Time{}, nil
+	}
+	if err != nil {
+		return time.Time{}, err
+	}
+	t, err := time.Parse(time.RFC3339, strings.TrimSpace(string(data)))
+	if err != nil {
+		return time.Time{}, fmt.Errorf("parsing %s: %w", filepath.Base(path), err)
+	}
+	return t, nil
+}
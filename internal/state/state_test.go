@@ -0,0 +1,243 @@
+package state
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestLegacyStateFormat(t *testing.T) {
+	tests := []struct {
+		contents string
+		want     bool
+	}{
+		{contents: "", want: true},
+		{contents: "enabled\n", want: true},
+		{contents: "disabled\n", want: false},
+		{contents: `{"enabled":false}`, want: false},
+		{contents: `{"enabled":true,"enabledUntil":"2000-01-01T00:00:00Z"}`, want: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.contents, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "state")
+			if err := os.WriteFile(path, []byte(tt.contents), 0o640); err != nil {
+				t.Fatal(err)
+			}
+			got, err := New(path).IsEnabled()
+			if err != nil {
+				t.Fatalf("IsEnabled() error = %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("IsEnabled() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCommitUntil(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state")
+	st := New(path)
+
+	// A shorter commitment never shortens an existing one
+	want := time.Now().Add(time.Hour).UTC().Truncate(time.Second)
+	if err := os.WriteFile(path, []byte("enabled\n"), 0o640); err != nil {
+		t.Fatal(err)
+	}
+	if err := st.CommitUntil(want); err != nil {
+		t.Fatalf("CommitUntil() error = %v", err)
+	}
+	if err := st.CommitUntil(time.Now().Add(time.Minute)); err != nil {
+		t.Fatalf("CommitUntil() error = %v", err)
+	}
+	until, err := st.CommittedUntil()
+	if err != nil || !until.Equal(want) {
+		t.Errorf("CommittedUntil() = %v, %v, want the longer deadline %v", until, err, want)
+	}
+
+	// Disabling keeps the commitment, and a disabled file is still enabled
+	// until it ends
+	if err := st.SetEnabled(false); err != nil {
+		t.Fatal(err)
+	}
+	if until, _ := st.CommittedUntil(); !until.Equal(want) {
+		t.Errorf("CommittedUntil() after SetEnabled(false) = %v, want %v", until, want)
+	}
+	if enabled, _ := st.IsEnabled(); !enabled {
+		t.Error("IsEnabled() = false during a commitment")
+	}
+}
+
+func TestCheckCommitment(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state")
+	st := New(path)
+	if err := st.CheckCommitment(); err != nil {
+		t.Fatalf("CheckCommitment() without a commitment error = %v", err)
+	}
+
+	// Inside the window disabling is refused, even when authorized by the key
+	if err := st.SetEnabled(true); err != nil {
+		t.Fatal(err)
+	}
+	if err := st.CommitUntil(time.Now().Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	st.SetAuth(AuthUSBKey)
+	if err := st.CheckCommitment(); !errors.Is(err, ErrCommitted) {
+		t.Errorf("CheckCommitment() inside the window error = %v, want %v", err, ErrCommitted)
+	}
+
+	// Once the window has ended the lock is gone
+	if err := os.WriteFile(path, []byte(`{"enabled":true,"enabledUntil":"2000-01-01T00:00:00Z"}`), 0o640); err != nil {
+		t.Fatal(err)
+	}
+	if err := st.CheckCommitment(); err != nil {
+		t.Errorf("CheckCommitment() after the window error = %v", err)
+	}
+	if err := st.SetEnabled(false); err != nil {
+		t.Fatal(err)
+	}
+	if enabled, _ := st.IsEnabled(); enabled {
+		t.Error("IsEnabled() = true after disabling once the window ended")
+	}
+
+	// The emergency path, root rewriting the state file, still ends it
+	if err := st.CommitUntil(time.Now().Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte(`{"enabled":false}`), 0o640); err != nil {
+		t.Fatal(err)
+	}
+	if err := st.CheckCommitment(); err != nil {
+		t.Errorf("CheckCommitment() after the emergency path error = %v", err)
+	}
+	if enabled, _ := st.IsEnabled(); enabled {
+		t.Error("IsEnabled() = true after the emergency path")
+	}
+}
+
+func TestAuditLog(t *testing.T) {
+	dir := t.TempDir()
+	logPath := filepath.Join(dir, "audit.log")
+	st := New(filepath.Join(dir, "state"))
+	st.SetAuditLog(logPath)
+	t.Setenv("SUDO_USER", "alice")
+
+	st.SetAuth(AuthUSBKey)
+	if err := st.SetEnabled(false); err != nil {
+		t.Fatal(err)
+	}
+	st.SetAuth("")
+	if err := st.SetEnabledBecause(true, "snooze ended"); err != nil {
+		t.Fatal(err)
+	}
+	st.SetAuth(AuthTOTP)
+	if err := st.AuditOverride("reddit.com", false); err != nil {
+		t.Fatal(err)
+	}
+
+	// A torn final line from a crash is skipped
+	f, err := os.OpenFile(logPath, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString(`{"time":"2026-`)
+	f.Close()
+
+	entries, err := ReadAuditLog(logPath, 0)
+	if err != nil {
+		t.Fatalf("ReadAuditLog() error = %v", err)
+	}
+	if len(entries) != 3 {
+		t.Fatalf("ReadAuditLog() returned %d entries, want 3", len(entries))
+	}
+	if e := entries[0]; e.Enabled || e.User != "alice" || e.Auth != AuthUSBKey || e.Reason != "" {
+		t.Errorf("entry 0 = %+v, want a key-verified disable by alice", e)
+	}
+	if e := entries[1]; !e.Enabled || e.Auth != "" || e.Reason != "snooze ended" {
+		t.Errorf("entry 1 = %+v, want an unverified enable with a reason", e)
+	}
+	if e := entries[2]; e.Enabled || e.Domain != "reddit.com" || e.Auth != AuthTOTP {
+		t.Errorf("entry 2 = %+v, want a TOTP-verified unblock of reddit.com", e)
+	}
+
+	last, err := ReadAuditLog(logPath, 1)
+	if err != nil || len(last) != 1 || last[0].Domain != "reddit.com" {
+		t.Errorf("ReadAuditLog(1) = %+v, %v, want the last entry", last, err)
+	}
+}
+
+func TestConcurrentSetEnabled(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state")
+	if err := New(path).CommitUntil(time.Now().Add(-time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(enabled bool) {
+			defer wg.Done()
+			// Each writer uses its own State, as the daemon and CLI would
+			st := New(path)
+			for j := 0; j < 50; j++ {
+				if err := st.SetEnabled(enabled); err != nil {
+					t.Errorf("SetEnabled() error = %v", err)
+					return
+				}
+			}
+		}(i%2 == 0)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	st := New(path)
+	for {
+		select {
+		case <-done:
+			return
+		default:
+		}
+		sf, err := st.load()
+		if err != nil {
+			t.Fatalf("load() during concurrent writes error = %v", err)
+		}
+		// The read-modify-write never loses the commitment written first
+		if sf.EnabledUntil.IsZero() {
+			t.Fatalf("load() = %+v, commitment lost", sf)
+		}
+	}
+}
+
+func TestConcurrentCategorySet(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "categories.json")
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(name string) {
+			defer wg.Done()
+			// Each writer uses its own Categories, as the daemon and CLI would
+			if err := NewCategories(path).Set(name, true); err != nil {
+				t.Errorf("Set(%q) error = %v", name, err)
+			}
+		}(string(rune('a' + i)))
+	}
+	wg.Wait()
+
+	// No writer's toggle is lost to another's read-modify-write
+	toggles, err := NewCategories(path).Load()
+	if err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+	if len(toggles) != 8 {
+		t.Errorf("Load() = %v, want 8 toggles", toggles)
+	}
+}
@@ -0,0 +1,62 @@
+package usbkey
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+// DefaultKeyLength is the size in bytes of keys made by GenerateKey
+const DefaultKeyLength = 64
+
+// MinKeyLength is the smallest key GenerateKey accepts, so a key can't be
+// guessed
+const MinKeyLength = 16
+
+// GenerateKey writes a random key of length bytes to keyPath and its hash,
+// in sha256sum format, to hashPath. Unless force is set, nothing is written
+// if either file already exists, so an enrolled key isn't lost by mistake.
+// It returns the key's hash.
+func GenerateKey(keyPath, hashPath string, length int, force bool) (string, error) {
+	if length < MinKeyLength {
+		return "", fmt.Errorf("key length must be at least %d bytes", MinKeyLength)
+	}
+	if info, err := os.Stat(hashPath); err == nil && info.IsDir() {
+		return "", fmt.Errorf("token hash path %s is a directory; give a file to write the hash to", hashPath)
+	}
+	if !force {
+		for _, path := range []string{keyPath, hashPath} {
+			if _, err := os.Stat(path); err == nil {
+				return "", fmt.Errorf("%s already exists (use --force to overwrite)", path)
+			} else if !errors.Is(err, fs.ErrNotExist) {
+				return "", err
+			}
+		}
+	}
+
+	key := make([]byte, length)
+	if _, err := rand.Read(key); err != nil {
+		return "", fmt.Errorf("generating key: %w", err)
+	}
+	sum := sha256.Sum256(key)
+	hash := hex.EncodeToString(sum[:])
+
+	if err := os.WriteFile(keyPath, key, 0o600); err != nil {
+		return "", fmt.Errorf("writing key: %w", err)
+	}
+
+	// Verify refuses hash files others could modify, so keep it 0644
+	if err := os.MkdirAll(filepath.Dir(hashPath), 0o755); err != nil {
+		return "", fmt.Errorf("writing token hash: %w", err)
+	}
+	line := fmt.Sprintf("%s  %s\n", hash, keyPath)
+	if err := os.WriteFile(hashPath, []byte(line), 0o644); err != nil {
+		return "", fmt.Errorf("writing token hash: %w", err)
+	}
+	return hash, nil
+}
@@ -0,0 +1,49 @@
+package usbkey
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestGenerateKey(t *testing.T) {
+	dir := t.TempDir()
+	keyPath := filepath.Join(dir, "usb", "focusd.key")
+	hashPath := filepath.Join(dir, "etc", "token.sha256")
+	if err := os.Mkdir(filepath.Dir(keyPath), 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := GenerateKey(keyPath, hashPath, 8, false); err == nil {
+		t.Error("GenerateKey() with an 8-byte key succeeded, want error")
+	}
+
+	hash, err := GenerateKey(keyPath, hashPath, 32, false)
+	if err != nil {
+		t.Fatalf("GenerateKey() error = %v", err)
+	}
+	if key, _ := os.ReadFile(keyPath); len(key) != 32 {
+		t.Errorf("key file has %d bytes, want 32", len(key))
+	}
+	v := New(keyPath, hashPath)
+	v.SetStrictPermissions(true)
+	if err := v.Verify(); err != nil {
+		t.Errorf("Verify() with the generated key = %v", err)
+	}
+
+	// An enrolled key isn't replaced without force
+	if _, err := GenerateKey(keyPath, hashPath, 32, false); err == nil || !strings.Contains(err.Error(), "already exists") {
+		t.Errorf("GenerateKey() over an existing key = %v, want already exists error", err)
+	}
+	forced, err := GenerateKey(keyPath, hashPath, 32, true)
+	if err != nil {
+		t.Fatalf("GenerateKey(force) error = %v", err)
+	}
+	if forced == hash {
+		t.Error("GenerateKey(force) produced the same key again")
+	}
+	if err := v.Verify(); err != nil {
+		t.Errorf("Verify() with the replaced key = %v", err)
+	}
+}
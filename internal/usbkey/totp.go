@@ -0,0 +1,111 @@
+package usbkey
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	// totpStep is the RFC 6238 time step
+	totpStep = 30 * time.Second
+
+	// totpDigits is the length of a code, as shown by authenticator apps
+	totpDigits = 6
+)
+
+// SetTOTP enables TOTP codes as a fallback for an absent USB key. The file
+// at secretPath holds a base32 secret shared with an authenticator app, and
+// window is how many time steps of clock drift either side are tolerated.
+// An empty path leaves TOTP disabled.
+func (v *Verifier) SetTOTP(secretPath string, window int) {
+	v.totpSecretPath = secretPath
+	v.totpWindow = window
+}
+
+// VerifyTOTP checks a code from the authenticator app against the secret
+// configured with SetTOTP
+func (v *Verifier) VerifyTOTP(code string) error {
+	if v.totpSecretPath == "" {
+		return fmt.Errorf("TOTP is not configured (set totpSecretPath)")
+	}
+
+	secret, err := readTOTPSecret(v.totpSecretPath)
+	if err != nil {
+		return fmt.Errorf("cannot read TOTP secret: %w", err)
+	}
+
+	if !checkTOTP(secret, strings.TrimSpace(code), time.Now(), v.totpWindow) {
+		return fmt.Errorf("invalid TOTP code")
+	}
+	return nil
+}
+
+// readTOTPSecret reads and decodes a base32 secret. Unlike the token hash,
+// the secret must stay private, so it may only be readable by its owner.
+func readTOTPSecret(path string) ([]byte, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if info.Mode().Perm()&0o077 != 0 {
+		return nil, fmt.Errorf("TOTP secret %s is accessible by group/others (mode %04o); expected 0600 (chmod 600 %s)",
+			path, info.Mode().Perm(), path)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	// Authenticator apps display secrets in groups, often in lowercase
+	encoded := strings.ToUpper(strings.Join(strings.Fields(string(data)), ""))
+	encoded = strings.TrimRight(encoded, "=")
+	secret, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(encoded)
+	if err != nil {
+		return nil, fmt.Errorf("TOTP secret is not valid base32: %w", err)
+	}
+	if len(secret) == 0 {
+		return nil, fmt.Errorf("TOTP secret is empty")
+	}
+	return secret, nil
+}
+
+// checkTOTP reports whether code is valid for now, or for up to window
+// time steps before or after it
+func checkTOTP(secret []byte, code string, now time.Time, window int) bool {
+	if len(code) != totpDigits {
+		return false
+	}
+
+	counter := now.Unix() / int64(totpStep/time.Second)
+	valid := false
+	for offset := -window; offset <= window; offset++ {
+		want := totpCode(secret, uint64(counter+int64(offset)))
+		// Check every step so timing doesn't reveal which one matched
+		if hmac.Equal([]byte(want), []byte(code)) {
+			valid = true
+		}
+	}
+	return valid
+}
+
+// totpCode computes the HOTP value (RFC 4226) for a counter, as used by
+// TOTP with HMAC-SHA1
+func totpCode(secret []byte, counter uint64) string {
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], counter)
+
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", totpDigits, value%1_000_000)
+}
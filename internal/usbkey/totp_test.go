@@ -0,0 +1,70 @@
+package usbkey
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestCheckTOTP(t *testing.T) {
+	// RFC 6238 appendix B test vectors for SHA1, truncated to six digits
+	secret := []byte("12345678901234567890")
+
+	tests := []struct {
+		name   string
+		unix   int64
+		code   string
+		window int
+		want   bool
+	}{
+		{name: "59", unix: 59, code: "287082", want: true},
+		{name: "1111111109", unix: 1111111109, code: "081804", want: true},
+		{name: "1234567890", unix: 1234567890, code: "005924", want: true},
+		{name: "2000000000", unix: 2000000000, code: "279037", want: true},
+		{name: "previous step outside window", unix: 59 + 30, code: "287082", want: false},
+		{name: "previous step inside window", unix: 59 + 30, code: "287082", window: 1, want: true},
+		{name: "wrong code", unix: 59, code: "287083", want: false},
+		{name: "wrong length", unix: 59, code: "94287082", want: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := checkTOTP(secret, tt.code, time.Unix(tt.unix, 0), tt.window); got != tt.want {
+				t.Errorf("checkTOTP() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestReadTOTPSecret(t *testing.T) {
+	tests := []struct {
+		name     string
+		contents string
+		mode     os.FileMode
+		wantErr  bool
+	}{
+		{name: "plain", contents: "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ\n", mode: 0o600},
+		{name: "grouped lowercase", contents: "gezd gnbv gy3t qojq gezd gnbv gy3t qojq\n", mode: 0o400},
+		{name: "readable by others", contents: "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ\n", mode: 0o644, wantErr: true},
+		{name: "not base32", contents: "not-a-secret!\n", mode: 0o600, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "totp.secret")
+			if err := os.WriteFile(path, []byte(tt.contents), tt.mode); err != nil {
+				t.Fatal(err)
+			}
+			os.Chmod(path, tt.mode)
+
+			secret, err := readTOTPSecret(path)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("readTOTPSecret() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && string(secret) != "12345678901234567890" {
+				t.Errorf("readTOTPSecret() = %q, want the RFC 6238 test secret", secret)
+			}
+		})
+	}
+}
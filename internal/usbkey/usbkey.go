@@ -9,12 +9,22 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
+	"sync"
 )
 
 // Verifier checks for the presence and validity of a USB key
 type Verifier struct {
 	keyGlob  string
 	hashPath string
+	strict   bool
+
+	// totpSecretPath enables TOTP codes as a fallback when set
+	totpSecretPath string
+	totpWindow     int
+
+	// warned holds the permission warnings already printed, so polling
+	// the key doesn't repeat them
+	warned sync.Map
 }
 
 // New creates a new USB key verifier
@@ -25,75 +35,152 @@ func New(keyGlob, hashPath string) *Verifier {
 	}
 }
 
+// SetStrictPermissions makes Verify refuse, rather than warn about, a token
+// hash file that group or others could modify
+func (v *Verifier) SetStrictPermissions(strict bool) {
+	v.strict = strict
+}
+
 // Verify checks if a valid USB key is present
-// Returns an error if the key is not found or doesn't match the expected hash
+// Returns an error if the key is not found or doesn't match any expected hash
 func (v *Verifier) Verify() error {
-	// Read the expected hash
-	expectedHash, err := v.readExpectedHash()
+	hashPaths, err := v.hashFiles()
+	if err != nil {
+		return fmt.Errorf("cannot read expected token hash: %w", err)
+	}
+
+	// Anyone who can replace the expected hash can authorize their own key
+	for _, path := range hashPaths {
+		if err := checkPermissions(path); err != nil {
+			if v.strict {
+				return fmt.Errorf("refusing insecure token hash: %w", err)
+			}
+			if _, seen := v.warned.LoadOrStore(err.Error(), true); !seen {
+				fmt.Fprintf(os.Stderr, "Warning: %v\n", err)
+			}
+		}
+	}
+
+	// Read the expected hashes
+	expected, err := readExpectedHashes(hashPaths)
 	if err != nil {
 		return fmt.Errorf("cannot read expected token hash: %w", err)
 	}
 
-	// Find the key file
-	keyFile, err := v.findKeyFile()
+	// Find the key files
+	keyFiles, err := v.findKeyFiles()
 	if err != nil {
 		return fmt.Errorf("USB key not found: %w", err)
 	}
 
-	// Verify the key file matches
-	ok, err := v.verifyKeyFile(keyFile, expectedHash)
+	// Accept the first mounted key that matches any expected hash
+	for _, keyFile := range keyFiles {
+		ok, err := verifyKeyFile(keyFile, expected)
+		if err != nil {
+			return fmt.Errorf("error verifying USB key: %w", err)
+		}
+		if ok {
+			return nil
+		}
+	}
+	return fmt.Errorf("USB key does not match expected token")
+}
+
+// hashFiles returns the token hash files named by hashPath, which may be a
+// single file, a directory of hash files or a glob pattern
+func (v *Verifier) hashFiles() ([]string, error) {
+	if strings.ContainsAny(v.hashPath, "*?[") {
+		matches, err := filepath.Glob(v.hashPath)
+		if err != nil {
+			return nil, err
+		}
+		if len(matches) == 0 {
+			return nil, fmt.Errorf("no token hash file matching %q found", v.hashPath)
+		}
+		return matches, nil
+	}
+
+	info, err := os.Stat(v.hashPath)
+	if err != nil || !info.IsDir() {
+		// A missing file is reported when the hashes are read
+		return []string{v.hashPath}, nil
+	}
+
+	entries, err := os.ReadDir(v.hashPath)
 	if err != nil {
-		return fmt.Errorf("error verifying USB key: %w", err)
+		return nil, err
+	}
+	var paths []string
+	for _, entry := range entries {
+		if entry.IsDir() || strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+		paths = append(paths, filepath.Join(v.hashPath, entry.Name()))
 	}
-	if !ok {
-		return fmt.Errorf("USB key does not match expected token")
+	if len(paths) == 0 {
+		return nil, fmt.Errorf("no token hash files in %s", v.hashPath)
 	}
+	return paths, nil
+}
 
-	return nil
+// readExpectedHashes reads the set of acceptable SHA256 hashes from the
+// given hash files, one hash per line
+func readExpectedHashes(paths []string) (map[string]bool, error) {
+	hashes := make(map[string]bool)
+	for _, path := range paths {
+		if err := readHashFile(path, hashes); err != nil {
+			return nil, err
+		}
+	}
+	if len(hashes) == 0 {
+		return nil, fmt.Errorf("empty token hash file")
+	}
+	return hashes, nil
 }
 
-// readExpectedHash reads the expected SHA256 hash from the hash file
-func (v *Verifier) readExpectedHash() (string, error) {
-	f, err := os.Open(v.hashPath)
+// readHashFile adds the hashes listed in path to hashes, skipping blank
+// lines and comments
+func readHashFile(path string, hashes map[string]bool) error {
+	f, err := os.Open(path)
 	if err != nil {
-		return "", err
+		return err
 	}
 	defer f.Close()
 
 	sc := bufio.NewScanner(f)
-	if !sc.Scan() {
-		return "", fmt.Errorf("empty token hash file")
-	}
-
-	line := sc.Text()
-	fields := strings.Fields(line)
-	if len(fields) == 0 {
-		return "", fmt.Errorf("invalid token hash file")
+	for sc.Scan() {
+		fields := strings.Fields(sc.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+
+		// sha256sum format: "<hash>  <filename>"
+		// We just need the hash part
+		hash := strings.ToLower(fields[0])
+		if len(hash) != sha256.Size*2 {
+			return fmt.Errorf("invalid token hash file %s: %q is not a SHA256 hash", path, fields[0])
+		}
+		hashes[hash] = true
 	}
-
-	// sha256sum format: "<hash>  <filename>"
-	// We just need the hash part
-	return strings.ToLower(fields[0]), nil
+	return sc.Err()
 }
 
-// findKeyFile finds the USB key file using the configured glob pattern
-func (v *Verifier) findKeyFile() (string, error) {
+// findKeyFiles returns every key file matching the configured glob pattern
+func (v *Verifier) findKeyFiles() ([]string, error) {
 	matches, err := filepath.Glob(v.keyGlob)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 
 	if len(matches) == 0 {
-		return "", fmt.Errorf("no key file matching %q found", v.keyGlob)
+		return nil, fmt.Errorf("no key file matching %q found", v.keyGlob)
 	}
-
-	// If multiple matches, use the first one
-	// In practice, there should only be one USB key mounted
-	return matches[0], nil
+	return matches, nil
 }
 
-// verifyKeyFile computes the SHA256 hash of the key file and compares it
-func (v *Verifier) verifyKeyFile(path string, expectedHash string) (bool, error) {
+// verifyKeyFile computes the SHA256 hash of the key file and reports whether
+// it is one of the expected hashes
+func verifyKeyFile(path string, expected map[string]bool) (bool, error) {
 	f, err := os.Open(path)
 	if err != nil {
 		return false, err
@@ -105,6 +192,48 @@ func (v *Verifier) verifyKeyFile(path string, expectedHash string) (bool, error)
 		return false, err
 	}
 
-	actualHash := hex.EncodeToString(h.Sum(nil))
-	return actualHash == expectedHash, nil
+	return expected[hex.EncodeToString(h.Sum(nil))], nil
+}
+
+// checkPermissions returns an error if the token hash file, or a directory
+// that could be used to replace it, is writable by group or others. Like
+// SSH's checks on authorized_keys, every directory up to the root is
+// checked, both on the way to a symlink and to its target. Directories with
+// the sticky bit set (such as /tmp or /nix/store) are accepted.
+func checkPermissions(path string) error {
+	resolved, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		// Missing files are reported when the hash is read
+		return nil
+	}
+
+	info, err := os.Stat(resolved)
+	if err != nil {
+		return nil
+	}
+	if info.Mode().Perm()&0o022 != 0 {
+		return fmt.Errorf("token hash file %s is group/world-writable (mode %04o); expected 0644 or stricter (chmod go-w %s)",
+			resolved, info.Mode().Perm(), resolved)
+	}
+
+	checked := map[string]bool{}
+	for _, p := range []string{path, resolved} {
+		abs, err := filepath.Abs(p)
+		if err != nil {
+			continue
+		}
+		for dir := filepath.Dir(abs); !checked[dir]; dir = filepath.Dir(dir) {
+			checked[dir] = true
+			info, err := os.Stat(dir)
+			if err != nil {
+				continue
+			}
+			if info.Mode().Perm()&0o022 != 0 && info.Mode()&os.ModeSticky == 0 {
+				return fmt.Errorf("token hash directory %s is group/world-writable (mode %04o); expected 0755 or stricter (chmod go-w %s)",
+					dir, info.Mode().Perm(), dir)
+			}
+		}
+	}
+
+	return nil
 }
@@ -0,0 +1,176 @@
+package usbkey
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCheckPermissions(t *testing.T) {
+	tests := []struct {
+		name     string
+		fileMode os.FileMode
+		dirMode  os.FileMode
+		wantErr  string
+	}{
+		{name: "secure", fileMode: 0o644, dirMode: 0o755},
+		{name: "read only", fileMode: 0o400, dirMode: 0o700},
+		{name: "group writable file", fileMode: 0o664, dirMode: 0o755, wantErr: "mode 0664"},
+		{name: "world writable file", fileMode: 0o646, dirMode: 0o755, wantErr: "mode 0646"},
+		{name: "world writable dir", fileMode: 0o644, dirMode: 0o777, wantErr: "directory"},
+		{name: "sticky world writable dir", fileMode: 0o644, dirMode: 0o777 | os.ModeSticky},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := filepath.Join(t.TempDir(), "focusd")
+			if err := os.Mkdir(dir, 0o755); err != nil {
+				t.Fatal(err)
+			}
+			path := filepath.Join(dir, "token.sha256")
+			if err := os.WriteFile(path, []byte("abc\n"), 0o644); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.Chmod(path, tt.fileMode); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.Chmod(dir, tt.dirMode); err != nil {
+				t.Fatal(err)
+			}
+
+			err := checkPermissions(path)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Errorf("checkPermissions() error = %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("checkPermissions() error = %v, want containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestCheckPermissionsPath(t *testing.T) {
+	base := t.TempDir()
+	if err := os.Chmod(base, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	mkdir := func(path string, mode os.FileMode) {
+		t.Helper()
+		if err := os.MkdirAll(path, 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chmod(path, mode); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	secure := filepath.Join(base, "secure", "token.sha256")
+	mkdir(filepath.Dir(secure), 0o755)
+	if err := os.WriteFile(secure, []byte("abc\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkPermissions(secure); err != nil {
+		t.Fatalf("checkPermissions() error = %v", err)
+	}
+
+	// A symlink in a writable directory can be pointed elsewhere
+	links := filepath.Join(base, "links")
+	mkdir(links, 0o777)
+	link := filepath.Join(links, "token.sha256")
+	if err := os.Symlink(secure, link); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkPermissions(link); err == nil || !strings.Contains(err.Error(), links) {
+		t.Errorf("checkPermissions() through a symlink in %s error = %v", links, err)
+	}
+
+	// So can any directory further up the path
+	open := filepath.Join(base, "open")
+	nested := filepath.Join(open, "inner", "token.sha256")
+	mkdir(filepath.Dir(nested), 0o755)
+	mkdir(open, 0o777)
+	if err := os.WriteFile(nested, []byte("abc\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkPermissions(nested); err == nil || !strings.Contains(err.Error(), open) {
+		t.Errorf("checkPermissions() below %s error = %v", open, err)
+	}
+}
+
+func TestVerifyStrictPermissions(t *testing.T) {
+	dir := t.TempDir()
+	hashPath := filepath.Join(dir, "token.sha256")
+	if err := os.WriteFile(hashPath, []byte("abc\n"), 0o666); err != nil {
+		t.Fatal(err)
+	}
+	os.Chmod(hashPath, 0o666)
+
+	v := New(filepath.Join(dir, "missing", "focusd.key"), hashPath)
+	v.SetStrictPermissions(true)
+
+	err := v.Verify()
+	if err == nil || !strings.Contains(err.Error(), "insecure token hash") {
+		t.Errorf("Verify() error = %v, want insecure token hash error", err)
+	}
+}
+
+func TestVerifyMultipleHashes(t *testing.T) {
+	hashOf := func(s string) string {
+		sum := sha256.Sum256([]byte(s))
+		return hex.EncodeToString(sum[:])
+	}
+	three := hashOf("first") + "  focusd.key\n" + hashOf("second") + "  focusd.key\n" + hashOf("third") + "  focusd.key\n"
+
+	tests := []struct {
+		name    string
+		key     string
+		hashes  map[string]string // file name -> contents
+		hashArg string            // relative to the hash directory; "" for the directory itself
+		wantErr bool
+	}{
+		{name: "second of three", key: "second", hashes: map[string]string{"token.sha256": three}, hashArg: "token.sha256"},
+		{name: "none of three", key: "fourth", hashes: map[string]string{"token.sha256": three}, hashArg: "token.sha256", wantErr: true},
+		{
+			name:   "directory",
+			key:    "second",
+			hashes: map[string]string{"alice.sha256": hashOf("first") + "\n", "bob.sha256": "# spare key\n" + hashOf("second") + "\n"},
+		},
+		{
+			name:    "glob",
+			key:     "second",
+			hashes:  map[string]string{"alice.sha256": hashOf("first") + "\n", "bob.sha256": hashOf("second") + "\n", "notes.txt": "x\n"},
+			hashArg: "*.sha256",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			keyDir := t.TempDir()
+			keyPath := filepath.Join(keyDir, "focusd.key")
+			if err := os.WriteFile(keyPath, []byte(tt.key), 0o600); err != nil {
+				t.Fatal(err)
+			}
+
+			hashDir := filepath.Join(t.TempDir(), "hashes")
+			if err := os.Mkdir(hashDir, 0o755); err != nil {
+				t.Fatal(err)
+			}
+			for name, contents := range tt.hashes {
+				if err := os.WriteFile(filepath.Join(hashDir, name), []byte(contents), 0o644); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			err := New(keyPath, filepath.Join(hashDir, tt.hashArg)).Verify()
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Verify() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,53 @@
+// Package version identifies the running build. The values are set at link
+// time, e.g.
+//
+//	go build -ldflags "-X focusd/internal/version.Version=1.2.0 \
+//	  -X focusd/internal/version.Commit=$(git rev-parse HEAD) \
+//	  -X focusd/internal/version.Date=$(date -u +%Y-%m-%dT%H:%M:%SZ)" ./cmd/focusd
+//
+// A build without them falls back to the VCS details the Go toolchain
+// embeds, if any.
+package version
+
+import (
+	"fmt"
+	"runtime/debug"
+)
+
+var (
+	// Version is the release version
+	Version = "dev"
+
+	// Commit is the git commit the binary was built from
+	Commit = ""
+
+	// Date is when the binary was built, in RFC 3339 format
+	Date = ""
+)
+
+func init() {
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return
+	}
+	for _, setting := range info.Settings {
+		switch {
+		case setting.Key == "vcs.revision" && Commit == "":
+			Commit = setting.Value
+		case setting.Key == "vcs.time" && Date == "":
+			Date = setting.Value
+		}
+	}
+}
+
+// String describes the build on one line
+func String() string {
+	commit, date := Commit, Date
+	if commit == "" {
+		commit = "unknown"
+	}
+	if date == "" {
+		date = "unknown"
+	}
+	return fmt.Sprintf("focusd %s (commit %s, built %s)", Version, commit, date)
+}
@@ -73,6 +73,7 @@ in
           usbKeyPath: "${cfg.usbKeyPath}"
           tokenHashPath: "/etc/focusd/token.sha256"
           dnsmasqConfigPath: "/run/focusd/dnsmasq.conf"
+          dnsmasqReloadCommand: ["${pkgs.systemd}/bin/systemctl", "restart", "dnsmasq.service"]
         '';
       };
     });
@@ -99,7 +100,7 @@ in
       wantedBy = [ "multi-user.target" ];
 
       serviceConfig = {
-        Type = "simple";
+        Type = "notify";
         ExecStart = "${cfg.package}/bin/focusd daemon --config /etc/focusd/config.yaml";
         ExecReload = "${pkgs.coreutils}/bin/kill -HUP $MAINPID";
         Restart = "on-failure";